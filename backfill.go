@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	metrics2 "github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-remote-write/pkg/backfill"
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	log "k8s.io/klog/v2"
+)
+
+const BACKFILL_COMMAND = "backfill"
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// runBackfill reads historical data from Prometheus and sends it to Anodot.
+// Usage: anodot-prometheus-remote-write backfill -prometheus-url=http://prometheus:9090 -match='up' -start=2021-01-01T00:00:00Z
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet(BACKFILL_COMMAND, flag.ExitOnError)
+	var selectors stringsFlag
+	fs.Var(&selectors, "match", "Series selector to backfill. Can be specified multiple times. Example: 'up{job=\"node\"}'")
+	prometheusURL := fs.String("prometheus-url", "", "Prometheus server url. Example: 'http://prometheus:9090'")
+	start := fs.String("start", "", "Start of backfilled time range, RFC3339 or unix timestamp")
+	end := fs.String("end", "", "End of backfilled time range, RFC3339 or unix timestamp. Defaults to current time")
+	mode := fs.String("mode", backfill.ModeAuto, "Prometheus API used to read data: auto, remote_read or query_range")
+	chunk := fs.Duration("chunk", time.Hour, "Time range read and submitted at once")
+	step := fs.Duration("step", time.Minute, "Query resolution used with query_range API")
+	timeout := fs.Duration("timeout", 2*time.Minute, "Prometheus request timeout")
+	checkpoint := fs.String("checkpoint", "backfill-checkpoint.json", "Path to checkpoint file used to resume backfill. Empty value disables checkpoints")
+	maxEPS := fs.Int("max-eps", 0, "Max number of metrics per second sent to Anodot. Defaults to ANODOT_MAX_ALLOWED_EPS, 0 means unlimited")
+	batchSize := fs.Int("batch-size", 1000, "Number of metrics sent to Anodot in single request")
+	serverUrl := fs.String("url", DEFAULT_ANODOT_URL, "Anodot server url. Example: 'https://api.anodot.com'")
+	tokenFlagValue := fs.String("token", DEFAULT_TOKEN, "Account API Token")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config := &backfill.Config{
+		Selectors:      selectors,
+		Mode:           *mode,
+		ChunkDuration:  *chunk,
+		Step:           *step,
+		Timeout:        *timeout,
+		CheckpointPath: *checkpoint,
+		MaxEPS:         *maxEPS,
+		BatchSize:      *batchSize,
+		End:            time.Now(),
+		DefaultEnd:     *end == "",
+	}
+
+	var err error
+	if config.PrometheusURL, err = url.Parse(*prometheusURL); err != nil {
+		return fmt.Errorf("failed to parse prometheus url %q: %w", *prometheusURL, err)
+	}
+	if config.Start, err = backfill.ParseTime(*start); err != nil {
+		return err
+	}
+	if *end != "" {
+		if config.End, err = backfill.ParseTime(*end); err != nil {
+			return err
+		}
+	}
+	if config.MaxEPS == 0 && len(strings.TrimSpace(os.Getenv("ANODOT_MAX_ALLOWED_EPS"))) > 0 {
+		if config.MaxEPS, err = strconv.Atoi(os.Getenv("ANODOT_MAX_ALLOWED_EPS")); err != nil {
+			return fmt.Errorf("could not parse ANODOT_MAX_ALLOWED_EPS: %w", err)
+		}
+	}
+
+	parser, err := anodotPrometheus.NewAnodotParser(nil, nil, tags(os.Getenv("ANODOT_TAGS")))
+	if err != nil {
+		return err
+	}
+	relabelConfigPath := os.Getenv("ANODOT_RELABEL_CONFIG_PATH")
+	if len(strings.TrimSpace(relabelConfigPath)) > 0 {
+		relabel, err := anodotPrometheus.NewMetricRelabel(relabelConfigPath)
+		if err != nil {
+			return err
+		}
+		parser.MetricsProcessors = append(parser.MetricsProcessors, relabel)
+	}
+
+	anodotURL, err := url.Parse(envOrFlag("ANODOT_URL", serverUrl))
+	if err != nil {
+		return fmt.Errorf("failed to construct Anodot server url: %w", err)
+	}
+	submitter, err := metrics2.NewAnodot20Client(*anodotURL, envOrFlag("ANODOT_API_TOKEN", tokenFlagValue), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create Anodot metrics submitter: %w", err)
+	}
+
+	backfiller, err := backfill.NewBackfiller(config, parser, submitter)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		oscall := <-c
+		log.Infof("system call:%+v. Stopping backfill", oscall)
+		cancel()
+	}()
+
+	log.Infof("Starting backfill of %d selector(s) from %s to %s", len(config.Selectors), config.Start.Format(time.RFC3339), config.End.Format(time.RFC3339))
+	return backfiller.Run(ctx)
+}
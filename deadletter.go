@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+
+	metrics2 "github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	log "k8s.io/klog/v2"
+)
+
+const DEAD_LETTER_COMMAND = "dead-letter"
+
+// runDeadLetter prints summary of metrics rejected by Anodot or submits them again.
+// Usage: anodot-prometheus-remote-write dead-letter -file=/data/dead-letter.ndjson -resubmit
+func runDeadLetter(args []string) error {
+	fs := flag.NewFlagSet(DEAD_LETTER_COMMAND, flag.ExitOnError)
+	var files stringsFlag
+	fs.Var(&files, "file", "Dead-letter file. Can be specified multiple times to include rotated files")
+	resubmit := fs.Bool("resubmit", false, "Send metrics from dead-letter files to Anodot. Only summary is printed otherwise")
+	errorCode := fs.Int64("error-code", 0, "Process only metrics rejected with this error code. 0 means all metrics")
+	batchSize := fs.Int("batch-size", 1000, "Number of metrics sent to Anodot in single request")
+	serverUrl := fs.String("url", DEFAULT_ANODOT_URL, "Anodot server url. Example: 'https://api.anodot.com'")
+	tokenFlagValue := fs.String("token", DEFAULT_TOKEN, "Account API Token")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("at least one dead-letter file should be specified with -file")
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("batch size should be positive")
+	}
+
+	var letters []remote.DeadLetter
+	for _, f := range files {
+		res, err := remote.ReadDeadLetters(f)
+		if err != nil {
+			return err
+		}
+		for _, l := range res {
+			if *errorCode == 0 || l.ErrorCode == *errorCode {
+				letters = append(letters, l)
+			}
+		}
+	}
+
+	if !*resubmit {
+		printDeadLetterSummary(letters)
+		return nil
+	}
+
+	anodotURL, err := url.Parse(envOrFlag("ANODOT_URL", serverUrl))
+	if err != nil {
+		return fmt.Errorf("failed to construct Anodot server url: %w", err)
+	}
+	submitter, err := metrics2.NewAnodot20Client(*anodotURL, envOrFlag("ANODOT_API_TOKEN", tokenFlagValue), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create Anodot metrics submitter: %w", err)
+	}
+
+	rejected := 0
+	for start := 0; start < len(letters); start += *batchSize {
+		end := start + *batchSize
+		if end > len(letters) {
+			end = len(letters)
+		}
+
+		batch := make([]metrics2.Anodot20Metric, 0, end-start)
+		for i := start; i < end; i++ {
+			batch = append(batch, letters[i].Anodot20Metric())
+		}
+
+		resp, err := submitter.SubmitMetrics(batch)
+		if createResponse, ok := resp.(*metrics2.CreateResponse); ok && createResponse.HasErrors() {
+			rejected += len(createResponse.Errors)
+			log.Warningf("Anodot rejected %d metric(s) again: %s", len(createResponse.Errors), createResponse.ErrorMessage())
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to submit %d metric(s): %w", len(batch), err)
+		}
+	}
+
+	log.Infof("Resubmitted %d metric(s), %d rejected again", len(letters), rejected)
+	return nil
+}
+
+func printDeadLetterSummary(letters []remote.DeadLetter) {
+	type key struct {
+		code   int64
+		reason string
+	}
+	counts := make(map[key]int)
+	for _, l := range letters {
+		counts[key{l.ErrorCode, l.Reason}]++
+	}
+
+	keys := make([]key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+
+	fmt.Printf("%d rejected metric(s)\n", len(letters))
+	for _, k := range keys {
+		fmt.Printf("%8d  error %d: %s\n", counts[k], k.code, k.reason)
+	}
+}
@@ -21,6 +21,8 @@ import (
 	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
 	"github.com/anodot/anodot-remote-write/pkg/relabling"
 	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/anodot/anodot-remote-write/pkg/scrape"
+	"github.com/anodot/anodot-remote-write/pkg/statsd"
 	"github.com/anodot/anodot-remote-write/pkg/version"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -58,6 +60,22 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == BACKFILL_COMMAND {
+		if err := runBackfill(os.Args[2:]); err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		log.Flush()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == DEAD_LETTER_COMMAND {
+		if err := runDeadLetter(os.Args[2:]); err != nil {
+			log.Fatalf("Dead-letter command failed: %v", err)
+		}
+		log.Flush()
+		return
+	}
+
 	flag.Parse()
 	token := envOrFlag("ANODOT_API_TOKEN", tokenFlagValue)
 
@@ -67,6 +85,11 @@ func main() {
 
 	log.V(3).Infof("Starting Anodot Remote Write on port: %d", *serverPort)
 
+	compressionConfig, err := remote.NewCompressionConfig()
+	if err != nil {
+		log.Fatal("Failed to create compression config: ", err.Error())
+	}
+
 	var mirrorSubmitter metrics2.Submitter
 	if *murl != "" {
 		log.V(4).Infof("Anodot Address - Mirror: %s", *murl)
@@ -77,7 +100,7 @@ func main() {
 			log.Fatalf("Failed to construct Anodot server url with url=%q. Error:%s", *murl, err.Error())
 		}
 
-		mirrorSubmitter, err = metrics2.NewAnodot20Client(*mirrorURL, *mtoken, nil)
+		mirrorSubmitter, err = remote.NewSubmitter(*mirrorURL, *mtoken, nil, compressionConfig)
 		if err != nil {
 			log.Fatalf("Failed to create mirror submitter: %s", err.Error())
 		}
@@ -127,6 +150,20 @@ func main() {
 		parser.MetricsProcessors = append(parser.MetricsProcessors, &anodotPrometheus.KubernetesPodNameProcessor{PodsData: mapping})
 	}
 
+	labelAggregationConfigPath := os.Getenv("ANODOT_LABEL_AGGREGATION_CONFIG_PATH")
+	if len(strings.TrimSpace(labelAggregationConfigPath)) > 0 {
+		config, err := anodotPrometheus.LoadLabelAggregationConfig(labelAggregationConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		aggregator, err := anodotPrometheus.NewLabelAggregator(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// runs after relabeling, so rules match final metric names and labels
+		parser.MetricsProcessors = append(parser.MetricsProcessors, aggregator)
+	}
+
 	primaryUrl, err := url.Parse(envOrFlag("ANODOT_URL", serverUrl))
 	if err != nil {
 		log.Fatalf("Failed to construct Anodot server url with url=%q. Error:%s", *serverUrl, err.Error())
@@ -141,19 +178,124 @@ func main() {
 		Timeout:   30 * time.Second,
 	}
 
-	primarySubmitter, err := metrics2.NewAnodot20Client(*primaryUrl, token, client)
+	primarySubmitter, err := remote.NewSubmitter(*primaryUrl, token, client, compressionConfig)
 	if err != nil {
 		log.Fatalf("Failed to create Anodot metrics submitter: %s", err.Error())
 	}
 
+	var anodot30Submitter *remote.Anodot30Submitter
+	schemasConfigPath := os.Getenv("ANODOT_SCHEMAS_CONFIG_PATH")
+	if len(strings.TrimSpace(schemasConfigPath)) > 0 {
+		schemasConfig, err := remote.LoadSchemasConfig(schemasConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accessKey := os.Getenv("ANODOT_ACCESS_KEY")
+		if len(strings.TrimSpace(accessKey)) == 0 {
+			log.Fatalf("ANODOT_ACCESS_KEY is required to create Anodot 3.0 schemas")
+		}
+		client30, err := metrics3.NewAnodot30Client(*primaryUrl, &accessKey, &token, client)
+		if err != nil {
+			log.Fatalf("failed to create anodot30 client: %v", err)
+		}
+		anodot30Submitter, err = remote.NewAnodot30Submitter(*primaryUrl, client30, schemasConfig)
+		if err != nil {
+			log.Fatal("Failed to create Anodot 3.0 submitter: ", err.Error())
+		}
+		primarySubmitter = anodot30Submitter
+	}
+
+	histogramConfig, err := anodotPrometheus.NewHistogramConfig()
+	if err != nil {
+		log.Fatal("Failed to create histogram config: ", err.Error())
+	}
+
+	counterRateConfig, err := anodotPrometheus.NewCounterRateConfig()
+	if err != nil {
+		log.Fatal("Failed to create counter rate config: ", err.Error())
+	}
+	metadataConfig, err := anodotPrometheus.NewMetadataConfig()
+	if err != nil {
+		log.Fatal("Failed to create metadata config: ", err.Error())
+	}
+	// metadata is not parsed from requests unless it is enabled, and counters are detected by name suffixes then
+	var metadata *anodotPrometheus.MetadataCache
+	if metadataConfig.Enabled {
+		metadata, err = anodotPrometheus.NewMetadataCache(metadataConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parser.Metadata = metadata
+	}
+	if counterRateConfig.Enabled {
+		parser.CounterRates = anodotPrometheus.NewCounterRateProcessor(counterRateConfig, metadata)
+	}
+
+	otlpConfig, err := anodotPrometheus.NewOTLPConfig()
+	if err != nil {
+		log.Fatal("Failed to create OTLP config: ", err.Error())
+	}
+
+	tlsConfig, err := anodotPrometheus.NewTLSConfig()
+	if err != nil {
+		log.Fatal("Failed to create TLS config: ", err.Error())
+	}
+
+	authConfig, err := anodotPrometheus.NewAuthConfig()
+	if err != nil {
+		log.Fatal("Failed to create auth config: ", err.Error())
+	}
+
+	adminConfig, err := anodotPrometheus.NewAdminConfig()
+	if err != nil {
+		log.Fatal("Failed to create admin config: ", err.Error())
+	}
+
+	createdTimestampConfig, err := anodotPrometheus.NewCreatedTimestampConfig()
+	if err != nil {
+		log.Fatal("Failed to create created timestamp config: ", err.Error())
+	}
+
 	//Actual server listening on port - serverPort
-	var s = anodotPrometheus.Receiver{Port: *serverPort, Parser: parser}
+	var s = anodotPrometheus.Receiver{Port: *serverPort, Parser: parser, Histograms: histogramConfig, OTLP: anodotPrometheus.NewOTLPConverter(otlpConfig), TLS: tlsConfig, Auth: authConfig, Admin: adminConfig, Metadata: metadata}
+	if createdTimestampConfig.Enabled {
+		s.CreatedTimestamps = anodotPrometheus.NewCreatedTimestamps(createdTimestampConfig)
+	}
 
 	config, err := remote.NewWorkerConfig()
 	if err != nil {
 		log.Fatal("Failed to create worker config: ", err.Error())
 	}
 
+	config.GlobalLimiter, err = remote.NewRateLimiter(remote.GlobalRateLimiter, config.GlobalMaxAllowedEPS, config.GlobalMaxAllowedBurst)
+	if err != nil {
+		log.Fatal("Failed to create global rate limiter: ", err.Error())
+	}
+
+	config.Queue, err = remote.NewQueueConfig()
+	if err != nil {
+		log.Fatal("Failed to create disk queue config: ", err.Error())
+	}
+
+	deadLetterConfig, err := remote.NewDeadLetterConfig()
+	if err != nil {
+		log.Fatal("Failed to create dead-letter config: ", err.Error())
+	}
+	if deadLetterConfig.Path != "" {
+		config.DeadLetter, err = remote.NewDeadLetterWriter(deadLetterConfig)
+		if err != nil {
+			log.Fatal("Failed to open dead-letter file: ", err.Error())
+		}
+	}
+
+	aggregationConfigPath := os.Getenv("ANODOT_AGGREGATION_CONFIG_PATH")
+	if len(strings.TrimSpace(aggregationConfigPath)) > 0 {
+		config.Aggregation, err = remote.LoadAggregationConfig(aggregationConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if isFlagPassed("workers") {
 		config.MaxWorkers = *maxWorkers
 	}
@@ -162,19 +304,55 @@ func main() {
 		config.Debug = *debug
 	}
 
-	primaryWorker, err := remote.NewWorker(primarySubmitter, config)
+	retryConfig, err := remote.NewRetryConfig()
 	if err != nil {
-		log.Fatal("Failed to create worker: ", err.Error())
+		log.Fatal("Failed to create retry config: ", err.Error())
+	}
+
+	var submitter metrics2.Submitter = remote.NewRetryingSubmitter(primarySubmitter, retryConfig)
+	var routingConfig *remote.RoutingConfig
+	routingConfigPath := os.Getenv("ANODOT_ROUTING_CONFIG_PATH")
+	if len(strings.TrimSpace(routingConfigPath)) > 0 {
+		routingConfig, err = remote.LoadRoutingConfig(routingConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	allWorkers := make([]*remote.Worker, 0)
-	allWorkers = append(allWorkers, primaryWorker)
 
+	submitters := map[string]metrics2.Submitter{remote.PrimaryDestination: submitter}
 	if mirrorSubmitter != nil {
-		mirrorWorker, err := remote.NewWorker(mirrorSubmitter, config)
+		// mirror is a routing destination which receives all metrics, so it is retried separately from primary one
+		// and metrics accepted by primary destination are not resent to it from disk queue
+		if routingConfig == nil {
+			routingConfig = &remote.RoutingConfig{}
+		}
+		routingConfig.AddMirror(remote.MirrorDestination)
+		submitters[remote.MirrorDestination] = remote.NewRetryingSubmitter(mirrorSubmitter, retryConfig)
+	}
+
+	if routingConfig != nil {
+		submitter, err = remote.NewRouter(routingConfig, submitters, retryConfig, client, compressionConfig)
 		if err != nil {
-			log.Fatal("Failed to create mirror worker: ", err.Error())
+			log.Fatal("Failed to create metrics router: ", err.Error())
+		}
+	}
+
+	primaryWorker, err := remote.NewWorker(submitter, config)
+	if err != nil {
+		log.Fatal("Failed to create worker: ", err.Error())
+	}
+	allWorkers := []*remote.Worker{primaryWorker}
+
+	tenantsConfigPath := os.Getenv("ANODOT_TENANTS_CONFIG_PATH")
+	if len(strings.TrimSpace(tenantsConfigPath)) > 0 {
+		tenantsConfig, err := anodotPrometheus.LoadTenantsConfig(tenantsConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Tenants, err = anodotPrometheus.NewTenants(tenantsConfig, parser, primaryUrl, config, retryConfig, client, compressionConfig)
+		if err != nil {
+			log.Fatal("Failed to create tenant workers: ", err.Error())
 		}
-		allWorkers = append(allWorkers, mirrorWorker)
 	}
 
 	ifReport := defaultIfBlank(os.Getenv("ANODOT_REPORT_MONITORING_METRICS"), "true")
@@ -231,6 +409,41 @@ func main() {
 		log.Fatalf("failed to finish gracefuly. system call:%+v", oscall)
 	}()
 
+	if metadata != nil {
+		go metadata.Run(ctx)
+	}
+	if anodot30Submitter != nil {
+		go anodot30Submitter.Run(ctx)
+	}
+
+	statsdConfig, err := statsd.NewConfig()
+	if err != nil {
+		log.Fatal("Failed to create StatsD config: ", err.Error())
+	}
+
+	if statsdConfig.Enabled() {
+		statsdServer, err := statsd.NewServer(statsdConfig, parser, allWorkers)
+		if err != nil {
+			log.Fatal("Failed to create StatsD server: ", err.Error())
+		}
+		if err := statsdServer.Start(ctx); err != nil {
+			log.Fatal("Failed to start StatsD server: ", err.Error())
+		}
+	}
+
+	scrapeConfigPath := os.Getenv("ANODOT_SCRAPE_CONFIG_PATH")
+	if len(strings.TrimSpace(scrapeConfigPath)) > 0 {
+		scrapeConfig, err := scrape.LoadConfig(scrapeConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scrapeManager, err := scrape.NewManager(scrapeConfig, parser, histogramConfig, allWorkers)
+		if err != nil {
+			log.Fatal("Failed to create scrape manager: ", err.Error())
+		}
+		scrapeManager.Run(ctx)
+	}
+
 	s.InitHttp(ctx, allWorkers)
 }
 
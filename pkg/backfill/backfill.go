@@ -0,0 +1,257 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	"github.com/prometheus/common/model"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	ModeAuto       = "auto"
+	ModeRemoteRead = "remote_read"
+	ModeQueryRange = "query_range"
+)
+
+type Config struct {
+	PrometheusURL *url.URL
+	// Selectors are series selectors which are backfilled, e.g. 'http_requests_total{job="api"}'.
+	Selectors []string
+	Start     time.Time
+	End       time.Time
+	// DefaultEnd is set if End was not specified and defaults to current time. End of saved checkpoint is used
+	// when such backfill is resumed.
+	DefaultEnd bool
+
+	// ChunkDuration is a time range read from Prometheus and submitted to Anodot at once.
+	// Progress is saved to checkpoint after every chunk.
+	ChunkDuration time.Duration
+	// Step is a query resolution used by query_range API.
+	Step time.Duration
+	// Mode is one of: auto (remote read with fallback to query_range), remote_read, query_range.
+	Mode    string
+	Timeout time.Duration
+
+	CheckpointPath string
+	MaxEPS         int
+	BatchSize      int
+}
+
+func (c *Config) Validate() error {
+	if c.PrometheusURL == nil || c.PrometheusURL.Host == "" {
+		return fmt.Errorf("prometheus url should be specified")
+	}
+	if len(c.Selectors) == 0 {
+		return fmt.Errorf("at least one selector should be specified")
+	}
+	for _, s := range c.Selectors {
+		if _, err := anodotPrometheus.ParseSelector(s); err != nil {
+			return err
+		}
+	}
+	if !c.Start.Before(c.End) {
+		return fmt.Errorf("start time %s should be before end time %s", c.Start.Format(time.RFC3339), c.End.Format(time.RFC3339))
+	}
+	if c.ChunkDuration <= 0 || c.Step <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("chunk duration, step and timeout should be positive")
+	}
+	if c.ChunkDuration%c.Step != 0 {
+		return fmt.Errorf("chunk duration %s should be multiple of step %s", c.ChunkDuration, c.Step)
+	}
+	switch c.Mode {
+	case ModeAuto, ModeRemoteRead, ModeQueryRange:
+	default:
+		return fmt.Errorf("unsupported backfill mode %q", c.Mode)
+	}
+	if c.MaxEPS < 0 || c.BatchSize <= 0 {
+		return fmt.Errorf("max EPS should not be negative and batch size should be positive")
+	}
+	return nil
+}
+
+// ParseTime parses time in RFC3339 format or as unix timestamp in seconds.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as RFC3339 time or unix timestamp", s)
+}
+
+// Backfiller reads historical samples from Prometheus and submits them to Anodot in time order.
+type Backfiller struct {
+	config    *Config
+	parser    *anodotPrometheus.AnodotParser
+	submitter metrics.Submitter
+	readers   []Reader
+}
+
+func NewBackfiller(config *Config, parser *anodotPrometheus.AnodotParser, submitter metrics.Submitter) (*Backfiller, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if parser == nil || submitter == nil {
+		return nil, fmt.Errorf("parser and submitter should not be nil")
+	}
+
+	client := &http.Client{Timeout: config.Timeout}
+	remoteRead := &RemoteReader{URL: config.PrometheusURL, Client: client}
+	queryRange := &QueryRangeReader{URL: config.PrometheusURL, Client: client, Step: config.Step}
+
+	var readers []Reader
+	switch config.Mode {
+	case ModeRemoteRead:
+		readers = []Reader{remoteRead}
+	case ModeQueryRange:
+		readers = []Reader{queryRange}
+	default:
+		readers = []Reader{remoteRead, queryRange}
+	}
+	return &Backfiller{config: config, parser: parser, submitter: submitter, readers: readers}, nil
+}
+
+// Run backfills configured time range. If checkpoint path is set, backfill is resumed from saved checkpoint
+// and progress is saved after every submitted chunk.
+func (b *Backfiller) Run(ctx context.Context) error {
+	checkpoint := &Checkpoint{
+		PrometheusURL: b.config.PrometheusURL.String(),
+		Selectors:     b.config.Selectors,
+		Start:         b.config.Start,
+		End:           b.config.End,
+		Completed:     b.config.Start,
+	}
+
+	if b.config.CheckpointPath != "" {
+		saved, err := LoadCheckpoint(b.config.CheckpointPath)
+		if err != nil {
+			return err
+		}
+		if saved != nil {
+			if b.config.DefaultEnd {
+				checkpoint.End = saved.End
+			}
+			if !saved.matches(checkpoint) {
+				return fmt.Errorf("checkpoint %s was created for different backfill parameters, remove it to start a new backfill", b.config.CheckpointPath)
+			}
+			checkpoint = saved
+			log.Infof("Resuming backfill from %s", checkpoint.Completed.Format(time.RFC3339))
+		}
+	}
+
+	end := checkpoint.End
+	total := end.Sub(b.config.Start)
+	started := time.Now()
+	var sentInRun int64
+
+	for from := checkpoint.Completed; from.Before(end); from = checkpoint.Completed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		to := from.Add(b.config.ChunkDuration)
+		if to.After(end) {
+			to = end
+		}
+
+		samples, err := b.read(ctx, from, to)
+		if err != nil {
+			return err
+		}
+
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp.Before(samples[j].Timestamp)
+		})
+		data := b.parser.ParsePrometheusRequest(samples)
+
+		if err := b.submit(ctx, data); err != nil {
+			return err
+		}
+		sentInRun += int64(len(data))
+
+		checkpoint.Completed = to
+		checkpoint.SamplesSent += int64(len(samples))
+		checkpoint.MetricsSent += int64(len(data))
+		if b.config.CheckpointPath != "" {
+			if err := checkpoint.Save(b.config.CheckpointPath); err != nil {
+				return fmt.Errorf("failed to save checkpoint: %w", err)
+			}
+		}
+
+		log.Infof("Backfill progress: %.1f%% (up to %s). Samples read: %d, metrics sent: %d, EPS: %.0f",
+			100*float64(to.Sub(b.config.Start))/float64(total), to.Format(time.RFC3339),
+			checkpoint.SamplesSent, checkpoint.MetricsSent, float64(sentInRun)/time.Since(started).Seconds())
+	}
+
+	log.Infof("Backfill finished. Samples read: %d, metrics sent: %d", checkpoint.SamplesSent, checkpoint.MetricsSent)
+	return nil
+}
+
+// read returns samples of all selectors in [from, to) time range. In auto mode query_range API is used
+// once Prometheus server responds that remote read is not supported.
+func (b *Backfiller) read(ctx context.Context, from, to time.Time) (model.Samples, error) {
+	// both remote read and query_range include end of time range
+	end := to.Add(-time.Millisecond)
+
+	var samples model.Samples
+	for _, selector := range b.config.Selectors {
+		for {
+			s, err := b.readers[0].Read(ctx, selector, from, end)
+			var notSupported *errNotSupported
+			if errors.As(err, &notSupported) && len(b.readers) > 1 {
+				log.Warningf("%v. Falling back to %s", err, b.readers[1].Name())
+				b.readers = b.readers[1:]
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %q with %s: %w", selector, b.readers[0].Name(), err)
+			}
+			samples = append(samples, s...)
+			break
+		}
+	}
+	return samples, nil
+}
+
+// submit sends metrics in batches and waits between batches to keep configured EPS.
+func (b *Backfiller) submit(ctx context.Context, data []metrics.Anodot20Metric) error {
+	for i := 0; i < len(data); i += b.config.BatchSize {
+		j := i + b.config.BatchSize
+		if j > len(data) {
+			j = len(data)
+		}
+
+		start := time.Now()
+		resp, err := b.submitter.SubmitMetrics(data[i:j])
+		if err != nil {
+			return fmt.Errorf("failed to submit metrics: %w", err)
+		}
+		if resp != nil && resp.HasErrors() {
+			log.Warningf("Anodot server returned errors: %s", resp.ErrorMessage())
+		}
+
+		if b.config.MaxEPS > 0 {
+			wait := time.Duration(float64(j-i)/float64(b.config.MaxEPS)*float64(time.Second)) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+	return nil
+}
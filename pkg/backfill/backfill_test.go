@@ -0,0 +1,251 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type MockSubmitter struct {
+	Sent [][]metrics.Anodot20Metric
+}
+
+func (s *MockSubmitter) SubmitMetrics(m []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	s.Sent = append(s.Sent, m)
+	return nil, nil
+}
+
+func (s *MockSubmitter) AnodotURL() *url.URL {
+	return &url.URL{Host: "localhost"}
+}
+
+func testConfig(t *testing.T, server *httptest.Server, mode string) *Config {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		PrometheusURL: u,
+		Selectors:     []string{`up{job="node"}`},
+		Start:         time.Unix(1574690000, 0),
+		End:           time.Unix(1574690000+2*3600, 0),
+		ChunkDuration: time.Hour,
+		Step:          time.Minute,
+		Mode:          mode,
+		Timeout:       time.Second,
+		BatchSize:     100,
+	}
+}
+
+func TestBackfillRemoteRead(t *testing.T) {
+	var queries []*prompb.Query
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, compressed)
+		var req prompb.ReadRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := req.Queries[0]
+		queries = append(queries, q)
+
+		// samples are returned out of order
+		resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: q.StartTimestampMs + 60000}},
+			},
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}, {Name: "instance", Value: "b"}},
+				Samples: []prompb.Sample{{Value: 0, Timestamp: q.StartTimestampMs}},
+			},
+		}}}}
+		out, _ := proto.Marshal(resp)
+		_, _ = w.Write(snappy.Encode(nil, out))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testConfig(t, server, ModeRemoteRead)
+	config.CheckpointPath = filepath.Join(dir, "checkpoint.json")
+
+	parser, _ := anodotPrometheus.NewAnodotParser(nil, nil, nil)
+	submitter := &MockSubmitter{}
+	b, err := NewBackfiller(config, parser, submitter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queries) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong number of queries \n got: %d\n want: 2", len(queries)))
+	}
+	if queries[0].StartTimestampMs != 1574690000000 || queries[0].EndTimestampMs != 1574693599999 || queries[1].StartTimestampMs != 1574693600000 {
+		t.Fatal(fmt.Sprintf("Wrong query time ranges \n got: %v", queries))
+	}
+	if len(queries[0].Matchers) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong query matchers \n got: %v", queries[0].Matchers))
+	}
+
+	if len(submitter.Sent) != 2 || len(submitter.Sent[0]) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong submitted metrics \n got: %v", submitter.Sent))
+	}
+	if !submitter.Sent[0][0].Timestamp.Before(submitter.Sent[0][1].Timestamp.Time) {
+		t.Fatal(fmt.Sprintf("Metrics should be sent in time order \n got: %v", submitter.Sent[0]))
+	}
+
+	checkpoint, err := LoadCheckpoint(config.CheckpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkpoint.Completed.Equal(config.End) || checkpoint.MetricsSent != 4 {
+		t.Fatal(fmt.Sprintf("Wrong checkpoint \n got: %+v", checkpoint))
+	}
+
+	// completed backfill is not repeated
+	submitter.Sent = nil
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitter.Sent) != 0 {
+		t.Fatal(fmt.Sprintf("Completed backfill should not be repeated \n got: %v", submitter.Sent))
+	}
+
+	// backfill without end time is resumed up to end of checkpoint
+	checkpoint.Completed = config.Start.Add(time.Hour)
+	if err := checkpoint.Save(config.CheckpointPath); err != nil {
+		t.Fatal(err)
+	}
+	end := config.End
+	config.End, config.DefaultEnd = time.Now(), true
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitter.Sent) != 1 || queries[2].StartTimestampMs != 1574693600000 {
+		t.Fatal(fmt.Sprintf("Backfill should be resumed up to checkpoint end \n got: %v", submitter.Sent))
+	}
+	if checkpoint, err = LoadCheckpoint(config.CheckpointPath); err != nil || !checkpoint.Completed.Equal(end) {
+		t.Fatal(fmt.Sprintf("Wrong checkpoint \n got: %+v", checkpoint))
+	}
+
+	// checkpoint of different backfill is rejected
+	config.Selectors = []string{"up"}
+	if err := b.Run(context.Background()); err == nil {
+		t.Fatalf("error should be returned for checkpoint of different backfill")
+	}
+}
+
+func TestBackfillFallbackToQueryRange(t *testing.T) {
+	var ranges [][2]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/read" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ranges = append(ranges, [2]string{r.Form.Get("start"), r.Form.Get("end")})
+
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		resp := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "matrix",
+				"result": []interface{}{map[string]interface{}{
+					"metric": map[string]string{"__name__": "up", "job": "node"},
+					"values": [][]interface{}{{start, "1"}, {start + 60, "1"}},
+				}},
+			},
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	parser, _ := anodotPrometheus.NewAnodotParser(nil, nil, nil)
+	submitter := &MockSubmitter{}
+	b, err := NewBackfiller(testConfig(t, server, ModeAuto), parser, submitter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]string{{"1574690000", "1574693599.999"}, {"1574693600", "1574697199.999"}}
+	if fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Fatal(fmt.Sprintf("Wrong query_range time ranges \n got: %v\n want: %v", ranges, expected))
+	}
+	if len(submitter.Sent) != 2 || len(submitter.Sent[1]) != 2 || submitter.Sent[1][0].Properties["job"] != "node" {
+		t.Fatal(fmt.Sprintf("Wrong submitted metrics \n got: %v", submitter.Sent))
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	u, _ := url.Parse("http://prometheus:9090")
+	valid := Config{PrometheusURL: u, Selectors: []string{"up"}, Start: time.Unix(0, 0), End: time.Unix(3600, 0),
+		ChunkDuration: time.Hour, Step: time.Minute, Mode: ModeAuto, Timeout: time.Second, BatchSize: 1000}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []func(c *Config){
+		func(c *Config) { c.Selectors = nil },
+		func(c *Config) { c.End = c.Start },
+		func(c *Config) { c.Step = 7 * time.Minute },
+		func(c *Config) { c.Mode = "unknown" },
+		func(c *Config) { c.BatchSize = 0 },
+	}
+	for i, f := range invalid {
+		c := valid
+		f(&c)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("error should be returned for invalid config %d", i)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := map[string]time.Time{
+		"2019-11-25T14:50:00Z": time.Unix(1574693400, 0),
+		"1574693400":           time.Unix(1574693400, 0),
+		"1574693400.5":         time.Unix(1574693400, 500000000),
+	}
+	for s, expected := range tests {
+		got, err := ParseTime(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(expected) {
+			t.Fatal(fmt.Sprintf("Wrong time \n got: %s\n want: %s", got, expected))
+		}
+	}
+
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Fatalf("error should be returned for invalid time")
+	}
+}
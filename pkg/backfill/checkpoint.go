@@ -0,0 +1,72 @@
+package backfill
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Checkpoint is a backfill progress persisted on disk, so interrupted backfill can be resumed
+// from the last fully submitted time range.
+type Checkpoint struct {
+	PrometheusURL string    `json:"prometheus_url"`
+	Selectors     []string  `json:"selectors"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	// Completed is the end of the last fully submitted time range.
+	Completed   time.Time `json:"completed"`
+	SamplesSent int64     `json:"samples_sent"`
+	MetricsSent int64     `json:"metrics_sent"`
+}
+
+// LoadCheckpoint reads checkpoint from path. Nil is returned if checkpoint file does not exist.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c Checkpoint
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save atomically writes checkpoint to path.
+func (c *Checkpoint) Save(path string) error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// matches reports whether checkpoint was created for the same backfill parameters.
+func (c *Checkpoint) matches(other *Checkpoint) bool {
+	return c.PrometheusURL == other.PrometheusURL && reflect.DeepEqual(c.Selectors, other.Selectors) &&
+		c.Start.Equal(other.Start) && c.End.Equal(other.End)
+}
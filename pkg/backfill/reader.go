@@ -0,0 +1,208 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	remoteReadEndpoint = "/api/v1/read"
+	queryRangeEndpoint = "/api/v1/query_range"
+
+	maxErrorBodyPreview = 256
+)
+
+// Reader reads samples of series matching selector in [start, end] time range.
+type Reader interface {
+	Read(ctx context.Context, selector string, start, end time.Time) (model.Samples, error)
+	Name() string
+}
+
+// errNotSupported is returned by RemoteReader if Prometheus server does not serve remote read API.
+type errNotSupported struct {
+	status string
+}
+
+func (e *errNotSupported) Error() string {
+	return fmt.Sprintf("remote read is not supported by server: %s", e.status)
+}
+
+// RemoteReader reads raw samples with Prometheus remote read API.
+type RemoteReader struct {
+	URL    *url.URL
+	Client *http.Client
+}
+
+func (r *RemoteReader) Name() string {
+	return "remote_read"
+}
+
+func (r *RemoteReader) Read(ctx context.Context, selector string, start, end time.Time) (model.Samples, error) {
+	matchers, err := anodotPrometheus.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: timestampMs(start),
+		EndTimestampMs:   timestampMs(end),
+		Matchers:         matchers,
+	}}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, endpointURL(r.URL, remoteReadEndpoint), bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	resp, err := r.Client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return nil, &errNotSupported{status: resp.Status}
+	case resp.StatusCode != http.StatusOK:
+		return nil, responseError(resp)
+	}
+
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var readResp prompb.ReadResponse
+	if err := proto.Unmarshal(reqBuf, &readResp); err != nil {
+		return nil, err
+	}
+
+	var samples model.Samples
+	for _, result := range readResp.Results {
+		for _, ts := range result.Timeseries {
+			metric := make(model.Metric, len(ts.Labels))
+			for _, l := range ts.Labels {
+				metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+			for _, s := range ts.Samples {
+				samples = append(samples, &model.Sample{Metric: metric.Clone(), Value: model.SampleValue(s.Value), Timestamp: model.Time(s.Timestamp)})
+			}
+		}
+	}
+	return samples, nil
+}
+
+// QueryRangeReader reads samples with '/api/v1/query_range' API evaluated at Step resolution.
+type QueryRangeReader struct {
+	URL    *url.URL
+	Client *http.Client
+	Step   time.Duration
+}
+
+func (r *QueryRangeReader) Name() string {
+	return "query_range"
+}
+
+type queryRangeResponse struct {
+	Status    string `json:"status"`
+	Error     string `json:"error"`
+	ErrorType string `json:"errorType"`
+	Data      struct {
+		ResultType string               `json:"resultType"`
+		Result     []model.SampleStream `json:"result"`
+	} `json:"data"`
+}
+
+func (r *QueryRangeReader) Read(ctx context.Context, selector string, start, end time.Time) (model.Samples, error) {
+	query := url.Values{}
+	query.Set("query", selector)
+	query.Set("start", formatTime(start))
+	query.Set("end", formatTime(end))
+	query.Set("step", strconv.FormatFloat(r.Step.Seconds(), 'f', -1, 64))
+
+	req, err := http.NewRequest(http.MethodPost, endpointURL(r.URL, queryRangeEndpoint), strings.NewReader(query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	var result queryRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+		}
+		return nil, err
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("query failed with HTTP status %s: %s: %s", resp.Status, result.ErrorType, result.Error)
+	}
+	if result.Data.ResultType != model.ValMatrix.String() {
+		return nil, fmt.Errorf("unexpected result type %q", result.Data.ResultType)
+	}
+
+	var samples model.Samples
+	for _, stream := range result.Data.Result {
+		metric := stream.Metric
+		for _, v := range stream.Values {
+			samples = append(samples, &model.Sample{Metric: metric.Clone(), Value: v.Value, Timestamp: v.Timestamp})
+		}
+	}
+	return samples, nil
+}
+
+func endpointURL(base *url.URL, endpoint string) string {
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + endpoint
+	return u.String()
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyPreview))
+	return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func timestampMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
@@ -0,0 +1,95 @@
+package prometheus
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ADMIN_RATE_LIMITS_ENDPOINT lists rate limiters on GET and changes limit of one of them on PUT.
+const ADMIN_RATE_LIMITS_ENDPOINT = "/admin/rate-limits"
+
+// AdminConfig enables admin endpoints, which are not registered if Token is empty.
+type AdminConfig struct {
+	// Token is a bearer token required by admin endpoints. It is separate from credentials of write endpoints clients.
+	Token string
+}
+
+func NewAdminConfig() (*AdminConfig, error) {
+	config := &AdminConfig{}
+	if err := envconfig.Process("ANODOT_ADMIN", config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *AdminConfig) Enabled() bool {
+	return c != nil && c.Token != ""
+}
+
+// withAdminAuth allows only requests with admin bearer token.
+func (rc *Receiver) withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !rc.Admin.Enabled() || subtle.ConstantTimeCompare([]byte(token), []byte(rc.Admin.Token)) != 1 {
+			httpResponses.With(prometheus.Labels{"response_code": "401"}).Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="anodot-remote-write-admin"`)
+			http.Error(w, "admin authentication required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RateLimit is a limit of rate limiter, either global, of tenant worker or of routing destination.
+type RateLimit struct {
+	Name  string `json:"name"`
+	EPS   int    `json:"eps"`
+	Burst int    `json:"burst"`
+}
+
+func rateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limits := make([]RateLimit, 0)
+		for _, l := range remote.RateLimiters() {
+			eps, burst := l.Limit()
+			limits = append(limits, RateLimit{Name: l.Name, EPS: eps, Burst: burst})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(limits); err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "500"}).Inc()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodPut:
+		var limit RateLimit
+		if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		l, ok := remote.LookupRateLimiter(limit.Name)
+		if !ok {
+			httpResponses.With(prometheus.Labels{"response_code": "404"}).Inc()
+			http.Error(w, fmt.Sprintf("unknown rate limiter %q", limit.Name), http.StatusNotFound)
+			return
+		}
+		if err := l.SetLimit(limit.EPS, limit.Burst); err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpResponses.With(prometheus.Labels{"response_code": "405"}).Inc()
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,81 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+)
+
+func TestRateLimitsHandler(t *testing.T) {
+	limiter, err := remote.NewRateLimiter("destination/admin-test", 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rateLimitsHandler(w, httptest.NewRequest(http.MethodGet, ADMIN_RATE_LIMITS_ENDPOINT, nil))
+	var limits []RateLimit
+	if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, l := range limits {
+		found = found || l == RateLimit{Name: "destination/admin-test", EPS: 1000, Burst: 1000}
+	}
+	if !found {
+		t.Fatal(fmt.Sprintf("Rate limiter is not listed \n got: %+v", limits))
+	}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"name": "destination/admin-test", "eps": 500, "burst": 2000}`, http.StatusNoContent},
+		{`{"name": "unknown", "eps": 500}`, http.StatusNotFound},
+		{`{"name": "destination/admin-test", "eps": -1}`, http.StatusBadRequest},
+		{`eps=1`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rateLimitsHandler(w, httptest.NewRequest(http.MethodPut, ADMIN_RATE_LIMITS_ENDPOINT, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Fatal(fmt.Sprintf("Wrong response code for %s \n got: %d\n want: %d", tt.body, w.Code, tt.code))
+		}
+	}
+
+	if eps, burst := limiter.Limit(); eps != 500 || burst != 2000 {
+		t.Fatal(fmt.Sprintf("Rate limit is not changed \n got: %d %d\n want: 500 2000", eps, burst))
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		admin         *AdminConfig
+		authorization string
+		code          int
+	}{
+		{nil, "", http.StatusUnauthorized},
+		{&AdminConfig{Token: "secret"}, "", http.StatusUnauthorized},
+		{&AdminConfig{Token: "secret"}, "Bearer wrong", http.StatusUnauthorized},
+		{&AdminConfig{Token: "secret"}, "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rc := &Receiver{Admin: tt.admin}
+		r := httptest.NewRequest(http.MethodGet, ADMIN_RATE_LIMITS_ENDPOINT, nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		rc.withAdminAuth(handler)(w, r)
+		if w.Code != tt.code {
+			t.Fatal(fmt.Sprintf("Wrong response code for %+v and %q \n got: %d\n want: %d", tt.admin, tt.authorization, w.Code, tt.code))
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+// Functions of label aggregation rules.
+const (
+	AggregationSum   = "sum"
+	AggregationAvg   = "avg"
+	AggregationMin   = "min"
+	AggregationMax   = "max"
+	AggregationCount = "count"
+)
+
+var (
+	labelAggregationSeries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "anodot_parser_aggregation_series",
+		Help: "Number of series which latest values are aggregated by label aggregation rules",
+	})
+
+	labelAggregationProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_parser_aggregation_produced_samples_total",
+		Help: "Total number of samples produced by label aggregation rules",
+	}, []string{"rule"})
+
+	labelAggregationConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_parser_aggregation_consumed_samples_total",
+		Help: "Total number of original samples which are not sent, because they are replaced by aggregates",
+	})
+)
+
+// LabelAggregationRule aggregates series matching Match selector into series without some of their labels.
+type LabelAggregationRule struct {
+	// Match is a series selector, e.g. 'http_requests_total{namespace="prod"}'.
+	Match string `yaml:"match"`
+	// Without lists labels which are removed from produced series. By lists the only labels which are kept.
+	// Metric name is kept in both cases.
+	Without []string `yaml:"without,omitempty"`
+	By      []string `yaml:"by,omitempty"`
+	// Function is one of: sum, avg, min, max, count.
+	Function string `yaml:"function"`
+	// Name of produced metric. Defaults to name of aggregated metric.
+	Name string `yaml:"name,omitempty"`
+	// KeepOriginal sends aggregated series as well.
+	KeepOriginal bool `yaml:"keep_original,omitempty"`
+}
+
+type LabelAggregationConfig struct {
+	// Staleness is a time after which series without new samples is not aggregated anymore.
+	Staleness model.Duration `yaml:"staleness,omitempty"`
+	// GracePeriod is a time aggregate waits for updates of all its series before it is produced with updates received
+	// so far. Aggregate is produced once all its series are updated, without waiting for grace period.
+	GracePeriod model.Duration         `yaml:"grace_period,omitempty"`
+	Rules       []LabelAggregationRule `yaml:"aggregation_rules"`
+}
+
+func LoadLabelAggregationConfig(path string) (*LabelAggregationConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config LabelAggregationConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", path)
+	}
+	if config.Staleness == 0 {
+		config.Staleness = model.Duration(5 * time.Minute)
+	}
+	if config.GracePeriod == 0 {
+		config.GracePeriod = model.Duration(30 * time.Second)
+	}
+	if _, err := NewLabelAggregator(&config); err != nil {
+		return nil, errors.Wrapf(err, "invalid aggregation rules in %s", path)
+	}
+	return &config, nil
+}
+
+type labelMatcher struct {
+	*prompb.LabelMatcher
+	re *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(metric model.Metric) bool {
+	v := string(metric[model.LabelName(m.Name)])
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return v == m.Value
+	case prompb.LabelMatcher_NEQ:
+		return v != m.Value
+	case prompb.LabelMatcher_RE:
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+type labelAggregationRule struct {
+	LabelAggregationRule
+	matchers []labelMatcher
+	labels   map[model.LabelName]bool
+}
+
+// groupMetric returns labels of series which metric is aggregated into.
+func (r *labelAggregationRule) groupMetric(metric model.Metric) model.Metric {
+	res := make(model.Metric, len(metric))
+	for l, v := range metric {
+		if l == model.MetricNameLabel || (len(r.By) > 0) == r.labels[l] {
+			res[l] = v
+		}
+	}
+	if r.Name != "" {
+		res[model.MetricNameLabel] = model.LabelValue(r.Name)
+	}
+	return res
+}
+
+type aggregatedSeries struct {
+	value    float64
+	ts       model.Time
+	lastSeen time.Time
+	// updated is true if series was updated since aggregate was produced
+	updated bool
+}
+
+type aggregationGroup struct {
+	rule   int
+	metric model.Metric
+	series map[string]*aggregatedSeries
+	// pendingSince is a time of the first update since aggregate was produced, zero if there are no updates
+	pendingSince time.Time
+}
+
+// latest returns timestamp of the latest sample of group series.
+func (g *aggregationGroup) latest() model.Time {
+	var latest model.Time
+	for _, s := range g.series {
+		if s.ts.After(latest) {
+			latest = s.ts
+		}
+	}
+	return latest
+}
+
+// complete returns true if all series which are not stale were updated since aggregate was produced.
+func (g *aggregationGroup) complete(staleness time.Duration) bool {
+	latest := g.latest()
+	for _, s := range g.series {
+		if !s.updated && latest.Sub(s.ts) <= staleness {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *aggregationGroup) value(function string, staleness time.Duration) (float64, model.Time) {
+	latest := g.latest()
+
+	var res float64
+	count := 0
+	for _, s := range g.series {
+		if latest.Sub(s.ts) > staleness {
+			continue
+		}
+		switch {
+		case count == 0:
+			res = s.value
+		case function == AggregationMin:
+			res = math.Min(res, s.value)
+		case function == AggregationMax:
+			res = math.Max(res, s.value)
+		default:
+			res += s.value
+		}
+		count++
+	}
+
+	switch function {
+	case AggregationAvg:
+		res /= float64(count)
+	case AggregationCount:
+		res = float64(count)
+	}
+	return res, latest
+}
+
+// LabelAggregator is a metrics processor which aggregates series across labels dropped by rules, e.g. sums series of
+// all pods. It keeps the latest value of every aggregated series, and produces aggregate with timestamp of the latest
+// sample once all its series are updated, or grace period passed since the first update. Aggregates are checked when
+// requests are parsed, so aggregate waiting for grace period is produced with the next request.
+type LabelAggregator struct {
+	config *LabelAggregationConfig
+	rules  []labelAggregationRule
+
+	mu        sync.Mutex
+	groups    map[string]*aggregationGroup
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func NewLabelAggregator(config *LabelAggregationConfig) (*LabelAggregator, error) {
+	a := &LabelAggregator{config: config, groups: make(map[string]*aggregationGroup), now: time.Now}
+	for _, r := range config.Rules {
+		switch r.Function {
+		case AggregationSum, AggregationAvg, AggregationMin, AggregationMax, AggregationCount:
+		default:
+			return nil, fmt.Errorf("unsupported aggregation function %q of rule %q", r.Function, r.Match)
+		}
+		if len(r.By) > 0 && len(r.Without) > 0 {
+			return nil, fmt.Errorf("aggregation rule %q should have either 'by' or 'without' labels", r.Match)
+		}
+		if r.Name == "" && r.KeepOriginal && len(r.By) == 0 && len(r.Without) == 0 {
+			return nil, fmt.Errorf("aggregation rule %q produces the same series as original ones", r.Match)
+		}
+
+		matchers, err := ParseSelector(r.Match)
+		if err != nil {
+			return nil, err
+		}
+		rule := labelAggregationRule{LabelAggregationRule: r, labels: make(map[model.LabelName]bool)}
+		for _, m := range matchers {
+			lm := labelMatcher{LabelMatcher: m}
+			if m.Type == prompb.LabelMatcher_RE || m.Type == prompb.LabelMatcher_NRE {
+				lm.re = regexp.MustCompile("^(?:" + m.Value + ")$")
+			}
+			rule.matchers = append(rule.matchers, lm)
+		}
+		for _, l := range append(r.By, r.Without...) {
+			rule.labels[model.LabelName(l)] = true
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func (a *LabelAggregator) Name() string {
+	return "LabelAggregator"
+}
+
+// Mutate does not change metrics, they are processed by Aggregate.
+func (a *LabelAggregator) Mutate(model.Metric) {}
+
+// fork returns aggregator with the same rules and own series state.
+func (a *LabelAggregator) fork() *LabelAggregator {
+	res, _ := NewLabelAggregator(a.config)
+	return res
+}
+
+// Aggregate remembers sample value in groups of all matching rules. Sample is dropped if any of them does not keep originals.
+func (a *LabelAggregator) Aggregate(sample *model.Sample) bool {
+	keep := true
+	now := a.now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep(now)
+
+RULES:
+	for i := range a.rules {
+		rule := &a.rules[i]
+		for _, m := range rule.matchers {
+			if !m.matches(sample.Metric) {
+				continue RULES
+			}
+		}
+		keep = keep && rule.KeepOriginal
+
+		metric := rule.groupMetric(sample.Metric)
+		key := strconv.Itoa(i) + metric.String()
+		group, ok := a.groups[key]
+		if !ok {
+			group = &aggregationGroup{rule: i, metric: metric, series: make(map[string]*aggregatedSeries)}
+			a.groups[key] = group
+		}
+
+		series, ok := group.series[sample.Metric.String()]
+		if !ok {
+			series = &aggregatedSeries{}
+			group.series[sample.Metric.String()] = series
+			labelAggregationSeries.Inc()
+		}
+		if sample.Timestamp.Before(series.ts) {
+			continue
+		}
+		series.value, series.ts, series.lastSeen, series.updated = float64(sample.Value), sample.Timestamp, now, true
+		if group.pendingSince.IsZero() {
+			group.pendingSince = now
+		}
+	}
+	if !keep {
+		labelAggregationConsumed.Inc()
+	}
+	return keep
+}
+
+// Produce returns aggregates of groups which all series were updated since aggregates were produced, or which were
+// updated earlier than grace period ago.
+func (a *LabelAggregator) Produce() model.Samples {
+	return a.produce(false)
+}
+
+// Flush returns aggregates of all groups updated since aggregates were produced, without waiting for grace period.
+func (a *LabelAggregator) Flush() model.Samples {
+	return a.produce(true)
+}
+
+func (a *LabelAggregator) produce(all bool) model.Samples {
+	now := a.now()
+	staleness := time.Duration(a.config.Staleness)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var keys []string
+	for key, g := range a.groups {
+		if !g.pendingSince.IsZero() && (all || g.complete(staleness) || now.Sub(g.pendingSince) >= time.Duration(a.config.GracePeriod)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	res := make(model.Samples, 0, len(keys))
+	for _, key := range keys {
+		g := a.groups[key]
+		g.pendingSince = time.Time{}
+		for _, s := range g.series {
+			s.updated = false
+		}
+
+		rule := a.rules[g.rule]
+		value, ts := g.value(rule.Function, staleness)
+		metric := make(model.Metric, len(g.metric))
+		for l, v := range g.metric {
+			metric[l] = v
+		}
+		res = append(res, &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: ts})
+		labelAggregationProduced.WithLabelValues(rule.Match).Inc()
+	}
+	return res
+}
+
+// sweep forgets series which were not seen during staleness period. Must be called with a.mu held.
+func (a *LabelAggregator) sweep(now time.Time) {
+	staleness := time.Duration(a.config.Staleness)
+	if now.Sub(a.lastSweep) < staleness/2 {
+		return
+	}
+	a.lastSweep = now
+
+	for key, g := range a.groups {
+		for id, s := range g.series {
+			if now.Sub(s.lastSeen) > staleness {
+				delete(g.series, id)
+				labelAggregationSeries.Dec()
+			}
+		}
+		if len(g.series) == 0 {
+			delete(a.groups, key)
+		}
+	}
+}
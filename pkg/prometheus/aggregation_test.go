@@ -0,0 +1,236 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func podSample(name string, pod string, ts int64, value float64) *model.Sample {
+	return &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: model.LabelValue(name), "namespace": "prod", "pod": model.LabelValue(pod)},
+		Timestamp: model.Time(ts),
+		Value:     model.SampleValue(value),
+	}
+}
+
+func producedValues(samples model.Samples) []string {
+	res := make([]string, 0, len(samples))
+	for _, s := range samples {
+		res = append(res, fmt.Sprintf("%s=%v@%d", s.Metric, s.Value, s.Timestamp))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestLabelAggregatorFunctions(t *testing.T) {
+	var rules []LabelAggregationRule
+	for _, f := range []string{AggregationSum, AggregationAvg, AggregationMin, AggregationMax, AggregationCount} {
+		rules = append(rules, LabelAggregationRule{Match: "requests_total", Without: []string{"pod"}, Function: f, Name: "requests_" + f})
+	}
+	a, err := NewLabelAggregator(&LabelAggregationConfig{Staleness: model.Duration(5 * time.Minute), Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range []float64{1, 2, 6} {
+		if a.Aggregate(podSample("requests_total", fmt.Sprint(i), int64(1000+i), v)) {
+			t.Fatal("Original sample should be dropped")
+		}
+	}
+	if !a.Aggregate(podSample("other_total", "0", 1000, 1)) {
+		t.Fatal("Sample not matching any rule should be kept")
+	}
+
+	got := producedValues(a.Produce())
+	want := []string{
+		`requests_avg{namespace="prod"}=3@1002`,
+		`requests_count{namespace="prod"}=3@1002`,
+		`requests_max{namespace="prod"}=6@1002`,
+		`requests_min{namespace="prod"}=1@1002`,
+		`requests_sum{namespace="prod"}=9@1002`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong aggregated samples \n got: %v\n want: %v", got, want))
+	}
+
+	if got := a.Produce(); len(got) != 0 {
+		t.Fatal(fmt.Sprintf("Aggregates without updates should not be produced \n got: %v", got))
+	}
+}
+
+func TestLabelAggregatorBy(t *testing.T) {
+	a, err := NewLabelAggregator(&LabelAggregationConfig{
+		Staleness: model.Duration(time.Minute),
+		Rules:     []LabelAggregationRule{{Match: `{__name__=~"cpu_.*",namespace!="kube-system"}`, By: []string{"namespace"}, Function: AggregationSum, KeepOriginal: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.Aggregate(podSample("cpu_seconds", "a", 0, 1)) {
+		t.Fatal("Original sample should be kept")
+	}
+	a.Aggregate(podSample("cpu_seconds", "b", 1000, 2))
+	a.Aggregate(podSample("memory_bytes", "b", 1000, 5))
+	sample := podSample("cpu_seconds", "c", 1000, 5)
+	sample.Metric["namespace"] = "kube-system"
+	a.Aggregate(sample)
+
+	got := producedValues(a.Produce())
+	want := []string{`cpu_seconds{namespace="prod"}=3@1000`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong aggregated samples \n got: %v\n want: %v", got, want))
+	}
+
+	// newer value of series replaces the previous one, older one is ignored
+	a.Aggregate(podSample("cpu_seconds", "a", 2000, 10))
+	a.Aggregate(podSample("cpu_seconds", "b", 500, 100))
+	// series 'b' is stale by time of the latest sample
+	a.Aggregate(podSample("cpu_seconds", "a", 62000, 20))
+	got = producedValues(a.Produce())
+	want = []string{`cpu_seconds{namespace="prod"}=20@62000`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Stale series should not be aggregated \n got: %v\n want: %v", got, want))
+	}
+}
+
+func TestLabelAggregatorGracePeriod(t *testing.T) {
+	a, err := NewLabelAggregator(&LabelAggregationConfig{
+		Staleness:   model.Duration(5 * time.Minute),
+		GracePeriod: model.Duration(30 * time.Second),
+		Rules:       []LabelAggregationRule{{Match: "requests_total", Without: []string{"pod"}, Function: AggregationSum}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1574693460, 0)
+	a.now = func() time.Time { return now }
+
+	a.Aggregate(podSample("requests_total", "a", 1000, 1))
+	a.Aggregate(podSample("requests_total", "b", 1000, 2))
+	a.Produce()
+
+	// aggregate is not produced until all series are updated
+	a.Aggregate(podSample("requests_total", "a", 16000, 3))
+	if got := a.Produce(); len(got) != 0 {
+		t.Fatal(fmt.Sprintf("Partial aggregate should not be produced \n got: %v", got))
+	}
+	a.Aggregate(podSample("requests_total", "b", 17000, 4))
+	got := producedValues(a.Produce())
+	want := []string{`requests_total{namespace="prod"}=7@17000`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong complete aggregate \n got: %v\n want: %v", got, want))
+	}
+
+	// aggregate is produced with series updated so far once grace period passes
+	a.Aggregate(podSample("requests_total", "a", 31000, 5))
+	now = now.Add(31 * time.Second)
+	got = producedValues(a.Produce())
+	want = []string{`requests_total{namespace="prod"}=9@31000`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong aggregate after grace period \n got: %v\n want: %v", got, want))
+	}
+}
+
+func TestLabelAggregatorSweep(t *testing.T) {
+	a, err := NewLabelAggregator(&LabelAggregationConfig{
+		Staleness: model.Duration(time.Minute),
+		Rules:     []LabelAggregationRule{{Match: "requests_total", Without: []string{"pod"}, Function: AggregationSum}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1574693460, 0)
+	a.now = func() time.Time { return now }
+
+	a.Aggregate(podSample("requests_total", "a", 0, 1))
+	now = now.Add(2 * time.Minute)
+	a.Aggregate(podSample("requests_total", "b", 0, 2))
+
+	if len(a.groups) != 1 || len(a.groups["0"+`requests_total{namespace="prod"}`].series) != 1 {
+		t.Fatal(fmt.Sprintf("Series not seen during staleness period should be removed \n got: %v", a.groups))
+	}
+}
+
+func TestParserLabelAggregation(t *testing.T) {
+	parser, err := NewAnodotParser(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregator, err := NewLabelAggregator(&LabelAggregationConfig{
+		Staleness:   model.Duration(time.Minute),
+		GracePeriod: model.Duration(time.Minute),
+		Rules:       []LabelAggregationRule{{Match: "requests_total", Without: []string{"pod"}, Function: AggregationSum}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.MetricsProcessors = []MetricsProcessor{aggregator}
+
+	result := parser.ParsePrometheusRequest(model.Samples{
+		podSample("requests_total", "a", 1574693460000, 1),
+		podSample("requests_total", "b", 1574693461000, 2),
+		podSample("memory_bytes", "a", 1574693460000, 3),
+	})
+	if len(result) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong number of metrics \n got: %v\n want: %d", result, 2))
+	}
+	got := result[1]
+	if got.Properties["what"] != "requests_total" || got.Properties["pod"] != "" || got.Value != 3 || !got.Timestamp.Equal(time.Unix(1574693461, 0)) {
+		t.Fatal(fmt.Sprintf("Wrong aggregated metric \n got: %+v", got))
+	}
+
+	// partial aggregate is produced on flush only
+	if result := parser.ParsePrometheusRequest(model.Samples{podSample("requests_total", "a", 1574693470000, 5)}); len(result) != 0 {
+		t.Fatal(fmt.Sprintf("Partial aggregate should not be sent \n got: %v", result))
+	}
+	if result := parser.Produce(false); len(result) != 0 {
+		t.Fatal(fmt.Sprintf("Partial aggregate should not be produced before grace period \n got: %v", result))
+	}
+	result = parser.Produce(true)
+	if len(result) != 1 || result[0].Value != 7 {
+		t.Fatal(fmt.Sprintf("Partial aggregate should be produced on flush \n got: %v", result))
+	}
+}
+
+func TestLoadLabelAggregationConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "label-aggregation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aggregation.yml")
+
+	tests := []struct {
+		content string
+		valid   bool
+	}{
+		{"aggregation_rules:\n  - match: 'requests_total{namespace=\"prod\"}'\n    without: [pod]\n    function: sum\n", true},
+		{"aggregation_rules:\n  - match: requests_total\n    without: [pod]\n    by: [namespace]\n    function: sum\n", false},
+		{"aggregation_rules:\n  - match: requests_total\n    without: [pod]\n    function: median\n", false},
+		{"aggregation_rules:\n  - match: 'requests_total{'\n    without: [pod]\n    function: sum\n", false},
+		{"aggregation_rules:\n  - match: requests_total\n    function: sum\n    keep_original: true\n", false},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadLabelAggregationConfig(path)
+		if (err == nil) != tt.valid {
+			t.Fatal(fmt.Sprintf("Wrong validation of %q \n got: %v\n want valid: %v", tt.content, err, tt.valid))
+		}
+		if err == nil && time.Duration(config.Staleness) != 5*time.Minute {
+			t.Fatal(fmt.Sprintf("Wrong default staleness \n got: %s\n want: %s", config.Staleness, 5*time.Minute))
+		}
+		if err == nil && time.Duration(config.GracePeriod) != 30*time.Second {
+			t.Fatal(fmt.Sprintf("Wrong default grace period \n got: %s\n want: %s", config.GracePeriod, 30*time.Second))
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+	log "k8s.io/klog/v2"
+)
+
+// anonymousClient is client identity used when authentication is disabled.
+const anonymousClient = "anonymous"
+
+var (
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_auth_failures_total",
+		Help: "Total number of rejected unauthenticated write requests",
+	}, []string{"reason"})
+
+	authCredentialsReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_auth_credentials_reloads_total",
+		Help: "Total number of client credentials file reloads",
+	}, []string{"result"})
+)
+
+// AuthConfig configures authentication of write endpoints. Authentication is disabled if CredentialsFile is empty.
+type AuthConfig struct {
+	// CredentialsFile is a YAML file with allowed clients. File is re-read once changed.
+	CredentialsFile string `split_words:"true"`
+	// ReloadInterval is how often credentials file is checked for changes.
+	ReloadInterval time.Duration `default:"1m" split_words:"true"`
+	// IdentityTag is a name of Anodot tag which holds authenticated client name. Tag is not added if empty.
+	IdentityTag string `split_words:"true"`
+}
+
+func NewAuthConfig() (*AuthConfig, error) {
+	config := &AuthConfig{}
+	if err := envconfig.Process("ANODOT_AUTH", config); err != nil {
+		return nil, err
+	}
+
+	if !config.Enabled() {
+		if config.IdentityTag != "" {
+			return nil, fmt.Errorf("ANODOT_AUTH_CREDENTIALS_FILE should be specified to add client identity tag")
+		}
+		return config, nil
+	}
+	if config.ReloadInterval <= 0 {
+		return nil, fmt.Errorf("ANODOT_AUTH_RELOAD_INTERVAL should be positive")
+	}
+	return config, nil
+}
+
+func (c *AuthConfig) Enabled() bool {
+	return c != nil && c.CredentialsFile != ""
+}
+
+// ClientCredentials identifies single client either by bearer token or by basic auth username and password.
+type ClientCredentials struct {
+	Name        string `yaml:"name"`
+	BearerToken string `yaml:"bearer_token,omitempty"`
+	Username    string `yaml:"username,omitempty"`
+	Password    string `yaml:"password,omitempty"`
+}
+
+type Credentials struct {
+	Clients []ClientCredentials `yaml:"clients"`
+}
+
+func parseCredentials(content []byte, path string) (*Credentials, error) {
+	var creds Credentials
+	if err := yaml.UnmarshalStrict(content, &creds); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", path)
+	}
+
+	names := make(map[string]bool)
+	for i, c := range creds.Clients {
+		if c.Name == "" {
+			return nil, fmt.Errorf("client %d in %s: name should be specified", i, path)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("client %q in %s is defined more than once", c.Name, path)
+		}
+		names[c.Name] = true
+
+		basic := c.Username != "" || c.Password != ""
+		if basic == (c.BearerToken != "") {
+			return nil, fmt.Errorf("client %q in %s: either bearer_token or username and password should be specified", c.Name, path)
+		}
+		if basic && (c.Username == "" || c.Password == "") {
+			return nil, fmt.Errorf("client %q in %s: both username and password should be specified", c.Name, path)
+		}
+	}
+	return &creds, nil
+}
+
+// authenticator checks write requests against client credentials loaded from file and reloads them once file is changed.
+type authenticator struct {
+	config *AuthConfig
+
+	mu          sync.RWMutex
+	credentials *Credentials
+	// content of loaded file, used to detect changes
+	loaded []byte
+}
+
+func newAuthenticator(config *AuthConfig) (*authenticator, error) {
+	a := &authenticator{config: config}
+	if _, err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload loads credentials file if its content changed. Returns true if credentials were reloaded.
+func (a *authenticator) reload() (bool, error) {
+	content, err := ioutil.ReadFile(a.config.CredentialsFile)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.RLock()
+	unchanged := a.loaded != nil && bytes.Equal(content, a.loaded)
+	a.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	creds, err := parseCredentials(content, a.config.CredentialsFile)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	a.credentials = creds
+	a.loaded = content
+	a.mu.Unlock()
+
+	log.V(3).Infof("Loaded credentials of %d client(s) from %s", len(creds.Clients), a.config.CredentialsFile)
+	return true, nil
+}
+
+func (a *authenticator) watch(ctx context.Context) {
+	ticker := time.NewTicker(a.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := a.reload()
+			if err != nil {
+				authCredentialsReloads.WithLabelValues("failure").Inc()
+				log.Errorf("failed to reload client credentials, keeping previous ones: %v", err)
+				continue
+			}
+			if reloaded {
+				authCredentialsReloads.WithLabelValues("success").Inc()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// authenticate returns name of the client which credentials are sent in Authorization header.
+func (a *authenticator) authenticate(r *http.Request) (string, bool) {
+	a.mu.RLock()
+	creds := a.credentials
+	a.mu.RUnlock()
+
+	if username, password, ok := r.BasicAuth(); ok {
+		for _, c := range creds.Clients {
+			if c.Username != "" && secureEqual(c.Username, username) && secureEqual(c.Password, password) {
+				return c.Name, true
+			}
+		}
+		authFailures.WithLabelValues("invalid_credentials").Inc()
+		return "", false
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		token := header[len("Bearer "):]
+		for _, c := range creds.Clients {
+			if c.BearerToken != "" && secureEqual(c.BearerToken, token) {
+				return c.Name, true
+			}
+		}
+		authFailures.WithLabelValues("invalid_credentials").Inc()
+		return "", false
+	}
+
+	authFailures.WithLabelValues("missing_credentials").Inc()
+	return "", false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+type clientIdentityKey struct{}
+
+// clientIdentity returns name of the authenticated client which sent the request.
+func clientIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value(clientIdentityKey{}).(string); ok {
+		return identity
+	}
+	return anonymousClient
+}
+
+// withAuth rejects requests without valid credentials if authentication is enabled.
+func (rc *Receiver) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rc.auth == nil {
+			next(w, r)
+			return
+		}
+
+		identity, ok := rc.auth.authenticate(r)
+		if !ok {
+			httpResponses.With(prometheus.Labels{"response_code": "401"}).Inc()
+			w.Header().Set("WWW-Authenticate", `Basic realm="anodot-remote-write"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, identity)))
+	}
+}
+
+// withInfluxAuth is withAuth which also accepts credentials in forms sent by InfluxDB clients:
+// 'Authorization: Token <token>' header of API v2, and 'u' and 'p' query parameters of API v1.
+// Token is checked as bearer token, and query parameters as basic auth username and password.
+func (rc *Receiver) withInfluxAuth(next http.HandlerFunc) http.HandlerFunc {
+	auth := rc.withAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rc.auth == nil {
+			next(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		query := r.URL.Query()
+		switch {
+		case len(header) > len("Token ") && strings.EqualFold(header[:len("Token ")], "Token "):
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+header[len("Token "):])
+		case header == "" && query.Get("u") != "":
+			r = r.Clone(r.Context())
+			r.SetBasicAuth(query.Get("u"), query.Get("p"))
+		}
+		auth(w, r)
+	}
+}
+
+// tagClientIdentity adds authenticated client name as Anodot tag to every sample, if configured.
+func (rc *Receiver) tagClientIdentity(r *http.Request, samples model.Samples) model.Samples {
+	if rc.auth == nil || rc.auth.config.IdentityTag == "" {
+		return samples
+	}
+
+	identity := model.LabelValue(clientIdentity(r))
+	for _, s := range samples {
+		// metric can be shared between samples of the same series and parser removes tag labels from it
+		s.Metric = s.Metric.Clone()
+		s.Metric[model.LabelName(AnodotTagLabelPrefix+rc.auth.config.IdentityTag)] = identity
+	}
+	return samples
+}
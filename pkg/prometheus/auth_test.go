@@ -0,0 +1,190 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+const testCredentials = `
+clients:
+  - name: prometheus-a
+    bearer_token: token-a
+  - name: prometheus-b
+    username: user-b
+    password: password-b
+`
+
+func TestAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &AuthConfig{CredentialsFile: filepath.Join(dir, "credentials.yml"), IdentityTag: "source"}
+	if err := ioutil.WriteFile(config.CredentialsFile, []byte(testCredentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &Receiver{auth: auth}
+
+	var identity string
+	var samples model.Samples
+	handler := rc.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		identity = clientIdentity(r)
+		metric := model.Metric{model.MetricNameLabel: "up"}
+		samples = rc.tagClientIdentity(r, model.Samples{{Metric: metric}, {Metric: metric}})
+	})
+
+	send := func(setAuth func(r *http.Request)) int {
+		identity = ""
+		r := httptest.NewRequest(http.MethodPost, RECEIVER_ENDPOINT, nil)
+		if setAuth != nil {
+			setAuth(r)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name     string
+		setAuth  func(r *http.Request)
+		code     int
+		identity string
+	}{
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-a") }, http.StatusOK, "prometheus-a"},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("user-b", "password-b") }, http.StatusOK, "prometheus-b"},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-b") }, http.StatusUnauthorized, ""},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("user-b", "password-a") }, http.StatusUnauthorized, ""},
+		{"no credentials", nil, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		if code := send(tt.setAuth); code != tt.code || identity != tt.identity {
+			t.Fatal(fmt.Sprintf("Wrong result for %s \n got: %d %q\n want: %d %q", tt.name, code, identity, tt.code, tt.identity))
+		}
+	}
+
+	send(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-a") })
+	for _, s := range samples {
+		if s.Metric["anodot_tag_source"] != "prometheus-a" {
+			t.Fatal(fmt.Sprintf("Identity tag is missing \n got: %v", s.Metric))
+		}
+	}
+
+	// changed credentials are applied without restart
+	rotated := strings.Replace(testCredentials, "token-a", "token-c", 1)
+	if err := ioutil.WriteFile(config.CredentialsFile, []byte(rotated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := auth.reload(); err != nil || !reloaded {
+		t.Fatal(fmt.Sprintf("credentials should be reloaded, reloaded: %v, err: %v", reloaded, err))
+	}
+	if code := send(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-a") }); code != http.StatusUnauthorized {
+		t.Fatal(fmt.Sprintf("Wrong response code for revoked token \n got: %d\n want: %d", code, http.StatusUnauthorized))
+	}
+	if code := send(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-c") }); code != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Wrong response code for new token \n got: %d\n want: %d", code, http.StatusOK))
+	}
+
+	// invalid file keeps previous credentials
+	if err := ioutil.WriteFile(config.CredentialsFile, []byte("clients:\n  - name: a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.reload(); err == nil {
+		t.Fatalf("error should be returned for client without credentials")
+	}
+	if code := send(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-c") }); code != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Wrong response code after failed reload \n got: %d\n want: %d", code, http.StatusOK))
+	}
+}
+
+func TestParseCredentialsErrors(t *testing.T) {
+	invalid := []string{
+		"clients:\n  - bearer_token: a\n",
+		"clients:\n  - name: a\n    bearer_token: a\n  - name: a\n    bearer_token: b\n",
+		"clients:\n  - name: a\n    bearer_token: a\n    username: b\n    password: c\n",
+		"clients:\n  - name: a\n    username: b\n",
+		"clients:\n  - name: a\n    token: a\n",
+	}
+	for _, content := range invalid {
+		if _, err := parseCredentials([]byte(content), "credentials.yml"); err == nil {
+			t.Fatalf("error should be returned for %q", content)
+		}
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	rc := &Receiver{}
+	var identity string
+	handler := rc.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		identity = clientIdentity(r)
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, RECEIVER_ENDPOINT, nil))
+	if w.Code != http.StatusOK || identity != anonymousClient {
+		t.Fatal(fmt.Sprintf("Wrong result \n got: %d %q\n want: %d %q", w.Code, identity, http.StatusOK, anonymousClient))
+	}
+}
+
+func TestInfluxAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &AuthConfig{CredentialsFile: filepath.Join(dir, "credentials.yml")}
+	if err := ioutil.WriteFile(config.CredentialsFile, []byte(testCredentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &Receiver{auth: auth}
+
+	var identity string
+	handler := rc.withInfluxAuth(func(w http.ResponseWriter, r *http.Request) {
+		identity = clientIdentity(r)
+	})
+
+	tests := []struct {
+		name     string
+		target   string
+		header   string
+		code     int
+		identity string
+	}{
+		{"v2 token", INFLUX_V2_WRITE_ENDPOINT, "Token token-a", http.StatusOK, "prometheus-a"},
+		{"bearer", INFLUX_V2_WRITE_ENDPOINT, "Bearer token-a", http.StatusOK, "prometheus-a"},
+		{"v1 query", INFLUX_V1_WRITE_ENDPOINT + "?db=telegraf&u=user-b&p=password-b", "", http.StatusOK, "prometheus-b"},
+		{"wrong token", INFLUX_V2_WRITE_ENDPOINT, "Token token-b", http.StatusUnauthorized, ""},
+		{"wrong query password", INFLUX_V1_WRITE_ENDPOINT + "?u=user-b&p=password-a", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		identity = ""
+		r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.code || identity != tt.identity {
+			t.Fatal(fmt.Sprintf("Wrong result for %s \n got: %d %q\n want: %d %q", tt.name, w.Code, identity, tt.code, tt.identity))
+		}
+	}
+}
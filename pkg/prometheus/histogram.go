@@ -0,0 +1,613 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	HistogramCountMetric     = "count"
+	HistogramSumMetric       = "sum"
+	HistogramQuantilesMetric = "quantiles"
+
+	quantileLabel = "quantile"
+	bucketSuffix  = "_bucket"
+
+	// customBucketsSchema is native histogram schema with custom bucket boundaries (NHCB).
+	customBucketsSchema = -53
+
+	// histogramResetGauge is native histogram reset hint of gauge histograms, which buckets are not cumulative.
+	histogramResetGauge = 3
+)
+
+var (
+	histogramsConverted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_parser_histograms_converted_total",
+		Help: "Total number of histograms converted to Anodot metrics",
+	}, []string{"type"})
+
+	histogramTrackedSeries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "anodot_parser_histogram_series",
+		Help: "Number of histogram series which previous buckets are tracked to calculate quantiles",
+	})
+
+	histogramResets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_parser_histogram_resets_total",
+		Help: "Total number of histogram resets detected",
+	})
+)
+
+// HistogramConfig configures which Anodot metrics are produced from Prometheus histograms.
+type HistogramConfig struct {
+	// Metrics is a list of metrics calculated from every histogram. Supported values are: count, sum, quantiles.
+	Metrics []string `default:"count,sum,quantiles"`
+	// Quantiles calculated from histogram buckets. Each quantile is sent as separate metric with 'quantile' property.
+	Quantiles []float64 `default:"0.5,0.9,0.99"`
+	// ClassicBuckets enables quantiles calculation from classic histograms '_bucket' series grouped by 'le' label.
+	ClassicBuckets bool `default:"false" split_words:"true"`
+	// DropBuckets drops classic histograms '_bucket' series once quantiles are calculated.
+	DropBuckets bool `default:"false" split_words:"true"`
+	// TTL is a time after which buckets of histogram which has no new samples are forgotten.
+	TTL time.Duration `default:"10m"`
+	// MaxSeries is a max number of histograms which buckets are tracked. Quantiles of new histograms are calculated
+	// from their cumulative buckets once it is reached.
+	MaxSeries int `default:"500000" split_words:"true"`
+
+	mu        sync.Mutex
+	series    map[string]*histogramState
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// histogramState is previous buckets of histogram series, which are subtracted to get buckets increase.
+type histogramState struct {
+	buckets  []histogramBucket
+	count    float64
+	ts       model.Time
+	lastSeen time.Time
+}
+
+func NewHistogramConfig() (*HistogramConfig, error) {
+	config := &HistogramConfig{}
+	if err := envconfig.Process("ANODOT_HISTOGRAM", config); err != nil {
+		return nil, err
+	}
+
+	for _, m := range config.Metrics {
+		switch m {
+		case HistogramCountMetric, HistogramSumMetric, HistogramQuantilesMetric:
+		default:
+			return nil, fmt.Errorf("unsupported histogram metric %q", m)
+		}
+	}
+
+	for _, q := range config.Quantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("histogram quantile should be in range [0, 1], got: %v", q)
+		}
+	}
+
+	if config.TTL <= 0 {
+		return nil, fmt.Errorf("histogram TTL should be positive, got: %s", config.TTL)
+	}
+	if config.MaxSeries <= 0 {
+		return nil, fmt.Errorf("histogram max series should be positive, got: %d", config.MaxSeries)
+	}
+	return config, nil
+}
+
+func (c *HistogramConfig) enabled(metric string) bool {
+	for _, m := range c.Metrics {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketSpan defines a number of consecutive native histogram buckets with their offset.
+type BucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+// Histogram is a native histogram sample. Wire format is shared by remote write 1.0 and 2.0.
+type Histogram struct {
+	Count         float64
+	Sum           float64
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+
+	NegativeSpans  []BucketSpan
+	NegativeDeltas []int64
+	NegativeCounts []float64
+
+	PositiveSpans  []BucketSpan
+	PositiveDeltas []int64
+	PositiveCounts []float64
+
+	// ResetHint is histogramResetGauge for gauge histograms.
+	ResetHint    int32
+	Timestamp    int64
+	CustomValues []float64
+}
+
+func (h *Histogram) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			h.Count = float64(f.varint)
+		case 2:
+			h.Count = f.double()
+		case 3:
+			h.Sum = f.double()
+		case 4:
+			h.Schema = int32(f.sint64())
+		case 5:
+			h.ZeroThreshold = f.double()
+		case 6:
+			h.ZeroCount = float64(f.varint)
+		case 7:
+			h.ZeroCount = f.double()
+		case 8, 11:
+			var span BucketSpan
+			err = walkProto(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					span.Offset = int32(f.sint64())
+				case 2:
+					span.Length = uint32(f.varint)
+				}
+				return nil
+			})
+			if f.num == 8 {
+				h.NegativeSpans = append(h.NegativeSpans, span)
+			} else {
+				h.PositiveSpans = append(h.PositiveSpans, span)
+			}
+		case 9, 12:
+			var deltas []uint64
+			deltas, err = repeatedVarints(f, nil)
+			for _, d := range deltas {
+				if f.num == 9 {
+					h.NegativeDeltas = append(h.NegativeDeltas, protowire.DecodeZigZag(d))
+				} else {
+					h.PositiveDeltas = append(h.PositiveDeltas, protowire.DecodeZigZag(d))
+				}
+			}
+		case 10:
+			h.NegativeCounts, err = repeatedDoubles(f, h.NegativeCounts)
+		case 13:
+			h.PositiveCounts, err = repeatedDoubles(f, h.PositiveCounts)
+		case 14:
+			h.ResetHint = int32(f.varint)
+		case 15:
+			h.Timestamp = int64(f.varint)
+		case 16:
+			h.CustomValues, err = repeatedDoubles(f, h.CustomValues)
+		}
+		return err
+	})
+}
+
+// histogramSeries is a series of native histograms with its labels.
+type histogramSeries struct {
+	metric     model.Metric
+	histograms []Histogram
+}
+
+// unmarshalHistogramsV1 extracts native histograms from remote write 1.0 request,
+// since they are not part of vendored prompb.WriteRequest.
+func unmarshalHistogramsV1(b []byte) ([]histogramSeries, error) {
+	var res []histogramSeries
+	err := walkProto(b, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+
+		series := histogramSeries{metric: model.Metric{}}
+		err := walkProto(f.bytes, func(f protoField) error {
+			switch f.num {
+			case 1:
+				var name, value string
+				err := walkProto(f.bytes, func(f protoField) error {
+					switch f.num {
+					case 1:
+						name = f.string()
+					case 2:
+						value = f.string()
+					}
+					return nil
+				})
+				series.metric[model.LabelName(name)] = model.LabelValue(value)
+				return err
+			case 4:
+				var h Histogram
+				if err := h.unmarshal(f.bytes); err != nil {
+					return err
+				}
+				series.histograms = append(series.histograms, h)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(series.histograms) > 0 {
+			res = append(res, series)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// histogramBucket is a bucket with (lower, upper] boundaries and number of observations in it.
+type histogramBucket struct {
+	lower, upper float64
+	count        float64
+}
+
+// bucketCounts returns absolute bucket counts, either from float counts or from integer deltas.
+func bucketCounts(deltas []int64, counts []float64) []float64 {
+	if len(counts) > 0 {
+		return counts
+	}
+	res := make([]float64, len(deltas))
+	var current int64
+	for i, d := range deltas {
+		current += d
+		res[i] = float64(current)
+	}
+	return res
+}
+
+// bucketIndexes expands spans into absolute bucket indexes.
+func bucketIndexes(spans []BucketSpan) []int32 {
+	var res []int32
+	var idx int32
+	for i, s := range spans {
+		if i == 0 {
+			idx = s.Offset
+		} else {
+			idx += s.Offset
+		}
+		for j := uint32(0); j < s.Length; j++ {
+			res = append(res, idx)
+			idx++
+		}
+	}
+	return res
+}
+
+// upperBound returns upper boundary of exponential bucket with given index.
+func (h *Histogram) upperBound(idx int32) float64 {
+	if h.Schema == customBucketsSchema {
+		if int(idx) < len(h.CustomValues) {
+			return h.CustomValues[idx]
+		}
+		return math.Inf(1)
+	}
+	base := math.Pow(2, math.Pow(2, -float64(h.Schema)))
+	return math.Pow(base, float64(idx))
+}
+
+func (h *Histogram) lowerBound(idx int32) float64 {
+	if h.Schema == customBucketsSchema && idx == 0 {
+		if len(h.CustomValues) > 0 && h.CustomValues[0] > 0 {
+			return 0
+		}
+		return math.Inf(-1)
+	}
+	return h.upperBound(idx - 1)
+}
+
+// buckets returns all populated buckets in ascending order of their boundaries.
+func (h *Histogram) buckets() []histogramBucket {
+	var res []histogramBucket
+
+	negIdx := bucketIndexes(h.NegativeSpans)
+	negCounts := bucketCounts(h.NegativeDeltas, h.NegativeCounts)
+	for i := len(negIdx) - 1; i >= 0 && i < len(negCounts); i-- {
+		res = append(res, histogramBucket{lower: -h.upperBound(negIdx[i]), upper: -h.lowerBound(negIdx[i]), count: negCounts[i]})
+	}
+
+	if h.ZeroCount > 0 {
+		res = append(res, histogramBucket{lower: -h.ZeroThreshold, upper: h.ZeroThreshold, count: h.ZeroCount})
+	}
+
+	posIdx := bucketIndexes(h.PositiveSpans)
+	posCounts := bucketCounts(h.PositiveDeltas, h.PositiveCounts)
+	for i := 0; i < len(posIdx) && i < len(posCounts); i++ {
+		res = append(res, histogramBucket{lower: h.lowerBound(posIdx[i]), upper: h.upperBound(posIdx[i]), count: posCounts[i]})
+	}
+	return res
+}
+
+// quantile estimates q-quantile of histogram observations using linear interpolation within bucket.
+func (h *Histogram) quantile(q float64) float64 {
+	return bucketsQuantile(q, h.buckets(), h.Count)
+}
+
+// bucketsQuantile estimates q-quantile of count observations in non-cumulative buckets.
+func bucketsQuantile(q float64, buckets []histogramBucket, count float64) float64 {
+	if len(buckets) == 0 || count <= 0 {
+		return math.NaN()
+	}
+
+	rank := q * count
+	var cumulative float64
+	for _, b := range buckets {
+		if b.count == 0 {
+			continue
+		}
+		if cumulative+b.count >= rank {
+			lower, upper := b.lower, b.upper
+			if math.IsInf(lower, -1) {
+				return upper
+			}
+			if math.IsInf(upper, 1) {
+				return lower
+			}
+			return lower + (upper-lower)*((rank-cumulative)/b.count)
+		}
+		cumulative += b.count
+	}
+	return buckets[len(buckets)-1].upper
+}
+
+// increase returns buckets increase since the previous histogram of series with given key and number of observations
+// in it, so quantiles describe observations made since the previous sample. Buckets are returned unchanged for the
+// first histogram of series and after histogram reset, which is detected by decrease of any bucket. False is returned
+// if histogram is not newer than the previous one.
+func (c *HistogramConfig) increase(key string, ts model.Time, buckets []histogramBucket, count float64) ([]histogramBucket, float64, bool) {
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+
+	current := append([]histogramBucket(nil), buckets...)
+	prev, ok := c.series[key]
+	if !ok {
+		if c.MaxSeries > 0 && len(c.series) >= c.MaxSeries {
+			return buckets, count, true
+		}
+		if c.series == nil {
+			c.series = make(map[string]*histogramState)
+		}
+		c.series[key] = &histogramState{buckets: current, count: count, ts: ts, lastSeen: now}
+		histogramTrackedSeries.Inc()
+		return buckets, count, true
+	}
+
+	if !ts.After(prev.ts) {
+		return nil, 0, false
+	}
+
+	previous := make(map[[2]float64]float64, len(prev.buckets))
+	for _, b := range prev.buckets {
+		previous[[2]float64{b.lower, b.upper}] = b.count
+	}
+
+	res := make([]histogramBucket, 0, len(buckets))
+	reset := count < prev.count
+	for _, b := range buckets {
+		bounds := [2]float64{b.lower, b.upper}
+		p := previous[bounds]
+		delete(previous, bounds)
+		if b.count < p {
+			reset = true
+			break
+		}
+		res = append(res, histogramBucket{lower: b.lower, upper: b.upper, count: b.count - p})
+	}
+	for _, p := range previous {
+		// bucket which had observations disappeared
+		if p > 0 {
+			reset = true
+		}
+	}
+
+	delta := count - prev.count
+	prev.buckets, prev.count, prev.ts, prev.lastSeen = current, count, ts, now
+	if reset {
+		histogramResets.Inc()
+		return buckets, count, true
+	}
+	return res, delta, true
+}
+
+// sweep forgets histograms which were not seen during TTL. Must be called with c.mu held.
+func (c *HistogramConfig) sweep(now time.Time) {
+	if c.TTL <= 0 || now.Sub(c.lastSweep) < c.TTL/2 {
+		return
+	}
+	c.lastSweep = now
+
+	for key, s := range c.series {
+		if now.Sub(s.lastSeen) > c.TTL {
+			delete(c.series, key)
+			histogramTrackedSeries.Dec()
+		}
+	}
+}
+
+// HistogramToSamples converts single native histogram into samples according to configuration.
+// Metric name of histogram is used as a base for produced metrics names.
+func (c *HistogramConfig) HistogramToSamples(metric model.Metric, h *Histogram) model.Samples {
+	var samples model.Samples
+	name := string(metric[model.MetricNameLabel])
+	ts := model.Time(h.Timestamp)
+
+	withName := func(n string) model.Metric {
+		m := metric.Clone()
+		m[model.MetricNameLabel] = model.LabelValue(n)
+		return m
+	}
+
+	if c.enabled(HistogramCountMetric) {
+		samples = append(samples, &model.Sample{Metric: withName(name + "_count"), Value: model.SampleValue(h.Count), Timestamp: ts})
+	}
+
+	if c.enabled(HistogramSumMetric) {
+		samples = append(samples, &model.Sample{Metric: withName(name + "_sum"), Value: model.SampleValue(h.Sum), Timestamp: ts})
+	}
+
+	if c.enabled(HistogramQuantilesMetric) {
+		buckets, count, ok := h.buckets(), h.Count, true
+		if h.ResetHint != histogramResetGauge {
+			buckets, count, ok = c.increase(metric.String(), ts, buckets, count)
+		}
+		for _, q := range c.Quantiles {
+			if !ok || count <= 0 {
+				break
+			}
+			m := withName(name)
+			m[quantileLabel] = model.LabelValue(formatQuantile(q))
+			samples = append(samples, &model.Sample{Metric: m, Value: model.SampleValue(bucketsQuantile(q, buckets, count)), Timestamp: ts})
+		}
+	}
+
+	histogramsConverted.WithLabelValues("native").Inc()
+	return samples
+}
+
+// ClassicHistogramsToSamples calculates quantiles from classic histograms '_bucket' series.
+// Buckets are grouped by all labels except 'le' and by timestamp. Quantiles are calculated from buckets increase
+// since the previous sample of histogram.
+// Samples which are not histogram buckets are returned unchanged.
+func (c *HistogramConfig) ClassicHistogramsToSamples(samples model.Samples) model.Samples {
+	if !c.ClassicBuckets || !c.enabled(HistogramQuantilesMetric) {
+		return samples
+	}
+
+	type group struct {
+		key     string
+		metric  model.Metric
+		ts      model.Time
+		buckets []histogramBucket
+	}
+
+	groups := make(map[string]*group)
+	var order []string
+	res := make(model.Samples, 0, len(samples))
+
+	for _, s := range samples {
+		name := string(s.Metric[model.MetricNameLabel])
+		le, hasLe := s.Metric[model.BucketLabel]
+		if !strings.HasSuffix(name, bucketSuffix) || !hasLe {
+			res = append(res, s)
+			continue
+		}
+
+		upper, err := strconv.ParseFloat(string(le), 64)
+		if err != nil {
+			res = append(res, s)
+			continue
+		}
+
+		if !c.DropBuckets {
+			res = append(res, s)
+		}
+
+		base := s.Metric.Clone()
+		delete(base, model.BucketLabel)
+		base[model.MetricNameLabel] = model.LabelValue(strings.TrimSuffix(name, bucketSuffix))
+
+		key := fmt.Sprintf("%d/%s", s.Timestamp, base.Fingerprint())
+		g, ok := groups[key]
+		if !ok {
+			g = &group{key: base.String(), metric: base, ts: s.Timestamp}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.buckets = append(g.buckets, histogramBucket{upper: upper, count: float64(s.Value)})
+	}
+
+	for _, key := range order {
+		g := groups[key]
+		var total float64
+		for _, b := range g.buckets {
+			total = math.Max(total, b.count)
+		}
+		buckets, _, ok := c.increase(g.key, g.ts, g.buckets, total)
+		for _, q := range c.Quantiles {
+			if !ok {
+				break
+			}
+			v := bucketQuantile(q, buckets)
+			if math.IsNaN(v) {
+				continue
+			}
+			m := g.metric.Clone()
+			m[quantileLabel] = model.LabelValue(formatQuantile(q))
+			res = append(res, &model.Sample{Metric: m, Value: model.SampleValue(v), Timestamp: g.ts})
+		}
+		histogramsConverted.WithLabelValues("classic").Inc()
+	}
+	return res
+}
+
+// bucketQuantile calculates quantile from cumulative classic histogram buckets,
+// the same way as Prometheus histogram_quantile() function does.
+func bucketQuantile(q float64, buckets []histogramBucket) float64 {
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upper < buckets[j].upper })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upper, 1) {
+		return math.NaN()
+	}
+
+	// cumulative counts should be monotonic
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	total := buckets[len(buckets)-1].count
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upper
+	}
+	if b == 0 && buckets[0].upper <= 0 {
+		return buckets[0].upper
+	}
+
+	var (
+		bucketStart float64
+		bucketEnd   = buckets[b].upper
+		count       = buckets[b].count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].upper
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+func formatQuantile(q float64) string {
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
@@ -0,0 +1,263 @@
+package prometheus
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestNewHistogramConfig(t *testing.T) {
+	config, err := NewHistogramConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Metrics) != 3 || len(config.Quantiles) != 3 || config.TTL != 10*time.Minute || config.MaxSeries != 500000 {
+		t.Fatalf("wrong default histogram config: %+v", config)
+	}
+
+	_ = os.Setenv("ANODOT_HISTOGRAM_METRICS", "count,avg")
+	defer os.Unsetenv("ANODOT_HISTOGRAM_METRICS")
+
+	_, err = NewHistogramConfig()
+	if err == nil {
+		t.Fatalf("error should be returned for unsupported histogram metric")
+	}
+}
+
+func TestNativeHistogramToSamples(t *testing.T) {
+	// schema 0: bucket boundaries are powers of 2. Buckets (0.5,1]=2, (1,2]=4, (2,4]=4
+	h := Histogram{
+		Count:          10,
+		Sum:            18,
+		Schema:         0,
+		PositiveSpans:  []BucketSpan{{Offset: 0, Length: 3}},
+		PositiveDeltas: []int64{2, 2, 0},
+		Timestamp:      1574693483000,
+	}
+
+	config := &HistogramConfig{Metrics: []string{HistogramCountMetric, HistogramSumMetric, HistogramQuantilesMetric}, Quantiles: []float64{0.5, 0.9}}
+	samples := config.HistogramToSamples(model.Metric{model.MetricNameLabel: "request_duration_seconds", "job": "api"}, &h)
+
+	if len(samples) != 4 {
+		t.Fatalf("unexpected number of samples: %d", len(samples))
+	}
+
+	expected := map[string]float64{
+		"request_duration_seconds_count": 10,
+		"request_duration_seconds_sum":   18,
+		"request_duration_seconds/0.5":   1.75,
+		"request_duration_seconds/0.9":   3.5,
+	}
+
+	for _, s := range samples {
+		key := string(s.Metric[model.MetricNameLabel])
+		if q, ok := s.Metric[quantileLabel]; ok {
+			key += "/" + string(q)
+		}
+		if s.Metric["job"] != "api" {
+			t.Fatalf("labels should be preserved: %s", s.Metric)
+		}
+		if float64(s.Value) != expected[key] {
+			t.Fatalf("Wrong value for %s \n got: %v\n want: %v", key, s.Value, expected[key])
+		}
+		if s.Timestamp != model.Time(h.Timestamp) {
+			t.Fatalf("wrong timestamp %d", s.Timestamp)
+		}
+	}
+}
+
+func TestNativeHistogramQuantilesOfIncrease(t *testing.T) {
+	histogram := func(ts int64, counts ...float64) *Histogram {
+		h := &Histogram{Schema: 0, PositiveSpans: []BucketSpan{{Offset: 0, Length: uint32(len(counts))}}, PositiveCounts: counts, Timestamp: ts}
+		for _, c := range counts {
+			h.Count += c
+		}
+		return h
+	}
+	median := func(config *HistogramConfig, h *Histogram) float64 {
+		samples := config.HistogramToSamples(model.Metric{model.MetricNameLabel: "request_duration_seconds"}, h)
+		if len(samples) != 1 {
+			t.Fatalf("unexpected number of samples: %d", len(samples))
+		}
+		return float64(samples[0].Value)
+	}
+
+	config := &HistogramConfig{Metrics: []string{HistogramQuantilesMetric}, Quantiles: []float64{0.5}, TTL: time.Minute, MaxSeries: 10}
+
+	// buckets (0.5,1], (1,2], (2,4]
+	if q := median(config, histogram(1000, 2, 4, 4)); q != 1.75 {
+		t.Fatalf("Quantile of the first histogram should be calculated from its buckets \n got: %v\n want: %v", q, 1.75)
+	}
+
+	// all new observations are in (2,4] bucket, while cumulative median is 2.57
+	if q := median(config, histogram(2000, 2, 4, 14)); q != 3 {
+		t.Fatalf("Quantile should be calculated from buckets increase \n got: %v\n want: %v", q, 3)
+	}
+
+	if samples := config.HistogramToSamples(model.Metric{model.MetricNameLabel: "request_duration_seconds"}, histogram(3000, 2, 4, 14)); len(samples) != 0 {
+		t.Fatalf("Quantiles should not be sent without new observations: %v", samples)
+	}
+
+	// histogram was reset
+	if q := median(config, histogram(4000, 1, 1, 0)); q != 1 {
+		t.Fatalf("Quantile should be calculated from buckets after reset \n got: %v\n want: %v", q, 1)
+	}
+
+	gauge := histogram(5000, 2, 4, 14)
+	gauge.ResetHint = histogramResetGauge
+	if q := median(config, gauge); math.Abs(q-(2+2*4.0/14)) > 1e-9 {
+		t.Fatalf("Quantile of gauge histogram should be calculated from its buckets \n got: %v\n want: %v", q, 2+2*4.0/14)
+	}
+}
+
+func TestNativeHistogramCustomBuckets(t *testing.T) {
+	h := Histogram{
+		Count:          4,
+		Schema:         customBucketsSchema,
+		PositiveSpans:  []BucketSpan{{Offset: 0, Length: 3}},
+		PositiveCounts: []float64{2, 1, 1},
+		CustomValues:   []float64{0.1, 0.5},
+	}
+
+	if q := h.quantile(0.25); q != 0.05 {
+		t.Fatalf("Wrong quantile \n got: %v\n want: %v", q, 0.05)
+	}
+
+	// observations in +Inf bucket are estimated by its lower boundary
+	if q := h.quantile(0.99); q != 0.5 {
+		t.Fatalf("Wrong quantile \n got: %v\n want: %v", q, 0.5)
+	}
+}
+
+func TestUnmarshalHistogramsV1(t *testing.T) {
+	var label []byte
+	label = protowire.AppendTag(label, 1, protowire.BytesType)
+	label = protowire.AppendString(label, model.MetricNameLabel)
+	label = protowire.AppendTag(label, 2, protowire.BytesType)
+	label = protowire.AppendString(label, "latency")
+
+	var deltas []byte
+	for _, d := range []int64{1, 2} {
+		deltas = protowire.AppendVarint(deltas, protowire.EncodeZigZag(d))
+	}
+
+	var span []byte
+	span = protowire.AppendTag(span, 1, protowire.VarintType)
+	span = protowire.AppendVarint(span, protowire.EncodeZigZag(-1))
+	span = protowire.AppendTag(span, 2, protowire.VarintType)
+	span = protowire.AppendVarint(span, 2)
+
+	var h []byte
+	h = protowire.AppendTag(h, 1, protowire.VarintType)
+	h = protowire.AppendVarint(h, 4)
+	h = protowire.AppendTag(h, 3, protowire.Fixed64Type)
+	h = protowire.AppendFixed64(h, math.Float64bits(2.5))
+	h = protowire.AppendTag(h, 4, protowire.VarintType)
+	h = protowire.AppendVarint(h, protowire.EncodeZigZag(1))
+	h = protowire.AppendTag(h, 11, protowire.BytesType)
+	h = protowire.AppendBytes(h, span)
+	h = protowire.AppendTag(h, 12, protowire.BytesType)
+	h = protowire.AppendBytes(h, deltas)
+	h = protowire.AppendTag(h, 15, protowire.VarintType)
+	h = protowire.AppendVarint(h, 1000)
+
+	var ts []byte
+	ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, label)
+	ts = protowire.AppendTag(ts, 4, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, h)
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, ts)
+
+	series, err := unmarshalHistogramsV1(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(series) != 1 || len(series[0].histograms) != 1 {
+		t.Fatalf("unexpected histograms: %+v", series)
+	}
+	if series[0].metric[model.MetricNameLabel] != "latency" {
+		t.Fatalf("wrong labels: %s", series[0].metric)
+	}
+
+	got := series[0].histograms[0]
+	if got.Count != 4 || got.Sum != 2.5 || got.Schema != 1 || got.Timestamp != 1000 {
+		t.Fatalf("wrong histogram: %+v", got)
+	}
+
+	buckets := got.buckets()
+	if len(buckets) != 2 || buckets[0].upper != math.Pow(math.Sqrt2, -1) || buckets[1].count != 3 {
+		t.Fatalf("wrong buckets: %+v", buckets)
+	}
+}
+
+func TestClassicHistogramsToSamples(t *testing.T) {
+	bucket := func(le string, value float64) *model.Sample {
+		return &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "latency_bucket", "le": model.LabelValue(le), "job": "api"},
+			Value:     model.SampleValue(value),
+			Timestamp: 1000,
+		}
+	}
+
+	samples := model.Samples{
+		bucket("0.1", 50),
+		bucket("0.5", 90),
+		bucket("1", 100),
+		bucket("+Inf", 100),
+		{Metric: model.Metric{model.MetricNameLabel: "latency_count", "job": "api"}, Value: 100, Timestamp: 1000},
+	}
+
+	config := &HistogramConfig{Metrics: []string{HistogramQuantilesMetric}, Quantiles: []float64{0.5, 0.9}, ClassicBuckets: true, DropBuckets: true}
+	res := config.ClassicHistogramsToSamples(samples)
+
+	if len(res) != 3 {
+		t.Fatalf("unexpected number of samples: %d", len(res))
+	}
+
+	if res[0].Metric[model.MetricNameLabel] != "latency_count" {
+		t.Fatalf("not bucket samples should be preserved")
+	}
+
+	expected := map[model.LabelValue]model.SampleValue{"0.5": 0.1, "0.9": 0.5}
+	for _, s := range res[1:] {
+		if s.Metric[model.MetricNameLabel] != "latency" || s.Metric["job"] != "api" || s.Timestamp != 1000 {
+			t.Fatalf("wrong quantile metric: %s", s)
+		}
+		if _, ok := s.Metric[model.BucketLabel]; ok {
+			t.Fatalf("'le' label should be removed")
+		}
+		if math.Abs(float64(s.Value-expected[s.Metric[quantileLabel]])) > 1e-9 {
+			t.Fatalf("Wrong quantile value \n got: %v\n want: %v", s.Value, expected[s.Metric[quantileLabel]])
+		}
+	}
+
+	// 10 new observations in (0.5,1] bucket
+	next := model.Samples{bucket("0.1", 50), bucket("0.5", 90), bucket("1", 110), bucket("+Inf", 110)}
+	for _, s := range next {
+		s.Timestamp = 2000
+	}
+	res = config.ClassicHistogramsToSamples(next)
+	expected = map[model.LabelValue]model.SampleValue{"0.5": 0.75, "0.9": 0.95}
+	if len(res) != 2 {
+		t.Fatalf("unexpected number of samples: %d", len(res))
+	}
+	for _, s := range res {
+		if math.Abs(float64(s.Value-expected[s.Metric[quantileLabel]])) > 1e-9 {
+			t.Fatalf("Quantile should be calculated from buckets increase \n got: %v\n want: %v", s.Value, expected[s.Metric[quantileLabel]])
+		}
+	}
+
+	config.ClassicBuckets = false
+	if len(config.ClassicHistogramsToSamples(samples)) != len(samples) {
+		t.Fatalf("samples should not be changed if classic buckets conversion is disabled")
+	}
+}
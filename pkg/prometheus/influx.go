@@ -0,0 +1,235 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	INFLUX_V1_WRITE_ENDPOINT = "/write"
+	INFLUX_V2_WRITE_ENDPOINT = "/api/v2/write"
+)
+
+var (
+	influxLinesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_remote_write_influx_lines_received_total",
+		Help: "The total number of received InfluxDB line protocol lines",
+	})
+
+	influxLinesRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_remote_write_influx_lines_rejected_total",
+		Help: "The total number of InfluxDB line protocol lines rejected due to parsing errors",
+	})
+
+	influxFieldsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_remote_write_influx_string_fields_skipped_total",
+		Help: "The total number of InfluxDB string fields skipped, since they can not be converted to metric value",
+	})
+)
+
+// influxPrecision returns timestamp unit duration for 'precision' parameter.
+// Both InfluxDB 1.x (n, u, ms, s, m, h) and 2.x (ns, us, ms, s) values are supported.
+func influxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", precision)
+}
+
+// ParseLineProtocol converts InfluxDB line protocol into samples. Every field becomes a separate sample
+// with '<measurement>_<field>' name and tags as labels. Lines without timestamp get now as their timestamp.
+// Lines which can not be parsed are returned as errors, while all valid lines are still converted.
+func ParseLineProtocol(body string, precision time.Duration, now time.Time) (model.Samples, []error) {
+	var samples model.Samples
+	var errs []error
+
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		influxLinesReceived.Inc()
+
+		s, err := parseLine(line, precision, now)
+		if err != nil {
+			influxLinesRejected.Inc()
+			errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			continue
+		}
+		samples = append(samples, s...)
+	}
+	return samples, errs
+}
+
+func parseLine(line string, precision time.Duration, now time.Time) (model.Samples, error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("expected measurement, fields and optional timestamp, got %d section(s)", len(sections))
+	}
+
+	series := splitUnescaped(sections[0], ',', false)
+	measurement := unescapeInflux(series[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("missing measurement")
+	}
+
+	base := model.Metric{}
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		base[model.LabelName(unescapeInflux(kv[0]))] = model.LabelValue(unescapeInflux(kv[1]))
+	}
+
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	if len(sections) == 3 {
+		v, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		ts = model.TimeFromUnixNano(v * int64(precision))
+	}
+
+	var samples model.Samples
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+
+		if strings.HasPrefix(kv[1], `"`) {
+			influxFieldsSkipped.Inc()
+			continue
+		}
+
+		value, err := parseFieldValue(kv[1])
+		if err != nil {
+			return nil, err
+		}
+
+		metric := base.Clone()
+		metric[model.MetricNameLabel] = model.LabelValue(measurement + "_" + unescapeInflux(kv[0]))
+		samples = append(samples, &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: ts})
+	}
+	return samples, nil
+}
+
+func parseFieldValue(v string) (float64, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(i), err
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(u), err
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, fmt.Errorf("invalid field value %q", v)
+	}
+	return f, err
+}
+
+// splitUnescaped splits s by separator which is not escaped by backslash.
+// If quotes is true, separators inside double-quoted strings are ignored as well.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var res []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+var influxUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+
+func unescapeInflux(s string) string {
+	return influxUnescaper.Replace(s)
+}
+
+func (rc *Receiver) influxHandler(workers []*remote.Worker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpResponses.With(prometheus.Labels{"response_code": "405"}).Inc()
+			http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if worker := fullWorker(workers); worker != nil {
+			rejectBufferFull(w, worker)
+			return
+		}
+
+		precision, err := influxPrecision(r.URL.Query().Get("precision"))
+		if err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		body, err := readRequestBody(r)
+		if err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		samples, errs := ParseLineProtocol(string(body), precision, time.Now())
+		if len(errs) > 0 {
+			// nothing is written, so clients which retry on 400 do not send duplicates of valid lines
+			log.V(3).Infof("rejected %d line protocol line(s): %v", len(errs), errs[0])
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, fmt.Sprintf("%d line(s) rejected, request is not written, first error: %s", len(errs), errs[0]), http.StatusBadRequest)
+			return
+		}
+
+		data := rc.Parser.ParsePrometheusRequest(rc.tagClientIdentity(r, samples))
+		if len(data) > 0 {
+			if worker := doAll(workers, data); worker != nil {
+				rejectBufferFull(w, worker)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,168 @@
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	metrics2 "github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/prometheus/common/model"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	now := time.Unix(1574693483, 0)
+	body := `
+# comment
+cpu,host=server\ 01,region=us-west usage_idle=97.5,usage_user=2i,online=true,status="ok" 1574693400
+disk\,io free=10u
+`
+
+	samples, errs := ParseLineProtocol(body, time.Second, now)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	expected := []struct {
+		metric model.Metric
+		value  model.SampleValue
+		ts     model.Time
+	}{
+		{model.Metric{model.MetricNameLabel: "cpu_usage_idle", "host": "server 01", "region": "us-west"}, 97.5, 1574693400000},
+		{model.Metric{model.MetricNameLabel: "cpu_usage_user", "host": "server 01", "region": "us-west"}, 2, 1574693400000},
+		{model.Metric{model.MetricNameLabel: "cpu_online", "host": "server 01", "region": "us-west"}, 1, 1574693400000},
+		{model.Metric{model.MetricNameLabel: "disk,io_free"}, 10, model.TimeFromUnix(now.Unix())},
+	}
+
+	if len(samples) != len(expected) {
+		t.Fatalf("unexpected number of samples: %d", len(samples))
+	}
+
+	for i, e := range expected {
+		if !samples[i].Metric.Equal(e.metric) || samples[i].Value != e.value || samples[i].Timestamp != e.ts {
+			t.Fatalf("Wrong sample \n got: %s\n want: %s %v @%d", samples[i], e.metric, e.value, e.ts)
+		}
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	body := `mem free=1
+mem
+mem,host free=1
+mem free=abc
+mem free=1 notatimestamp
+mem used=2 1574693400000`
+
+	samples, errs := ParseLineProtocol(body, time.Millisecond, time.Now())
+	if len(errs) != 4 {
+		t.Fatalf("unexpected number of errors: %v", errs)
+	}
+
+	if len(samples) != 2 || samples[1].Timestamp != 1574693400000 {
+		t.Fatalf("valid lines should be converted: %v", samples)
+	}
+}
+
+func TestInfluxPrecision(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":   time.Nanosecond,
+		"ns": time.Nanosecond,
+		"u":  time.Microsecond,
+		"us": time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	}
+
+	for precision, expected := range tests {
+		t.Run(fmt.Sprintf("precision=%q", precision), func(t *testing.T) {
+			got, err := influxPrecision(precision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != expected {
+				t.Fatalf("Wrong precision \n got: %s\n want: %s", got, expected)
+			}
+		})
+	}
+
+	if _, err := influxPrecision("d"); err == nil {
+		t.Fatalf("error should be returned for invalid precision")
+	}
+}
+
+func TestInfluxHandlerBufferFull(t *testing.T) {
+	anodotURL, _ := url.Parse("https://api.anodot.com")
+	submitter, err := metrics2.NewAnodot20Client(*anodotURL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &remote.WorkerConfig{BatchSendDeadline: time.Minute, MaxWorkers: 1, MetricsPerRequestSize: 1000,
+		MaxBufferSize: 2, OverflowPolicy: remote.OverflowDropNewest, BufferFullStatusCode: http.StatusTooManyRequests}
+	worker, err := remote.NewWorker(submitter, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser, _ := NewAnodotParser(nil, nil, nil)
+	rc := &Receiver{Parser: parser}
+	handler := rc.influxHandler([]*remote.Worker{worker})
+
+	write := func(body string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, INFLUX_V1_WRITE_ENDPOINT, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := write("cpu value=1 1574693483000000000"); code != http.StatusNoContent {
+		t.Fatal(fmt.Sprintf("Wrong response code for buffered metrics \n got: %d\n want: %d", code, http.StatusNoContent))
+	}
+	// request is rejected as a whole, so retried request does not duplicate already buffered metrics
+	if code := write("cpu value=2 1574693484000000000\ncpu value=3 1574693485000000000"); code != http.StatusTooManyRequests {
+		t.Fatal(fmt.Sprintf("Wrong response code for metrics not fitting into buffer \n got: %d\n want: %d", code, http.StatusTooManyRequests))
+	}
+	if worker.BufferSize() != 1 {
+		t.Fatal(fmt.Sprintf("Wrong buffer size \n got: %d\n want: 1", worker.BufferSize()))
+	}
+	if code := write("cpu value=4 1574693486000000000"); code != http.StatusNoContent {
+		t.Fatal(fmt.Sprintf("Wrong response code for buffered metrics \n got: %d\n want: %d", code, http.StatusNoContent))
+	}
+	if code := write("cpu value=5 1574693487000000000"); code != http.StatusTooManyRequests {
+		t.Fatal(fmt.Sprintf("Wrong response code for full buffer \n got: %d\n want: %d", code, http.StatusTooManyRequests))
+	}
+	if worker.BufferSize() != 2 {
+		t.Fatal(fmt.Sprintf("Wrong buffer size \n got: %d\n want: 2", worker.BufferSize()))
+	}
+}
+
+func TestInfluxHandlerInvalidLines(t *testing.T) {
+	anodotURL, _ := url.Parse("https://api.anodot.com")
+	submitter, err := metrics2.NewAnodot20Client(*anodotURL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &remote.WorkerConfig{BatchSendDeadline: time.Minute, MaxWorkers: 1, MetricsPerRequestSize: 1000,
+		MaxBufferSize: 10, OverflowPolicy: remote.OverflowDropNewest, BufferFullStatusCode: http.StatusTooManyRequests}
+	worker, err := remote.NewWorker(submitter, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser, _ := NewAnodotParser(nil, nil, nil)
+	rc := &Receiver{Parser: parser}
+	handler := rc.influxHandler([]*remote.Worker{worker})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, INFLUX_V1_WRITE_ENDPOINT, strings.NewReader("cpu value=1 1574693483000000000\ncpu value=")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(fmt.Sprintf("Wrong response code for invalid line \n got: %d\n want: %d", w.Code, http.StatusBadRequest))
+	}
+	if worker.BufferSize() != 0 {
+		t.Fatal(fmt.Sprintf("Valid lines of rejected request should not be sent \n got: %d\n want: 0", worker.BufferSize()))
+	}
+}
@@ -0,0 +1,370 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	// DEBUG_METADATA_ENDPOINT lists cached metric families metadata. Like admin endpoints, it requires admin token.
+	DEBUG_METADATA_ENDPOINT = "/debug/metadata"
+
+	// targetTypeProperty is Anodot 2.0 property which defines how metric is aggregated: sum for counters, average for gauges.
+	targetTypeProperty = "target_type"
+	targetTypeCounter  = "counter"
+	targetTypeGauge    = "gauge"
+
+	metricTypeTag = "metric_type"
+	unitTag       = "unit"
+)
+
+var (
+	metadataFamilies = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "anodot_parser_metadata_families",
+		Help: "Number of metric families which metadata is cached",
+	})
+
+	metadataDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_parser_metadata_dropped_total",
+		Help: "Total number of metric families metadata not cached because cache is full",
+	})
+)
+
+var metricTypeNames = map[MetricType]string{
+	MetricTypeUnknown:        "unknown",
+	MetricTypeCounter:        "counter",
+	MetricTypeGauge:          "gauge",
+	MetricTypeHistogram:      "histogram",
+	MetricTypeGaugeHistogram: "gaugehistogram",
+	MetricTypeSummary:        "summary",
+	MetricTypeInfo:           "info",
+	MetricTypeStateset:       "stateset",
+}
+
+func (t MetricType) String() string {
+	if name, ok := metricTypeNames[t]; ok {
+		return name
+	}
+	return metricTypeNames[MetricTypeUnknown]
+}
+
+func (t MetricType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *MetricType) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for k, v := range metricTypeNames {
+		if v == name {
+			*t = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown metric type %q", name)
+}
+
+// MetricMetadata describes metric family, as sent in remote write metadata.
+type MetricMetadata struct {
+	Family string     `json:"family"`
+	Type   MetricType `json:"type"`
+	Help   string     `json:"help,omitempty"`
+	Unit   string     `json:"unit,omitempty"`
+}
+
+// MetadataConfig configures usage of metric families metadata sent with remote write requests.
+type MetadataConfig struct {
+	// Enabled sets Anodot 'target_type' property and adds 'metric_type' and 'unit' tags to metrics with known metadata.
+	Enabled bool `default:"false"`
+	// CachePath is a file where metadata is persisted, so it is known right after restart. Not persisted if empty.
+	CachePath string `split_words:"true"`
+	// SaveInterval is how often metadata changes are written to CachePath.
+	SaveInterval time.Duration `default:"1m" split_words:"true"`
+	// MaxFamilies is a max number of cached metric families.
+	MaxFamilies int `default:"100000" split_words:"true"`
+}
+
+func NewMetadataConfig() (*MetadataConfig, error) {
+	config := &MetadataConfig{}
+	if err := envconfig.Process("ANODOT_METADATA", config); err != nil {
+		return nil, err
+	}
+	if config.SaveInterval <= 0 {
+		return nil, fmt.Errorf("metadata save interval should be positive, got: %s", config.SaveInterval)
+	}
+	if config.MaxFamilies <= 0 {
+		return nil, fmt.Errorf("metadata max families should be positive, got: %d", config.MaxFamilies)
+	}
+	return config, nil
+}
+
+// MetadataCache keeps the latest metadata of every metric family.
+type MetadataCache struct {
+	config *MetadataConfig
+
+	mu       sync.RWMutex
+	families map[string]MetricMetadata
+	dirty    bool
+}
+
+// NewMetadataCache creates cache and loads metadata persisted at config.CachePath, if any.
+func NewMetadataCache(config *MetadataConfig) (*MetadataCache, error) {
+	c := &MetadataCache{config: config, families: make(map[string]MetricMetadata)}
+	if config.CachePath == "" {
+		return c, nil
+	}
+
+	b, err := ioutil.ReadFile(config.CachePath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata cache %s: %w", config.CachePath, err)
+	}
+
+	var persisted []MetricMetadata
+	if err := json.Unmarshal(b, &persisted); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata cache %s: %w", config.CachePath, err)
+	}
+	c.Observe(persisted)
+	c.dirty = false
+	return c, nil
+}
+
+// Observe updates metadata of metric families.
+func (c *MetadataCache) Observe(metadata []MetricMetadata) {
+	for _, md := range metadata {
+		if md.Type == MetricTypeUnknown && md.Unit == "" && md.Help == "" {
+			continue
+		}
+
+		c.mu.RLock()
+		prev, ok := c.families[md.Family]
+		c.mu.RUnlock()
+		if ok && prev == md {
+			continue
+		}
+
+		c.mu.Lock()
+		if _, ok := c.families[md.Family]; !ok && len(c.families) >= c.config.MaxFamilies {
+			c.mu.Unlock()
+			metadataDropped.Inc()
+			continue
+		}
+		c.families[md.Family] = md
+		c.dirty = true
+		metadataFamilies.Set(float64(len(c.families)))
+		c.mu.Unlock()
+	}
+}
+
+// Lookup returns metadata of metric family.
+func (c *MetadataCache) Lookup(family string) (MetricMetadata, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	md, ok := c.families[family]
+	return md, ok
+}
+
+// Families returns all cached metadata sorted by metric family.
+func (c *MetadataCache) Families() []MetricMetadata {
+	c.mu.RLock()
+	res := make([]MetricMetadata, 0, len(c.families))
+	for _, md := range c.families {
+		res = append(res, md)
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Family < res[j].Family })
+	return res
+}
+
+// family returns metadata of the family which metric belongs to. Metrics of histograms and summaries, as well as
+// counters, may have suffixes which are not part of their family name.
+func (c *MetadataCache) family(name string) (MetricMetadata, bool) {
+	if md, ok := c.Lookup(name); ok {
+		return md, true
+	}
+
+	for _, suffix := range []string{"_total", "_count", "_sum", "_bucket"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if md, ok := c.Lookup(strings.TrimSuffix(name, suffix)); ok {
+			return md, true
+		}
+	}
+	return MetricMetadata{}, false
+}
+
+// SeriesType returns type of the series values: counter for counters, as well as for sums, counts and buckets of
+// histograms and summaries. False is returned if metric family metadata is unknown.
+func (c *MetadataCache) SeriesType(name string) (MetricType, bool) {
+	if c == nil {
+		return MetricTypeUnknown, false
+	}
+
+	md, ok := c.family(name)
+	if !ok || md.Type == MetricTypeUnknown {
+		return MetricTypeUnknown, false
+	}
+
+	switch md.Type {
+	case MetricTypeHistogram, MetricTypeSummary, MetricTypeGaugeHistogram:
+		// remote write 2.0 sends histogram type with every classic histogram series, named with its suffix
+		for _, suffix := range []string{"_count", "_sum", "_bucket"} {
+			if strings.HasSuffix(name, suffix) {
+				if md.Type == MetricTypeGaugeHistogram {
+					return MetricTypeGauge, true
+				}
+				return MetricTypeCounter, true
+			}
+		}
+	case MetricTypeCounter:
+		if name == md.Family+"_total" {
+			return MetricTypeCounter, true
+		}
+	}
+
+	if md.Family != name {
+		return MetricTypeUnknown, false
+	}
+	return md.Type, true
+}
+
+// Save writes metadata to config.CachePath if it was changed since the last save.
+func (c *MetadataCache) Save() error {
+	if c.config.CachePath == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	dirty := c.dirty
+	c.dirty = false
+	c.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(c.Families())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.config.CachePath+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(c.config.CachePath+".tmp", c.config.CachePath)
+}
+
+// Run saves metadata periodically until ctx is done.
+func (c *MetadataCache) Run(ctx context.Context) {
+	if c.config.CachePath == "" {
+		return
+	}
+
+	ticker := time.NewTicker(c.config.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Save(); err != nil {
+				log.Errorf("Failed to save metadata cache: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rc *Receiver) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpResponses.With(prometheus.Labels{"response_code": "405"}).Inc()
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	families := make([]MetricMetadata, 0)
+	if name := r.URL.Query().Get("metric"); name != "" {
+		if md, ok := rc.Metadata.family(name); ok {
+			families = append(families, md)
+		}
+	} else {
+		families = rc.Metadata.Families()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(families); err != nil {
+		httpResponses.With(prometheus.Labels{"response_code": "500"}).Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// unmarshalMetadataV1 decodes metadata field of prometheus.WriteRequest, which is missing in vendored prompb.
+func unmarshalMetadataV1(b []byte) ([]MetricMetadata, error) {
+	var res []MetricMetadata
+	err := walkProto(b, func(f protoField) error {
+		if f.num != 3 {
+			return nil
+		}
+
+		var md MetricMetadata
+		err := walkProto(f.bytes, func(f protoField) error {
+			switch f.num {
+			case 1:
+				md.Type = MetricType(f.varint)
+			case 2:
+				md.Family = f.string()
+			case 4:
+				md.Help = f.string()
+			case 5:
+				md.Unit = f.string()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if md.Family != "" {
+			res = append(res, md)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// metricMetadata returns metadata of series which have it. Series name is used as metric family name.
+func (r *WriteV2Request) metricMetadata() []MetricMetadata {
+	var res []MetricMetadata
+	for i := range r.Timeseries {
+		ts := &r.Timeseries[i]
+		if ts.Metadata.Type == MetricTypeUnknown {
+			continue
+		}
+
+		metric, err := r.labels(ts)
+		if err != nil || metric[model.MetricNameLabel] == "" {
+			continue
+		}
+		help, _ := r.symbol(ts.Metadata.HelpRef)
+		unit, _ := r.symbol(ts.Metadata.UnitRef)
+		res = append(res, MetricMetadata{Family: string(metric[model.MetricNameLabel]), Type: ts.Metadata.Type, Help: help, Unit: unit})
+	}
+	return res
+}
@@ -0,0 +1,155 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testMetadataCache(t *testing.T, path string) *MetadataCache {
+	c, err := NewMetadataCache(&MetadataConfig{CachePath: path, MaxFamilies: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUnmarshalMetadataV1(t *testing.T) {
+	var md []byte
+	md = protowire.AppendTag(md, 1, protowire.VarintType)
+	md = protowire.AppendVarint(md, uint64(MetricTypeCounter))
+	md = protowire.AppendTag(md, 2, protowire.BytesType)
+	md = protowire.AppendString(md, "http_requests")
+	md = protowire.AppendTag(md, 4, protowire.BytesType)
+	md = protowire.AppendString(md, "Number of requests")
+	md = protowire.AppendTag(md, 5, protowire.BytesType)
+	md = protowire.AppendString(md, "requests")
+
+	var body []byte
+	body = protowire.AppendTag(body, 3, protowire.BytesType)
+	body = protowire.AppendBytes(body, md)
+
+	got, err := unmarshalMetadataV1(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MetricMetadata{{Family: "http_requests", Type: MetricTypeCounter, Help: "Number of requests", Unit: "requests"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal(fmt.Sprintf("Wrong metadata \n got: %v\n want: %v", got, want))
+	}
+}
+
+func TestMetadataCacheSeriesType(t *testing.T) {
+	c := testMetadataCache(t, "")
+	c.Observe([]MetricMetadata{
+		{Family: "http_requests", Type: MetricTypeCounter},
+		{Family: "latency", Type: MetricTypeHistogram},
+		{Family: "rpc_duration", Type: MetricTypeSummary},
+		{Family: "memory_bytes", Type: MetricTypeGauge},
+		// remote write 2.0 sends metadata of every series
+		{Family: "size_bucket", Type: MetricTypeHistogram},
+	})
+
+	for _, tc := range []struct {
+		name  string
+		want  MetricType
+		found bool
+	}{
+		{name: "http_requests_total", want: MetricTypeCounter, found: true},
+		{name: "http_requests_count", found: false},
+		{name: "latency_bucket", want: MetricTypeCounter, found: true},
+		{name: "size_bucket", want: MetricTypeCounter, found: true},
+		{name: "rpc_duration", want: MetricTypeSummary, found: true},
+		{name: "rpc_duration_sum", want: MetricTypeCounter, found: true},
+		{name: "memory_bytes", want: MetricTypeGauge, found: true},
+		{name: "memory_bytes_total", found: false},
+		{name: "unknown_total", found: false},
+	} {
+		got, found := c.SeriesType(tc.name)
+		if got != tc.want || found != tc.found {
+			t.Fatal(fmt.Sprintf("Wrong type of %s \n got: %s %v\n want: %s %v", tc.name, got, found, tc.want, tc.found))
+		}
+	}
+}
+
+func TestMetadataCachePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.json")
+
+	c := testMetadataCache(t, path)
+	md := MetricMetadata{Family: "http_requests", Type: MetricTypeCounter, Help: "Number of requests", Unit: "requests"}
+	c.Observe([]MetricMetadata{md})
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := testMetadataCache(t, path)
+	if got := restored.Families(); !reflect.DeepEqual(got, []MetricMetadata{md}) {
+		t.Fatal(fmt.Sprintf("Wrong restored metadata \n got: %v\n want: %v", got, []MetricMetadata{md}))
+	}
+}
+
+func TestParserMetadataAnnotations(t *testing.T) {
+	parser, err := NewAnodotParser(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.Metadata = testMetadataCache(t, "")
+	parser.Metadata.Observe([]MetricMetadata{
+		{Family: "http_requests", Type: MetricTypeCounter, Unit: "requests"},
+		{Family: "memory_bytes", Type: MetricTypeGauge, Unit: "bytes"},
+	})
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "http_requests_total"}, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "memory_bytes"}, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "unknown"}, Value: 1},
+	}
+	got := parser.ParsePrometheusRequest(samples)
+
+	want := []struct {
+		targetType string
+		tags       map[string]string
+	}{
+		{targetType: targetTypeCounter, tags: map[string]string{metricTypeTag: "counter", unitTag: "requests"}},
+		{targetType: targetTypeGauge, tags: map[string]string{metricTypeTag: "gauge", unitTag: "bytes"}},
+		{tags: map[string]string{}},
+	}
+	for i, w := range want {
+		if got[i].Properties[targetTypeProperty] != w.targetType || !reflect.DeepEqual(got[i].Tags, w.tags) {
+			t.Fatal(fmt.Sprintf("Wrong metadata of %s \n got: %s %v\n want: %s %v", got[i].Properties[whatPropertyName], got[i].Properties[targetTypeProperty], got[i].Tags, w.targetType, w.tags))
+		}
+	}
+}
+
+func TestMetadataHandler(t *testing.T) {
+	rc := &Receiver{Metadata: testMetadataCache(t, "")}
+	rc.Metadata.Observe([]MetricMetadata{
+		{Family: "http_requests", Type: MetricTypeCounter},
+		{Family: "memory_bytes", Type: MetricTypeGauge},
+	})
+
+	w := httptest.NewRecorder()
+	rc.metadataHandler(w, httptest.NewRequest(http.MethodGet, DEBUG_METADATA_ENDPOINT+"?metric=http_requests_total", nil))
+	var got []MetricMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []MetricMetadata{{Family: "http_requests", Type: MetricTypeCounter}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal(fmt.Sprintf("Wrong metadata \n got: %v\n want: %v", got, want))
+	}
+}
@@ -0,0 +1,554 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	log "k8s.io/klog/v2"
+)
+
+const OTLP_METRICS_ENDPOINT = "/v1/metrics"
+
+// otlpTemporalityDelta is OpenTelemetry aggregation temporality of sums reporting change since last report.
+const otlpTemporalityDelta = 1
+
+var (
+	otlpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_otlp_received_requests_total",
+		Help: "The total number of received OTLP metrics export requests",
+	}, []string{"encoding"})
+
+	otlpDataPointsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_otlp_data_points_dropped_total",
+		Help: "Total number of OTLP data points which were not converted to Anodot metrics",
+	}, []string{"reason"})
+)
+
+// OTLPConfig configures conversion of OpenTelemetry metrics.
+type OTLPConfig struct {
+	// ResourceAttributesAsProperties is a list of resource attributes sent as Anodot properties.
+	// All other resource attributes, as well as instrumentation scope name and version, are sent as Anodot tags.
+	ResourceAttributesAsProperties []string `default:"service.name,service.namespace,service.instance.id" split_words:"true"`
+	// DeltaToCumulative accumulates delta sums into cumulative values, the same way Prometheus counters are reported.
+	// By default delta values are sent as they are, as a value per reporting interval.
+	DeltaToCumulative bool `default:"false" split_words:"true"`
+}
+
+func NewOTLPConfig() (*OTLPConfig, error) {
+	config := &OTLPConfig{}
+	err := envconfig.Process("ANODOT_OTLP", config)
+	return config, err
+}
+
+// OTLPConverter converts OpenTelemetry metrics export requests into Prometheus samples.
+type OTLPConverter struct {
+	*OTLPConfig
+
+	mu sync.Mutex
+	// cumulative values of delta sums, by series fingerprint
+	cumulative map[model.Fingerprint]otlpCumulativeValue
+}
+
+type otlpCumulativeValue struct {
+	start uint64
+	value float64
+}
+
+func NewOTLPConverter(config *OTLPConfig) *OTLPConverter {
+	return &OTLPConverter{OTLPConfig: config, cumulative: make(map[model.Fingerprint]otlpCumulativeValue)}
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpMetric struct {
+	Name                 string                `json:"name"`
+	Unit                 string                `json:"unit"`
+	Gauge                *otlpNumberData       `json:"gauge"`
+	Sum                  *otlpNumberData       `json:"sum"`
+	Histogram            *otlpHistogramData    `json:"histogram"`
+	ExponentialHistogram *otlpExpHistogramData `json:"exponentialHistogram"`
+	Summary              *otlpSummaryData      `json:"summary"`
+}
+
+type otlpNumberData struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int32                 `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	AsDouble          *float64       `json:"asDouble"`
+	AsInt             *otlpInt64     `json:"asInt"`
+}
+
+func (dp *otlpNumberDataPoint) value() float64 {
+	if dp.AsInt != nil {
+		return float64(*dp.AsInt)
+	}
+	if dp.AsDouble != nil {
+		return *dp.AsDouble
+	}
+	return 0
+}
+
+type otlpHistogramData struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int32                    `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	Count             otlpUint64     `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []otlpUint64   `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpExpHistogramData struct {
+	DataPoints             []otlpExpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int32                       `json:"aggregationTemporality"`
+}
+
+type otlpExpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	Count             otlpUint64     `json:"count"`
+	Sum               float64        `json:"sum"`
+	Scale             int32          `json:"scale"`
+	ZeroCount         otlpUint64     `json:"zeroCount"`
+	ZeroThreshold     float64        `json:"zeroThreshold"`
+	Positive          otlpBuckets    `json:"positive"`
+	Negative          otlpBuckets    `json:"negative"`
+}
+
+type otlpBuckets struct {
+	Offset       int32        `json:"offset"`
+	BucketCounts []otlpUint64 `json:"bucketCounts"`
+}
+
+type otlpSummaryData struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes     []otlpKeyValue      `json:"attributes"`
+	TimeUnixNano   otlpUint64          `json:"timeUnixNano"`
+	Count          otlpUint64          `json:"count"`
+	Sum            float64             `json:"sum"`
+	QuantileValues []otlpValueQuantile `json:"quantileValues"`
+}
+
+type otlpValueQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    *otlpInt64 `json:"intValue"`
+	DoubleValue *float64   `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue []byte `json:"bytesValue"`
+}
+
+// String returns attribute value as a string. Arrays and key-value lists are rendered as JSON.
+func (v otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+	case v.ArrayValue != nil:
+		values := make([]string, 0, len(v.ArrayValue.Values))
+		for _, av := range v.ArrayValue.Values {
+			values = append(values, av.String())
+		}
+		b, _ := json.Marshal(values)
+		return string(b)
+	case v.KvlistValue != nil:
+		values := make(map[string]string, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.String()
+		}
+		b, _ := json.Marshal(values)
+		return string(b)
+	case v.BytesValue != nil:
+		return fmt.Sprintf("%x", v.BytesValue)
+	}
+	return ""
+}
+
+// otlpUint64 is uint64 which in OTLP JSON encoding is represented as a string.
+type otlpUint64 uint64
+
+func (u *otlpUint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	*u = otlpUint64(v)
+	return err
+}
+
+// otlpInt64 is int64 which in OTLP JSON encoding is represented as a string.
+type otlpInt64 int64
+
+func (i *otlpInt64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = otlpInt64(v)
+	return err
+}
+
+// sanitizeLabelName converts OpenTelemetry attribute or metric name into valid Prometheus label name.
+func sanitizeLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || (r >= '0' && r <= '9' && i > 0) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func nanosToTime(nanos otlpUint64) model.Time {
+	return model.Time(int64(nanos) / 1e6)
+}
+
+// resourceMetric builds labels shared by all metrics of resource and instrumentation scope.
+func (c *OTLPConverter) resourceMetric(resource otlpResource, scope otlpScope) model.Metric {
+	metric := model.Metric{}
+
+	for _, attr := range resource.Attributes {
+		name := sanitizeLabelName(attr.Key)
+		if c.isPropertyAttribute(attr.Key) {
+			metric[model.LabelName(name)] = model.LabelValue(attr.Value.String())
+		} else {
+			metric[model.LabelName(AnodotTagLabelPrefix+name)] = model.LabelValue(attr.Value.String())
+		}
+	}
+
+	if scope.Name != "" {
+		metric[AnodotTagLabelPrefix+"otel_scope_name"] = model.LabelValue(scope.Name)
+	}
+	if scope.Version != "" {
+		metric[AnodotTagLabelPrefix+"otel_scope_version"] = model.LabelValue(scope.Version)
+	}
+	return metric
+}
+
+func (c *OTLPConverter) isPropertyAttribute(key string) bool {
+	for _, a := range c.ResourceAttributesAsProperties {
+		if a == key {
+			return true
+		}
+	}
+	return false
+}
+
+func withAttributes(base model.Metric, name string, attributes []otlpKeyValue) model.Metric {
+	metric := base.Clone()
+	for _, attr := range attributes {
+		metric[model.LabelName(sanitizeLabelName(attr.Key))] = model.LabelValue(attr.Value.String())
+	}
+	metric[model.MetricNameLabel] = model.LabelValue(name)
+	return metric
+}
+
+// ToSamples converts OTLP metrics into Prometheus samples. Histograms are converted using histograms config,
+// and dropped if it is nil. Monotonic delta sums which are not accumulated are returned separately, as they should
+// not be treated as cumulative counters.
+func (c *OTLPConverter) ToSamples(req *otlpRequest, histograms *HistogramConfig) (samples model.Samples, deltas model.Samples) {
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			base := c.resourceMetric(rm.Resource, sm.Scope)
+
+			for _, m := range sm.Metrics {
+				name := sanitizeLabelName(m.Name)
+
+				switch {
+				case m.Gauge != nil:
+					for _, dp := range m.Gauge.DataPoints {
+						samples = append(samples, &model.Sample{
+							Metric:    withAttributes(base, name, dp.Attributes),
+							Value:     model.SampleValue(dp.value()),
+							Timestamp: nanosToTime(dp.TimeUnixNano),
+						})
+					}
+				case m.Sum != nil:
+					for _, dp := range m.Sum.DataPoints {
+						metric := withAttributes(base, name, dp.Attributes)
+						sample := &model.Sample{Metric: metric, Value: model.SampleValue(dp.value()), Timestamp: nanosToTime(dp.TimeUnixNano)}
+						switch {
+						case m.Sum.AggregationTemporality != otlpTemporalityDelta:
+							samples = append(samples, sample)
+						case c.DeltaToCumulative && m.Sum.IsMonotonic:
+							sample.Value = model.SampleValue(c.accumulate(metric, dp.StartTimeUnixNano, float64(sample.Value)))
+							samples = append(samples, sample)
+						default:
+							deltas = append(deltas, sample)
+						}
+					}
+				case m.Histogram != nil:
+					if histograms == nil {
+						otlpDataPointsDropped.WithLabelValues("histograms_disabled").Add(float64(len(m.Histogram.DataPoints)))
+						continue
+					}
+					for _, dp := range m.Histogram.DataPoints {
+						samples = append(samples, histograms.HistogramToSamples(withAttributes(base, name, dp.Attributes), dp.histogram(m.Histogram.AggregationTemporality))...)
+					}
+				case m.ExponentialHistogram != nil:
+					if histograms == nil {
+						otlpDataPointsDropped.WithLabelValues("histograms_disabled").Add(float64(len(m.ExponentialHistogram.DataPoints)))
+						continue
+					}
+					for _, dp := range m.ExponentialHistogram.DataPoints {
+						samples = append(samples, histograms.HistogramToSamples(withAttributes(base, name, dp.Attributes), dp.histogram(m.ExponentialHistogram.AggregationTemporality))...)
+					}
+				case m.Summary != nil:
+					for _, dp := range m.Summary.DataPoints {
+						samples = append(samples, dp.toSamples(withAttributes(base, name, dp.Attributes))...)
+					}
+				default:
+					otlpDataPointsDropped.WithLabelValues("unsupported_type").Inc()
+				}
+			}
+		}
+	}
+	return samples, deltas
+}
+
+// accumulate adds delta value to cumulative value of series. Accumulation starts over once start time of delta
+// is before the start time of accumulated value, which means producer restart.
+func (c *OTLPConverter) accumulate(metric model.Metric, start otlpUint64, delta float64) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fp := metric.Fingerprint()
+	current, ok := c.cumulative[fp]
+	if !ok || uint64(start) < current.start {
+		current = otlpCumulativeValue{start: uint64(start)}
+	}
+	current.value += delta
+	c.cumulative[fp] = current
+	return current.value
+}
+
+// histogramResetHint returns reset hint of OTLP histogram. Buckets of delta histogram contain observations of the
+// reporting interval only, so they are not cumulative, as buckets of gauge histogram.
+func histogramResetHint(temporality int32) int32 {
+	if temporality == otlpTemporalityDelta {
+		return histogramResetGauge
+	}
+	return 0
+}
+
+// histogram converts explicit buckets histogram into native histogram with custom buckets.
+func (dp *otlpHistogramDataPoint) histogram(temporality int32) *Histogram {
+	h := &Histogram{
+		Count:        float64(dp.Count),
+		Sum:          dp.Sum,
+		Schema:       customBucketsSchema,
+		ResetHint:    histogramResetHint(temporality),
+		Timestamp:    int64(nanosToTime(dp.TimeUnixNano)),
+		CustomValues: dp.ExplicitBounds,
+	}
+	for _, c := range dp.BucketCounts {
+		h.PositiveCounts = append(h.PositiveCounts, float64(c))
+	}
+	h.PositiveSpans = []BucketSpan{{Offset: 0, Length: uint32(len(h.PositiveCounts))}}
+	return h
+}
+
+// histogram converts exponential histogram into Prometheus native histogram.
+// OTLP bucket with index i is (base^i, base^(i+1)], while in Prometheus it is (base^(i-1), base^i].
+func (dp *otlpExpHistogramDataPoint) histogram(temporality int32) *Histogram {
+	h := &Histogram{
+		Count:         float64(dp.Count),
+		Sum:           dp.Sum,
+		Schema:        dp.Scale,
+		ZeroCount:     float64(dp.ZeroCount),
+		ZeroThreshold: dp.ZeroThreshold,
+		ResetHint:     histogramResetHint(temporality),
+		Timestamp:     int64(nanosToTime(dp.TimeUnixNano)),
+	}
+	for _, c := range dp.Positive.BucketCounts {
+		h.PositiveCounts = append(h.PositiveCounts, float64(c))
+	}
+	for _, c := range dp.Negative.BucketCounts {
+		h.NegativeCounts = append(h.NegativeCounts, float64(c))
+	}
+	h.PositiveSpans = []BucketSpan{{Offset: dp.Positive.Offset + 1, Length: uint32(len(h.PositiveCounts))}}
+	h.NegativeSpans = []BucketSpan{{Offset: dp.Negative.Offset + 1, Length: uint32(len(h.NegativeCounts))}}
+	return h
+}
+
+func (dp *otlpSummaryDataPoint) toSamples(metric model.Metric) model.Samples {
+	name := string(metric[model.MetricNameLabel])
+	ts := nanosToTime(dp.TimeUnixNano)
+
+	withName := func(n string) model.Metric {
+		m := metric.Clone()
+		m[model.MetricNameLabel] = model.LabelValue(n)
+		return m
+	}
+
+	samples := model.Samples{
+		{Metric: withName(name + "_count"), Value: model.SampleValue(dp.Count), Timestamp: ts},
+		{Metric: withName(name + "_sum"), Value: model.SampleValue(dp.Sum), Timestamp: ts},
+	}
+
+	sort.Slice(dp.QuantileValues, func(i, j int) bool { return dp.QuantileValues[i].Quantile < dp.QuantileValues[j].Quantile })
+	for _, q := range dp.QuantileValues {
+		m := withName(name)
+		m[quantileLabel] = model.LabelValue(formatQuantile(q.Quantile))
+		samples = append(samples, &model.Sample{Metric: m, Value: model.SampleValue(q.Value), Timestamp: ts})
+	}
+	return samples
+}
+
+// OTLP/HTTP request body encodings.
+const (
+	otlpEncodingProtobuf    = "protobuf"
+	otlpEncodingJSON        = "json"
+	otlpEncodingUnsupported = "unsupported"
+)
+
+// otlpEncoding returns encoding of OTLP/HTTP request body by its Content-Type header.
+func otlpEncoding(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return otlpEncodingUnsupported
+	}
+
+	switch mediaType {
+	case "application/x-protobuf":
+		return otlpEncodingProtobuf
+	case "application/json":
+		return otlpEncodingJSON
+	default:
+		return otlpEncodingUnsupported
+	}
+}
+
+// decodeOTLPRequest decodes OTLP/HTTP request body, either in protobuf or in JSON encoding.
+func decodeOTLPRequest(contentType string, body []byte) (*otlpRequest, error) {
+	var req otlpRequest
+	var err error
+	switch otlpEncoding(contentType) {
+	case otlpEncodingProtobuf:
+		err = req.unmarshal(body)
+	case otlpEncodingJSON:
+		err = json.Unmarshal(body, &req)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Type %q", contentType)
+	}
+	return &req, err
+}
+
+func (rc *Receiver) otlpHandler(workers []*remote.Worker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpResponses.With(prometheus.Labels{"response_code": "405"}).Inc()
+			http.Error(w, "only POST method is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if worker := fullWorker(workers); worker != nil {
+			rejectBufferFull(w, worker)
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		encoding := otlpEncoding(contentType)
+		otlpRequests.WithLabelValues(encoding).Inc()
+
+		body, err := readRequestBody(r)
+		if err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req, err := decodeOTLPRequest(contentType, body)
+		if err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		samples, deltas := rc.OTLP.ToSamples(req, rc.Histograms)
+		data := rc.Parser.ParsePrometheusRequest(rc.tagClientIdentity(r, samples))
+		if len(deltas) > 0 {
+			// delta sums are already a value per reporting interval, so they are not converted to rates again
+			data = append(data, rc.Parser.withoutCounterRates().ParsePrometheusRequest(rc.tagClientIdentity(r, deltas))...)
+		}
+		log.V(4).Infof("converted %d OTLP metric(s)", len(data))
+		if len(data) > 0 {
+			if worker := doAll(workers, data); worker != nil {
+				rejectBufferFull(w, worker)
+				return
+			}
+		}
+
+		// empty ExportMetricsServiceResponse
+		if encoding == otlpEncodingJSON {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,328 @@
+package prometheus
+
+// Protobuf decoding of OTLP ExportMetricsServiceRequest.
+// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+func (r *otlpRequest) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		var rm otlpResourceMetrics
+		if err := rm.unmarshal(f.bytes); err != nil {
+			return err
+		}
+		r.ResourceMetrics = append(r.ResourceMetrics, rm)
+		return nil
+	})
+}
+
+func (rm *otlpResourceMetrics) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			return walkProto(f.bytes, func(f protoField) error {
+				if f.num != 1 {
+					return nil
+				}
+				return appendKeyValue(&rm.Resource.Attributes, f.bytes)
+			})
+		case 2:
+			var sm otlpScopeMetrics
+			if err := sm.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+		}
+		return nil
+	})
+}
+
+func (sm *otlpScopeMetrics) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			return walkProto(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					sm.Scope.Name = f.string()
+				case 2:
+					sm.Scope.Version = f.string()
+				}
+				return nil
+			})
+		case 2:
+			var m otlpMetric
+			if err := m.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			sm.Metrics = append(sm.Metrics, m)
+		}
+		return nil
+	})
+}
+
+func (m *otlpMetric) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.Name = f.string()
+		case 3:
+			m.Unit = f.string()
+		case 5:
+			m.Gauge = &otlpNumberData{}
+			return m.Gauge.unmarshal(f.bytes)
+		case 7:
+			m.Sum = &otlpNumberData{}
+			return m.Sum.unmarshal(f.bytes)
+		case 9:
+			m.Histogram = &otlpHistogramData{}
+			return m.Histogram.unmarshal(f.bytes)
+		case 10:
+			m.ExponentialHistogram = &otlpExpHistogramData{}
+			return m.ExponentialHistogram.unmarshal(f.bytes)
+		case 11:
+			m.Summary = &otlpSummaryData{}
+			return m.Summary.unmarshal(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (d *otlpNumberData) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			var dp otlpNumberDataPoint
+			if err := dp.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			d.DataPoints = append(d.DataPoints, dp)
+		case 2:
+			d.AggregationTemporality = int32(f.varint)
+		case 3:
+			d.IsMonotonic = f.varint != 0
+		}
+		return nil
+	})
+}
+
+func (dp *otlpNumberDataPoint) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 2:
+			dp.StartTimeUnixNano = otlpUint64(f.fixed)
+		case 3:
+			dp.TimeUnixNano = otlpUint64(f.fixed)
+		case 4:
+			v := f.double()
+			dp.AsDouble = &v
+		case 6:
+			v := otlpInt64(f.fixed)
+			dp.AsInt = &v
+		case 7:
+			return appendKeyValue(&dp.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (d *otlpHistogramData) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			var dp otlpHistogramDataPoint
+			if err := dp.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			d.DataPoints = append(d.DataPoints, dp)
+		case 2:
+			d.AggregationTemporality = int32(f.varint)
+		}
+		return nil
+	})
+}
+
+func (dp *otlpHistogramDataPoint) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 2:
+			dp.StartTimeUnixNano = otlpUint64(f.fixed)
+		case 3:
+			dp.TimeUnixNano = otlpUint64(f.fixed)
+		case 4:
+			dp.Count = otlpUint64(f.fixed)
+		case 5:
+			dp.Sum = f.double()
+		case 6:
+			var counts []uint64
+			counts, err = repeatedFixed64(f, nil)
+			for _, c := range counts {
+				dp.BucketCounts = append(dp.BucketCounts, otlpUint64(c))
+			}
+		case 7:
+			dp.ExplicitBounds, err = repeatedDoubles(f, dp.ExplicitBounds)
+		case 9:
+			err = appendKeyValue(&dp.Attributes, f.bytes)
+		}
+		return err
+	})
+}
+
+func (d *otlpExpHistogramData) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			var dp otlpExpHistogramDataPoint
+			if err := dp.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			d.DataPoints = append(d.DataPoints, dp)
+		case 2:
+			d.AggregationTemporality = int32(f.varint)
+		}
+		return nil
+	})
+}
+
+func (dp *otlpExpHistogramDataPoint) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			return appendKeyValue(&dp.Attributes, f.bytes)
+		case 2:
+			dp.StartTimeUnixNano = otlpUint64(f.fixed)
+		case 3:
+			dp.TimeUnixNano = otlpUint64(f.fixed)
+		case 4:
+			dp.Count = otlpUint64(f.fixed)
+		case 5:
+			dp.Sum = f.double()
+		case 6:
+			dp.Scale = int32(f.sint64())
+		case 7:
+			dp.ZeroCount = otlpUint64(f.fixed)
+		case 8:
+			return dp.Positive.unmarshal(f.bytes)
+		case 9:
+			return dp.Negative.unmarshal(f.bytes)
+		case 14:
+			dp.ZeroThreshold = f.double()
+		}
+		return nil
+	})
+}
+
+func (bu *otlpBuckets) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			bu.Offset = int32(f.sint64())
+		case 2:
+			counts, err := repeatedVarints(f, nil)
+			for _, c := range counts {
+				bu.BucketCounts = append(bu.BucketCounts, otlpUint64(c))
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (d *otlpSummaryData) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		var dp otlpSummaryDataPoint
+		err := walkProto(f.bytes, func(f protoField) error {
+			switch f.num {
+			case 3:
+				dp.TimeUnixNano = otlpUint64(f.fixed)
+			case 4:
+				dp.Count = otlpUint64(f.fixed)
+			case 5:
+				dp.Sum = f.double()
+			case 6:
+				var q otlpValueQuantile
+				err := walkProto(f.bytes, func(f protoField) error {
+					switch f.num {
+					case 1:
+						q.Quantile = f.double()
+					case 2:
+						q.Value = f.double()
+					}
+					return nil
+				})
+				dp.QuantileValues = append(dp.QuantileValues, q)
+				return err
+			case 7:
+				return appendKeyValue(&dp.Attributes, f.bytes)
+			}
+			return nil
+		})
+		d.DataPoints = append(d.DataPoints, dp)
+		return err
+	})
+}
+
+func appendKeyValue(dst *[]otlpKeyValue, b []byte) error {
+	var kv otlpKeyValue
+	err := walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			kv.Key = f.string()
+		case 2:
+			return kv.Value.unmarshal(f.bytes)
+		}
+		return nil
+	})
+	*dst = append(*dst, kv)
+	return err
+}
+
+func (v *otlpAnyValue) unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			s := f.string()
+			v.StringValue = &s
+		case 2:
+			bv := f.varint != 0
+			v.BoolValue = &bv
+		case 3:
+			i := otlpInt64(f.varint)
+			v.IntValue = &i
+		case 4:
+			d := f.double()
+			v.DoubleValue = &d
+		case 5:
+			v.ArrayValue = &struct {
+				Values []otlpAnyValue `json:"values"`
+			}{}
+			return walkProto(f.bytes, func(f protoField) error {
+				if f.num != 1 {
+					return nil
+				}
+				var av otlpAnyValue
+				err := av.unmarshal(f.bytes)
+				v.ArrayValue.Values = append(v.ArrayValue.Values, av)
+				return err
+			})
+		case 6:
+			v.KvlistValue = &struct {
+				Values []otlpKeyValue `json:"values"`
+			}{}
+			return walkProto(f.bytes, func(f protoField) error {
+				if f.num != 1 {
+					return nil
+				}
+				return appendKeyValue(&v.KvlistValue.Values, f.bytes)
+			})
+		case 7:
+			v.BytesValue = f.bytes
+		}
+		return nil
+	})
+}
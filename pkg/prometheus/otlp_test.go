@@ -0,0 +1,227 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const otlpJSONRequest = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "checkout"}},
+      {"key": "host.name", "value": {"stringValue": "node-1"}}
+    ]},
+    "scopeMetrics": [{
+      "scope": {"name": "io.opentelemetry.runtime", "version": "1.0"},
+      "metrics": [
+        {"name": "process.memory.usage", "unit": "By", "gauge": {"dataPoints": [
+          {"attributes": [{"key": "pool", "value": {"stringValue": "heap"}}], "timeUnixNano": "1574693483000000000", "asInt": "2048"}
+        ]}},
+        {"name": "http.requests", "sum": {"aggregationTemporality": 1, "isMonotonic": true, "dataPoints": [
+          {"startTimeUnixNano": "1574693423000000000", "timeUnixNano": "1574693483000000000", "asDouble": 5}
+        ]}},
+        {"name": "http.duration", "histogram": {"aggregationTemporality": 2, "dataPoints": [
+          {"timeUnixNano": "1574693483000000000", "count": "4", "sum": 1.2, "bucketCounts": ["2", "2", "0"], "explicitBounds": [0.1, 0.5]}
+        ]}}
+      ]
+    }]
+  }]
+}`
+
+func TestOTLPJSONToSamples(t *testing.T) {
+	req, err := decodeOTLPRequest("application/json", []byte(otlpJSONRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	converter := NewOTLPConverter(&OTLPConfig{ResourceAttributesAsProperties: []string{"service.name"}})
+	histograms := &HistogramConfig{Metrics: []string{HistogramCountMetric}}
+	samples, deltas := converter.ToSamples(req, histograms)
+
+	if len(samples) != 2 || len(deltas) != 1 {
+		t.Fatalf("unexpected number of samples: %d, deltas: %d", len(samples), len(deltas))
+	}
+
+	gauge := samples[0]
+	expected := model.Metric{
+		model.MetricNameLabel:           "process_memory_usage",
+		"service_name":                  "checkout",
+		"pool":                          "heap",
+		"anodot_tag_host_name":          "node-1",
+		"anodot_tag_otel_scope_name":    "io.opentelemetry.runtime",
+		"anodot_tag_otel_scope_version": "1.0",
+	}
+	if !gauge.Metric.Equal(expected) {
+		t.Fatalf("Wrong labels \n got: %s\n want: %s", gauge.Metric, expected)
+	}
+	if gauge.Value != 2048 || gauge.Timestamp != 1574693483000 {
+		t.Fatalf("wrong gauge sample: %s", gauge)
+	}
+
+	if deltas[0].Metric[model.MetricNameLabel] != "http_requests" || deltas[0].Value != 5 {
+		t.Fatalf("delta sum should be sent as is: %s", deltas[0])
+	}
+
+	if samples[1].Metric[model.MetricNameLabel] != "http_duration_count" || samples[1].Value != 4 {
+		t.Fatalf("wrong histogram sample: %s", samples[1])
+	}
+
+	parser, err := NewAnodotParser(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := parser.ParsePrometheusRequest(samples[:1])
+	if metrics[0].Tags["host_name"] != "node-1" || metrics[0].Properties["service_name"] != "checkout" {
+		t.Fatalf("resource attributes should be converted to tags and properties: %+v", metrics[0])
+	}
+}
+
+func TestOTLPDeltaToCumulative(t *testing.T) {
+	converter := NewOTLPConverter(&OTLPConfig{DeltaToCumulative: true})
+
+	sum := func(start, value float64) *otlpRequest {
+		return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{ScopeMetrics: []otlpScopeMetrics{{Metrics: []otlpMetric{{
+			Name: "requests",
+			Sum: &otlpNumberData{AggregationTemporality: otlpTemporalityDelta, IsMonotonic: true, DataPoints: []otlpNumberDataPoint{
+				{StartTimeUnixNano: otlpUint64(start), AsDouble: &value},
+			}},
+		}}}}}}}
+	}
+
+	for i, tt := range []struct {
+		start, value, expected float64
+	}{
+		{100, 5, 5},
+		{200, 3, 8},
+		// producer restarted
+		{50, 1, 1},
+	} {
+		samples, _ := converter.ToSamples(sum(tt.start, tt.value), nil)
+		if float64(samples[0].Value) != tt.expected {
+			t.Fatalf("step %d: Wrong cumulative value \n got: %v\n want: %v", i, samples[0].Value, tt.expected)
+		}
+	}
+}
+
+func TestOTLPExponentialHistogram(t *testing.T) {
+	dp := otlpExpHistogramDataPoint{
+		Count:    3,
+		Scale:    0,
+		Positive: otlpBuckets{Offset: 0, BucketCounts: []otlpUint64{1, 2}},
+	}
+
+	// OTLP bucket 0 is (1,2], bucket 1 is (2,4]
+	buckets := dp.histogram(0).buckets()
+	if len(buckets) != 2 || buckets[0].lower != 1 || buckets[0].upper != 2 || buckets[1].upper != 4 {
+		t.Fatalf("wrong buckets: %+v", buckets)
+	}
+}
+
+func TestOTLPProtobufRequest(t *testing.T) {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, "checkout")
+
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, "service.name")
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, anyValue)
+
+	var resource []byte
+	resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+	resource = protowire.AppendBytes(resource, kv)
+
+	var dp []byte
+	dp = protowire.AppendTag(dp, 3, protowire.Fixed64Type)
+	dp = protowire.AppendFixed64(dp, 1574693483000000000)
+	dp = protowire.AppendTag(dp, 4, protowire.Fixed64Type)
+	dp = protowire.AppendFixed64(dp, math.Float64bits(0.75))
+
+	var gauge []byte
+	gauge = protowire.AppendTag(gauge, 1, protowire.BytesType)
+	gauge = protowire.AppendBytes(gauge, dp)
+
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, "cpu.utilization")
+	metric = protowire.AppendTag(metric, 5, protowire.BytesType)
+	metric = protowire.AppendBytes(metric, gauge)
+
+	var scopeMetrics []byte
+	scopeMetrics = protowire.AppendTag(scopeMetrics, 2, protowire.BytesType)
+	scopeMetrics = protowire.AppendBytes(scopeMetrics, metric)
+
+	var resourceMetrics []byte
+	resourceMetrics = protowire.AppendTag(resourceMetrics, 1, protowire.BytesType)
+	resourceMetrics = protowire.AppendBytes(resourceMetrics, resource)
+	resourceMetrics = protowire.AppendTag(resourceMetrics, 2, protowire.BytesType)
+	resourceMetrics = protowire.AppendBytes(resourceMetrics, scopeMetrics)
+
+	var body []byte
+	body = protowire.AppendTag(body, 1, protowire.BytesType)
+	body = protowire.AppendBytes(body, resourceMetrics)
+
+	req, err := decodeOTLPRequest("application/x-protobuf", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	converter := NewOTLPConverter(&OTLPConfig{ResourceAttributesAsProperties: []string{"service.name"}})
+	samples, _ := converter.ToSamples(req, nil)
+	if len(samples) != 1 {
+		t.Fatalf("unexpected number of samples: %d", len(samples))
+	}
+
+	expected := model.Metric{model.MetricNameLabel: "cpu_utilization", "service_name": "checkout"}
+	if !samples[0].Metric.Equal(expected) || samples[0].Value != 0.75 || samples[0].Timestamp != 1574693483000 {
+		t.Fatalf("wrong sample: %s", samples[0])
+	}
+
+	if _, err := decodeOTLPRequest("text/plain", body); err == nil {
+		t.Fatalf("error should be returned for unsupported content type")
+	}
+}
+
+func TestOTLPEncoding(t *testing.T) {
+	tests := map[string]string{
+		"application/x-protobuf":          otlpEncodingProtobuf,
+		"application/json; charset=utf-8": otlpEncodingJSON,
+		"text/plain":                      otlpEncodingUnsupported,
+		"":                                otlpEncodingUnsupported,
+	}
+	for contentType, want := range tests {
+		if got := otlpEncoding(contentType); got != want {
+			t.Fatalf("Wrong encoding of %q \n got: %s\n want: %s", contentType, got, want)
+		}
+	}
+}
+
+func TestOTLPDeltaNotConvertedToRate(t *testing.T) {
+	value := 5.0
+	req := &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{ScopeMetrics: []otlpScopeMetrics{{Metrics: []otlpMetric{{
+		Name: "requests_total",
+		Sum: &otlpNumberData{AggregationTemporality: otlpTemporalityDelta, IsMonotonic: true, DataPoints: []otlpNumberDataPoint{
+			{TimeUnixNano: 1574693483000000000, AsDouble: &value},
+		}},
+	}}}}}}}
+
+	parser, err := NewAnodotParser(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.CounterRates = NewCounterRateProcessor(&CounterRateConfig{Mode: CounterRateMode, TTL: time.Minute, MaxSeries: 10, Suffixes: []string{"_total"}}, nil)
+
+	_, deltas := NewOTLPConverter(&OTLPConfig{}).ToSamples(req, nil)
+	metrics := parser.withoutCounterRates().ParsePrometheusRequest(deltas)
+	if len(metrics) != 1 || metrics[0].Value != 5 {
+		t.Fatalf("Delta sum should be sent as is \n got: %+v", metrics)
+	}
+	if parser.CounterRates == nil {
+		t.Fatalf("Counter rates of original parser should not be changed")
+	}
+}
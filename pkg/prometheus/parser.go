@@ -22,7 +22,8 @@ const (
 	maxKeyLength          = 50
 	maxNumberOfProperties = 20
 	whatPropertyName      = "what"
-	anodotTagLabelPrefix  = "anodot_tag_"
+	// AnodotTagLabelPrefix marks labels which are sent as Anodot tags instead of properties.
+	AnodotTagLabelPrefix = "anodot_tag_"
 )
 
 var (
@@ -49,6 +50,18 @@ type MetricsProcessor interface {
 	Name() string
 }
 
+// SamplesAggregator is a MetricsProcessor which produces new samples from samples it aggregates.
+type SamplesAggregator interface {
+	MetricsProcessor
+	// Aggregate is called instead of Mutate. Sample is dropped if false is returned, and it is counted by aggregator
+	// as consumed rather than dropped.
+	Aggregate(sample *model.Sample) bool
+	// Produce returns samples of aggregates which are ready to be sent.
+	Produce() model.Samples
+	// Flush returns samples of all pending aggregates, e.g. on shutdown.
+	Flush() model.Samples
+}
+
 type KubernetesPodNameProcessor struct {
 	PodsData *relabling.PodsMapping
 }
@@ -118,7 +131,7 @@ func (k *KubernetesPodNameProcessor) Mutate(prometheusMetric model.Metric) {
 
 			if len(strings.TrimSpace(anodotPodName)) != 0 {
 				prometheusMetric[labelName] = model.LabelValue(anodotPodName)
-				prometheusMetric[anodotTagLabelPrefix+"originalPodName"] = model.LabelValue(podName)
+				prometheusMetric[AnodotTagLabelPrefix+"originalPodName"] = model.LabelValue(podName)
 				log.V(4).Infof("set '%s' to='%s' for '%s'='%s'", relabling.AnodotPodNameLabel, anodotPodName, string(labelName), podName)
 			} else {
 				log.Warning("setting prometheus metric to nil ")
@@ -140,6 +153,12 @@ type AnodotParser struct {
 	Tags map[string]string
 
 	MetricsProcessors []MetricsProcessor
+
+	// CounterRates converts counters to rates, if set.
+	CounterRates *CounterRateProcessor
+
+	// Metadata sets Anodot target type and metric type and unit tags of metrics with known metadata, if set.
+	Metadata *MetadataCache
 }
 
 func NewAnodotParser(filterIn *string, filterOut *string, tags map[string]string) (*AnodotParser, error) {
@@ -174,8 +193,8 @@ func (p *AnodotParser) extractTags(prometheusMetric model.Metric) map[string]str
 
 	//convert labels to tags
 	for k, v := range prometheusMetric {
-		if strings.HasPrefix(string(k), anodotTagLabelPrefix) {
-			res[strings.TrimPrefix(string(k), anodotTagLabelPrefix)] = string(v)
+		if strings.HasPrefix(string(k), AnodotTagLabelPrefix) {
+			res[strings.TrimPrefix(string(k), AnodotTagLabelPrefix)] = string(v)
 			delete(prometheusMetric, k)
 		}
 	}
@@ -223,15 +242,9 @@ func (p *AnodotParser) filter(metrics *[]metrics.Anodot20Metric, metric *metrics
 func (p *AnodotParser) ParsePrometheusRequest(samples model.Samples) []metrics.Anodot20Metric {
 	result := make([]metrics.Anodot20Metric, 0)
 
-SAMPLES:
 	for _, r := range samples {
-
-		var metric metrics.Anodot20Metric
-
-		metric.Timestamp = metrics.AnodotTimestamp{Time: r.Timestamp.Time()}
-		metric.Value = float64(r.Value)
-
-		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+		value := float64(r.Value)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
 			log.V(4).Infof("'%s' skipped. Nan and Inf values are ignored", r.Metric.String())
 			incorrectValue.Inc()
 			continue
@@ -243,50 +256,155 @@ SAMPLES:
 			continue
 		}
 
-		for _, processor := range p.MetricsProcessors {
-			processor.Mutate(r.Metric)
+		p.parseSample(&result, r, 0)
+	}
+
+	p.produce(&result, false)
+	return result
+}
+
+// Produce returns metrics of aggregates which are ready to be sent, so they are sent even if no samples are parsed.
+// All pending aggregates are returned if flush is set.
+func (p *AnodotParser) Produce(flush bool) []metrics.Anodot20Metric {
+	result := make([]metrics.Anodot20Metric, 0)
+	p.produce(&result, flush)
+	return result
+}
 
-			if len(r.Metric) == 0 {
-				relablingDropped.WithLabelValues(processor.Name()).Inc()
-				continue SAMPLES
+// produce passes samples produced by aggregating processors to processors which follow them.
+func (p *AnodotParser) produce(result *[]metrics.Anodot20Metric, flush bool) {
+	for i, processor := range p.MetricsProcessors {
+		if aggregator, ok := processor.(SamplesAggregator); ok {
+			samples := aggregator.Produce()
+			if flush {
+				samples = aggregator.Flush()
+			}
+			for _, r := range samples {
+				p.parseSample(result, r, i+1)
 			}
 		}
+	}
+}
 
-		labels := make(model.LabelNames, 0, len(r.Metric))
-		for l := range r.Metric {
-			labels = append(labels, l)
+// parseSample applies processors starting from the given one to sample, and converts it to Anodot metric.
+func (p *AnodotParser) parseSample(result *[]metrics.Anodot20Metric, r *model.Sample, from int) {
+	// metadata is looked up by name sent by Prometheus, which processors may change
+	name := string(r.Metric[model.MetricNameLabel])
+	// counters are converted after processors preceding aggregators, so series dropped by them are not tracked,
+	// and samples produced by aggregators are aggregated from converted values
+	converted := from > 0 || p.CounterRates == nil
+	for _, processor := range p.MetricsProcessors[from:] {
+		if aggregator, ok := processor.(SamplesAggregator); ok {
+			if !converted {
+				if r = p.convertCounter(name, r); r == nil {
+					return
+				}
+				converted = true
+			}
+			if !aggregator.Aggregate(r) {
+				return
+			}
+			continue
 		}
-		sort.Sort(labels)
-		metric.Properties = make(map[string]string)
+		processor.Mutate(r.Metric)
 
-		metric.Tags = p.extractTags(r.Metric)
+		if len(r.Metric) == 0 {
+			relablingDropped.WithLabelValues(processor.Name()).Inc()
+			return
+		}
+	}
 
-		for _, l := range labels {
+	if !converted {
+		if r = p.convertCounter(name, r); r == nil {
+			return
+		}
+	}
 
-			v := r.Metric[l]
+	var metric metrics.Anodot20Metric
+	metric.Timestamp = metrics.AnodotTimestamp{Time: r.Timestamp.Time()}
+	metric.Value = float64(r.Value)
 
-			if len(l) == 0 || len(v) == 0 {
-				continue
-			}
+	labels := make(model.LabelNames, 0, len(r.Metric))
+	for l := range r.Metric {
+		labels = append(labels, l)
+	}
+	sort.Sort(labels)
+	metric.Properties = make(map[string]string)
 
-			if len(l) >= maxKeyLength {
-				l = l[:maxKeyLength]
-			}
+	metric.Tags = p.extractTags(r.Metric)
 
-			if len(v) >= maxPropertyLength {
-				v = v[:maxPropertyLength]
-			}
+	for _, l := range labels {
 
-			if l == model.MetricNameLabel {
-				metric.Properties[whatPropertyName] = string(v)
-				continue
+		v := r.Metric[l]
+
+		if len(l) == 0 || len(v) == 0 {
+			continue
+		}
+
+		if len(l) >= maxKeyLength {
+			l = l[:maxKeyLength]
+		}
+
+		if len(v) >= maxPropertyLength {
+			v = v[:maxPropertyLength]
+		}
+
+		if l == model.MetricNameLabel {
+			metric.Properties[whatPropertyName] = string(v)
+			continue
+		}
+		metric.Properties[string(l)] = string(v)
+	}
+	p.annotate(&metric, name)
+	p.filter(result, &metric)
+}
+
+// convertCounter returns copy of sample with counter value converted to rate, so samples of caller are not changed.
+// Nil is returned if sample should be dropped.
+func (p *AnodotParser) convertCounter(name string, r *model.Sample) *model.Sample {
+	value, ok := p.CounterRates.convert(name, r)
+	if !ok {
+		return nil
+	}
+	return &model.Sample{Metric: r.Metric, Value: model.SampleValue(value), Timestamp: r.Timestamp}
+}
+
+// withoutCounterRates returns parser which sends counters values as they are.
+func (p *AnodotParser) withoutCounterRates() *AnodotParser {
+	if p.CounterRates == nil {
+		return p
+	}
+	res := *p
+	res.CounterRates = nil
+	return &res
+}
+
+// annotate sets Anodot target type according to metric family type, and adds type and unit tags.
+// Counters converted to per-second rate are gauges.
+func (p *AnodotParser) annotate(metric *metrics.Anodot20Metric, name string) {
+	if p.Metadata == nil {
+		return
+	}
+
+	if _, ok := metric.Properties[targetTypeProperty]; !ok {
+		if t, ok := p.Metadata.SeriesType(name); ok {
+			metric.Properties[targetTypeProperty] = targetTypeGauge
+			if t == MetricTypeCounter && (p.CounterRates == nil || p.CounterRates.config.Mode == CounterDeltaMode) {
+				metric.Properties[targetTypeProperty] = targetTypeCounter
 			}
-			metric.Properties[string(l)] = string(v)
 		}
-		p.filter(&result, &metric)
+	}
 
+	md, ok := p.Metadata.family(name)
+	if !ok {
+		return
+	}
+	if _, ok := metric.Tags[metricTypeTag]; !ok && md.Type != MetricTypeUnknown {
+		metric.Tags[metricTypeTag] = md.Type.String()
+	}
+	if _, ok := metric.Tags[unitTag]; !ok && md.Unit != "" {
+		metric.Tags[unitTag] = md.Unit
 	}
-	return result
 }
 
 func removeMetricData(prometheusMetric model.Metric) {
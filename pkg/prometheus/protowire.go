@@ -0,0 +1,127 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a single decoded protobuf field. Only one of varint, fixed
+// or bytes is set depending on the wire type.
+type protoField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	fixed  uint64
+	bytes  []byte
+}
+
+func (f protoField) double() float64 {
+	return math.Float64frombits(f.fixed)
+}
+
+func (f protoField) sint64() int64 {
+	return protowire.DecodeZigZag(f.varint)
+}
+
+func (f protoField) string() string {
+	return string(f.bytes)
+}
+
+// walkProto iterates over all top-level fields of protobuf message b.
+// Unknown wire types are skipped.
+func walkProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.fixed = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repeatedVarints decodes repeated varint field, both in packed and not packed encoding.
+func repeatedVarints(f protoField, dst []uint64) ([]uint64, error) {
+	switch f.typ {
+	case protowire.VarintType:
+		return append(dst, f.varint), nil
+	case protowire.BytesType:
+		b := f.bytes
+		for len(b) > 0 {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return dst, protowire.ParseError(n)
+			}
+			dst = append(dst, v)
+			b = b[n:]
+		}
+		return dst, nil
+	}
+	return dst, fmt.Errorf("field %d: unexpected wire type %d for repeated varint", f.num, f.typ)
+}
+
+// repeatedDoubles decodes repeated double field, both in packed and not packed encoding.
+func repeatedDoubles(f protoField, dst []float64) ([]float64, error) {
+	switch f.typ {
+	case protowire.Fixed64Type:
+		return append(dst, f.double()), nil
+	case protowire.BytesType:
+		b := f.bytes
+		for len(b) > 0 {
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return dst, protowire.ParseError(n)
+			}
+			dst = append(dst, math.Float64frombits(v))
+			b = b[n:]
+		}
+		return dst, nil
+	}
+	return dst, fmt.Errorf("field %d: unexpected wire type %d for repeated double", f.num, f.typ)
+}
+
+// repeatedFixed64 decodes repeated fixed64 field, both in packed and not packed encoding.
+func repeatedFixed64(f protoField, dst []uint64) ([]uint64, error) {
+	switch f.typ {
+	case protowire.Fixed64Type:
+		return append(dst, f.fixed), nil
+	case protowire.BytesType:
+		b := f.bytes
+		for len(b) > 0 {
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return dst, protowire.ParseError(n)
+			}
+			dst = append(dst, v)
+			b = b[n:]
+		}
+		return dst, nil
+	}
+	return dst, fmt.Errorf("field %d: unexpected wire type %d for repeated fixed64", f.num, f.typ)
+}
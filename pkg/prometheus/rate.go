@@ -0,0 +1,188 @@
+package prometheus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// CounterRateMode sends per-second rate of counters.
+	CounterRateMode = "rate"
+	// CounterDeltaMode sends counters increase since previous sample.
+	CounterDeltaMode = "delta"
+)
+
+var (
+	counterRateSeries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "anodot_parser_counter_rate_series",
+		Help: "Number of counter series which previous value is tracked to calculate rate",
+	})
+
+	counterRateResets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_parser_counter_resets_total",
+		Help: "Total number of counter resets detected",
+	})
+
+	counterRateDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_parser_counter_rate_dropped_total",
+		Help: "Total number of counter samples dropped during rate calculation",
+	}, []string{"reason"})
+)
+
+// CounterRateConfig configures conversion of cumulative Prometheus counters to rates.
+type CounterRateConfig struct {
+	Enabled bool `default:"false"`
+	// Mode is either 'rate' (per second) or 'delta' (per interval between samples).
+	Mode string `default:"rate"`
+	// TTL is a time after which series which has no new samples is forgotten.
+	TTL time.Duration `default:"10m"`
+	// MaxSeries is a max number of tracked series. Samples of new series are dropped once it is reached, since their
+	// cumulative values can not be sent along with rates of other series.
+	MaxSeries int `default:"500000" split_words:"true"`
+	// Suffixes identify counters which have no type in remote write metadata.
+	Suffixes []string `default:"_total,_count,_sum,_bucket"`
+}
+
+func NewCounterRateConfig() (*CounterRateConfig, error) {
+	config := &CounterRateConfig{}
+	if err := envconfig.Process("ANODOT_COUNTER_RATE", config); err != nil {
+		return nil, err
+	}
+
+	if config.Mode != CounterRateMode && config.Mode != CounterDeltaMode {
+		return nil, fmt.Errorf("unsupported counter rate mode %q", config.Mode)
+	}
+	if config.TTL <= 0 {
+		return nil, fmt.Errorf("counter rate TTL should be positive, got: %s", config.TTL)
+	}
+	if config.MaxSeries <= 0 {
+		return nil, fmt.Errorf("counter rate max series should be positive, got: %d", config.MaxSeries)
+	}
+	return config, nil
+}
+
+type counterState struct {
+	value    float64
+	ts       model.Time
+	lastSeen time.Time
+}
+
+// CounterRateProcessor converts counters to rate or delta using previous sample of the same series.
+// The first sample of series is only remembered, as well as samples which are not newer than previous one.
+type CounterRateProcessor struct {
+	config   *CounterRateConfig
+	metadata *MetadataCache
+
+	mu        sync.Mutex
+	series    map[string]*counterState
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+// NewCounterRateProcessor creates processor which identifies counters by metadata, if it is known, and by name suffixes otherwise.
+func NewCounterRateProcessor(config *CounterRateConfig, metadata *MetadataCache) *CounterRateProcessor {
+	return &CounterRateProcessor{
+		config:   config,
+		metadata: metadata,
+		series:   make(map[string]*counterState),
+		now:      time.Now,
+	}
+}
+
+// fork returns processor with own series state and the same metadata.
+func (p *CounterRateProcessor) fork() *CounterRateProcessor {
+	if p == nil {
+		return nil
+	}
+	return NewCounterRateProcessor(p.config, p.metadata)
+}
+
+// isCounter checks whether metric is counter either by its metadata type, or by its name suffix.
+func (p *CounterRateProcessor) isCounter(name string) bool {
+	if t, ok := p.metadata.SeriesType(name); ok {
+		return t == MetricTypeCounter
+	}
+
+	for _, suffix := range p.config.Suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert returns value to send instead of sample value. False is returned if sample should be dropped.
+func (p *CounterRateProcessor) Convert(sample *model.Sample) (float64, bool) {
+	return p.convert(string(sample.Metric[model.MetricNameLabel]), sample)
+}
+
+// convert is Convert of sample which metric may be changed by metrics processors, so counter is identified by the
+// given metric name sent by client.
+func (p *CounterRateProcessor) convert(name string, sample *model.Sample) (float64, bool) {
+	if !p.isCounter(name) {
+		return float64(sample.Value), true
+	}
+
+	key := sample.Metric.String()
+	value := float64(sample.Value)
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+
+	prev, ok := p.series[key]
+	if !ok {
+		if len(p.series) >= p.config.MaxSeries {
+			counterRateDropped.WithLabelValues("max_series").Inc()
+			return 0, false
+		}
+		p.series[key] = &counterState{value: value, ts: sample.Timestamp, lastSeen: now}
+		counterRateSeries.Inc()
+		counterRateDropped.WithLabelValues("first_sample").Inc()
+		return 0, false
+	}
+
+	if !sample.Timestamp.After(prev.ts) {
+		counterRateDropped.WithLabelValues("out_of_order").Inc()
+		return 0, false
+	}
+
+	delta := value - prev.value
+	if delta < 0 {
+		// counter was reset, it counts from zero since then
+		counterRateResets.Inc()
+		delta = value
+	}
+
+	elapsed := sample.Timestamp.Sub(prev.ts)
+	prev.value, prev.ts, prev.lastSeen = value, sample.Timestamp, now
+
+	if p.config.Mode == CounterDeltaMode {
+		return delta, true
+	}
+	return delta / elapsed.Seconds(), true
+}
+
+// sweep forgets series which were not seen during TTL. Must be called with p.mu held.
+func (p *CounterRateProcessor) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < p.config.TTL/2 {
+		return
+	}
+	p.lastSweep = now
+
+	for key, s := range p.series {
+		if now.Sub(s.lastSeen) > p.config.TTL {
+			delete(p.series, key)
+			counterRateSeries.Dec()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package prometheus
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func testCounterRateConfig() *CounterRateConfig {
+	return &CounterRateConfig{Mode: CounterRateMode, TTL: 10 * time.Minute, MaxSeries: 100, Suffixes: []string{"_total", "_count", "_sum", "_bucket"}}
+}
+
+func counterSample(name string, ts int64, value float64) *model.Sample {
+	return &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: model.LabelValue(name), "pod": "a"},
+		Timestamp: model.Time(ts),
+		Value:     model.SampleValue(value),
+	}
+}
+
+func TestCounterRateConvert(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []float64
+	}{
+		{mode: CounterRateMode, want: []float64{1, 0.5, 2}},
+		{mode: CounterDeltaMode, want: []float64{10, 5, 20}},
+	} {
+		config := testCounterRateConfig()
+		config.Mode = tc.mode
+		p := NewCounterRateProcessor(config, nil)
+
+		if _, ok := p.Convert(counterSample("requests_total", 0, 100)); ok {
+			t.Fatal("First sample of series should be dropped")
+		}
+
+		var got []float64
+		// the last sample is after counter reset
+		for _, s := range []*model.Sample{counterSample("requests_total", 10000, 110), counterSample("requests_total", 20000, 115), counterSample("requests_total", 30000, 20)} {
+			v, ok := p.Convert(s)
+			if !ok {
+				t.Fatal(fmt.Sprintf("Sample should not be dropped: %s", s))
+			}
+			got = append(got, v)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatal(fmt.Sprintf("Wrong %s values \n got: %v\n want: %v", tc.mode, got, tc.want))
+		}
+
+		if _, ok := p.Convert(counterSample("requests_total", 30000, 25)); ok {
+			t.Fatal("Sample which is not newer than previous one should be dropped")
+		}
+	}
+}
+
+func TestCounterRateNotCounters(t *testing.T) {
+	metadata, err := NewMetadataCache(&MetadataConfig{MaxFamilies: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewCounterRateProcessor(testCounterRateConfig(), metadata)
+	metadata.Observe([]MetricMetadata{
+		{Family: "queue_total", Type: MetricTypeGauge},
+		{Family: "errors", Type: MetricTypeCounter},
+		{Family: "latency", Type: MetricTypeHistogram},
+	})
+
+	for _, tc := range []struct {
+		name    string
+		counter bool
+	}{
+		{name: "memory_bytes", counter: false},
+		{name: "queue_total", counter: false},
+		{name: "requests_count", counter: true},
+		{name: "errors", counter: true},
+		{name: "errors_total", counter: true},
+		{name: "latency_sum", counter: true},
+	} {
+		if p.isCounter(tc.name) != tc.counter {
+			t.Fatal(fmt.Sprintf("Wrong counter detection of %s \n got: %v\n want: %v", tc.name, !tc.counter, tc.counter))
+		}
+	}
+
+	v, ok := p.Convert(counterSample("memory_bytes", 0, 42))
+	if !ok || v != 42 {
+		t.Fatal(fmt.Sprintf("Gauge should be sent as is \n got: %v %v\n want: %v %v", v, ok, 42, true))
+	}
+}
+
+func TestCounterRateSeriesLimits(t *testing.T) {
+	config := testCounterRateConfig()
+	config.MaxSeries = 1
+	p := NewCounterRateProcessor(config, nil)
+	now := time.Unix(1574693483, 0)
+	p.now = func() time.Time { return now }
+
+	p.Convert(counterSample("a_total", 0, 1))
+	p.Convert(counterSample("b_total", 0, 5))
+	if v, ok := p.Convert(counterSample("b_total", 500, 6)); ok {
+		t.Fatal(fmt.Sprintf("Samples of series above limit should be dropped \n got: %v", v))
+	}
+
+	now = now.Add(config.TTL + time.Second)
+	if _, ok := p.Convert(counterSample("b_total", 1000, 6)); ok {
+		t.Fatal("Stale series should be evicted, so new series is tracked")
+	}
+	if _, ok := p.series[counterSample("a_total", 0, 1).Metric.String()]; ok {
+		t.Fatal("Stale series should be evicted")
+	}
+}
+
+func TestParserCounterRates(t *testing.T) {
+	parser, err := NewAnodotParser(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabel, err := NewMetricRelabel("./test_data/relabel_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.MetricsProcessors = []MetricsProcessor{relabel}
+	config := testCounterRateConfig()
+	config.MaxSeries = 1
+	config.Suffixes = []string{"_total", "-metric"}
+	parser.CounterRates = NewCounterRateProcessor(config, nil)
+
+	// series dropped by relabeling does not take slot of series limit
+	parser.ParsePrometheusRequest(model.Samples{counterSample("expensive-cassandra-metric", 0, 1)})
+	if len(parser.CounterRates.series) != 0 {
+		t.Fatal(fmt.Sprintf("Dropped series should not be tracked \n got: %v", parser.CounterRates.series))
+	}
+
+	parser.ParsePrometheusRequest(model.Samples{counterSample("requests_total", 0, 100)})
+	sample := counterSample("requests_total", 10000, 110)
+	result := parser.ParsePrometheusRequest(model.Samples{sample})
+	if len(result) != 1 || result[0].Value != 1 {
+		t.Fatal(fmt.Sprintf("Wrong counter rate \n got: %+v\n want: %v", result, 1))
+	}
+	if sample.Value != 110 {
+		t.Fatal(fmt.Sprintf("Sample of caller should not be changed \n got: %v\n want: %v", sample.Value, 110))
+	}
+}
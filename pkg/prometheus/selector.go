@@ -0,0 +1,99 @@
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+
+// ParseSelector converts series selector, e.g. 'http_requests_total{job="api",code=~"5.."}',
+// into label matchers used by Prometheus remote read API.
+func ParseSelector(selector string) ([]*prompb.LabelMatcher, error) {
+	s := strings.TrimSpace(selector)
+	var matchers []*prompb.LabelMatcher
+
+	if name := metricNameRegex.FindString(s); name != "" {
+		matchers = append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: name})
+		s = strings.TrimSpace(s[len(name):])
+	}
+
+	if s != "" {
+		if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("invalid selector %q", selector)
+		}
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+
+	for s != "" {
+		name := metricNameRegex.FindString(s)
+		if name == "" {
+			return nil, fmt.Errorf("invalid selector %q: expected label name at %q", selector, s)
+		}
+		s = strings.TrimSpace(s[len(name):])
+
+		var matchType prompb.LabelMatcher_Type
+		switch {
+		case strings.HasPrefix(s, "=~"):
+			matchType, s = prompb.LabelMatcher_RE, s[2:]
+		case strings.HasPrefix(s, "!~"):
+			matchType, s = prompb.LabelMatcher_NRE, s[2:]
+		case strings.HasPrefix(s, "!="):
+			matchType, s = prompb.LabelMatcher_NEQ, s[2:]
+		case strings.HasPrefix(s, "="):
+			matchType, s = prompb.LabelMatcher_EQ, s[1:]
+		default:
+			return nil, fmt.Errorf("invalid selector %q: expected match operator after %q", selector, name)
+		}
+		s = strings.TrimSpace(s)
+
+		quoted, err := quotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: expected quoted label value at %q", selector, s)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", selector, err)
+		}
+		if matchType == prompb.LabelMatcher_RE || matchType == prompb.LabelMatcher_NRE {
+			if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %v", selector, err)
+			}
+		}
+		matchers = append(matchers, &prompb.LabelMatcher{Type: matchType, Name: name, Value: value})
+
+		s = strings.TrimSpace(s[len(quoted):])
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return nil, fmt.Errorf("invalid selector %q: expected ',' at %q", selector, s)
+		}
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("selector %q should contain at least one matcher", selector)
+	}
+	return matchers, nil
+}
+
+// quotedPrefix returns quoted string at the beginning of s, including quotes.
+func quotedPrefix(s string) (string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '`') {
+		return "", fmt.Errorf("missing quote")
+	}
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote != '`':
+			i++
+		case s[i] == quote:
+			return s[:i+1], nil
+		}
+	}
+	return "", fmt.Errorf("missing closing quote")
+}
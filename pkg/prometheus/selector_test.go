@@ -0,0 +1,49 @@
+package prometheus
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		expected []*prompb.LabelMatcher
+	}{
+		{"up", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}},
+		{`http_requests_total{job="api", code=~"5..",method!="GET",path!~"/health.*"}`, []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+			{Type: prompb.LabelMatcher_RE, Name: "code", Value: "5.."},
+			{Type: prompb.LabelMatcher_NEQ, Name: "method", Value: "GET"},
+			{Type: prompb.LabelMatcher_NRE, Name: "path", Value: "/health.*"},
+		}},
+		{`{__name__=~"node_.*",instance="a,b\"c"}`, []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "node_.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "instance", Value: `a,b"c`},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatal(fmt.Sprintf("Wrong matchers \n got: %v\n want: %v", got, tt.expected))
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{"", "{}", "up{", `up{job}`, `up{job="a"`, `up{job=a}`, `up{job="a" code="b"}`, `up{job=~"("}`} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Fatalf("error should be returned for %q", selector)
+		}
+	}
+}
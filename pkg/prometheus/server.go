@@ -1,12 +1,15 @@
 package prometheus
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/anodot/anodot-common/pkg/metrics"
 	"github.com/anodot/anodot-remote-write/utils"
 	log "k8s.io/klog/v2"
 
@@ -26,22 +29,59 @@ import (
 
 const GRACEFUL_TIMEOUT_SECONDS int = 5
 
+// labelAggregationFlushPeriod is how often label aggregates which are ready are sent without waiting for new requests.
+const labelAggregationFlushPeriod = time.Second
+
 type Receiver struct {
 	Port   int
 	Parser *AnodotParser
+	// Histograms configures conversion of native and classic histograms. Histograms are dropped if nil.
+	Histograms *HistogramConfig
+	// OTLP enables OpenTelemetry metrics ingestion on OTLP_METRICS_ENDPOINT.
+	OTLP *OTLPConverter
+	// TLS enables HTTPS with optional client certificates verification. Plain HTTP is used if nil.
+	TLS *TLSConfig
+	// Auth enables authentication of write endpoints. Requests are not authenticated if nil.
+	Auth *AuthConfig
+	// Tenants routes remote write requests with TENANT_HEADER to dedicated workers. All requests are sent by default workers if nil.
+	Tenants *Tenants
+	// Metadata caches metric families metadata sent with remote write requests. Metadata is ignored if nil.
+	Metadata *MetadataCache
+	// Admin enables admin and debug endpoints protected by admin token. They are not registered if nil.
+	Admin *AdminConfig
+	// CreatedTimestamps injects zero samples at created timestamps of remote write 2.0 counters. Created timestamps are ignored if nil.
+	CreatedTimestamps *CreatedTimestamps
+
+	auth *authenticator
+}
+
+// writeStats holds number of entries accepted from remote write request.
+type writeStats struct {
+	samples    int
+	histograms int
 }
 
 var (
-	totalRequests = promauto.NewCounter(prometheus.CounterOpts{
+	totalRequests = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "anodot_remote_write_received_requests",
 		Help: "The total number of received requests from Prometheus server",
-	})
+	}, []string{"client"})
 
 	httpResponses = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "anodot_remote_write_http_responses_total",
 		Help: "Total number of Anodot Remote Write HTTP responses",
 	}, []string{"response_code"})
 
+	requestsByProtoMsg = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_received_requests_by_protocol_total",
+		Help: "The total number of received requests from Prometheus server by remote write protobuf message",
+	}, []string{"proto"})
+
+	selfMetricsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_remote_write_self_metrics_buffer_errors_total",
+		Help: "Total number of times own metrics were not fully buffered by worker because its buffer is full",
+	})
+
 	versionInfo = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "anodot_remote_write_version",
 		Help: "Build info",
@@ -70,8 +110,189 @@ func (rc *Receiver) protoToSamples(req *prompb.WriteRequest) model.Samples {
 	return samples
 }
 
+func (rc *Receiver) protoV2ToSamples(req *WriteV2Request) (model.Samples, writeStats, error) {
+	var samples model.Samples
+	var stats writeStats
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		metric, err := req.labels(ts)
+		if err != nil {
+			return nil, stats, err
+		}
+
+		if zero := rc.CreatedTimestamps.zeroSample(metric, ts); zero != nil {
+			samples = append(samples, zero)
+		}
+		for _, s := range ts.Samples {
+			samples = append(samples, &model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(s.Value),
+				Timestamp: model.Time(s.Timestamp),
+			})
+		}
+		stats.samples += len(ts.Samples)
+
+		samples = append(samples, rc.histogramsToSamples(metric, ts.Histograms)...)
+		if rc.Histograms != nil {
+			stats.histograms += len(ts.Histograms)
+		}
+	}
+	return samples, stats, nil
+}
+
+func (rc *Receiver) histogramsToSamples(metric model.Metric, histograms []Histogram) model.Samples {
+	if rc.Histograms == nil {
+		return nil
+	}
+
+	var samples model.Samples
+	for i := range histograms {
+		samples = append(samples, rc.Histograms.HistogramToSamples(metric, &histograms[i])...)
+	}
+	return samples
+}
+
+// decodeWriteRequest decodes remote write request body according to protobuf message type.
+func (rc *Receiver) decodeWriteRequest(protoMsg string, reqBuf []byte) (model.Samples, writeStats, error) {
+	var samples model.Samples
+	var stats writeStats
+
+	switch protoMsg {
+	case RemoteWriteV2Proto:
+		var req WriteV2Request
+		if err := req.Unmarshal(reqBuf); err != nil {
+			return nil, stats, err
+		}
+		var err error
+		samples, stats, err = rc.protoV2ToSamples(&req)
+		if err != nil {
+			return nil, stats, err
+		}
+		if rc.Metadata != nil {
+			rc.Metadata.Observe(req.metricMetadata())
+		}
+	default:
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+			return nil, stats, err
+		}
+		samples = rc.protoToSamples(&req)
+		stats.samples = len(samples)
+
+		if rc.Metadata != nil {
+			metadata, err := unmarshalMetadataV1(reqBuf)
+			if err != nil {
+				return nil, stats, err
+			}
+			rc.Metadata.Observe(metadata)
+		}
+
+		if rc.Histograms != nil {
+			series, err := unmarshalHistogramsV1(reqBuf)
+			if err != nil {
+				return nil, stats, err
+			}
+			for _, s := range series {
+				samples = append(samples, rc.histogramsToSamples(s.metric, s.histograms)...)
+				stats.histograms += len(s.histograms)
+			}
+		}
+	}
+
+	if rc.Histograms != nil {
+		samples = rc.Histograms.ClassicHistogramsToSamples(samples)
+	}
+	return samples, stats, nil
+}
+
+// readRequestBody reads request body, decompressing it if it is sent with gzip Content-Encoding.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	gr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = gr.Close()
+	}()
+	return ioutil.ReadAll(gr)
+}
+
+// fullWorker returns the first worker which buffer is full.
+func fullWorker(workers []*remote.Worker) *remote.Worker {
+	for _, worker := range workers {
+		if worker.BufferFull() {
+			return worker
+		}
+	}
+	return nil
+}
+
+// doAll sends data to all workers. If any worker has no room for data, nothing is sent and that worker is returned,
+// so request is rejected and retried by client without duplicating metrics already buffered by other workers.
+func doAll(workers []*remote.Worker, data []metrics.Anodot20Metric) *remote.Worker {
+	for i := 0; i < len(workers); i++ {
+		if !workers[i].HasRoom(data) {
+			return workers[i]
+		}
+	}
+	for i := 0; i < len(workers); i++ {
+		// metrics may be already buffered by other workers, so request is accepted and dropped metrics are counted by worker
+		if err := workers[i].Do(data); err != nil {
+			log.Warningf("Metrics are not fully buffered by worker %s: %v", workers[i], err)
+		}
+	}
+	return nil
+}
+
+// produceAggregates periodically sends label aggregates which are ready, so they are not delayed until the next request.
+func (rc *Receiver) produceAggregates(ctx context.Context, workers []*remote.Worker) {
+	ticker := time.NewTicker(labelAggregationFlushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rc.sendAggregates(workers, false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendAggregates sends label aggregates of default and tenant parsers to their workers. All pending aggregates are
+// sent if flush is set.
+func (rc *Receiver) sendAggregates(workers []*remote.Worker, flush bool) {
+	send := func(parser *AnodotParser, workers []*remote.Worker) {
+		data := parser.Produce(flush)
+		if len(data) == 0 {
+			return
+		}
+		for i := range workers {
+			if err := workers[i].Do(data); err != nil {
+				log.Warningf("Aggregated metrics are not fully buffered by worker %s: %v", workers[i], err)
+			}
+		}
+	}
+
+	send(rc.Parser, workers)
+	if rc.Tenants != nil {
+		for _, t := range rc.Tenants.tenants {
+			send(t.Parser, t.Workers)
+		}
+	}
+}
+
+// rejectBufferFull responds with status code which makes Prometheus retry request later, instead of dropping metrics.
+func rejectBufferFull(w http.ResponseWriter, worker *remote.Worker) {
+	httpResponses.With(prometheus.Labels{"response_code": strconv.Itoa(worker.BufferFullStatusCode)}).Inc()
+	http.Error(w, remote.ErrBufferFull.Error(), worker.BufferFullStatusCode)
+}
+
 func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
-	var srv http.Server
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", rc.Port)}
 
 	log.V(2).Infof("Initializing %d remote write config(s): %s", len(workers), workers)
 
@@ -84,13 +305,18 @@ func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
 			for {
 				select {
 				case <-ticker.C:
-					samples, err := utils.FetchMetrics("http://127.0.0.1:1234/metrics", 3, time.Second*5)
+					// own metrics are read directly, since metrics endpoint may require TLS and client authentication
+					samples, err := utils.GatherMetrics(prometheus.DefaultGatherer)
 					if err != nil {
-						log.Errorf("failed to scrape own metrics endpoint. %s", err.Error())
+						log.Errorf("failed to gather own metrics. %s", err.Error())
 					}
 
+					data := rc.Parser.ParsePrometheusRequest(samples)
 					for i := 0; i < len(workers); i++ {
-						workers[i].Do(rc.Parser.ParsePrometheusRequest(samples))
+						if err := workers[i].Do(data); err != nil {
+							selfMetricsDropped.Inc()
+							log.Warningf("Own metrics are not fully buffered by worker %s: %v", workers[i], err)
+						}
 					}
 				case <-quit:
 					ticker.Stop()
@@ -100,8 +326,39 @@ func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
 		}()
 	}
 
-	http.HandleFunc(RECEIVER_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
-		totalRequests.Inc()
+	go rc.produceAggregates(ctx, workers)
+
+	if rc.Auth.Enabled() {
+		auth, err := newAuthenticator(rc.Auth)
+		if err != nil {
+			log.Fatalf("Failed to load client credentials: %v", err)
+		}
+		go auth.watch(ctx)
+		rc.auth = auth
+	}
+
+	http.HandleFunc(RECEIVER_ENDPOINT, rc.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		totalRequests.WithLabelValues(clientIdentity(r)).Inc()
+
+		parser, workers, err := rc.route(r, workers)
+		if err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if worker := fullWorker(workers); worker != nil {
+			rejectBufferFull(w, worker)
+			return
+		}
+
+		protoMsg, err := remoteWriteProtoMsg(r.Header.Get("Content-Type"))
+		if err != nil {
+			httpResponses.With(prometheus.Labels{"response_code": "415"}).Inc()
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		requestsByProtoMsg.WithLabelValues(protoMsg).Inc()
 
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -117,22 +374,42 @@ func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
 			return
 		}
 
-		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		samples, stats, err := rc.decodeWriteRequest(protoMsg, reqBuf)
+		if err != nil {
 			httpResponses.With(prometheus.Labels{"response_code": "400"}).Inc()
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		data := rc.Parser.ParsePrometheusRequest(rc.protoToSamples(&req))
-		if len(data) == 0 {
-			return
+		data := parser.ParsePrometheusRequest(rc.tagClientIdentity(r, samples))
+		if len(data) > 0 {
+			if worker := doAll(workers, data); worker != nil {
+				rejectBufferFull(w, worker)
+				return
+			}
 		}
 
-		for i := 0; i < len(workers); i++ {
-			workers[i].Do(data)
+		if protoMsg == RemoteWriteV2Proto {
+			// exemplars are not forwarded to Anodot, so none of them is written
+			w.Header().Set(remoteWriteSamplesWrittenHeader, strconv.Itoa(stats.samples))
+			w.Header().Set(remoteWriteHistogramsWrittenHeader, strconv.Itoa(stats.histograms))
+			w.Header().Set(remoteWriteExemplarsWrittenHeader, "0")
 		}
-	})
+	}))
+
+	if rc.OTLP != nil {
+		http.HandleFunc(OTLP_METRICS_ENDPOINT, rc.withAuth(rc.otlpHandler(workers)))
+	}
+
+	http.HandleFunc(INFLUX_V1_WRITE_ENDPOINT, rc.withInfluxAuth(rc.influxHandler(workers)))
+	http.HandleFunc(INFLUX_V2_WRITE_ENDPOINT, rc.withInfluxAuth(rc.influxHandler(workers)))
+
+	if rc.Admin.Enabled() {
+		http.HandleFunc(ADMIN_RATE_LIMITS_ENDPOINT, rc.withAdminAuth(rateLimitsHandler))
+	}
+	if rc.Metadata != nil && rc.Admin.Enabled() {
+		http.HandleFunc(DEBUG_METADATA_ENDPOINT, rc.withAdminAuth(rc.metadataHandler))
+	}
 
 	http.HandleFunc(HEALTH_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -142,8 +419,31 @@ func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
 
 	versionInfo.With(prometheus.Labels{"version": version.VERSION, "git_sha1": version.REVISION}).Inc()
 
+	if rc.TLS.Enabled() {
+		reloader, err := newCertReloader(rc.TLS)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificates: %v", err)
+		}
+		go reloader.watch(ctx)
+
+		srv.TLSConfig, err = reloader.serverConfig()
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		srv.ErrorLog = newServerErrorLog()
+	}
+
 	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", rc.Port), nil))
+		var err error
+		if srv.TLSConfig != nil {
+			log.V(2).Infof("Serving HTTPS on port %d", rc.Port)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
 	// Do graceful shutdown
@@ -160,7 +460,9 @@ func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
 	if err := srv.Shutdown(ctxShutDown); err != nil {
 		log.Fatalf("Server Shutdown Failed:%+s", err)
 	}
+	rc.sendAggregates(workers, true)
 
+	workers = append(workers, rc.Tenants.Workers()...)
 	var wg sync.WaitGroup
 	wg.Add(len(workers))
 
@@ -172,5 +474,11 @@ func (rc *Receiver) InitHttp(ctx context.Context, workers []*remote.Worker) {
 	}
 
 	wg.Wait()
+
+	if rc.Metadata != nil {
+		if err := rc.Metadata.Save(); err != nil {
+			log.Errorf("Failed to save metadata cache: %v", err)
+		}
+	}
 	log.Info("Server exited properly")
 }
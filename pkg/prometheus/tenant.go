@@ -0,0 +1,205 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+)
+
+// TENANT_HEADER holds ID of the tenant which metrics are sent in the request.
+const TENANT_HEADER = "X-Scope-OrgID"
+
+const (
+	// UnknownTenantReject rejects requests of tenants missing in configuration.
+	UnknownTenantReject = "reject"
+	// UnknownTenantDefault sends metrics of unknown tenants with default parser and workers.
+	UnknownTenantDefault = "default"
+)
+
+var (
+	tenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_tenant_requests_total",
+		Help: "Total number of write requests by tenant",
+	}, []string{"tenant"})
+
+	unknownTenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_unknown_tenant_requests_total",
+		Help: "Total number of write requests with tenant ID missing in configuration",
+	}, []string{"action"})
+)
+
+// TenantConfig describes Anodot account which receives metrics of the tenant.
+type TenantConfig struct {
+	ID string `yaml:"id"`
+	// URL of Anodot server. Default Anodot URL is used if empty.
+	URL   string `yaml:"url,omitempty"`
+	Token string `yaml:"token"`
+	// Tags are added to tags configured by ANODOT_TAGS.
+	Tags map[string]string `yaml:"tags,omitempty"`
+	// FilterIn and FilterOut replace -filterIn and -filterOut expressions if specified.
+	FilterIn  map[string]string `yaml:"filter_in,omitempty"`
+	FilterOut map[string]string `yaml:"filter_out,omitempty"`
+	// MaxEPS and MaxBurst replace ANODOT_MAX_ALLOWED_EPS and ANODOT_MAX_ALLOWED_BURST if specified.
+	MaxEPS   int `yaml:"max_eps,omitempty"`
+	MaxBurst int `yaml:"max_burst,omitempty"`
+}
+
+type TenantsConfig struct {
+	// UnknownTenant is either "reject" or "default".
+	UnknownTenant string         `yaml:"unknown_tenant,omitempty"`
+	Tenants       []TenantConfig `yaml:"tenants"`
+}
+
+func LoadTenantsConfig(path string) (*TenantsConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config TenantsConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", path)
+	}
+
+	if config.UnknownTenant == "" {
+		config.UnknownTenant = UnknownTenantReject
+	}
+	if config.UnknownTenant != UnknownTenantReject && config.UnknownTenant != UnknownTenantDefault {
+		return nil, fmt.Errorf("unknown_tenant in %s should be either %q or %q", path, UnknownTenantReject, UnknownTenantDefault)
+	}
+
+	ids := make(map[string]bool)
+	for i, t := range config.Tenants {
+		if t.ID == "" {
+			return nil, fmt.Errorf("tenant %d in %s: id should be specified", i, path)
+		}
+		if t.ID == remote.DefaultTenant {
+			return nil, fmt.Errorf("tenant id %q in %s is reserved", t.ID, path)
+		}
+		if ids[t.ID] {
+			return nil, fmt.Errorf("tenant %q in %s is defined more than once", t.ID, path)
+		}
+		ids[t.ID] = true
+		if t.Token == "" {
+			return nil, fmt.Errorf("tenant %q in %s: token should be specified", t.ID, path)
+		}
+	}
+	return &config, nil
+}
+
+// Tenant has dedicated parser and workers which send metrics to the tenant's Anodot account.
+type Tenant struct {
+	ID      string
+	Parser  *AnodotParser
+	Workers []*remote.Worker
+}
+
+type Tenants struct {
+	tenants               map[string]*Tenant
+	routeUnknownToDefault bool
+}
+
+// NewTenants creates parser and worker of every configured tenant. Tenant parsers share metrics processors of base parser.
+func NewTenants(config *TenantsConfig, base *AnodotParser, defaultURL *url.URL, workerConfig *remote.WorkerConfig, retry *remote.RetryConfig, client *http.Client, compression *remote.CompressionConfig) (*Tenants, error) {
+	res := &Tenants{tenants: make(map[string]*Tenant), routeUnknownToDefault: config.UnknownTenant == UnknownTenantDefault}
+
+	for _, tc := range config.Tenants {
+		anodotURL := defaultURL
+		if tc.URL != "" {
+			var err error
+			anodotURL, err = url.Parse(tc.URL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse url of tenant %q: %w", tc.ID, err)
+			}
+		}
+
+		submitter, err := remote.NewSubmitter(*anodotURL, tc.Token, client, compression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create submitter of tenant %q: %w", tc.ID, err)
+		}
+		tenantWorkerConfig := workerConfig
+		if tc.MaxEPS > 0 {
+			c := *workerConfig
+			c.MaxAllowedEPS, c.MaxAllowedBurst = tc.MaxEPS, tc.MaxBurst
+			tenantWorkerConfig = &c
+		}
+		worker, err := remote.NewTenantWorker(tc.ID, remote.NewRetryingSubmitter(submitter, retry), tenantWorkerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create worker of tenant %q: %w", tc.ID, err)
+		}
+
+		res.tenants[tc.ID] = &Tenant{ID: tc.ID, Parser: tenantParser(base, &tc), Workers: []*remote.Worker{worker}}
+	}
+	return res, nil
+}
+
+func tenantParser(base *AnodotParser, tc *TenantConfig) *AnodotParser {
+	parser := *base
+
+	parser.Tags = make(map[string]string, len(base.Tags)+len(tc.Tags))
+	for k, v := range base.Tags {
+		parser.Tags[k] = v
+	}
+	for k, v := range tc.Tags {
+		parser.Tags[k] = v
+	}
+
+	if tc.FilterIn != nil {
+		parser.FilterInProperties = tc.FilterIn
+	}
+	if tc.FilterOut != nil {
+		parser.FilterOutProperties = tc.FilterOut
+	}
+	// tenants may send the same series, so previous counter values are tracked separately
+	parser.CounterRates = base.CounterRates.fork()
+	parser.MetricsProcessors = make([]MetricsProcessor, len(base.MetricsProcessors))
+	for i, p := range base.MetricsProcessors {
+		if a, ok := p.(*LabelAggregator); ok {
+			p = a.fork()
+		}
+		parser.MetricsProcessors[i] = p
+	}
+	return &parser
+}
+
+// Workers returns workers of all tenants.
+func (t *Tenants) Workers() []*remote.Worker {
+	if t == nil {
+		return nil
+	}
+
+	var res []*remote.Worker
+	for _, tenant := range t.tenants {
+		res = append(res, tenant.Workers...)
+	}
+	return res
+}
+
+// route returns parser and workers which handle the request according to its tenant ID.
+// Requests without tenant ID are handled by default parser and workers.
+func (rc *Receiver) route(r *http.Request, workers []*remote.Worker) (*AnodotParser, []*remote.Worker, error) {
+	id := r.Header.Get(TENANT_HEADER)
+	if rc.Tenants == nil || id == "" {
+		tenantRequests.WithLabelValues(remote.DefaultTenant).Inc()
+		return rc.Parser, workers, nil
+	}
+
+	if tenant, ok := rc.Tenants.tenants[id]; ok {
+		tenantRequests.WithLabelValues(id).Inc()
+		return tenant.Parser, tenant.Workers, nil
+	}
+
+	if rc.Tenants.routeUnknownToDefault {
+		unknownTenantRequests.WithLabelValues(UnknownTenantDefault).Inc()
+		tenantRequests.WithLabelValues(remote.DefaultTenant).Inc()
+		return rc.Parser, workers, nil
+	}
+	unknownTenantRequests.WithLabelValues(UnknownTenantReject).Inc()
+	return nil, nil, fmt.Errorf("unknown tenant %q", id)
+}
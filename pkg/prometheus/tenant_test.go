@@ -0,0 +1,137 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metrics2 "github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+)
+
+const testTenants = `
+tenants:
+  - id: team-a
+    token: token-a
+    tags:
+      business_unit: a
+  - id: team-b
+    url: https://b.anodot.com
+    token: token-b
+    filter_out:
+      job: test
+`
+
+func writeTenantsConfig(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "tenants.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTenantRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := LoadTenantsConfig(writeTenantsConfig(t, dir, testTenants))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.UnknownTenant != UnknownTenantReject {
+		t.Fatal(fmt.Sprintf("Wrong default unknown_tenant \n got: %s\n want: %s", config.UnknownTenant, UnknownTenantReject))
+	}
+
+	parser, _ := NewAnodotParser(nil, nil, map[string]string{"env": "prod"})
+	defaultURL, _ := url.Parse("https://api.anodot.com")
+	workerConfig := &remote.WorkerConfig{MetricsPerRequestSize: 1000, MaxWorkers: 1, BatchSendDeadline: time.Minute, Debug: true}
+	tenants, err := NewTenants(config, parser, defaultURL, workerConfig, &remote.RetryConfig{MaxAttempts: 1, InitialBackoff: time.Second, MaxBackoff: time.Second}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants.Workers()) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong number of tenant workers \n got: %d\n want: 2", len(tenants.Workers())))
+	}
+
+	submitter, err := metrics2.NewAnodot20Client(*defaultURL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultWorker, err := remote.NewWorker(submitter, workerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultWorkers := []*remote.Worker{defaultWorker}
+	rc := &Receiver{Parser: parser, Tenants: tenants}
+
+	request := func(tenant string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, RECEIVER_ENDPOINT, nil)
+		if tenant != "" {
+			r.Header.Set(TENANT_HEADER, tenant)
+		}
+		return r
+	}
+
+	p, workers, err := rc.route(request(""), defaultWorkers)
+	if err != nil || p != parser || workers[0] != defaultWorker {
+		t.Fatal(fmt.Sprintf("request without tenant should be routed to default workers, err: %v", err))
+	}
+
+	p, workers, err = rc.route(request("team-a"), defaultWorkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workers[0].Tenant != "team-a" || p.Tags["business_unit"] != "a" || p.Tags["env"] != "prod" {
+		t.Fatal(fmt.Sprintf("Wrong route of team-a \n got: %s %v", workers[0].Tenant, p.Tags))
+	}
+	if _, ok := parser.Tags["business_unit"]; ok {
+		t.Fatalf("tenant tags should not change default parser")
+	}
+
+	p, workers, err = rc.route(request("team-b"), defaultWorkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workers[0].Tenant != "team-b" || workers[0].String() != "Anodot URL='b.anodot.com' tenant='team-b'" || p.FilterOutProperties["job"] != "test" {
+		t.Fatal(fmt.Sprintf("Wrong route of team-b \n got: %s %v", workers[0], p.FilterOutProperties))
+	}
+
+	if _, _, err := rc.route(request("team-c"), defaultWorkers); err == nil {
+		t.Fatalf("error should be returned for unknown tenant")
+	}
+
+	tenants.routeUnknownToDefault = true
+	if p, workers, err := rc.route(request("team-c"), defaultWorkers); err != nil || p != parser || workers[0] != defaultWorker {
+		t.Fatal(fmt.Sprintf("unknown tenant should be routed to default workers, err: %v", err))
+	}
+}
+
+func TestLoadTenantsConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := []string{
+		"tenants:\n  - token: a\n",
+		"tenants:\n  - id: a\n",
+		"tenants:\n  - id: default\n    token: a\n",
+		"tenants:\n  - id: a\n    token: a\n  - id: a\n    token: b\n",
+		"unknown_tenant: drop\ntenants: []\n",
+	}
+	for _, content := range invalid {
+		if _, err := LoadTenantsConfig(writeTenantsConfig(t, dir, content)); err == nil {
+			t.Fatalf("error should be returned for %q", content)
+		}
+	}
+}
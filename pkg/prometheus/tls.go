@@ -0,0 +1,318 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "k8s.io/klog/v2"
+)
+
+var (
+	tlsHandshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_tls_handshake_failures_total",
+		Help: "Total number of failed TLS handshakes",
+	}, []string{"reason"})
+
+	tlsCertificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_tls_certificate_expiry_timestamp_seconds",
+		Help: "Expiration time of loaded TLS certificate in unix seconds",
+	}, []string{"type"})
+
+	tlsCertificateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_tls_certificate_reloads_total",
+		Help: "Total number of TLS certificate reloads",
+	}, []string{"result"})
+)
+
+// TLSConfig configures TLS of receiver HTTP server. TLS is disabled if CertFile is empty.
+type TLSConfig struct {
+	CertFile string `split_words:"true"`
+	KeyFile  string `split_words:"true"`
+	// ClientCAFile enables mutual TLS. Clients should present certificate signed by one of the CAs.
+	ClientCAFile string `split_words:"true"`
+	// AllowedSubjects is a list of allowed client certificate common names.
+	AllowedSubjects []string `split_words:"true"`
+	// AllowedSANs is a list of allowed client certificate DNS names, email addresses, URIs or IP addresses.
+	AllowedSANs []string `envconfig:"ALLOWED_SANS"`
+	// ReloadInterval is how often certificate files are checked for changes.
+	ReloadInterval time.Duration `default:"1m" split_words:"true"`
+	MinVersion     string        `default:"1.2" split_words:"true"`
+}
+
+func NewTLSConfig() (*TLSConfig, error) {
+	config := &TLSConfig{}
+	if err := envconfig.Process("ANODOT_TLS", config); err != nil {
+		return nil, err
+	}
+
+	if !config.Enabled() {
+		if config.KeyFile != "" || config.ClientCAFile != "" {
+			return nil, fmt.Errorf("ANODOT_TLS_CERT_FILE should be specified to enable TLS")
+		}
+		return config, nil
+	}
+
+	if config.KeyFile == "" {
+		return nil, fmt.Errorf("ANODOT_TLS_KEY_FILE should be specified together with ANODOT_TLS_CERT_FILE")
+	}
+	if config.ClientCAFile == "" && (len(config.AllowedSubjects) > 0 || len(config.AllowedSANs) > 0) {
+		return nil, fmt.Errorf("ANODOT_TLS_CLIENT_CA_FILE should be specified to restrict allowed clients")
+	}
+	if config.ReloadInterval <= 0 {
+		return nil, fmt.Errorf("ANODOT_TLS_RELOAD_INTERVAL should be positive")
+	}
+	if _, err := tlsVersion(config.MinVersion); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && c.CertFile != ""
+}
+
+func tlsVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q", v)
+}
+
+// certReloader keeps server certificate and client CAs loaded from files and reloads them once files are changed.
+type certReloader struct {
+	config *TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	// content of loaded files, used to detect changes
+	loaded []byte
+}
+
+func newCertReloader(config *TLSConfig) (*certReloader, error) {
+	r := &certReloader{config: config}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads certificate files if their content changed. Returns true if certificates were reloaded.
+func (r *certReloader) reload() (bool, error) {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+
+	var content [][]byte
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return false, err
+		}
+		content = append(content, b)
+	}
+
+	all := bytes.Join(content, nil)
+	r.mu.RLock()
+	unchanged := bytes.Equal(all, r.loaded)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(content[0], content[1])
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS key pair %s, %s: %w", r.config.CertFile, r.config.KeyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	cert.Leaf = leaf
+	tlsCertificateExpiry.WithLabelValues("server").Set(float64(leaf.NotAfter.Unix()))
+
+	var pool *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pool = x509.NewCertPool()
+		expiry, err := appendCertsFromPEM(pool, content[2])
+		if err != nil {
+			return false, fmt.Errorf("failed to load client CA %s: %w", r.config.ClientCAFile, err)
+		}
+		tlsCertificateExpiry.WithLabelValues("client_ca").Set(float64(expiry.Unix()))
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCA = pool
+	r.loaded = all
+	r.mu.Unlock()
+
+	log.V(3).Infof("Loaded TLS certificate '%s' valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	return true, nil
+}
+
+// appendCertsFromPEM adds all certificates to pool and returns the earliest expiration time.
+func appendCertsFromPEM(pool *x509.CertPool, pemCerts []byte) (time.Time, error) {
+	var expiry time.Time
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return expiry, err
+		}
+		pool.AddCert(cert)
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+
+	if expiry.IsZero() {
+		return expiry, fmt.Errorf("no certificates found")
+	}
+	return expiry, nil
+}
+
+func (r *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				tlsCertificateReloads.WithLabelValues("failure").Inc()
+				log.Errorf("failed to reload TLS certificates, keeping previous ones: %v", err)
+				continue
+			}
+			if reloaded {
+				tlsCertificateReloads.WithLabelValues("success").Inc()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// serverConfig returns TLS configuration which always uses the latest loaded certificates.
+func (r *certReloader) serverConfig() (*tls.Config, error) {
+	minVersion, err := tlsVersion(r.config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{MinVersion: minVersion, GetCertificate: r.getCertificate}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		// NextProtos are added to base config by http.Server once it starts serving, e.g. to negotiate HTTP/2
+		c := &tls.Config{MinVersion: minVersion, GetCertificate: r.getCertificate, NextProtos: base.NextProtos}
+
+		r.mu.RLock()
+		clientCA := r.clientCA
+		r.mu.RUnlock()
+		if clientCA != nil {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			c.ClientCAs = clientCA
+			c.VerifyConnection = r.verifyClient
+		}
+		return c, nil
+	}
+	return base, nil
+}
+
+// verifyClient checks that verified client certificate matches allowed subjects or SANs, if any configured.
+func (r *certReloader) verifyClient(cs tls.ConnectionState) error {
+	if len(r.config.AllowedSubjects) == 0 && len(r.config.AllowedSANs) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		tlsHandshakeFailures.WithLabelValues("client_not_allowed").Inc()
+		return fmt.Errorf("client certificate is required")
+	}
+
+	cert := cs.PeerCertificates[0]
+	if clientAllowed(cert, r.config.AllowedSubjects, r.config.AllowedSANs) {
+		return nil
+	}
+
+	tlsHandshakeFailures.WithLabelValues("client_not_allowed").Inc()
+	return fmt.Errorf("client certificate '%s' is not allowed", cert.Subject.CommonName)
+}
+
+func clientAllowed(cert *x509.Certificate, subjects []string, sans []string) bool {
+	for _, s := range subjects {
+		if cert.Subject.CommonName == s {
+			return true
+		}
+	}
+
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for _, allowed := range sans {
+		for _, n := range names {
+			if n == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsErrorLogWriter counts TLS handshake errors reported by http.Server and forwards all messages to klog.
+type tlsErrorLogWriter struct{}
+
+func (tlsErrorLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.Contains(msg, "TLS handshake error") {
+		tlsHandshakeFailures.WithLabelValues("handshake_error").Inc()
+		log.V(4).Info(msg)
+		return len(p), nil
+	}
+	log.Error(msg)
+	return len(p), nil
+}
+
+func newServerErrorLog() *stdlog.Logger {
+	return stdlog.New(tlsErrorLogWriter{}, "", 0)
+}
@@ -0,0 +1,245 @@
+package prometheus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * time.Duration(serial)),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLSServerWithClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", 100, nil, true)
+	server := newTestCert(t, "localhost", 2, ca, false)
+	allowedClient := newTestCert(t, "prometheus-a", 3, ca, false)
+	otherClient := newTestCert(t, "prometheus-b", 4, ca, false)
+
+	config := &TLSConfig{
+		CertFile:        filepath.Join(dir, "tls.crt"),
+		KeyFile:         filepath.Join(dir, "tls.key"),
+		ClientCAFile:    filepath.Join(dir, "ca.crt"),
+		AllowedSubjects: []string{"prometheus-a"},
+		MinVersion:      "1.2",
+	}
+	write := func(path string, content []byte) {
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config.CertFile, server.certPEM)
+	write(config.KeyFile, server.keyPEM)
+	write(config.ClientCAFile, ca.certPEM)
+
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := reloader.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	if c, err := tlsConfig.GetConfigForClient(nil); err != nil || len(c.NextProtos) != 2 {
+		t.Fatal(fmt.Sprintf("NextProtos should be copied to client config \n got: %v", c))
+	}
+	tlsConfig.NextProtos = nil
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:  http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }),
+		ErrorLog: newServerErrorLog(),
+	}
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(client *testCert) (*http.Response, error) {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{client.tlsCertificate(t)}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		return c.Get(fmt.Sprintf("https://%s/", listener.Addr().String()))
+	}
+
+	resp, err := get(allowedClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Fatal(fmt.Sprintf("Wrong server certificate \n got: %v\n want: 2", resp.TLS.PeerCertificates[0].SerialNumber))
+	}
+
+	if _, err := get(otherClient); err == nil {
+		t.Fatalf("client with not allowed subject should be rejected")
+	}
+	if _, err := get(nil); err == nil {
+		t.Fatalf("client without certificate should be rejected")
+	}
+
+	// rotated certificate is used without restart
+	rotated := newTestCert(t, "localhost", 5, ca, false)
+	write(config.CertFile, rotated.certPEM)
+	write(config.KeyFile, rotated.keyPEM)
+	reloaded, err := reloader.reload()
+	if err != nil || !reloaded {
+		t.Fatal(fmt.Sprintf("certificates should be reloaded, reloaded: %v, err: %v", reloaded, err))
+	}
+
+	resp, err = get(allowedClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 5 {
+		t.Fatal(fmt.Sprintf("Wrong server certificate \n got: %v\n want: 5", resp.TLS.PeerCertificates[0].SerialNumber))
+	}
+
+	// invalid files keep previous certificate
+	write(config.KeyFile, server.keyPEM)
+	if _, err := reloader.reload(); err == nil {
+		t.Fatalf("error should be returned for mismatched key pair")
+	}
+	if cert, _ := reloader.getCertificate(nil); cert.Leaf.SerialNumber.Int64() != 5 {
+		t.Fatal(fmt.Sprintf("Wrong server certificate \n got: %v\n want: 5", cert.Leaf.SerialNumber))
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	ca := newTestCert(t, "ca", 100, nil, true)
+	client := newTestCert(t, "prometheus-a", 2, ca, false)
+
+	tests := []struct {
+		subjects []string
+		sans     []string
+		allowed  bool
+	}{
+		{[]string{"prometheus-a"}, nil, true},
+		{[]string{"prometheus-b"}, nil, false},
+		{nil, []string{"127.0.0.1"}, true},
+		{nil, []string{"prometheus-a"}, true},
+		{[]string{"prometheus-b"}, []string{"10.0.0.1"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := clientAllowed(client.cert, tt.subjects, tt.sans); got != tt.allowed {
+			t.Fatal(fmt.Sprintf("Wrong result for subjects=%v sans=%v \n got: %v\n want: %v", tt.subjects, tt.sans, got, tt.allowed))
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	defer func() {
+		for _, v := range []string{"ANODOT_TLS_CERT_FILE", "ANODOT_TLS_KEY_FILE", "ANODOT_TLS_CLIENT_CA_FILE", "ANODOT_TLS_ALLOWED_SANS"} {
+			_ = os.Unsetenv(v)
+		}
+	}()
+
+	config, err := NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Enabled() {
+		t.Fatalf("TLS should be disabled by default")
+	}
+
+	_ = os.Setenv("ANODOT_TLS_CERT_FILE", "tls.crt")
+	_ = os.Setenv("ANODOT_TLS_KEY_FILE", "tls.key")
+	_ = os.Setenv("ANODOT_TLS_ALLOWED_SANS", "a.example.com,b.example.com")
+	if _, err := NewTLSConfig(); err == nil {
+		t.Fatalf("error should be returned for allowed SANs without client CA")
+	}
+
+	_ = os.Setenv("ANODOT_TLS_CLIENT_CA_FILE", "ca.crt")
+	config, err = NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Enabled() || config.ClientCAFile != "ca.crt" || len(config.AllowedSANs) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong TLS config \n got: %+v", config))
+	}
+}
@@ -0,0 +1,302 @@
+package prometheus
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+// Remote write protobuf message types, sent as 'proto' parameter of Content-Type header.
+// See https://prometheus.io/docs/specs/remote_write_spec_2_0/#protocol
+const (
+	RemoteWriteV1Proto = "prometheus.WriteRequest"
+	RemoteWriteV2Proto = "io.prometheus.write.v2.Request"
+
+	remoteWriteSamplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	remoteWriteHistogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	remoteWriteExemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+var (
+	createdTimestampSeries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_created_timestamp_series",
+		Help: "Number of counter series which created timestamp is tracked",
+	})
+
+	createdTimestampZeroSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_created_timestamp_zero_samples_total",
+		Help: "Total number of zero samples injected at created timestamps of counters, by result",
+	}, []string{"result"})
+)
+
+// remoteWriteProtoMsg returns remote write protobuf message type based on request Content-Type header.
+// Missing Content-Type and missing 'proto' parameter are treated as remote write 1.0 for backward compatibility.
+func remoteWriteProtoMsg(contentType string) (string, error) {
+	if strings.TrimSpace(contentType) == "" {
+		return RemoteWriteV1Proto, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse Content-Type %q: %w", contentType, err)
+	}
+	if mediaType != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported Content-Type %q", contentType)
+	}
+
+	switch proto := params["proto"]; proto {
+	case "", RemoteWriteV1Proto:
+		return RemoteWriteV1Proto, nil
+	case RemoteWriteV2Proto:
+		return RemoteWriteV2Proto, nil
+	default:
+		return "", fmt.Errorf("unsupported remote write protobuf message %q", proto)
+	}
+}
+
+// MetricType is a Prometheus metric type, as sent in remote write metadata.
+type MetricType int32
+
+const (
+	MetricTypeUnknown MetricType = iota
+	MetricTypeCounter
+	MetricTypeGauge
+	MetricTypeHistogram
+	MetricTypeGaugeHistogram
+	MetricTypeSummary
+	MetricTypeInfo
+	MetricTypeStateset
+)
+
+// WriteV2Request is a decoded io.prometheus.write.v2.Request message.
+type WriteV2Request struct {
+	Symbols    []string
+	Timeseries []WriteV2TimeSeries
+}
+
+type WriteV2TimeSeries struct {
+	LabelsRefs []uint32
+	Samples    []WriteV2Sample
+	Histograms []Histogram
+	Metadata   WriteV2Metadata
+	// CreatedTimestamp is time in milliseconds when the series (counter, histogram, summary) was created.
+	CreatedTimestamp int64
+}
+
+type WriteV2Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+type WriteV2Metadata struct {
+	Type    MetricType
+	HelpRef uint32
+	UnitRef uint32
+}
+
+func (r *WriteV2Request) Unmarshal(b []byte) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 4:
+			r.Symbols = append(r.Symbols, f.string())
+		case 5:
+			var ts WriteV2TimeSeries
+			if err := ts.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			r.Timeseries = append(r.Timeseries, ts)
+		}
+		return nil
+	})
+}
+
+func (ts *WriteV2TimeSeries) unmarshal(b []byte) error {
+	var refs []uint64
+	err := walkProto(b, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			refs, err = repeatedVarints(f, refs)
+		case 2:
+			var s WriteV2Sample
+			err = walkProto(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					s.Value = f.double()
+				case 2:
+					s.Timestamp = int64(f.varint)
+				}
+				return nil
+			})
+			ts.Samples = append(ts.Samples, s)
+		case 3:
+			var h Histogram
+			err = h.unmarshal(f.bytes)
+			ts.Histograms = append(ts.Histograms, h)
+		case 5:
+			err = walkProto(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					ts.Metadata.Type = MetricType(f.varint)
+				case 3:
+					ts.Metadata.HelpRef = uint32(f.varint)
+				case 4:
+					ts.Metadata.UnitRef = uint32(f.varint)
+				}
+				return nil
+			})
+		case 6:
+			ts.CreatedTimestamp = int64(f.varint)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ts.LabelsRefs = make([]uint32, len(refs))
+	for i, r := range refs {
+		ts.LabelsRefs[i] = uint32(r)
+	}
+	return nil
+}
+
+// symbol returns symbol table entry by its reference.
+func (r *WriteV2Request) symbol(ref uint32) (string, error) {
+	if int(ref) >= len(r.Symbols) {
+		return "", fmt.Errorf("symbol reference %d is out of range of symbols table of size %d", ref, len(r.Symbols))
+	}
+	return r.Symbols[ref], nil
+}
+
+// labels resolves series labels using request symbols table.
+func (r *WriteV2Request) labels(ts *WriteV2TimeSeries) (model.Metric, error) {
+	if len(ts.LabelsRefs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of label references: %d", len(ts.LabelsRefs))
+	}
+
+	metric := make(model.Metric, len(ts.LabelsRefs)/2)
+	for i := 0; i < len(ts.LabelsRefs); i += 2 {
+		name, err := r.symbol(ts.LabelsRefs[i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.symbol(ts.LabelsRefs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		metric[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return metric, nil
+}
+
+// CreatedTimestampConfig configures injection of zero samples at created timestamps of remote write 2.0 counters,
+// so counter reset is visible even if the first samples after it are lost or dropped by counter rate conversion.
+type CreatedTimestampConfig struct {
+	Enabled bool `default:"false"`
+	// TTL is a time after which series which has no new samples is forgotten.
+	// Zero sample is not injected for created timestamp older than TTL, e.g. after restart.
+	TTL time.Duration `default:"10m"`
+	// MaxSeries is a max number of tracked series. Zero samples are not injected for new series once it is reached.
+	MaxSeries int `default:"500000" split_words:"true"`
+}
+
+func NewCreatedTimestampConfig() (*CreatedTimestampConfig, error) {
+	config := &CreatedTimestampConfig{}
+	if err := envconfig.Process("ANODOT_CREATED_TIMESTAMP", config); err != nil {
+		return nil, err
+	}
+
+	if config.TTL <= 0 {
+		return nil, fmt.Errorf("created timestamp TTL should be positive, got: %s", config.TTL)
+	}
+	if config.MaxSeries <= 0 {
+		return nil, fmt.Errorf("created timestamp max series should be positive, got: %d", config.MaxSeries)
+	}
+	return config, nil
+}
+
+type createdTimestamp struct {
+	ts       int64
+	lastSeen time.Time
+}
+
+// CreatedTimestamps injects zero sample at created timestamp of counter series. Remote write 2.0 sends created
+// timestamp with every request, so the last one of every series is tracked to inject zero sample once per reset.
+type CreatedTimestamps struct {
+	config *CreatedTimestampConfig
+
+	mu        sync.Mutex
+	series    map[string]*createdTimestamp
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func NewCreatedTimestamps(config *CreatedTimestampConfig) *CreatedTimestamps {
+	return &CreatedTimestamps{config: config, series: make(map[string]*createdTimestamp), now: time.Now}
+}
+
+// zeroSample returns zero sample at created timestamp of counter series if it was not returned before.
+func (c *CreatedTimestamps) zeroSample(metric model.Metric, ts *WriteV2TimeSeries) *model.Sample {
+	if c == nil || ts.CreatedTimestamp == 0 || ts.Metadata.Type != MetricTypeCounter || len(ts.Samples) == 0 {
+		return nil
+	}
+	if ts.CreatedTimestamp >= ts.Samples[0].Timestamp {
+		return nil
+	}
+
+	key := metric.String()
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+
+	prev, ok := c.series[key]
+	if ok {
+		prev.lastSeen = now
+		if prev.ts == ts.CreatedTimestamp {
+			return nil
+		}
+		prev.ts = ts.CreatedTimestamp
+	} else {
+		if len(c.series) >= c.config.MaxSeries {
+			createdTimestampZeroSamples.WithLabelValues("max_series").Inc()
+			return nil
+		}
+		c.series[key] = &createdTimestamp{ts: ts.CreatedTimestamp, lastSeen: now}
+		createdTimestampSeries.Inc()
+
+		// series was created before it was seen for the first time, zero sample may already be sent
+		if model.Time(ts.Samples[0].Timestamp).Sub(model.Time(ts.CreatedTimestamp)) > c.config.TTL {
+			createdTimestampZeroSamples.WithLabelValues("too_old").Inc()
+			return nil
+		}
+	}
+
+	createdTimestampZeroSamples.WithLabelValues("injected").Inc()
+	return &model.Sample{Metric: metric, Value: 0, Timestamp: model.Time(ts.CreatedTimestamp)}
+}
+
+// sweep forgets series which were not seen during TTL. Must be called with c.mu held.
+func (c *CreatedTimestamps) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.config.TTL/2 {
+		return
+	}
+	c.lastSweep = now
+
+	for key, s := range c.series {
+		if now.Sub(s.lastSeen) > c.config.TTL {
+			delete(c.series, key)
+			createdTimestampSeries.Dec()
+		}
+	}
+}
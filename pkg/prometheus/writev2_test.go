@@ -0,0 +1,181 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRemoteWriteProtoMsg(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+		isValid     bool
+	}{
+		{"", RemoteWriteV1Proto, true},
+		{"application/x-protobuf", RemoteWriteV1Proto, true},
+		{"application/x-protobuf;proto=prometheus.WriteRequest", RemoteWriteV1Proto, true},
+		{"application/x-protobuf;proto=io.prometheus.write.v2.Request", RemoteWriteV2Proto, true},
+		{"application/x-protobuf; proto=io.prometheus.write.v2.Request", RemoteWriteV2Proto, true},
+		{"application/x-protobuf;proto=io.prometheus.write.v3.Request", "", false},
+		{"application/json", "", false},
+		{";;", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			got, err := remoteWriteProtoMsg(tt.contentType)
+			if (err == nil) != tt.isValid {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("Wrong protobuf message type \n got: %q\n want: %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteV2RequestToSamples(t *testing.T) {
+	symbols := []string{"", "__name__", "http_requests_total", "job", "api", "help text"}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(42))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, 1574693483000)
+
+	var refs []byte
+	for _, r := range []uint64{1, 2, 3, 4} {
+		refs = protowire.AppendVarint(refs, r)
+	}
+
+	var metadata []byte
+	metadata = protowire.AppendTag(metadata, 1, protowire.VarintType)
+	metadata = protowire.AppendVarint(metadata, uint64(MetricTypeCounter))
+	metadata = protowire.AppendTag(metadata, 3, protowire.VarintType)
+	metadata = protowire.AppendVarint(metadata, 5)
+
+	var ts []byte
+	ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, refs)
+	ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, sample)
+	ts = protowire.AppendTag(ts, 5, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, metadata)
+	ts = protowire.AppendTag(ts, 6, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 1574693000000)
+
+	var body []byte
+	for _, s := range symbols {
+		body = protowire.AppendTag(body, 4, protowire.BytesType)
+		body = protowire.AppendString(body, s)
+	}
+	body = protowire.AppendTag(body, 5, protowire.BytesType)
+	body = protowire.AppendBytes(body, ts)
+
+	var req WriteV2Request
+	if err := req.Unmarshal(body); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.Timeseries) != 1 {
+		t.Fatalf("unexpected number of timeseries: %d", len(req.Timeseries))
+	}
+	series := req.Timeseries[0]
+	if series.Metadata.Type != MetricTypeCounter || series.Metadata.HelpRef != 5 {
+		t.Fatalf("wrong metadata: %+v", series.Metadata)
+	}
+	if series.CreatedTimestamp != 1574693000000 {
+		t.Fatalf("wrong created timestamp: %d", series.CreatedTimestamp)
+	}
+
+	receiver := Receiver{}
+	samples, stats, err := receiver.protoV2ToSamples(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 1 || stats.samples != 1 {
+		t.Fatalf("unexpected number of samples: %d", len(samples))
+	}
+
+	expected := model.Metric{model.MetricNameLabel: "http_requests_total", "job": "api"}
+	if !samples[0].Metric.Equal(expected) {
+		t.Fatalf("Wrong labels \n got: %s\n want: %s", samples[0].Metric, expected)
+	}
+	if samples[0].Value != 42 || samples[0].Timestamp != 1574693483000 {
+		t.Fatalf("wrong sample: %s", samples[0])
+	}
+}
+
+func TestWriteV2RequestInvalidSymbolRef(t *testing.T) {
+	req := WriteV2Request{
+		Symbols:    []string{"", "__name__"},
+		Timeseries: []WriteV2TimeSeries{{LabelsRefs: []uint32{1, 2}, Samples: []WriteV2Sample{{Value: 1}}}},
+	}
+
+	receiver := Receiver{}
+	_, _, err := receiver.protoV2ToSamples(&req)
+	if err == nil {
+		t.Fatalf("error should be returned for out of range symbol reference")
+	}
+
+	req.Timeseries[0].LabelsRefs = []uint32{1}
+	_, _, err = receiver.protoV2ToSamples(&req)
+	if err == nil {
+		t.Fatalf("error should be returned for odd number of label references")
+	}
+}
+
+func TestCreatedTimestampsZeroSample(t *testing.T) {
+	c := NewCreatedTimestamps(&CreatedTimestampConfig{TTL: 10 * time.Minute, MaxSeries: 1})
+	now := time.Unix(1574693483, 0)
+	c.now = func() time.Time { return now }
+
+	metric := model.Metric{model.MetricNameLabel: "http_requests_total"}
+	series := &WriteV2TimeSeries{
+		Samples:          []WriteV2Sample{{Value: 1, Timestamp: 1574693483000}},
+		Metadata:         WriteV2Metadata{Type: MetricTypeCounter},
+		CreatedTimestamp: 1574693480000,
+	}
+
+	zero := c.zeroSample(metric, series)
+	if zero == nil || zero.Value != 0 || zero.Timestamp != 1574693480000 || !zero.Metric.Equal(metric) {
+		t.Fatalf("Wrong zero sample \n got: %v\n want: %s", zero, `http_requests_total => 0 @[1574693480]`)
+	}
+	if zero := c.zeroSample(metric, series); zero != nil {
+		t.Fatalf("Zero sample should be injected once per created timestamp \n got: %v", zero)
+	}
+
+	// counter is reset
+	series.CreatedTimestamp = 1574693482000
+	if zero := c.zeroSample(metric, series); zero == nil || zero.Timestamp != 1574693482000 {
+		t.Fatalf("Zero sample should be injected after reset \n got: %v", zero)
+	}
+
+	other := model.Metric{model.MetricNameLabel: "other_total"}
+	if zero := c.zeroSample(other, series); zero != nil {
+		t.Fatalf("Zero sample should not be injected once max series is reached \n got: %v", zero)
+	}
+
+	series.Metadata.Type = MetricTypeGauge
+	series.CreatedTimestamp = 1574693481000
+	if zero := c.zeroSample(metric, series); zero != nil {
+		t.Fatalf("Zero sample should be injected for counters only \n got: %v", zero)
+	}
+}
+
+func TestCreatedTimestampsTooOld(t *testing.T) {
+	c := NewCreatedTimestamps(&CreatedTimestampConfig{TTL: 10 * time.Minute, MaxSeries: 10})
+	series := &WriteV2TimeSeries{
+		Samples:          []WriteV2Sample{{Value: 1, Timestamp: 1574693483000}},
+		Metadata:         WriteV2Metadata{Type: MetricTypeCounter},
+		CreatedTimestamp: 1574693483000 - int64(time.Hour/time.Millisecond),
+	}
+	if zero := c.zeroSample(model.Metric{model.MetricNameLabel: "http_requests_total"}, series); zero != nil {
+		t.Fatalf("Zero sample should not be injected for series created long before it was seen \n got: %v", zero)
+	}
+}
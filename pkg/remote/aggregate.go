@@ -0,0 +1,325 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+)
+
+// Aggregation functions applied to samples of series within time bucket.
+const (
+	AggregateLast = "last"
+	AggregateAvg  = "avg"
+	AggregateSum  = "sum"
+	AggregateMax  = "max"
+	AggregateMin  = "min"
+)
+
+// aggregationFlushPeriod is how often closed buckets are checked.
+const aggregationFlushPeriod = time.Second
+
+var (
+	aggregatedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_aggregated_samples_total",
+		Help: "Total number of samples aggregated into time buckets",
+	}, labels)
+
+	aggregationLateSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_aggregation_late_samples_total",
+		Help: "Total number of samples dropped because their time bucket was already sent",
+	}, labels)
+
+	aggregationRejectedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_aggregation_rejected_samples_total",
+		Help: "Total number of samples dropped because they are too far in the future or max number of open time buckets is reached",
+	}, append(labels, "reason"))
+
+	aggregationSeries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_aggregation_open_series",
+		Help: "Number of series in time buckets which are not sent yet",
+	}, labels)
+)
+
+// AggregationRuleConfig applies Function to metrics which name matches Match regular expression.
+type AggregationRuleConfig struct {
+	Match    string `yaml:"match"`
+	Function string `yaml:"function"`
+}
+
+type AggregationConfig struct {
+	// Interval is a size of time buckets, aligned to Unix epoch.
+	Interval time.Duration `yaml:"interval"`
+	// GracePeriod is a time after bucket end during which late samples are still aggregated.
+	GracePeriod time.Duration `yaml:"grace_period,omitempty"`
+	// MaxBuckets limits number of open time buckets. Defaults to number of buckets within grace period, current
+	// and the next one.
+	MaxBuckets int `yaml:"max_buckets,omitempty"`
+	// Default function is applied to metrics not matching any rule.
+	Default string                  `yaml:"default,omitempty"`
+	Rules   []AggregationRuleConfig `yaml:"rules,omitempty"`
+}
+
+func LoadAggregationConfig(path string) (*AggregationConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AggregationConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", path)
+	}
+
+	if config.Default == "" {
+		config.Default = AggregateLast
+	}
+	if _, err := newAggregationRules(&config); err != nil {
+		return nil, fmt.Errorf("invalid aggregation config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+type aggregationRule struct {
+	match    *regexp.Regexp
+	function string
+}
+
+func newAggregationRules(config *AggregationConfig) ([]aggregationRule, error) {
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("aggregation interval should be positive")
+	}
+	if config.GracePeriod < 0 {
+		return nil, fmt.Errorf("aggregation grace period should not be negative")
+	}
+	if config.MaxBuckets < 0 {
+		return nil, fmt.Errorf("aggregation max buckets should not be negative")
+	}
+	if err := checkAggregationFunction(config.Default); err != nil {
+		return nil, err
+	}
+
+	rules := make([]aggregationRule, 0, len(config.Rules))
+	for _, r := range config.Rules {
+		if err := checkAggregationFunction(r.Function); err != nil {
+			return nil, err
+		}
+		// anchored as Prometheus label matchers
+		match, err := regexp.Compile("^(?:" + r.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation rule %q: %w", r.Match, err)
+		}
+		rules = append(rules, aggregationRule{match: match, function: r.Function})
+	}
+	return rules, nil
+}
+
+func checkAggregationFunction(f string) error {
+	switch f {
+	case AggregateLast, AggregateAvg, AggregateSum, AggregateMax, AggregateMin:
+		return nil
+	default:
+		return fmt.Errorf("unsupported aggregation function %q", f)
+	}
+}
+
+type aggregate struct {
+	metric   metrics.Anodot20Metric
+	function string
+	// timestamp of the latest sample, used by last function
+	last  time.Time
+	value float64
+	count int
+}
+
+func (a *aggregate) add(m metrics.Anodot20Metric) {
+	a.count++
+	switch a.function {
+	case AggregateSum, AggregateAvg:
+		a.value += m.Value
+	case AggregateMax:
+		a.value = math.Max(a.value, m.Value)
+	case AggregateMin:
+		a.value = math.Min(a.value, m.Value)
+	case AggregateLast:
+		if m.Timestamp.Before(a.last) {
+			return
+		}
+		a.value = m.Value
+	}
+	if !m.Timestamp.Before(a.last) {
+		a.last = m.Timestamp.Time
+		a.metric.Tags = m.Tags
+	}
+}
+
+func (a *aggregate) result() float64 {
+	if a.function == AggregateAvg {
+		return a.value / float64(a.count)
+	}
+	return a.value
+}
+
+// Aggregator rolls samples of every series up into time buckets, and releases buckets once their grace period ends.
+// Aggregated metric has timestamp of its bucket start. Samples later than the next bucket are dropped, so number of
+// open buckets is bounded.
+type Aggregator struct {
+	config     *AggregationConfig
+	rules      []aggregationRule
+	labels     []string
+	maxBuckets int
+
+	mu sync.Mutex
+	// buckets by start time, series in bucket are identified by their properties
+	buckets map[int64]map[string]*aggregate
+	series  int
+}
+
+func NewAggregator(config *AggregationConfig, labelValues []string) (*Aggregator, error) {
+	rules, err := newAggregationRules(config)
+	if err != nil {
+		return nil, err
+	}
+	maxBuckets := config.MaxBuckets
+	if maxBuckets == 0 {
+		maxBuckets = int(config.GracePeriod/config.Interval) + 3
+	}
+	return &Aggregator{config: config, rules: rules, labels: labelValues, maxBuckets: maxBuckets, buckets: make(map[int64]map[string]*aggregate)}, nil
+}
+
+func (a *Aggregator) function(name string) string {
+	for _, r := range a.rules {
+		if r.match.MatchString(name) {
+			return r.function
+		}
+	}
+	return a.config.Default
+}
+
+// closedBefore returns start of the oldest bucket which is still open.
+func (a *Aggregator) closedBefore(now time.Time) time.Time {
+	return now.Add(-a.config.GracePeriod).Truncate(a.config.Interval)
+}
+
+// Add aggregates metrics into their buckets. Metrics of already closed buckets, metrics later than the next bucket and
+// metrics of new buckets exceeding max number of buckets are dropped.
+func (a *Aggregator) Add(data []metrics.Anodot20Metric, now time.Time) {
+	closed := a.closedBefore(now)
+	// samples of the next bucket are accepted, so clock skew of clients does not drop them
+	future := now.Truncate(a.config.Interval).Add(2 * a.config.Interval)
+	late, rejected := 0, make(map[string]int)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, m := range data {
+		start := m.Timestamp.Truncate(a.config.Interval)
+		if start.Before(closed) {
+			late++
+			continue
+		}
+		if !start.Before(future) {
+			rejected["future"]++
+			continue
+		}
+
+		bucket, ok := a.buckets[start.UnixNano()]
+		if !ok {
+			if len(a.buckets) >= a.maxBuckets {
+				rejected["max_buckets"]++
+				continue
+			}
+			bucket = make(map[string]*aggregate)
+			a.buckets[start.UnixNano()] = bucket
+		}
+
+		key := seriesKey(m.Properties)
+		agg, ok := bucket[key]
+		if !ok {
+			function := a.function(m.Properties[whatProperty])
+			agg = &aggregate{
+				metric:   metrics.Anodot20Metric{Properties: m.Properties, Timestamp: metrics.AnodotTimestamp{Time: start}},
+				function: function,
+				value:    m.Value,
+				count:    1,
+				last:     m.Timestamp.Time,
+			}
+			agg.metric.Tags = m.Tags
+			bucket[key] = agg
+			a.series++
+			continue
+		}
+		agg.add(m)
+	}
+
+	aggregatedSamples.WithLabelValues(a.labels...).Add(float64(len(data) - late - rejected["future"] - rejected["max_buckets"]))
+	if late > 0 {
+		aggregationLateSamples.WithLabelValues(a.labels...).Add(float64(late))
+	}
+	for reason, n := range rejected {
+		aggregationRejectedSamples.WithLabelValues(append(a.labels, reason)...).Add(float64(n))
+	}
+	aggregationSeries.WithLabelValues(a.labels...).Set(float64(a.series))
+}
+
+// Flush returns aggregated metrics of buckets closed by now, oldest bucket first.
+func (a *Aggregator) Flush(now time.Time) []metrics.Anodot20Metric {
+	return a.flush(a.closedBefore(now))
+}
+
+// FlushAll returns aggregated metrics of all buckets, including open ones.
+func (a *Aggregator) FlushAll() []metrics.Anodot20Metric {
+	return a.flush(time.Unix(0, math.MaxInt64))
+}
+
+func (a *Aggregator) flush(closed time.Time) []metrics.Anodot20Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var starts []int64
+	for start := range a.buckets {
+		if start < closed.UnixNano() {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var res []metrics.Anodot20Metric
+	for _, start := range starts {
+		for _, agg := range a.buckets[start] {
+			m := agg.metric
+			m.Value = agg.result()
+			res = append(res, m)
+		}
+		a.series -= len(a.buckets[start])
+		delete(a.buckets, start)
+	}
+	aggregationSeries.WithLabelValues(a.labels...).Set(float64(a.series))
+	return res
+}
+
+func seriesKey(properties map[string]string) string {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0xff)
+		b.WriteString(properties[k])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
@@ -0,0 +1,234 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+func aggregationSample(name string, pod string, ts time.Time, value float64) metrics.Anodot20Metric {
+	return metrics.Anodot20Metric{Properties: map[string]string{"what": name, "pod": pod}, Timestamp: metrics.AnodotTimestamp{Time: ts}, Value: value}
+}
+
+func TestAggregatorFunctions(t *testing.T) {
+	config := &AggregationConfig{
+		Interval:    time.Minute,
+		GracePeriod: 30 * time.Second,
+		Default:     AggregateLast,
+		Rules: []AggregationRuleConfig{
+			{Match: ".*_total", Function: AggregateSum},
+			{Match: "cpu_.*", Function: AggregateAvg},
+			{Match: "max_.*", Function: AggregateMax},
+			{Match: "min_.*", Function: AggregateMin},
+		},
+	}
+	a, err := NewAggregator(config, []string{"127.0.0.1", DefaultTenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := time.Unix(1574693460, 0)
+	var data []metrics.Anodot20Metric
+	// samples are out of order, the last one by timestamp is sent by last function
+	for i, v := range []float64{3, 1, 2, 4} {
+		ts := bucket.Add(time.Duration((i+1)%4) * 15 * time.Second)
+		for _, name := range []string{"requests_total", "cpu_usage", "max_latency", "min_latency", "memory_bytes"} {
+			data = append(data, aggregationSample(name, "a", ts, v))
+		}
+	}
+	a.Add(data, bucket.Add(45*time.Second))
+	// the next bucket is not closed yet
+	a.Add([]metrics.Anodot20Metric{aggregationSample("memory_bytes", "a", bucket.Add(time.Minute), 10)}, bucket.Add(70*time.Second))
+
+	if got := a.Flush(bucket.Add(89 * time.Second)); len(got) != 0 {
+		t.Fatal(fmt.Sprintf("Bucket should not be flushed during grace period \n got: %v", got))
+	}
+
+	got := make(map[string]float64)
+	for _, m := range a.Flush(bucket.Add(90 * time.Second)) {
+		if !m.Timestamp.Equal(bucket) {
+			t.Fatal(fmt.Sprintf("Wrong timestamp of aggregated metric \n got: %s\n want: %s", m.Timestamp, bucket))
+		}
+		got[m.Properties["what"]] = m.Value
+	}
+	want := map[string]float64{"requests_total": 10, "cpu_usage": 2.5, "max_latency": 4, "min_latency": 1, "memory_bytes": 2}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong aggregated values \n got: %v\n want: %v", got, want))
+	}
+
+	// sample of flushed bucket is late
+	a.Add([]metrics.Anodot20Metric{aggregationSample("memory_bytes", "a", bucket.Add(59*time.Second), 1)}, bucket.Add(91*time.Second))
+	rest := a.FlushAll()
+	if len(rest) != 1 || rest[0].Value != 10 {
+		t.Fatal(fmt.Sprintf("Only open bucket should be left \n got: %v", rest))
+	}
+}
+
+func TestAggregatorSeries(t *testing.T) {
+	a, err := NewAggregator(&AggregationConfig{Interval: time.Minute, Default: AggregateSum}, []string{"127.0.0.1", DefaultTenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := time.Unix(1574693460, 0)
+	a.Add([]metrics.Anodot20Metric{
+		aggregationSample("requests_total", "a", bucket, 1),
+		aggregationSample("requests_total", "b", bucket, 2),
+		aggregationSample("requests_total", "a", bucket.Add(time.Second), 3),
+	}, bucket)
+
+	var got []string
+	for _, m := range a.FlushAll() {
+		got = append(got, fmt.Sprintf("%s=%v", m.Properties["pod"], m.Value))
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[a=4 b=2]" {
+		t.Fatal(fmt.Sprintf("Series should be aggregated separately \n got: %v\n want: %v", got, "[a=4 b=2]"))
+	}
+}
+
+func TestAggregatorBuckets(t *testing.T) {
+	a, err := NewAggregator(&AggregationConfig{Interval: time.Minute, Default: AggregateSum, MaxBuckets: 2}, []string{"127.0.0.1", DefaultTenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := time.Unix(1574693460, 0)
+	a.Add([]metrics.Anodot20Metric{
+		aggregationSample("requests_total", "a", bucket, 1),
+		// samples of the next bucket are aggregated, later ones are dropped
+		aggregationSample("requests_total", "a", bucket.Add(time.Minute), 2),
+		aggregationSample("requests_total", "a", bucket.Add(2*time.Minute), 3),
+		aggregationSample("requests_total", "a", bucket.Add(24*time.Hour), 4),
+	}, bucket.Add(10*time.Second))
+	if len(a.buckets) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong number of open buckets \n got: %d\n want: 2", len(a.buckets)))
+	}
+
+	// a new bucket is not opened once max number of buckets is reached
+	a.Add([]metrics.Anodot20Metric{aggregationSample("requests_total", "a", bucket.Add(2*time.Minute), 5)}, bucket.Add(70*time.Second))
+	if len(a.buckets) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong number of open buckets \n got: %d\n want: 2", len(a.buckets)))
+	}
+
+	var got []float64
+	for _, m := range a.FlushAll() {
+		got = append(got, m.Value)
+	}
+	sort.Float64s(got)
+	if fmt.Sprint(got) != "[1 2]" {
+		t.Fatal(fmt.Sprintf("Only samples of open buckets should be aggregated \n got: %v\n want: %v", got, "[1 2]"))
+	}
+
+	if a, _ := NewAggregator(&AggregationConfig{Interval: time.Minute, GracePeriod: 5 * time.Minute, Default: AggregateSum}, nil); a.maxBuckets != 8 {
+		t.Fatal(fmt.Sprintf("Wrong default max buckets \n got: %d\n want: 8", a.maxBuckets))
+	}
+}
+
+func TestLoadAggregationConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aggregation.yml")
+
+	tests := []struct {
+		content string
+		valid   bool
+	}{
+		{"interval: 1m\ngrace_period: 30s\nrules:\n  - match: .*_total\n    function: sum\n", true},
+		{"grace_period: 30s\n", false},
+		{"interval: 1m\ndefault: median\n", false},
+		{"interval: 1m\nrules:\n  - match: \"(\"\n    function: sum\n", false},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadAggregationConfig(path)
+		if (err == nil) != tt.valid {
+			t.Fatal(fmt.Sprintf("Wrong validation of %q \n got: %v\n want valid: %v", tt.content, err, tt.valid))
+		}
+		if err == nil && config.Default != AggregateLast {
+			t.Fatal(fmt.Sprintf("Wrong default function \n got: %s\n want: %s", config.Default, AggregateLast))
+		}
+	}
+}
+
+func TestWorkerAggregationBufferFull(t *testing.T) {
+	config := &WorkerConfig{MetricsPerRequestSize: 1000, MaxBufferSize: 1, OverflowPolicy: OverflowDropNewest,
+		Aggregation: &AggregationConfig{Interval: time.Minute, Default: AggregateSum}}
+	worker := bufferTestWorker(t, config, noopSubmitter())
+
+	now := time.Now()
+	if err := worker.Do([]metrics.Anodot20Metric{aggregationSample("requests_total", "a", now, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.enqueue(worker.aggregator.FlushAll()); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.Do([]metrics.Anodot20Metric{aggregationSample("requests_total", "a", now, 1)}); err != ErrBufferFull {
+		t.Fatal(fmt.Sprintf("Wrong error \n got: %v\n want: %v", err, ErrBufferFull))
+	}
+
+	config.Queue = &QueueConfig{Dir: os.TempDir()}
+	if _, err := NewWorker(noopSubmitter(), config); err == nil {
+		t.Fatal("error should be returned for aggregation with disk queue")
+	}
+}
+
+func TestWorkerAggregationBlockOnStop(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	submitter := MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		mu.Lock()
+		sent += len(data)
+		mu.Unlock()
+		return nil, nil
+	}}
+	config := &WorkerConfig{MetricsPerRequestSize: 1, MaxBufferSize: 1, OverflowPolicy: OverflowBlock, BlockTimeout: time.Minute,
+		Aggregation: &AggregationConfig{Interval: time.Minute, Default: AggregateSum}}
+	worker := bufferTestWorker(t, config, submitter)
+
+	now := time.Now()
+	for _, pod := range []string{"a", "b", "c"} {
+		if err := worker.Do([]metrics.Anodot20Metric{aggregationSample("requests_total", pod, now, 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	worker.SetStopWg(&wg)
+	worker.FlushBuffer <- true
+	worker.Done <- true
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker should not wait for buffer room while sending open time buckets on stop")
+	}
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		s := sent
+		mu.Unlock()
+		if s == 3 {
+			return
+		}
+	}
+	t.Fatal(fmt.Sprintf("All aggregated metrics should be sent \n got: %d\n want: 3", sent))
+}
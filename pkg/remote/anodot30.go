@@ -0,0 +1,373 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	// whatProperty holds metric name of Anodot 2.0 metrics, it is sent as measurement name in Anodot 3.0.
+	whatProperty = "what"
+
+	defaultMeasurementAggregation = "average"
+	defaultMeasurementCountBy     = "none"
+)
+
+var (
+	unmatchedSchemaMetrics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_remote_write_schema_unmatched_metrics_total",
+		Help: "Total number of metrics dropped because no Anodot 3.0 schema has their measurement",
+	})
+
+	watermarksSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_watermarks_total",
+		Help: "Total number of Anodot 3.0 watermarks sent",
+	}, []string{"schema", "status"})
+)
+
+// MeasurementConfig is a measurement of Anodot 3.0 schema. Name is a Prometheus metric name.
+type MeasurementConfig struct {
+	Name string `yaml:"name"`
+	// Aggregation is either 'average' or 'sum'.
+	Aggregation string `yaml:"aggregation,omitempty"`
+	CountBy     string `yaml:"count_by,omitempty"`
+	Units       string `yaml:"units,omitempty"`
+}
+
+type SchemaConfig struct {
+	Name string `yaml:"name"`
+	// Dimensions are metric labels which identify series of the schema. Other labels are not sent.
+	Dimensions   []string            `yaml:"dimensions"`
+	Measurements []MeasurementConfig `yaml:"measurements"`
+	// MissingDimensionFill is a value of dimensions missing in metric labels. Anodot default policy is used if empty.
+	MissingDimensionFill string `yaml:"missing_dimension_fill,omitempty"`
+}
+
+type SchemasConfig struct {
+	// Bucket is a time bucket of schemas. Watermark of every schema is sent once bucket is closed.
+	Bucket time.Duration `yaml:"bucket,omitempty"`
+	// WatermarkDelay is a time after bucket end during which its samples still may be sent.
+	WatermarkDelay time.Duration  `yaml:"watermark_delay,omitempty"`
+	Schemas        []SchemaConfig `yaml:"schemas"`
+}
+
+func LoadSchemasConfig(path string) (*SchemasConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config SchemasConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", path)
+	}
+
+	if config.Bucket == 0 {
+		config.Bucket = time.Minute
+	}
+	if config.WatermarkDelay == 0 {
+		config.WatermarkDelay = 2 * time.Minute
+	}
+	if config.Bucket < 0 || config.WatermarkDelay < 0 {
+		return nil, fmt.Errorf("schemas bucket and watermark delay should be positive in %s", path)
+	}
+	if len(config.Schemas) == 0 {
+		return nil, fmt.Errorf("at least one schema should be specified in %s", path)
+	}
+
+	measurements := make(map[string]string)
+	for i, s := range config.Schemas {
+		if s.Name == "" {
+			return nil, fmt.Errorf("schema name should be specified in %s", path)
+		}
+		if len(s.Measurements) == 0 {
+			return nil, fmt.Errorf("schema %q should have at least one measurement", s.Name)
+		}
+		for j, m := range s.Measurements {
+			if m.Name == "" {
+				return nil, fmt.Errorf("measurement name should be specified in schema %q", s.Name)
+			}
+			if schema, ok := measurements[m.Name]; ok {
+				return nil, fmt.Errorf("measurement %q is used in schemas %q and %q", m.Name, schema, s.Name)
+			}
+			measurements[m.Name] = s.Name
+
+			if m.Aggregation == "" {
+				config.Schemas[i].Measurements[j].Aggregation = defaultMeasurementAggregation
+			}
+			if m.CountBy == "" {
+				config.Schemas[i].Measurements[j].CountBy = defaultMeasurementCountBy
+			}
+		}
+	}
+	return &config, nil
+}
+
+func (c *SchemaConfig) anodotSchema() metrics3.AnodotMetricsSchema {
+	schema := metrics3.AnodotMetricsSchema{
+		Name:         c.Name,
+		Dimensions:   c.Dimensions,
+		Measurements: make(map[string]metrics3.MeasurmentBase, len(c.Measurements)),
+	}
+	for _, m := range c.Measurements {
+		schema.Measurements[m.Name] = metrics3.MeasurmentBase{Aggregation: m.Aggregation, CountBy: m.CountBy, Units: m.Units}
+	}
+	if c.MissingDimensionFill != "" {
+		schema.MissingDimPolicy = &metrics3.DimensionPolicy{Action: "fill", Fill: c.MissingDimensionFill}
+	}
+	return schema
+}
+
+type anodotSchema struct {
+	id     string
+	config SchemaConfig
+}
+
+// Anodot30Client is a part of metrics3.Anodot30Client used to send metrics.
+type Anodot30Client interface {
+	GetSchemas() (*metrics3.GetSchemaResponse, error)
+	CreateSchema(schema metrics3.AnodotMetricsSchema) (*metrics3.CreateSchemaResponse, error)
+	SubmitMetrics(metrics []metrics3.AnodotMetrics30) (*metrics3.SubmitMetricsResponse, error)
+	SubmitWatermark(schemaId string, watermark metrics3.AnodotTimestamp) (*metrics3.SubmitWatermarkResponse, error)
+}
+
+// Anodot30Submitter sends metrics to Anodot 3.0 API as measurements of schemas. Metric is sent with schema which has
+// measurement named as metric, and its dimensions are taken from metric properties.
+type Anodot30Submitter struct {
+	client    Anodot30Client
+	serverURL *url.URL
+	config    *SchemasConfig
+
+	// schemas by measurement name
+	schemas map[string]*anodotSchema
+
+	mu        sync.Mutex
+	watermark time.Time
+}
+
+// NewAnodot30Submitter looks up schemas from config by name in Anodot, and creates those which do not exist yet.
+func NewAnodot30Submitter(anodotURL url.URL, client Anodot30Client, config *SchemasConfig) (*Anodot30Submitter, error) {
+	resp, err := client.GetSchemas()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Anodot schemas: %w", err)
+	}
+	if resp.HasErrors() {
+		return nil, fmt.Errorf("failed to get Anodot schemas: %s", resp.ErrorMessage())
+	}
+
+	existing := make(map[string]metrics3.AnodotMetricsSchema, len(resp.Schemas))
+	for _, s := range resp.Schemas {
+		existing[s.Name] = s
+	}
+
+	s := &Anodot30Submitter{client: client, serverURL: &anodotURL, config: config, schemas: make(map[string]*anodotSchema)}
+	for _, sc := range config.Schemas {
+		schema := &anodotSchema{config: sc}
+		if e, ok := existing[sc.Name]; ok {
+			schema.id = e.Id
+			if !sameSchema(e, sc.anodotSchema()) {
+				log.Warningf("Anodot schema %q differs from configured one, schema %s is used as is", sc.Name, e.Id)
+			}
+		} else {
+			created, err := client.CreateSchema(sc.anodotSchema())
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Anodot schema %q: %w", sc.Name, err)
+			}
+			if created.HasErrors() || created.SchemaId == nil {
+				return nil, fmt.Errorf("failed to create Anodot schema %q: %s", sc.Name, created.ErrorMessage())
+			}
+			schema.id = *created.SchemaId
+			log.Infof("Anodot schema %q is created with id %s", sc.Name, schema.id)
+		}
+
+		for _, m := range sc.Measurements {
+			s.schemas[m.Name] = schema
+		}
+	}
+	return s, nil
+}
+
+func sameSchema(a, b metrics3.AnodotMetricsSchema) bool {
+	if len(a.Measurements) != len(b.Measurements) || len(a.Dimensions) != len(b.Dimensions) {
+		return false
+	}
+	for name, m := range b.Measurements {
+		if am, ok := a.Measurements[name]; !ok || am.Aggregation != m.Aggregation {
+			return false
+		}
+	}
+	dims := make(map[string]bool, len(a.Dimensions))
+	for _, d := range a.Dimensions {
+		dims[d] = true
+	}
+	for _, d := range b.Dimensions {
+		if !dims[d] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Anodot30Submitter) AnodotURL() *url.URL {
+	return s.serverURL
+}
+
+// convert groups metrics into Anodot 3.0 metrics, one per schema, timestamp and dimensions, as long as their
+// measurements differ. It returns indexes of original metrics of every Anodot 3.0 metric.
+func (s *Anodot30Submitter) convert(data []metrics.Anodot20Metric) ([]metrics3.AnodotMetrics30, [][]int) {
+	var res []metrics3.AnodotMetrics30
+	var indexes [][]int
+	open := make(map[string]int)
+
+	for i, m := range data {
+		name := m.Properties[whatProperty]
+		schema, ok := s.schemas[name]
+		if !ok {
+			unmatchedSchemaMetrics.Inc()
+			log.V(4).Infof("Metric %q is dropped, it is not a measurement of any schema", name)
+			continue
+		}
+
+		dimensions := make(map[string]string, len(schema.config.Dimensions))
+		key := []string{schema.id, strconv.FormatInt(m.Timestamp.Unix(), 10)}
+		for _, d := range schema.config.Dimensions {
+			if v, ok := m.Properties[d]; ok {
+				dimensions[d] = v
+			}
+			key = append(key, dimensions[d])
+		}
+
+		k := strings.Join(key, "\xff")
+		if j, ok := open[k]; ok {
+			if _, duplicate := res[j].Measurements[name]; !duplicate {
+				res[j].Measurements[name] = m.Value
+				indexes[j] = append(indexes[j], i)
+				continue
+			}
+		}
+
+		tags := make(map[string][]string, len(m.Tags))
+		for k, v := range m.Tags {
+			tags[k] = []string{v}
+		}
+		open[k] = len(res)
+		res = append(res, metrics3.AnodotMetrics30{
+			SchemaId:     schema.id,
+			Timestamp:    metrics3.AnodotTimestamp{Time: m.Timestamp.Time},
+			Dimensions:   dimensions,
+			Measurements: map[string]float64{name: m.Value},
+			Tags:         tags,
+		})
+		indexes = append(indexes, []int{i})
+	}
+	return res, indexes
+}
+
+// SubmitMetrics converts metrics to Anodot 3.0 ones and sends them. Errors of rejected Anodot 3.0 metrics are
+// reported for every original metric it was made of.
+func (s *Anodot30Submitter) SubmitMetrics(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	converted, indexes := s.convert(data)
+	if len(converted) == 0 {
+		return &metrics.CreateResponse{}, nil
+	}
+
+	resp, err := s.client.SubmitMetrics(converted)
+	anodotResponse := &metrics.CreateResponse{}
+	if resp == nil {
+		return anodotResponse, err
+	}
+	anodotResponse.HttpResponse = resp.HttpResponse
+
+	for _, e := range resp.Errors {
+		i, convErr := strconv.Atoi(e.Index)
+		if convErr != nil || i < 0 || i >= len(indexes) {
+			anodotResponse.Errors = append(anodotResponse.Errors, e)
+			continue
+		}
+		for _, original := range indexes[i] {
+			e.Index = strconv.Itoa(original)
+			anodotResponse.Errors = append(anodotResponse.Errors, e)
+		}
+	}
+
+	if err != nil {
+		return anodotResponse, err
+	}
+	if resp.HttpResponse != nil && resp.HttpResponse.StatusCode/100 != 2 {
+		return anodotResponse, fmt.Errorf("http error: %d", resp.HttpResponse.StatusCode)
+	}
+	if anodotResponse.HasErrors() {
+		return anodotResponse, fmt.Errorf("%s", anodotResponse.ErrorMessage())
+	}
+	return anodotResponse, nil
+}
+
+// closedBucket returns end of the latest bucket which samples are not expected anymore.
+func (s *Anodot30Submitter) closedBucket(now time.Time) time.Time {
+	return now.Add(-s.config.WatermarkDelay).Truncate(s.config.Bucket)
+}
+
+// SendWatermarks sends watermark of every schema once its bucket is closed.
+func (s *Anodot30Submitter) SendWatermarks(now time.Time) {
+	watermark := s.closedBucket(now)
+
+	s.mu.Lock()
+	if !watermark.After(s.watermark) {
+		s.mu.Unlock()
+		return
+	}
+	s.watermark = watermark
+	s.mu.Unlock()
+
+	for _, sc := range s.config.Schemas {
+		schema := s.schemas[sc.Measurements[0].Name]
+		resp, err := s.client.SubmitWatermark(schema.id, metrics3.AnodotTimestamp{Time: watermark})
+		if err == nil && resp.HttpResponse != nil && resp.HttpResponse.StatusCode/100 != 2 {
+			err = fmt.Errorf("http error: %d", resp.HttpResponse.StatusCode)
+		}
+		if err == nil && resp.HasErrors() {
+			err = fmt.Errorf("%s", resp.ErrorMessage())
+		}
+		if resp != nil && resp.HttpResponse != nil && resp.HttpResponse.Body != nil {
+			_ = resp.HttpResponse.Body.Close()
+		}
+
+		if err != nil {
+			watermarksSent.WithLabelValues(sc.Name, "error").Inc()
+			log.Errorf("Failed to send watermark %s of schema %q: %v", watermark.UTC(), sc.Name, err)
+			continue
+		}
+		watermarksSent.WithLabelValues(sc.Name, "ok").Inc()
+	}
+}
+
+// Run sends watermarks as buckets are closed until ctx is done.
+func (s *Anodot30Submitter) Run(ctx context.Context) {
+	next := s.closedBucket(time.Now()).Add(s.config.Bucket).Add(s.config.WatermarkDelay)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			s.SendWatermarks(time.Now())
+			next = next.Add(s.config.Bucket)
+			timer.Reset(time.Until(next))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
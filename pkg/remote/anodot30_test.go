@@ -0,0 +1,211 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+)
+
+type mockAnodot30Client struct {
+	schemas    []metrics3.AnodotMetricsSchema
+	created    []metrics3.AnodotMetricsSchema
+	sent       []metrics3.AnodotMetrics30
+	rejected   []string
+	watermarks map[string][]time.Time
+}
+
+func (c *mockAnodot30Client) GetSchemas() (*metrics3.GetSchemaResponse, error) {
+	return &metrics3.GetSchemaResponse{Schemas: c.schemas}, nil
+}
+
+func (c *mockAnodot30Client) CreateSchema(schema metrics3.AnodotMetricsSchema) (*metrics3.CreateSchemaResponse, error) {
+	c.created = append(c.created, schema)
+	id := schema.Name + "-id"
+	return &metrics3.CreateSchemaResponse{SchemaId: &id}, nil
+}
+
+func (c *mockAnodot30Client) SubmitMetrics(data []metrics3.AnodotMetrics30) (*metrics3.SubmitMetricsResponse, error) {
+	c.sent = append(c.sent, data...)
+	resp := &metrics3.SubmitMetricsResponse{}
+	for _, index := range c.rejected {
+		resp.Errors = append(resp.Errors, struct {
+			Description string
+			Error       int64
+			Index       string
+		}{Description: "rejected", Error: 1001, Index: index})
+	}
+	return resp, nil
+}
+
+func (c *mockAnodot30Client) SubmitWatermark(schemaId string, watermark metrics3.AnodotTimestamp) (*metrics3.SubmitWatermarkResponse, error) {
+	if c.watermarks == nil {
+		c.watermarks = make(map[string][]time.Time)
+	}
+	c.watermarks[schemaId] = append(c.watermarks[schemaId], watermark.Time)
+	return &metrics3.SubmitWatermarkResponse{}, nil
+}
+
+var testSchemasConfig = &SchemasConfig{
+	Bucket:         time.Minute,
+	WatermarkDelay: 30 * time.Second,
+	Schemas: []SchemaConfig{
+		{
+			Name:       "http",
+			Dimensions: []string{"service", "code"},
+			Measurements: []MeasurementConfig{
+				{Name: "http_requests_total", Aggregation: "sum", CountBy: "none"},
+				{Name: "http_errors_total", Aggregation: "sum", CountBy: "none"},
+			},
+		},
+		{
+			Name:         "node",
+			Dimensions:   []string{"instance"},
+			Measurements: []MeasurementConfig{{Name: "node_load1", Aggregation: "average", CountBy: "none"}},
+		},
+	},
+}
+
+func TestLoadSchemasConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schemas.yml")
+	content := `
+watermark_delay: 1m
+schemas:
+  - name: http
+    dimensions: [service, code]
+    measurements:
+      - name: http_requests_total
+        aggregation: sum
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadSchemasConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SchemasConfig{
+		Bucket:         time.Minute,
+		WatermarkDelay: time.Minute,
+		Schemas: []SchemaConfig{{
+			Name:         "http",
+			Dimensions:   []string{"service", "code"},
+			Measurements: []MeasurementConfig{{Name: "http_requests_total", Aggregation: "sum", CountBy: "none"}},
+		}},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Fatal(fmt.Sprintf("Wrong schemas config \n got: %+v\n want: %+v", config, want))
+	}
+
+	duplicate := content + `  - name: other
+    measurements:
+      - name: http_requests_total
+`
+	if err := ioutil.WriteFile(path, []byte(duplicate), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSchemasConfig(path); err == nil {
+		t.Fatal("Measurement used in more than one schema should not be accepted")
+	}
+}
+
+func TestAnodot30SubmitterSchemas(t *testing.T) {
+	client := &mockAnodot30Client{schemas: []metrics3.AnodotMetricsSchema{testSchemasConfig.Schemas[0].anodotSchema()}}
+	client.schemas[0].Id = "existing-id"
+
+	s, err := NewAnodot30Submitter(url.URL{Scheme: "http", Host: "127.0.0.1"}, client, testSchemasConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.created) != 1 || client.created[0].Name != "node" {
+		t.Fatal(fmt.Sprintf("Only missing schema should be created \n got: %+v", client.created))
+	}
+	if s.schemas["http_errors_total"].id != "existing-id" || s.schemas["node_load1"].id != "node-id" {
+		t.Fatal(fmt.Sprintf("Wrong schema ids \n got: %s, %s", s.schemas["http_errors_total"].id, s.schemas["node_load1"].id))
+	}
+}
+
+func TestAnodot30SubmitterSubmitMetrics(t *testing.T) {
+	client := &mockAnodot30Client{}
+	s, err := NewAnodot30Submitter(url.URL{Scheme: "http", Host: "127.0.0.1"}, client, testSchemasConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := metrics.AnodotTimestamp{Time: time.Unix(1574693460, 0)}
+	data := []metrics.Anodot20Metric{
+		{Properties: map[string]string{"what": "http_requests_total", "service": "api", "code": "200", "pod": "a"}, Timestamp: ts, Value: 10},
+		{Properties: map[string]string{"what": "http_errors_total", "service": "api", "code": "200"}, Timestamp: ts, Value: 1},
+		{Properties: map[string]string{"what": "unknown"}, Timestamp: ts, Value: 1},
+		{Properties: map[string]string{"what": "node_load1", "instance": "n1"}, Timestamp: ts, Value: 0.5, Tags: map[string]string{"env": "prod"}},
+	}
+
+	client.rejected = []string{"0"}
+	resp, err := s.SubmitMetrics(data)
+	if err == nil {
+		t.Fatal("error of rejected metrics should be returned")
+	}
+
+	want := []metrics3.AnodotMetrics30{
+		{
+			SchemaId:     "http-id",
+			Timestamp:    metrics3.AnodotTimestamp{Time: ts.Time},
+			Dimensions:   map[string]string{"service": "api", "code": "200"},
+			Measurements: map[string]float64{"http_requests_total": 10, "http_errors_total": 1},
+			Tags:         map[string][]string{},
+		},
+		{
+			SchemaId:     "node-id",
+			Timestamp:    metrics3.AnodotTimestamp{Time: ts.Time},
+			Dimensions:   map[string]string{"instance": "n1"},
+			Measurements: map[string]float64{"node_load1": 0.5},
+			Tags:         map[string][]string{"env": {"prod"}},
+		},
+	}
+	if !reflect.DeepEqual(client.sent, want) {
+		t.Fatal(fmt.Sprintf("Wrong Anodot 3.0 metrics \n got: %+v\n want: %+v", client.sent, want))
+	}
+
+	var indexes []string
+	for _, e := range resp.(*metrics.CreateResponse).Errors {
+		indexes = append(indexes, e.Index)
+	}
+	if !reflect.DeepEqual(indexes, []string{"0", "1"}) {
+		t.Fatal(fmt.Sprintf("Errors should refer to original metrics \n got: %v\n want: %v", indexes, []string{"0", "1"}))
+	}
+}
+
+func TestAnodot30SubmitterWatermarks(t *testing.T) {
+	client := &mockAnodot30Client{}
+	s, err := NewAnodot30Submitter(url.URL{Scheme: "http", Host: "127.0.0.1"}, client, testSchemasConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1574693460, 0).Add(45 * time.Second)
+	s.SendWatermarks(now)
+	// bucket is not closed yet
+	s.SendWatermarks(now.Add(30 * time.Second))
+	s.SendWatermarks(now.Add(time.Minute))
+
+	want := []time.Time{time.Unix(1574693460, 0), time.Unix(1574693520, 0)}
+	for _, id := range []string{"http-id", "node-id"} {
+		if !reflect.DeepEqual(client.watermarks[id], want) {
+			t.Fatal(fmt.Sprintf("Wrong watermarks of %s \n got: %v\n want: %v", id, client.watermarks[id], want))
+		}
+	}
+}
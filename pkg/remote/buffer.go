@@ -0,0 +1,221 @@
+package remote
+
+import (
+	"errors"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+const (
+	// OverflowDropOldest removes the oldest buffered metrics to fit new ones.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest drops new metrics which do not fit into buffer.
+	OverflowDropNewest = "drop-newest"
+	// OverflowBlock waits until buffered metrics are sent, up to BlockTimeout, and drops new metrics which still do not fit.
+	OverflowBlock = "block"
+
+	// metricOverheadBytes is an approximate size of metric struct, timestamp and maps headers.
+	metricOverheadBytes = 128
+	// entryOverheadBytes is an approximate size of a single map entry without key and value data.
+	entryOverheadBytes = 32
+
+	// payloadOverheadBytes is an approximate size of serialized metric without properties and tags,
+	// e.g. {"properties":{},"tags":{},"timestamp":1600000000,"value":0.5},
+	payloadOverheadBytes = 64
+	// payloadEntryOverheadBytes is a size of quotes, colon and comma around serialized property or tag.
+	payloadEntryOverheadBytes = 6
+)
+
+// ErrBufferFull is returned when metrics are dropped because buffer is full.
+var ErrBufferFull = errors.New("metrics buffer is full")
+
+// estimatedMetricSize approximates memory used by buffered metric.
+func estimatedMetricSize(m *metrics.Anodot20Metric) int {
+	size := metricOverheadBytes
+	for k, v := range m.Properties {
+		size += entryOverheadBytes + len(k) + len(v)
+	}
+	for k, v := range m.Tags {
+		size += entryOverheadBytes + len(k) + len(v)
+	}
+	return size
+}
+
+// estimatedMetricPayloadSize approximates size of metric serialized to JSON.
+func estimatedMetricPayloadSize(m *metrics.Anodot20Metric) int {
+	size := payloadOverheadBytes
+	for k, v := range m.Properties {
+		size += payloadEntryOverheadBytes + len(k) + len(v)
+	}
+	for k, v := range m.Tags {
+		size += payloadEntryOverheadBytes + len(k) + len(v)
+	}
+	return size
+}
+
+func estimatedPayloadSize(data []metrics.Anodot20Metric) int {
+	size := 2
+	for i := range data {
+		size += estimatedMetricPayloadSize(&data[i])
+	}
+	return size
+}
+
+// chunkSize returns number of metrics from the start of data which are sent in single request,
+// limited by MetricsPerRequestSize and MaxRequestBytes. At least one metric is sent even if it exceeds MaxRequestBytes.
+func (w *Worker) chunkSize(data []metrics.Anodot20Metric) int {
+	n := len(data)
+	if n > w.MetricsPerRequestSize {
+		n = w.MetricsPerRequestSize
+	}
+	if w.MaxRequestBytes <= 0 {
+		return n
+	}
+
+	size := 2
+	for i := 0; i < n; i++ {
+		size += estimatedMetricPayloadSize(&data[i])
+		if size > w.MaxRequestBytes && i > 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// bufferedRequestFull returns true if buffered metrics exceed MaxRequestBytes, so request can be sent before
+// MetricsPerRequestSize metrics are buffered.
+func (w *Worker) bufferedRequestFull() bool {
+	if w.MaxRequestBytes <= 0 {
+		return false
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.chunkSize(w.MetricsBuffer) < len(w.MetricsBuffer)
+}
+
+// fits returns true if metrics of given number and size can be added to buffer without exceeding limits.
+// Must be called with w.mu held.
+func (w *Worker) fits(count int, bytes int) bool {
+	if w.MaxBufferSize > 0 && len(w.MetricsBuffer)+count > w.MaxBufferSize {
+		return false
+	}
+	return w.MaxBufferBytes <= 0 || w.bufferBytes+bytes <= w.MaxBufferBytes
+}
+
+// BufferFull returns true if buffer reached its limits and new metrics can not be added without applying overflow policy.
+func (w *Worker) BufferFull() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return !w.fits(1, 0) || (w.MaxBufferBytes > 0 && w.bufferBytes >= w.MaxBufferBytes)
+}
+
+// HasRoom returns true if all metrics of data can be buffered without dropping any of them. Only drop-newest policy
+// drops new metrics, and data is always accepted by empty buffer, so request larger than the whole buffer is not
+// rejected forever.
+func (w *Worker) HasRoom(data []metrics.Anodot20Metric) bool {
+	if w.Debug || w.queue != nil || w.OverflowPolicy != OverflowDropNewest {
+		return true
+	}
+	if w.aggregator != nil {
+		// aggregates of data are buffered once their time buckets are closed, so only full buffer rejects data
+		return !w.BufferFull()
+	}
+
+	bytes := 0
+	for i := range data {
+		bytes += estimatedMetricSize(&data[i])
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.MetricsBuffer) == 0 || w.fits(len(data), bytes)
+}
+
+// addToBuffer appends metrics to buffer according to overflow policy and returns number of dropped metrics.
+// Must be called with w.mu held, which is temporarily released while waiting up to timeout with OverflowBlock policy.
+// It must not be called by the goroutine which sends buffered metrics, since nothing would drain the buffer meanwhile.
+func (w *Worker) addToBuffer(data []metrics.Anodot20Metric, timeout time.Duration) int {
+	if w.OverflowPolicy == OverflowDropOldest {
+		return w.addDroppingOldest(data)
+	}
+
+	var deadline time.Time
+	if w.OverflowPolicy == OverflowBlock {
+		deadline = time.Now().Add(timeout)
+		// wakes up waiting for buffer room once timeout is reached
+		timer := time.AfterFunc(timeout, func() {
+			w.mu.Lock()
+			w.bufferDrained.Broadcast()
+			w.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for i := range data {
+		size := estimatedMetricSize(&data[i])
+
+		// metric is added to empty buffer even if it exceeds limits, so it is never blocked forever
+		for w.OverflowPolicy == OverflowBlock && !w.fits(1, size) && len(w.MetricsBuffer) > 0 && time.Now().Before(deadline) {
+			select {
+			case w.FlushBuffer <- true:
+			default:
+				// flush is already pending
+			}
+			w.bufferDrained.Wait()
+		}
+
+		if !w.fits(1, size) && (w.OverflowPolicy != OverflowBlock || len(w.MetricsBuffer) > 0) {
+			w.updateBufferMetrics()
+			return len(data) - i
+		}
+		w.MetricsBuffer = append(w.MetricsBuffer, data[i])
+		w.bufferBytes += size
+	}
+	w.updateBufferMetrics()
+	return 0
+}
+
+// appendToBuffer appends metrics to buffer ignoring its limits. Must be called with w.mu held.
+func (w *Worker) appendToBuffer(data []metrics.Anodot20Metric) {
+	for i := range data {
+		w.MetricsBuffer = append(w.MetricsBuffer, data[i])
+		w.bufferBytes += estimatedMetricSize(&data[i])
+	}
+	w.updateBufferMetrics()
+}
+
+// addDroppingOldest appends all metrics and then removes the oldest ones exceeding buffer limits.
+func (w *Worker) addDroppingOldest(data []metrics.Anodot20Metric) int {
+	w.appendToBuffer(data)
+
+	n, bytes := 0, w.bufferBytes
+	for n < len(w.MetricsBuffer) {
+		overCount := w.MaxBufferSize > 0 && len(w.MetricsBuffer)-n > w.MaxBufferSize
+		overBytes := w.MaxBufferBytes > 0 && bytes > w.MaxBufferBytes
+		if !overCount && !overBytes {
+			break
+		}
+		bytes -= estimatedMetricSize(&w.MetricsBuffer[n])
+		n++
+	}
+
+	if n > 0 {
+		w.removeOldest(n)
+	}
+	return n
+}
+
+// removeOldest removes first n metrics from buffer. Must be called with w.mu held.
+func (w *Worker) removeOldest(n int) {
+	for i := 0; i < n; i++ {
+		w.bufferBytes -= estimatedMetricSize(&w.MetricsBuffer[i])
+	}
+	w.MetricsBuffer = append(w.MetricsBuffer[:0], w.MetricsBuffer[n:]...)
+	w.updateBufferMetrics()
+	w.bufferDrained.Broadcast()
+}
+
+func (w *Worker) updateBufferMetrics() {
+	bufferedMetrics.WithLabelValues(w.labelValues()...).Set(float64(len(w.MetricsBuffer)))
+	bufferedBytes.WithLabelValues(w.labelValues()...).Set(float64(w.bufferBytes))
+}
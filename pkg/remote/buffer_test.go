@@ -0,0 +1,209 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+func bufferTestWorker(t *testing.T, config *WorkerConfig, submitter MockSubmitter) *Worker {
+	config.BatchSendDeadline = time.Minute
+	config.MaxWorkers = 1
+	config.BufferFullStatusCode = 503
+	worker, err := NewWorker(submitter, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return worker
+}
+
+func noopSubmitter() MockSubmitter {
+	return MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		return nil, nil
+	}}
+}
+
+func TestBufferDropNewest(t *testing.T) {
+	worker := bufferTestWorker(t, &WorkerConfig{MetricsPerRequestSize: 1000, MaxBufferSize: 10, OverflowPolicy: OverflowDropNewest}, noopSubmitter())
+
+	data := randomMetrics(15)
+	if err := worker.Do(data); err != ErrBufferFull {
+		t.Fatal(fmt.Sprintf("Wrong error \n got: %v\n want: %v", err, ErrBufferFull))
+	}
+	if worker.BufferSize() != 10 || worker.MetricsBuffer[9].Value != 9 {
+		t.Fatal(fmt.Sprintf("Oldest metrics should be kept \n got: %v", worker.MetricsBuffer))
+	}
+	if !worker.BufferFull() {
+		t.Fatalf("buffer should be full")
+	}
+}
+
+func TestBufferHasRoom(t *testing.T) {
+	worker := bufferTestWorker(t, &WorkerConfig{MetricsPerRequestSize: 1000, MaxBufferSize: 10, OverflowPolicy: OverflowDropNewest}, noopSubmitter())
+
+	if !worker.HasRoom(randomMetrics(15)) {
+		t.Fatal("Empty buffer should accept metrics exceeding its size")
+	}
+	if err := worker.Do(randomMetrics(6)); err != nil {
+		t.Fatal(err)
+	}
+	if worker.HasRoom(randomMetrics(5)) {
+		t.Fatal("Buffer should not have room for metrics exceeding its size")
+	}
+	if !worker.HasRoom(randomMetrics(4)) {
+		t.Fatal("Buffer should have room for metrics within its size")
+	}
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	worker := bufferTestWorker(t, &WorkerConfig{MetricsPerRequestSize: 1000, MaxBufferSize: 10, OverflowPolicy: OverflowDropOldest}, noopSubmitter())
+
+	if err := worker.Do(randomMetrics(15)); err != ErrBufferFull {
+		t.Fatal(fmt.Sprintf("Wrong error \n got: %v\n want: %v", err, ErrBufferFull))
+	}
+	if worker.BufferSize() != 10 || worker.MetricsBuffer[0].Value != 5 || worker.MetricsBuffer[9].Value != 14 {
+		t.Fatal(fmt.Sprintf("Newest metrics should be kept \n got: %v", worker.MetricsBuffer))
+	}
+}
+
+func TestBufferBytesLimit(t *testing.T) {
+	data := randomMetrics(10)
+	size := estimatedMetricSize(&data[0])
+	worker := bufferTestWorker(t, &WorkerConfig{MetricsPerRequestSize: 1000, MaxBufferBytes: 4 * size, OverflowPolicy: OverflowDropNewest}, noopSubmitter())
+
+	if err := worker.Do(data); err != ErrBufferFull {
+		t.Fatal(fmt.Sprintf("Wrong error \n got: %v\n want: %v", err, ErrBufferFull))
+	}
+	if worker.BufferSize() != 4 || worker.bufferBytes != 4*size {
+		t.Fatal(fmt.Sprintf("Wrong buffer \n got: %d metrics, %d bytes\n want: 4 metrics, %d bytes", worker.BufferSize(), worker.bufferBytes, 4*size))
+	}
+}
+
+func TestBufferBlock(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	submitter := MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		mu.Lock()
+		sent += len(data)
+		mu.Unlock()
+		return nil, nil
+	}}
+	worker := bufferTestWorker(t, &WorkerConfig{MetricsPerRequestSize: 5, MaxBufferSize: 10, OverflowPolicy: OverflowBlock, BlockTimeout: 5 * time.Second}, submitter)
+
+	done := make(chan error)
+	go func() {
+		done <- worker.Do(randomMetrics(50))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Do should not block once buffered metrics are sent")
+	}
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; {
+		mu.Lock()
+		s := sent
+		mu.Unlock()
+		if s == 50 {
+			return
+		}
+	}
+	t.Fatal(fmt.Sprintf("All metrics should be sent \n got: %d\n want: 50", sent))
+}
+
+func TestBufferBlockTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	submitter := MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		<-release
+		return nil, nil
+	}}
+	worker := bufferTestWorker(t, &WorkerConfig{MetricsPerRequestSize: 5, MaxBufferSize: 10, OverflowPolicy: OverflowBlock, BlockTimeout: 100 * time.Millisecond}, submitter)
+
+	done := make(chan error)
+	go func() {
+		done <- worker.Do(randomMetrics(50))
+	}()
+
+	select {
+	case err := <-done:
+		if err != ErrBufferFull {
+			t.Fatal(fmt.Sprintf("Wrong error \n got: %v\n want: %v", err, ErrBufferFull))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Do should stop waiting for buffer room after block timeout")
+	}
+}
+
+func TestBufferConfig(t *testing.T) {
+	unsetEnvVars()
+	defer unsetEnvVars()
+
+	config, err := NewWorkerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxBufferSize != 1000000 || config.OverflowPolicy != OverflowDropNewest || config.BufferFullStatusCode != 503 || config.BlockTimeout != 5*time.Second {
+		t.Fatal(fmt.Sprintf("Wrong default buffer config \n got: %+v", config))
+	}
+
+	for k, v := range map[string]string{"ANODOT_OVERFLOW_POLICY": "drop-all", "ANODOT_BUFFER_FULL_STATUS_CODE": "500"} {
+		_ = os.Setenv(k, v)
+		if _, err := NewWorkerConfig(); err == nil {
+			t.Fatalf("error should be returned for %s=%s", k, v)
+		}
+		_ = os.Unsetenv(k)
+	}
+}
+
+func TestChunkSizeByBytes(t *testing.T) {
+	small := metrics.Anodot20Metric{Properties: map[string]string{"what": "up"}, Timestamp: metrics.AnodotTimestamp{Time: time.Now()}, Value: 1.5}
+	large := metrics.Anodot20Metric{Properties: map[string]string{"what": "up"}, Tags: map[string]string{}, Timestamp: small.Timestamp, Value: 1.5}
+	for i := 0; i < 20; i++ {
+		large.Properties[fmt.Sprintf("property_%d", i)] = fmt.Sprintf("some_long_property_value_%d", i)
+	}
+
+	// estimation is close to actual size of serialized metrics
+	for _, m := range []metrics.Anodot20Metric{small, large} {
+		payload, err := json.Marshal([]metrics.Anodot20Metric{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimated := estimatedPayloadSize([]metrics.Anodot20Metric{m}); estimated < len(payload) || estimated > len(payload)*3/2 {
+			t.Fatal(fmt.Sprintf("Wrong payload size estimation \n got: %d\n want: about %d", estimated, len(payload)))
+		}
+	}
+
+	worker := bufferTestWorker(t, &WorkerConfig{MaxBufferSize: 100, OverflowPolicy: OverflowDropNewest}, noopSubmitter())
+	worker.MetricsPerRequestSize = 10
+	worker.MaxRequestBytes = 4 * estimatedMetricPayloadSize(&large)
+
+	tests := []struct {
+		name string
+		data []metrics.Anodot20Metric
+		want int
+	}{
+		{"small metrics limited by count", []metrics.Anodot20Metric{small, small, small, small, small, small, small, small, small, small, small, small}, 10},
+		{"large metrics limited by bytes", []metrics.Anodot20Metric{large, large, large, large, large, large}, 3},
+		{"single metric exceeding limit", []metrics.Anodot20Metric{large}, 1},
+	}
+	for _, tt := range tests {
+		if got := worker.chunkSize(tt.data); got != tt.want {
+			t.Fatal(fmt.Sprintf("Wrong chunk size for %s \n got: %d\n want: %d", tt.name, got, tt.want))
+		}
+	}
+
+	worker.MaxRequestBytes = estimatedMetricPayloadSize(&large) / 2
+	if got := worker.chunkSize([]metrics.Anodot20Metric{large, large}); got != 1 {
+		t.Fatal(fmt.Sprintf("Metric exceeding limit should be sent alone \n got: %d\n want: 1", got))
+	}
+}
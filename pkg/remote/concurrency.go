@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// decreaseFactor is applied to concurrency limit once Anodot is overloaded.
+	decreaseFactor = 0.5
+	// latencyAlpha is a weight of the last request in smoothed latency.
+	latencyAlpha = 0.1
+)
+
+var concurrencyLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "anodot_remote_write_concurrency_limit",
+	Help: "Current limit of concurrent requests to Anodot server",
+}, labels)
+
+// concurrencyLimiter limits number of concurrent requests using additive increase, multiplicative decrease.
+// Limit starts at max, halves on throttling, server errors or latency spikes, and grows back by one after every limit of
+// successful requests.
+type concurrencyLimiter struct {
+	min, max float64
+	// latencyTolerance is a ratio of request latency to smoothed latency which is considered a spike.
+	latencyTolerance float64
+	labels           []string
+
+	mu       sync.Mutex
+	released *sync.Cond
+	limit    float64
+	inFlight int
+	latency  time.Duration
+	// decreases are applied at most once per smoothed latency, so concurrent failures of single overload are counted once
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimiter(min, max int64, latencyTolerance float64, labelValues []string) *concurrencyLimiter {
+	if max < 1 {
+		max = 1
+	}
+	if min < 1 {
+		min = 1
+	}
+	if min > max {
+		min = max
+	}
+
+	l := &concurrencyLimiter{min: float64(min), max: float64(max), latencyTolerance: latencyTolerance, labels: labelValues, limit: float64(max)}
+	l.released = sync.NewCond(&l.mu)
+	concurrencyLimit.WithLabelValues(labelValues...).Set(l.limit)
+	return l
+}
+
+// Acquire waits until number of requests in flight is below limit. It returns true if it had to wait.
+func (l *concurrencyLimiter) Acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	waited := false
+	for l.inFlight >= l.current() {
+		waited = true
+		l.released.Wait()
+	}
+	l.inFlight++
+	return waited
+}
+
+// Release adjusts limit according to outcome of finished request. Overloaded is true for throttling, server and connection errors.
+func (l *concurrencyLimiter) Release(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	spike := l.latency > 0 && l.latencyTolerance > 0 && float64(latency) > l.latencyTolerance*float64(l.latency)
+
+	if overloaded || spike {
+		if time.Since(l.lastDecrease) > l.latency {
+			l.limit = math.Max(l.min, l.limit*decreaseFactor)
+			l.lastDecrease = time.Now()
+		}
+	} else {
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+
+	if !overloaded {
+		if l.latency == 0 {
+			l.latency = latency
+		} else {
+			l.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(l.latency))
+		}
+	}
+
+	concurrencyLimit.WithLabelValues(l.labels...).Set(math.Floor(l.limit))
+	l.released.Broadcast()
+}
+
+func (l *concurrencyLimiter) current() int {
+	return int(math.Floor(l.limit))
+}
+
+func (l *concurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current()
+}
@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	l := newConcurrencyLimiter(2, 8, 2, []string{"127.0.0.1", DefaultTenant})
+	if l.Limit() != 8 {
+		t.Fatal(fmt.Sprintf("Wrong initial limit \n got: %d\n want: %d", l.Limit(), 8))
+	}
+
+	// concurrent failures of single overload halve limit once per smoothed latency
+	l.Acquire()
+	l.Release(100*time.Millisecond, false)
+	for i := 0; i < 3; i++ {
+		l.Acquire()
+	}
+	for i := 0; i < 3; i++ {
+		l.Release(100*time.Millisecond, true)
+	}
+	if l.Limit() != 4 {
+		t.Fatal(fmt.Sprintf("Limit should be halved on overload \n got: %d\n want: %d", l.Limit(), 4))
+	}
+
+	// healthy requests grow limit back up to max
+	for i := 0; i < 100; i++ {
+		l.Acquire()
+		l.Release(100*time.Millisecond, false)
+	}
+	if l.Limit() != 8 {
+		t.Fatal(fmt.Sprintf("Limit should grow to max \n got: %d\n want: %d", l.Limit(), 8))
+	}
+
+	// limit is not decreased below min
+	for i := 0; i < 5; i++ {
+		l.lastDecrease = time.Time{}
+		l.Acquire()
+		l.Release(100*time.Millisecond, true)
+	}
+	if l.Limit() != 2 {
+		t.Fatal(fmt.Sprintf("Limit should not be below min \n got: %d\n want: %d", l.Limit(), 2))
+	}
+}
+
+func TestConcurrencyLimiterLatencySpike(t *testing.T) {
+	l := newConcurrencyLimiter(1, 8, 2, []string{"127.0.0.1", DefaultTenant})
+	for i := 0; i < 100; i++ {
+		l.Acquire()
+		l.Release(10*time.Millisecond, false)
+	}
+
+	l.lastDecrease = time.Time{}
+	l.Acquire()
+	l.Release(time.Second, false)
+	if l.Limit() != 4 {
+		t.Fatal(fmt.Sprintf("Limit should be halved on latency spike \n got: %d\n want: %d", l.Limit(), 4))
+	}
+}
+
+func TestConcurrencyLimiterAcquireWaits(t *testing.T) {
+	l := newConcurrencyLimiter(1, 1, 2, []string{"127.0.0.1", DefaultTenant})
+	if l.Acquire() {
+		t.Fatal("Acquire should not wait for free slot")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.Acquire()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquire should wait while limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release(time.Millisecond, false)
+	select {
+	case waited := <-acquired:
+		if !waited {
+			t.Fatal("Acquire should report waiting")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire should return once slot is released")
+	}
+}
@@ -0,0 +1,227 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "k8s.io/klog/v2"
+)
+
+var (
+	rejectedMetrics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_rejected_metrics_total",
+		Help: "Total number of metrics rejected by Anodot server",
+	}, append(labels, "error_code"))
+
+	deadLetterErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_remote_write_dead_letter_errors_total",
+		Help: "Total number of errors occurred while writing rejected metrics to dead-letter file",
+	})
+)
+
+// DeadLetterConfig configures file which keeps metrics rejected by Anodot. Dead-letter file is disabled if Path is empty.
+type DeadLetterConfig struct {
+	Path string
+	// MaxBytes is a size of file which is rotated once exceeded. MaxFiles rotated files are kept.
+	MaxBytes int64 `default:"104857600" split_words:"true"`
+	MaxFiles int   `default:"5" split_words:"true"`
+}
+
+func NewDeadLetterConfig() (*DeadLetterConfig, error) {
+	config := &DeadLetterConfig{}
+	if err := envconfig.Process("ANODOT_DEAD_LETTER", config); err != nil {
+		return nil, err
+	}
+	if config.Path != "" && (config.MaxBytes <= 0 || config.MaxFiles < 0) {
+		return nil, fmt.Errorf("ANODOT_DEAD_LETTER_MAX_BYTES should be positive and ANODOT_DEAD_LETTER_MAX_FILES should not be negative")
+	}
+	return config, nil
+}
+
+// DeadLetterMetric keeps metric as it was sent to Anodot, without escaping of properties.
+type DeadLetterMetric struct {
+	Properties map[string]string `json:"properties"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Timestamp  int64             `json:"timestamp"`
+	Value      float64           `json:"value"`
+}
+
+// DeadLetter is a single line of dead-letter file.
+type DeadLetter struct {
+	Time      time.Time        `json:"time"`
+	AnodotURL string           `json:"anodot_url"`
+	Tenant    string           `json:"tenant"`
+	ErrorCode int64            `json:"error_code"`
+	Reason    string           `json:"reason"`
+	Metric    DeadLetterMetric `json:"metric"`
+}
+
+func (d *DeadLetter) Anodot20Metric() metrics.Anodot20Metric {
+	return metrics.Anodot20Metric{
+		Properties: d.Metric.Properties,
+		Tags:       d.Metric.Tags,
+		Timestamp:  metrics.AnodotTimestamp{Time: time.Unix(d.Metric.Timestamp, 0)},
+		Value:      d.Metric.Value,
+	}
+}
+
+// DeadLetterWriter appends rejected metrics to NDJSON file and rotates it by size. It is safe for concurrent use.
+type DeadLetterWriter struct {
+	config *DeadLetterConfig
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewDeadLetterWriter(config *DeadLetterConfig) (*DeadLetterWriter, error) {
+	w := &DeadLetterWriter{config: config}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *DeadLetterWriter) open() error {
+	f, err := os.OpenFile(w.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate renames file to <path>.1, shifting previously rotated files. Must be called with w.mu held.
+func (w *DeadLetterWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.config.MaxFiles == 0 {
+		_ = os.Remove(w.config.Path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", w.config.Path, w.config.MaxFiles))
+		for i := w.config.MaxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.config.Path, i), fmt.Sprintf("%s.%d", w.config.Path, i+1))
+		}
+		if err := os.Rename(w.config.Path, w.config.Path+".1"); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+func (w *DeadLetterWriter) Write(letters []DeadLetter) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, l := range letters {
+		line, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+
+		if w.size > 0 && w.size+int64(len(line)) > w.config.MaxBytes {
+			if err := w.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := w.file.Write(line)
+		w.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *DeadLetterWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// ReadDeadLetters reads all records of dead-letter file.
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var l DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("failed to parse line %d of %s: %w", line, path, err)
+		}
+		res = append(res, l)
+	}
+	return res, scanner.Err()
+}
+
+// rejected maps errors of Anodot response to metrics of the sent batch, which errors refer to by index.
+func (w *Worker) rejected(data []metrics.Anodot20Metric, resp metrics.AnodotResponse) []DeadLetter {
+	createResponse, ok := resp.(*metrics.CreateResponse)
+	if !ok || createResponse == nil || !createResponse.HasErrors() {
+		return nil
+	}
+
+	now := time.Now()
+	host := w.metricsSubmitter.AnodotURL().Host
+	var res []DeadLetter
+	for _, e := range createResponse.Errors {
+		rejectedMetrics.WithLabelValues(host, w.Tenant, strconv.FormatInt(e.Error, 10)).Inc()
+
+		i, err := strconv.Atoi(e.Index)
+		if err != nil || i < 0 || i >= len(data) {
+			log.Warningf("Anodot rejected metric with unknown index %q: %s", e.Index, e.Description)
+			continue
+		}
+
+		m := data[i]
+		log.V(4).Infof("Anodot rejected metric %v: %s", m.Properties, e.Description)
+		res = append(res, DeadLetter{
+			Time:      now,
+			AnodotURL: host,
+			Tenant:    w.Tenant,
+			ErrorCode: e.Error,
+			Reason:    e.Description,
+			Metric:    DeadLetterMetric{Properties: m.Properties, Tags: m.Tags, Timestamp: m.Timestamp.Unix(), Value: m.Value},
+		})
+	}
+	return res
+}
+
+// deadLetter records metrics rejected by Anodot and writes them to dead-letter file if it is configured.
+func (w *Worker) deadLetter(data []metrics.Anodot20Metric, resp metrics.AnodotResponse) {
+	letters := w.rejected(data, resp)
+	if len(letters) == 0 || w.DeadLetter == nil {
+		return
+	}
+	if err := w.DeadLetter.Write(letters); err != nil {
+		deadLetterErrors.Inc()
+		log.Error("Failed to write rejected metrics to dead-letter file: ", err)
+	}
+}
@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+// rejectingResponse returns response of Anodot which rejected metrics with the given indexes.
+func rejectingResponse(indexes ...string) *metrics.CreateResponse {
+	resp := &metrics.CreateResponse{HttpResponse: &http.Response{StatusCode: http.StatusOK}}
+	for _, i := range indexes {
+		resp.Errors = append(resp.Errors, struct {
+			Description string
+			Error       int64
+			Index       string
+		}{Description: "Invalid property value", Error: 2001, Index: i})
+	}
+	return resp
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewDeadLetterWriter(&DeadLetterConfig{Path: filepath.Join(dir, "dead-letter.ndjson"), MaxBytes: 1 << 20, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	submitter := MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		resp := rejectingResponse("1", "7")
+		// keeps HTTP responses metric checked by other tests unchanged
+		resp.HttpResponse = nil
+		return resp, fmt.Errorf("%s", resp.ErrorMessage())
+	}}
+	worker, err := NewWorker(submitter, &WorkerConfig{BatchSendDeadline: time.Minute, MaxWorkers: 1, MetricsPerRequestSize: 1000, DeadLetter: writer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomMetrics(3)
+	for i := range data {
+		data[i].Properties = map[string]string{"what": fmt.Sprintf("metric.%d", i)}
+	}
+	if _, err := worker.submit(submitter, data); err == nil {
+		t.Fatal("error should be returned for rejected metrics")
+	}
+
+	letters, err := ReadDeadLetters(filepath.Join(dir, "dead-letter.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// index 7 is out of batch
+	if len(letters) != 1 {
+		t.Fatal(fmt.Sprintf("Wrong number of dead letters \n got: %d\n want: %d", len(letters), 1))
+	}
+	l := letters[0]
+	if l.Metric.Properties["what"] != "metric.1" || l.ErrorCode != 2001 || l.Reason != "Invalid property value" || l.Tenant != DefaultTenant {
+		t.Fatal(fmt.Sprintf("Wrong dead letter \n got: %+v", l))
+	}
+	if m := l.Anodot20Metric(); m.Timestamp.Unix() != data[1].Timestamp.Unix() || m.Value != data[1].Value {
+		t.Fatal(fmt.Sprintf("Wrong resubmitted metric \n got: %+v\n want: %+v", m, data[1]))
+	}
+}
+
+func TestDeadLetterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letter.ndjson")
+	writer, err := NewDeadLetterWriter(&DeadLetterConfig{Path: path, MaxBytes: 300, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	letter := DeadLetter{Reason: "Invalid property value", Metric: DeadLetterMetric{Properties: map[string]string{"what": "up"}}}
+	for i := 0; i < 10; i++ {
+		if err := writer.Write([]DeadLetter{letter}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Fatal(fmt.Sprintf("Dead-letter file %s is not rotated \n got: %d bytes", p, info.Size()))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("Only 2 rotated files should be kept")
+	}
+}
@@ -0,0 +1,210 @@
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "k8s.io/klog/v2"
+)
+
+var (
+	sentRawBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_sent_raw_bytes_total",
+		Help: "Total size of metrics payloads sent to Anodot before compression",
+	}, []string{"anodot_url"})
+
+	sentCompressedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_sent_compressed_bytes_total",
+		Help: "Total size of metrics payloads sent to Anodot after compression",
+	}, []string{"anodot_url"})
+
+	compressionFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_compression_fallbacks_total",
+		Help: "Total number of times compression was disabled because Anodot server rejected compressed payload",
+	}, []string{"anodot_url"})
+)
+
+// CompressionConfig enables gzip compression of metrics sent to Anodot.
+type CompressionConfig struct {
+	Enabled bool `default:"false"`
+	// Level is a gzip compression level from 1 (best speed) to 9 (best compression), -1 is a default level.
+	Level int `default:"-1"`
+}
+
+func NewCompressionConfig() (*CompressionConfig, error) {
+	config := &CompressionConfig{}
+	if err := envconfig.Process("ANODOT_GZIP", config); err != nil {
+		return nil, err
+	}
+	if config.Level != gzip.DefaultCompression && (config.Level < gzip.BestSpeed || config.Level > gzip.BestCompression) {
+		return nil, fmt.Errorf("ANODOT_GZIP_LEVEL should be between %d and %d, or %d", gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression)
+	}
+	return config, nil
+}
+
+// NewSubmitter creates Anodot 2.0 submitter which compresses payloads if compression is enabled.
+func NewSubmitter(anodotURL url.URL, token string, client *http.Client, compression *CompressionConfig) (metrics.Submitter, error) {
+	if compression == nil || !compression.Enabled {
+		return metrics.NewAnodot20Client(anodotURL, token, client)
+	}
+	return NewGzipSubmitter(anodotURL, token, client, compression.Level)
+}
+
+// GzipSubmitter sends gzip compressed metrics to Anodot 2.0 API. Compression is disabled once server rejects it
+// with 415 Unsupported Media Type, and rejected batch is sent again uncompressed.
+type GzipSubmitter struct {
+	ServerURL *url.URL
+	Token     string
+	Level     int
+
+	client   *http.Client
+	disabled int32
+}
+
+func NewGzipSubmitter(anodotURL url.URL, token string, client *http.Client, level int) (*GzipSubmitter, error) {
+	if len(strings.TrimSpace(token)) == 0 {
+		return nil, fmt.Errorf("anodot api token should not be blank")
+	}
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+		// the same as default client of Anodot 2.0 submitter
+		if debugHTTP, _ := strconv.ParseBool(os.Getenv("ANODOT_HTTP_DEBUG_ENABLED")); debugHTTP {
+			client.Transport = &debugHTTPTransport{r: http.DefaultTransport}
+		}
+	}
+	return &GzipSubmitter{ServerURL: &anodotURL, Token: token, Level: level, client: client}, nil
+}
+
+func (s *GzipSubmitter) AnodotURL() *url.URL {
+	return s.ServerURL
+}
+
+func (s *GzipSubmitter) SubmitMetrics(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	if atomic.LoadInt32(&s.disabled) == 0 {
+		resp, err := s.send(payload, true)
+		if resp == nil || resp.HttpResponse.StatusCode != http.StatusUnsupportedMediaType {
+			return response(resp), err
+		}
+
+		atomic.StoreInt32(&s.disabled, 1)
+		compressionFallbacks.WithLabelValues(s.ServerURL.Host).Inc()
+		log.Warningf("Anodot server %s does not accept gzip compressed metrics, sending them uncompressed", s.ServerURL.Host)
+	}
+	resp, err := s.send(payload, false)
+	return response(resp), err
+}
+
+// response converts nil CreateResponse to untyped nil, so callers can check response against nil.
+func response(resp *metrics.CreateResponse) metrics.AnodotResponse {
+	if resp == nil {
+		return nil
+	}
+	return resp
+}
+
+// send posts payload to Anodot. Response is nil if request was not sent or no response was received, and body of
+// non-200 response is closed.
+func (s *GzipSubmitter) send(payload []byte, compress bool) (*metrics.CreateResponse, error) {
+	body := payload
+	if compress {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, s.Level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	sURL := *s.ServerURL
+	sURL.Path = "/api/v1/metrics"
+	q := sURL.Query()
+	q.Set("token", s.Token)
+	q.Set("protocol", "anodot20")
+	sURL.RawQuery = q.Encode()
+
+	r, err := http.NewRequest(http.MethodPost, sURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if compress {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+
+	sentRawBytes.WithLabelValues(s.ServerURL.Host).Add(float64(len(payload)))
+	sentCompressedBytes.WithLabelValues(s.ServerURL.Host).Add(float64(len(body)))
+
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	anodotResponse := &metrics.CreateResponse{HttpResponse: resp}
+	if resp.StatusCode != http.StatusOK {
+		// status code and headers, e.g. Retry-After, are still available to callers
+		closeResponse(anodotResponse)
+		return anodotResponse, fmt.Errorf("http error: %d", resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return anodotResponse, err
+	}
+	if err := json.Unmarshal(bodyBytes, anodotResponse); err != nil {
+		return anodotResponse, fmt.Errorf("failed to parse Anodot sever response: %w", err)
+	}
+	if anodotResponse.HasErrors() {
+		return anodotResponse, errors.New(anodotResponse.ErrorMessage())
+	}
+	return anodotResponse, nil
+}
+
+// debugHTTPTransport logs dumps of requests and responses if ANODOT_HTTP_DEBUG_ENABLED is true, like transport of
+// Anodot 2.0 submitter which is not exported by anodot-common.
+type debugHTTPTransport struct {
+	r http.RoundTripper
+}
+
+func (d *debugHTTPTransport) RoundTrip(h *http.Request) (*http.Response, error) {
+	dump, _ := httputil.DumpRequestOut(h, true)
+	log.Infof("HTTP request:\n%s", string(dump))
+	resp, err := d.r.RoundTrip(h)
+	if err != nil {
+		log.Errorf("failed to obtain response: %v", err)
+		return resp, err
+	}
+
+	dump, _ = httputil.DumpResponse(resp, true)
+	log.Infof("HTTP response:\n%s", string(dump))
+	return resp, err
+}
@@ -0,0 +1,132 @@
+package remote
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestGzipSubmitter(t *testing.T) {
+	var encodings []string
+	acceptGzip := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		if encoding == "gzip" && !acceptGzip {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body := r.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+
+		var data []map[string]interface{}
+		if err := json.NewDecoder(body).Decode(&data); err != nil || r.URL.Query().Get("token") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(data) == 3 {
+			_, _ = w.Write([]byte(`{"errors": [{"description": "Invalid property value", "error": 2001, "index": "2"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errors": []}`))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	s, err := NewSubmitter(*serverURL, "token", nil, &CompressionConfig{Enabled: true, Level: gzip.BestCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.SubmitMetrics(randomMetrics(2)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.SubmitMetrics(randomMetrics(3))
+	if err == nil || !resp.HasErrors() || resp.RawResponse().StatusCode != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Rejected metrics should be returned \n got: %v, %v", resp, err))
+	}
+
+	// compression is disabled once rejected by server
+	acceptGzip = false
+	for i := 0; i < 2; i++ {
+		if _, err := s.SubmitMetrics(randomMetrics(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"gzip", "gzip", "gzip", "", ""}
+	if fmt.Sprint(encodings) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong content encodings \n got: %q\n want: %q", encodings, want))
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	config, err := NewCompressionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Enabled || config.Level != gzip.DefaultCompression {
+		t.Fatal(fmt.Sprintf("Wrong default compression config \n got: %+v", config))
+	}
+
+	anodotURL, _ := url.Parse("https://api.anodot.com")
+	if s, err := NewSubmitter(*anodotURL, "token", nil, config); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.(*GzipSubmitter); ok {
+		t.Fatal("Compression should be disabled by default")
+	}
+
+	_ = os.Setenv("ANODOT_GZIP_LEVEL", "10")
+	defer os.Unsetenv("ANODOT_GZIP_LEVEL")
+	if _, err := NewCompressionConfig(); err == nil {
+		t.Fatal("error should be returned for invalid compression level")
+	}
+
+	if _, err := NewGzipSubmitter(*anodotURL, " ", nil, gzip.DefaultCompression); err == nil {
+		t.Fatal("error should be returned for blank token")
+	}
+}
+
+func TestGzipSubmitterErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	serverURL, _ := url.Parse(server.URL)
+	s, err := NewGzipSubmitter(*serverURL, "token", nil, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.SubmitMetrics(randomMetrics(1))
+	if err == nil || resp == nil || resp.RawResponse().StatusCode != http.StatusTooManyRequests || resp.RawResponse().Header.Get("Retry-After") != "5" {
+		t.Fatal(fmt.Sprintf("Throttling response should be returned \n got: %v, %v", resp, err))
+	}
+
+	// response is nil if request was not sent
+	server.Close()
+	if resp, err := s.SubmitMetrics(randomMetrics(1)); err == nil || resp != nil {
+		t.Fatal(fmt.Sprintf("Nil response should be returned for connection error \n got: %v, %v", resp, err))
+	}
+
+	_ = os.Setenv("ANODOT_HTTP_DEBUG_ENABLED", "true")
+	defer os.Unsetenv("ANODOT_HTTP_DEBUG_ENABLED")
+	if s, err := NewGzipSubmitter(*serverURL, "token", nil, gzip.DefaultCompression); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.client.Transport.(*debugHTTPTransport); !ok {
+		t.Fatal("HTTP debug transport should be used")
+	}
+}
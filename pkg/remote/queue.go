@@ -0,0 +1,564 @@
+package remote
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	segmentSuffix  = ".seg"
+	checkpointFile = "checkpoint"
+	// recordHeaderSize holds payload length, CRC32 of timestamp and payload, and timestamp in unix nanoseconds.
+	recordHeaderSize = 16
+)
+
+// ErrQueueClosed is returned by queue operations after queue is closed.
+var ErrQueueClosed = errors.New("disk queue is closed")
+
+var (
+	queueBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_queue_bytes",
+		Help: "Size of metrics batches stored in disk queue awaiting to be sent",
+	}, labels)
+
+	queueOldestAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_queue_oldest_entry_age_seconds",
+		Help: "Age of the oldest metrics batch stored in disk queue",
+	}, labels)
+
+	queueReplayProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_queue_replay_progress_ratio",
+		Help: "Part of metrics batches found in disk queue on startup which are already sent",
+	}, labels)
+
+	queueSentBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_queue_sent_batches_total",
+		Help: "Total number of metrics batches sent from disk queue",
+	}, labels)
+
+	queueDroppedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_queue_dropped_bytes_total",
+		Help: "Total size of disk queue data dropped because of size or age limits or corruption",
+	}, append(labels, "reason"))
+)
+
+// QueueConfig configures disk queue which persists metrics before they are sent to Anodot. Queue is disabled if Dir is empty.
+type QueueConfig struct {
+	// Dir holds queue of every worker in subdirectory named after worker tenant.
+	Dir          string
+	MaxBytes     int64         `default:"1073741824" split_words:"true"`
+	MaxAge       time.Duration `default:"24h" split_words:"true"`
+	SegmentBytes int64         `default:"67108864" split_words:"true"`
+	// RetryInterval is a delay before sending of failed batch is repeated.
+	RetryInterval time.Duration `default:"5s" split_words:"true"`
+	// SyncInterval is a period of flushing appended batches to disk. Every batch is flushed once appended if it is zero.
+	SyncInterval time.Duration `default:"1s" split_words:"true"`
+}
+
+func NewQueueConfig() (*QueueConfig, error) {
+	config := &QueueConfig{}
+	if err := envconfig.Process("ANODOT_QUEUE", config); err != nil {
+		return nil, err
+	}
+	if !config.Enabled() {
+		return config, nil
+	}
+
+	if config.MaxBytes <= 0 || config.SegmentBytes <= 0 || config.SegmentBytes > config.MaxBytes {
+		return nil, fmt.Errorf("ANODOT_QUEUE_SEGMENT_BYTES should be positive and not greater than ANODOT_QUEUE_MAX_BYTES")
+	}
+	if config.RetryInterval <= 0 {
+		return nil, fmt.Errorf("ANODOT_QUEUE_RETRY_INTERVAL should be positive")
+	}
+	if config.SyncInterval < 0 {
+		return nil, fmt.Errorf("ANODOT_QUEUE_SYNC_INTERVAL should not be negative")
+	}
+	return config, nil
+}
+
+func (c *QueueConfig) Enabled() bool {
+	return c != nil && c.Dir != ""
+}
+
+type segment struct {
+	id   uint64
+	size int64
+	// timestamp of the last record
+	last time.Time
+}
+
+func (s *segment) path(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", s.id, segmentSuffix))
+}
+
+// QueuePosition identifies batch returned by Peek, so it is acknowledged only if it is still in the queue.
+type QueuePosition struct {
+	segment uint64
+	offset  int64
+	size    int64
+}
+
+// queuedMetric is a lossless representation of Anodot20Metric, which JSON encoding escapes values and truncates timestamps.
+type queuedMetric struct {
+	Properties map[string]string `json:"p"`
+	Tags       map[string]string `json:"t,omitempty"`
+	Timestamp  int64             `json:"ts"`
+	Value      float64           `json:"v"`
+}
+
+// DiskQueue is a write-ahead queue of metrics batches stored in segment files.
+// Batches are read in the order they were appended and removed once acknowledged, so they survive restarts.
+type DiskQueue struct {
+	dir    string
+	config *QueueConfig
+	labels []string
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	closed   bool
+	stop     chan struct{}
+
+	// segments are sorted from the oldest, records are appended to the last one
+	segments []*segment
+	writer   *os.File
+	// dirty is true if writer has records which are not flushed to disk yet
+	dirty bool
+	// readOffset is a position of the next record in the first segment
+	readOffset int64
+
+	replayTotal, replayed int64
+}
+
+// OpenDiskQueue opens queue in the given directory, dropping corrupted records and data acknowledged before restart.
+func OpenDiskQueue(dir string, config *QueueConfig, labelValues []string) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &DiskQueue{dir: dir, config: config, labels: labelValues, stop: make(chan struct{})}
+	q.notEmpty = sync.NewCond(&q.mu)
+
+	ids, err := segmentIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	checkpointID, checkpointOffset := q.readCheckpoint()
+
+	for _, id := range ids {
+		s := &segment{id: id}
+		if id < checkpointID {
+			_ = os.Remove(s.path(dir))
+			continue
+		}
+		if err := q.scan(s); err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, s)
+	}
+
+	if len(q.segments) > 0 && q.segments[0].id == checkpointID && checkpointOffset <= q.segments[0].size {
+		q.readOffset = checkpointOffset
+	}
+
+	var next uint64 = 1
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1].id + 1
+	}
+	if err := q.roll(next); err != nil {
+		return nil, err
+	}
+
+	q.replayTotal = q.pendingBytes()
+	q.updateMetrics()
+	if q.replayTotal > 0 {
+		log.Infof("Replaying %d byte(s) of metrics stored in disk queue %s", q.replayTotal, dir)
+	}
+	if config.SyncInterval > 0 {
+		go q.syncPeriodically()
+	}
+	return q, nil
+}
+
+func segmentIDs(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// scan validates records of segment and truncates it after the last valid one.
+func (q *DiskQueue) scan(s *segment) error {
+	f, err := os.OpenFile(s.path(q.dir), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for offset < info.Size() {
+		ts, payload, err := readRecord(f, offset)
+		if err != nil {
+			break
+		}
+		s.last = ts
+		offset += recordHeaderSize + int64(len(payload))
+	}
+
+	if offset < info.Size() {
+		log.Warningf("Disk queue segment %s is corrupted at offset %d, dropping %d byte(s)", s.path(q.dir), offset, info.Size()-offset)
+		queueDroppedBytes.WithLabelValues(append(q.labels, "corrupted")...).Add(float64(info.Size() - offset))
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	s.size = offset
+	return nil
+}
+
+func readRecord(r io.ReaderAt, offset int64) (time.Time, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, size)
+	if _, err := r.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[8:16])
+	_, _ = crc.Write(payload)
+	if crc.Sum32() != checksum {
+		return time.Time{}, nil, fmt.Errorf("checksum mismatch at offset %d", offset)
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))), payload, nil
+}
+
+func (q *DiskQueue) readCheckpoint() (uint64, int64) {
+	content, err := ioutil.ReadFile(filepath.Join(q.dir, checkpointFile))
+	if err != nil {
+		return 0, 0
+	}
+
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(content), "%d %d", &id, &offset); err != nil {
+		log.Warningf("Ignoring invalid disk queue checkpoint in %s: %v", q.dir, err)
+		return 0, 0
+	}
+	return id, offset
+}
+
+// writeCheckpoint persists position of the next record to read. Must be called with q.mu held.
+func (q *DiskQueue) writeCheckpoint() error {
+	path := filepath.Join(q.dir, checkpointFile)
+	content := fmt.Sprintf("%d %d", q.segments[0].id, q.readOffset)
+	if err := ioutil.WriteFile(path+".tmp", []byte(content), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// roll starts new segment for writing. Must be called with q.mu held.
+func (q *DiskQueue) roll(id uint64) error {
+	s := &segment{id: id}
+	f, err := os.OpenFile(s.path(q.dir), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if q.writer != nil {
+		if err := q.sync(); err != nil {
+			log.Error("Failed to flush disk queue segment: ", err)
+		}
+		_ = q.writer.Close()
+	}
+	q.writer = f
+	q.segments = append(q.segments, s)
+	return nil
+}
+
+// Append persists batch to the queue. Once it is flushed to disk, batch is delivered even if process restarts.
+func (q *DiskQueue) Append(data []metrics.Anodot20Metric) error {
+	queued := make([]queuedMetric, len(data))
+	for i, m := range data {
+		queued[i] = queuedMetric{Properties: m.Properties, Tags: m.Tags, Timestamp: m.Timestamp.UnixNano(), Value: m.Value}
+	}
+	payload, err := json.Marshal(queued)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(now.UnixNano()))
+	copy(record[recordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+int64(len(record)) > q.config.SegmentBytes {
+		if err := q.roll(last.id + 1); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	if _, err := q.writer.Write(record); err != nil {
+		return err
+	}
+	q.dirty = true
+	if q.config.SyncInterval <= 0 {
+		if err := q.sync(); err != nil {
+			return err
+		}
+	}
+	last.size += int64(len(record))
+	last.last = now
+
+	q.enforceMaxBytes()
+	q.updateMetrics()
+	q.notEmpty.Signal()
+	return nil
+}
+
+// sync flushes appended records to disk. Must be called with q.mu held.
+func (q *DiskQueue) sync() error {
+	if !q.dirty {
+		return nil
+	}
+	q.dirty = false
+	return q.writer.Sync()
+}
+
+// syncPeriodically flushes appended records every SyncInterval until queue is closed.
+func (q *DiskQueue) syncPeriodically() {
+	ticker := time.NewTicker(q.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			if !q.closed {
+				if err := q.sync(); err != nil {
+					log.Error("Failed to flush disk queue segment: ", err)
+				}
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// enforceMaxBytes drops the oldest segments exceeding size limit. Must be called with q.mu held.
+func (q *DiskQueue) enforceMaxBytes() {
+	for len(q.segments) > 1 && q.pendingBytes() > q.config.MaxBytes {
+		q.dropHead("max_bytes")
+	}
+}
+
+// dropHead removes the first segment which is not written anymore. Must be called with q.mu held.
+func (q *DiskQueue) dropHead(reason string) {
+	s := q.segments[0]
+	if reason != "" {
+		log.Warningf("Dropping disk queue segment %s: %s", s.path(q.dir), reason)
+		queueDroppedBytes.WithLabelValues(append(q.labels, reason)...).Add(float64(s.size - q.readOffset))
+	}
+	q.replayed += s.size - q.readOffset
+
+	_ = os.Remove(s.path(q.dir))
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+	if err := q.writeCheckpoint(); err != nil {
+		log.Error("Failed to write disk queue checkpoint: ", err)
+	}
+}
+
+func (q *DiskQueue) pendingBytes() int64 {
+	var res int64
+	for _, s := range q.segments {
+		res += s.size
+	}
+	return res - q.readOffset
+}
+
+// Peek returns the oldest batch and its position without removing it from the queue. It blocks until batch is available
+// or queue is closed.
+func (q *DiskQueue) Peek() ([]metrics.Anodot20Metric, QueuePosition, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return nil, QueuePosition{}, ErrQueueClosed
+		}
+
+		head := q.segments[0]
+		if len(q.segments) > 1 && (q.readOffset >= head.size || time.Since(head.last) > q.config.MaxAge) {
+			reason := "max_age"
+			if q.readOffset >= head.size {
+				reason = ""
+			}
+			q.dropHead(reason)
+			q.updateMetrics()
+			continue
+		}
+		if q.readOffset >= head.size {
+			q.notEmpty.Wait()
+			continue
+		}
+
+		f, err := os.Open(head.path(q.dir))
+		if err != nil {
+			return nil, QueuePosition{}, err
+		}
+		ts, payload, err := readRecord(f, q.readOffset)
+		_ = f.Close()
+		if err != nil {
+			log.Warningf("Failed to read disk queue segment %s: %v", head.path(q.dir), err)
+			queueDroppedBytes.WithLabelValues(append(q.labels, "corrupted")...).Add(float64(head.size - q.readOffset))
+			q.replayed += head.size - q.readOffset
+			q.readOffset = head.size
+			continue
+		}
+
+		queueOldestAge.WithLabelValues(q.labels...).Set(time.Since(ts).Seconds())
+		if time.Since(ts) > q.config.MaxAge {
+			queueDroppedBytes.WithLabelValues(append(q.labels, "max_age")...).Add(float64(recordHeaderSize + len(payload)))
+			q.advance(int64(recordHeaderSize + len(payload)))
+			continue
+		}
+
+		var queued []queuedMetric
+		if err := json.Unmarshal(payload, &queued); err != nil {
+			log.Warningf("Failed to decode disk queue record in %s: %v", head.path(q.dir), err)
+			queueDroppedBytes.WithLabelValues(append(q.labels, "corrupted")...).Add(float64(recordHeaderSize + len(payload)))
+			q.advance(int64(recordHeaderSize + len(payload)))
+			continue
+		}
+
+		data := make([]metrics.Anodot20Metric, len(queued))
+		for i, m := range queued {
+			data[i] = metrics.Anodot20Metric{Properties: m.Properties, Tags: m.Tags, Timestamp: metrics.AnodotTimestamp{Time: time.Unix(0, m.Timestamp)}, Value: m.Value}
+		}
+		return data, QueuePosition{segment: head.id, offset: q.readOffset, size: int64(recordHeaderSize + len(payload))}, nil
+	}
+}
+
+// Ack removes batch at the given position returned by Peek from the queue. Batch which was already dropped because of
+// queue limits while it was sent is ignored.
+func (q *DiskQueue) Ack(pos QueuePosition) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.segments[0].id != pos.segment || q.readOffset != pos.offset {
+		return nil
+	}
+
+	queueSentBatches.WithLabelValues(q.labels...).Inc()
+	return q.advance(pos.size)
+}
+
+// advance moves read position to the next record. Must be called with q.mu held.
+func (q *DiskQueue) advance(size int64) error {
+	q.readOffset += size
+	q.replayed += size
+	if len(q.segments) > 1 && q.readOffset >= q.segments[0].size {
+		q.dropHead("")
+	} else if err := q.writeCheckpoint(); err != nil {
+		return err
+	}
+	q.updateMetrics()
+	return nil
+}
+
+// Wait pauses for the given duration and returns false if queue was closed meanwhile.
+func (q *DiskQueue) Wait(d time.Duration) bool {
+	select {
+	case <-q.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Close stops queue. Batches which are not acknowledged are sent after restart.
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+
+	err := q.sync()
+	q.closed = true
+	close(q.stop)
+	q.notEmpty.Broadcast()
+	if closeErr := q.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// updateMetrics must be called with q.mu held.
+func (q *DiskQueue) updateMetrics() {
+	pending := q.pendingBytes()
+	queueBytes.WithLabelValues(q.labels...).Set(float64(pending))
+	if pending == 0 {
+		queueOldestAge.WithLabelValues(q.labels...).Set(0)
+	}
+
+	progress := 1.0
+	if q.replayTotal > 0 && q.replayed < q.replayTotal {
+		progress = float64(q.replayed) / float64(q.replayTotal)
+	}
+	queueReplayProgress.WithLabelValues(q.labels...).Set(progress)
+}
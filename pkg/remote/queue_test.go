@@ -0,0 +1,315 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+func testQueueConfig(dir string) *QueueConfig {
+	return &QueueConfig{Dir: dir, MaxBytes: 1 << 20, MaxAge: time.Hour, SegmentBytes: 1 << 16, RetryInterval: 10 * time.Millisecond}
+}
+
+func queueBatch(value float64) []metrics.Anodot20Metric {
+	return []metrics.Anodot20Metric{{
+		Properties: map[string]string{"what": "up", "instance": "127.0.0.1:9090"},
+		Tags:       map[string]string{"env": "test"},
+		Timestamp:  metrics.AnodotTimestamp{Time: time.Unix(1600000000, 123)},
+		Value:      value,
+	}}
+}
+
+func openTestQueue(t *testing.T, config *QueueConfig) *DiskQueue {
+	q, err := OpenDiskQueue(config.Dir, config, []string{"127.0.0.1", DefaultTenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func peekValue(t *testing.T, q *DiskQueue) (float64, QueuePosition) {
+	data, pos, err := q.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data[0].Value, pos
+}
+
+func TestDiskQueueReplayAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testQueueConfig(dir)
+	q := openTestQueue(t, config)
+	for i := 1; i <= 3; i++ {
+		if err := q.Append(queueBatch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, pos, err := q.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0].Value != 1 || data[0].Timestamp.UnixNano() != time.Unix(1600000000, 123).UnixNano() || data[0].Properties["instance"] != "127.0.0.1:9090" {
+		t.Fatal(fmt.Sprintf("Wrong batch read from queue \n got: %+v\n want: %+v", data[0], queueBatch(1)[0]))
+	}
+	if err := q.Ack(pos); err != nil {
+		t.Fatal(err)
+	}
+	_ = q.Close()
+
+	// acknowledged batch is not replayed
+	q = openTestQueue(t, config)
+	defer q.Close()
+	for _, want := range []float64{2, 3} {
+		got, pos := peekValue(t, q)
+		if got != want {
+			t.Fatal(fmt.Sprintf("Wrong batch order after restart \n got: %v\n want: %v", got, want))
+		}
+		if err := q.Ack(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiskQueueCorruptedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testQueueConfig(dir)
+	q := openTestQueue(t, config)
+	for i := 1; i <= 2; i++ {
+		if err := q.Append(queueBatch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = q.Close()
+
+	// torn write of the last record
+	path := q.segments[0].path(dir)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openTestQueue(t, config)
+	defer q.Close()
+	got, pos := peekValue(t, q)
+	if got != 1 {
+		t.Fatal(fmt.Sprintf("Valid record should be kept \n got: %v\n want: %v", got, 1))
+	}
+	if err := q.Ack(pos); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Append(queueBatch(3)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := peekValue(t, q); got != 3 {
+		t.Fatal(fmt.Sprintf("Corrupted record should be dropped \n got: %v\n want: %v", got, 3))
+	}
+}
+
+func TestDiskQueueLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testQueueConfig(dir)
+	record := int64(recordHeaderSize + 140)
+	config.SegmentBytes = 2 * record
+	config.MaxBytes = 4 * record
+
+	q := openTestQueue(t, config)
+	defer q.Close()
+	for i := 1; i <= 10; i++ {
+		if err := q.Append(queueBatch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.pendingBytes() > config.MaxBytes {
+		t.Fatal(fmt.Sprintf("Queue exceeds size limit \n got: %d\n want: <= %d", q.pendingBytes(), config.MaxBytes))
+	}
+	if got, _ := peekValue(t, q); got <= 1 {
+		t.Fatal(fmt.Sprintf("The oldest batches should be dropped \n got: %v", got))
+	}
+
+	// expired segments are dropped
+	q.segments[0].last = time.Now().Add(-2 * time.Hour)
+	head := q.segments[0].id
+	q.Peek()
+	if q.segments[0].id == head {
+		t.Fatal("Expired segment should be dropped")
+	}
+}
+
+func TestDiskQueueAckDroppedBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testQueueConfig(dir)
+	record := int64(recordHeaderSize + 140)
+	config.SegmentBytes = 2 * record
+	config.MaxBytes = 4 * record
+
+	q := openTestQueue(t, config)
+	defer q.Close()
+	for i := 1; i <= 3; i++ {
+		if err := q.Append(queueBatch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, pos := peekValue(t, q)
+
+	// segment of batch which is being sent is dropped because of size limit
+	for i := 4; i <= 6; i++ {
+		if err := q.Append(queueBatch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head, _ := peekValue(t, q)
+	if err := q.Ack(pos); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := peekValue(t, q); got != head {
+		t.Fatal(fmt.Sprintf("Batch which is not sent should not be acknowledged \n got: %v\n want: %v", got, head))
+	}
+}
+
+func TestWorkerDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var sent []float64
+	calls := 0
+	submitter := MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// Anodot is unavailable for first requests
+		if calls <= 3 {
+			return nil, errors.New("connection refused")
+		}
+		for _, m := range data {
+			sent = append(sent, m.Value)
+		}
+		return nil, nil
+	}}
+
+	config := &WorkerConfig{BatchSendDeadline: time.Minute, MaxWorkers: 1, MetricsPerRequestSize: 1, MaxBufferSize: 10, OverflowPolicy: OverflowDropNewest, BufferFullStatusCode: 503, Queue: testQueueConfig(dir)}
+	worker, err := NewWorker(submitter, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.queue.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err := worker.Do(queueBatch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, DefaultTenant)); err != nil {
+		t.Fatal(err)
+	}
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := len(sent) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(sent) != "[1 2 3]" {
+		t.Fatal(fmt.Sprintf("Queued metrics should be sent in order after recovery \n got: %v\n want: [1 2 3]", sent))
+	}
+}
+
+func TestWorkerDiskQueueRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	sent := make(map[string]int)
+	destination := func(name string, failures int) metrics.Submitter {
+		return NewRetryingSubmitter(MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			if calls[name] <= failures {
+				return nil, errors.New("connection refused")
+			}
+			sent[name] += len(data)
+			return nil, nil
+		}}, testRetryConfig)
+	}
+
+	routingConfig := &RoutingConfig{}
+	routingConfig.AddMirror(MirrorDestination)
+	router, err := NewRouter(routingConfig, map[string]metrics.Submitter{PrimaryDestination: destination(PrimaryDestination, 0), MirrorDestination: destination(MirrorDestination, 2)}, testRetryConfig, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &WorkerConfig{BatchSendDeadline: time.Minute, MaxWorkers: 1, MetricsPerRequestSize: 1, MaxBufferSize: 10, OverflowPolicy: OverflowDropNewest, BufferFullStatusCode: 503, Queue: testQueueConfig(dir)}
+	worker, err := NewWorker(router, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.queue.Close()
+
+	if err := worker.Do(queueBatch(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// destinations do not retry themselves, so failed one is retried from queue without backoff of retry policy
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := sent[MirrorDestination] == 1
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent[MirrorDestination] != 1 || calls[MirrorDestination] != 3 {
+		t.Fatal(fmt.Sprintf("Failed destination should be retried from queue \n got: %d calls, %d sent\n want: 3 calls, 1 sent", calls[MirrorDestination], sent[MirrorDestination]))
+	}
+	if calls[PrimaryDestination] != 1 {
+		t.Fatal(fmt.Sprintf("Metrics should not be resent to destination which accepted them \n got: %d\n want: 1", calls[PrimaryDestination]))
+	}
+}
@@ -0,0 +1,161 @@
+package remote
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// GlobalRateLimiter is a name of limiter shared by all destinations and tenants of Anodot account.
+const GlobalRateLimiter = "global"
+
+var (
+	rateLimitEPS = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_rate_limit_eps",
+		Help: "Max number of metrics per second allowed by rate limiter, 0 means unlimited",
+	}, []string{"limiter"})
+
+	rateLimitWait = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_rate_limit_wait_seconds_total",
+		Help: "Total time spent waiting for rate limiter before sending metrics",
+	}, []string{"limiter"})
+)
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = make(map[string]*RateLimiter)
+)
+
+// RateLimiter is a token bucket which limits number of metrics per second. Batch larger than available tokens is sent
+// once tokens it lacks are accumulated, so limit holds on average for batches of any size.
+type RateLimiter struct {
+	Name string
+
+	mu     sync.Mutex
+	eps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter creates limiter allowing eps metrics per second with bursts up to burst metrics.
+// Zero eps means no limit and zero burst means one second of metrics. Limiter is registered by name, replacing previous one.
+func NewRateLimiter(name string, eps int, burst int) (*RateLimiter, error) {
+	l := &RateLimiter{Name: name, now: time.Now, sleep: time.Sleep}
+	if err := l.SetLimit(eps, burst); err != nil {
+		return nil, err
+	}
+	l.tokens = l.burst
+
+	rateLimitersMu.Lock()
+	rateLimiters[name] = l
+	rateLimitersMu.Unlock()
+	return l, nil
+}
+
+// RateLimiters returns registered limiters sorted by name.
+func RateLimiters() []*RateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	res := make([]*RateLimiter, 0, len(rateLimiters))
+	for _, l := range rateLimiters {
+		res = append(res, l)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// LookupRateLimiter returns registered limiter with the given name.
+func LookupRateLimiter(name string) (*RateLimiter, bool) {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	l, ok := rateLimiters[name]
+	return l, ok
+}
+
+// SetLimit changes limit at runtime. Tokens accumulated so far are kept up to the new burst.
+func (l *RateLimiter) SetLimit(eps int, burst int) error {
+	if eps < 0 || burst < 0 {
+		return fmt.Errorf("rate limit and burst of %s should not be negative", l.Name)
+	}
+	if burst == 0 {
+		burst = eps
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.eps = float64(eps)
+	l.burst = float64(burst)
+	l.tokens = math.Min(l.tokens, l.burst)
+	rateLimitEPS.WithLabelValues(l.Name).Set(l.eps)
+	return nil
+}
+
+// Limit returns current number of metrics per second and burst.
+func (l *RateLimiter) Limit() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.eps), int(l.burst)
+}
+
+// refill adds tokens accumulated since last call. Must be called with l.mu held.
+func (l *RateLimiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.eps)
+	}
+	l.last = now
+}
+
+// reserve takes n tokens and returns time to wait until they are available.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.eps <= 0 {
+		return 0
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.eps * float64(time.Second))
+}
+
+// Wait blocks until n metrics can be sent and returns time spent waiting.
+func (l *RateLimiter) Wait(n int) time.Duration {
+	d := l.reserve(n)
+	if d > 0 {
+		rateLimitWait.WithLabelValues(l.Name).Add(d.Seconds())
+		l.sleep(d)
+	}
+	return d
+}
+
+// RateLimitedSubmitter waits for rate limiter before every submission.
+type RateLimitedSubmitter struct {
+	metrics.Submitter
+	limiter *RateLimiter
+}
+
+func NewRateLimitedSubmitter(submitter metrics.Submitter, limiter *RateLimiter) *RateLimitedSubmitter {
+	return &RateLimitedSubmitter{Submitter: submitter, limiter: limiter}
+}
+
+func (s *RateLimitedSubmitter) SubmitMetrics(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	s.limiter.Wait(len(data))
+	return s.Submitter.SubmitMetrics(data)
+}
@@ -0,0 +1,85 @@
+package remote
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+func testRateLimiter(t *testing.T, eps int, burst int) (*RateLimiter, *[]time.Duration) {
+	l, err := NewRateLimiter(fmt.Sprintf("test/%d/%d", eps, burst), eps, burst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	var sleeps []time.Duration
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	l.last = now
+	return l, &sleeps
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, sleeps := testRateLimiter(t, 1000, 2000)
+
+	// burst is sent without waiting
+	if d := l.Wait(2000); d != 0 {
+		t.Fatal(fmt.Sprintf("Burst should not wait \n got: %v", d))
+	}
+	// batches of any size wait proportionally to their size
+	for _, n := range []int{500, 1500, 10} {
+		want := time.Duration(n) * time.Millisecond
+		if d := l.Wait(n); d != want {
+			t.Fatal(fmt.Sprintf("Wrong wait for batch of %d metrics \n got: %v\n want: %v", n, d, want))
+		}
+	}
+	if len(*sleeps) != 3 {
+		t.Fatal(fmt.Sprintf("Wrong number of waits \n got: %d\n want: %d", len(*sleeps), 3))
+	}
+
+	// limit is changed at runtime
+	if err := l.SetLimit(100, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := l.Wait(50); d != 500*time.Millisecond {
+		t.Fatal(fmt.Sprintf("Wrong wait after limit change \n got: %v\n want: %v", d, 500*time.Millisecond))
+	}
+	if eps, burst := l.Limit(); eps != 100 || burst != 100 {
+		t.Fatal(fmt.Sprintf("Wrong limit \n got: %d %d\n want: 100 100", eps, burst))
+	}
+
+	if err := l.SetLimit(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := l.Wait(1000000); d != 0 {
+		t.Fatal(fmt.Sprintf("Unlimited limiter should not wait \n got: %v", d))
+	}
+	if err := l.SetLimit(-1, 0); err == nil {
+		t.Fatal("error should be returned for negative limit")
+	}
+}
+
+func TestRateLimitedSubmitter(t *testing.T) {
+	l, sleeps := testRateLimiter(t, 10, 10)
+	if registered, ok := LookupRateLimiter(l.Name); !ok || registered != l {
+		t.Fatal("rate limiter should be registered by name")
+	}
+
+	s := NewRateLimitedSubmitter(MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		return nil, nil
+	}}, l)
+	for i := 0; i < 3; i++ {
+		if _, err := s.SubmitMetrics(randomMetrics(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(*sleeps) != "[1s 1s]" {
+		t.Fatal(fmt.Sprintf("Wrong waits \n got: %v\n want: [1s 1s]", *sleeps))
+	}
+}
@@ -0,0 +1,219 @@
+package remote
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "k8s.io/klog/v2"
+)
+
+var (
+	submissionRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_submission_retries_total",
+		Help: "Total number of retried metrics submissions to Anodot",
+	}, []string{"anodot_url"})
+
+	droppedBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_dropped_batches_total",
+		Help: "Total number of metrics batches dropped after failed submission to Anodot",
+	}, []string{"anodot_url", "reason"})
+
+	droppedBatchMetrics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_dropped_batch_metrics_total",
+		Help: "Total number of metrics in batches dropped after failed submission to Anodot",
+	}, []string{"anodot_url", "reason"})
+)
+
+// RetryConfig is a policy of retrying failed metrics submissions. Retries are disabled if MaxAttempts is 1.
+type RetryConfig struct {
+	MaxAttempts    int           `default:"5" split_words:"true" yaml:"max_attempts"`
+	InitialBackoff time.Duration `default:"1s" split_words:"true" yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `default:"30s" split_words:"true" yaml:"max_backoff"`
+	// MaxElapsedTime limits total time spent on submission of single batch, including retries.
+	MaxElapsedTime time.Duration `default:"2m" split_words:"true" yaml:"max_elapsed_time"`
+	// Jitter is a fraction of backoff which is randomly added or subtracted.
+	Jitter float64 `default:"0.2" yaml:"jitter"`
+}
+
+func NewRetryConfig() (*RetryConfig, error) {
+	config := &RetryConfig{}
+	if err := envconfig.Process("ANODOT_RETRY", config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *RetryConfig) Validate() error {
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("retry max attempts should be positive")
+	}
+	if c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("retry initial backoff should be positive and not greater than max backoff")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("retry jitter should be between 0 and 1")
+	}
+	return nil
+}
+
+// withDefaults returns copy of config with zero fields taken from defaults.
+func (c *RetryConfig) withDefaults(defaults *RetryConfig) *RetryConfig {
+	res := *c
+	if res.MaxAttempts == 0 {
+		res.MaxAttempts = defaults.MaxAttempts
+	}
+	if res.InitialBackoff == 0 {
+		res.InitialBackoff = defaults.InitialBackoff
+	}
+	if res.MaxBackoff == 0 {
+		res.MaxBackoff = defaults.MaxBackoff
+	}
+	if res.MaxElapsedTime == 0 {
+		res.MaxElapsedTime = defaults.MaxElapsedTime
+	}
+	if res.Jitter == 0 {
+		res.Jitter = defaults.Jitter
+	}
+	return &res
+}
+
+// backoff returns delay before the given retry attempt, starting from 1.
+func (c *RetryConfig) backoff(attempt int) time.Duration {
+	d := c.InitialBackoff
+	for i := 1; i < attempt && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if c.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * c.Jitter * float64(d))
+	}
+	return d
+}
+
+// RetryingSubmitter retries submissions failed with transient errors according to retry policy.
+type RetryingSubmitter struct {
+	metrics.Submitter
+	config *RetryConfig
+
+	sleep func(time.Duration)
+	now   func() time.Time
+}
+
+func NewRetryingSubmitter(submitter metrics.Submitter, config *RetryConfig) *RetryingSubmitter {
+	return &RetryingSubmitter{Submitter: submitter, config: config, sleep: time.Sleep, now: time.Now}
+}
+
+func (s *RetryingSubmitter) SubmitMetrics(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	host := s.AnodotURL().Host
+	start := s.now()
+
+	for attempt := 1; ; attempt++ {
+		resp, err := s.Submitter.SubmitMetrics(data)
+		if err == nil {
+			return resp, nil
+		}
+		if resp != nil && resp.RawResponse() != nil && resp.RawResponse().StatusCode == http.StatusOK {
+			// some metrics are rejected, the rest are accepted
+			return resp, err
+		}
+
+		if !retriable(resp) {
+			s.drop(host, "permanent_error", len(data))
+			return resp, err
+		}
+		if attempt >= s.config.MaxAttempts {
+			s.drop(host, "retries_exhausted", len(data))
+			return resp, err
+		}
+
+		delay := s.config.backoff(attempt)
+		if retryAfter, ok := retryAfter(resp, s.now()); ok && retryAfter > delay {
+			delay = retryAfter
+		}
+		if s.config.MaxElapsedTime > 0 && s.now().Add(delay).Sub(start) > s.config.MaxElapsedTime {
+			s.drop(host, "retries_exhausted", len(data))
+			return resp, err
+		}
+
+		closeResponse(resp)
+		submissionRetries.WithLabelValues(host).Inc()
+		log.V(3).Infof("Failed to send %d metric(s) to %s, attempt %d of %d, retrying in %s: %v", len(data), host, attempt, s.config.MaxAttempts, delay, err)
+		s.sleep(delay)
+	}
+}
+
+// withoutRetries returns submitter wrapped by RetryingSubmitter, for callers which keep failed batches and retry them
+// themselves, so batches are not counted as dropped. Router destinations are unwrapped as well. Other submitters are
+// returned as is.
+func withoutRetries(submitter metrics.Submitter) metrics.Submitter {
+	switch s := submitter.(type) {
+	case *RetryingSubmitter:
+		return s.Submitter
+	case *Router:
+		return s.withoutRetries()
+	}
+	return submitter
+}
+
+func (s *RetryingSubmitter) drop(host string, reason string, size int) {
+	droppedBatches.WithLabelValues(host, reason).Inc()
+	droppedBatchMetrics.WithLabelValues(host, reason).Add(float64(size))
+}
+
+// retriable returns true for connection errors, timeouts, throttling and server errors.
+func retriable(resp metrics.AnodotResponse) bool {
+	if resp == nil || resp.RawResponse() == nil {
+		return true
+	}
+
+	code := resp.RawResponse().StatusCode
+	switch {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code >= 500 && code != http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns delay requested by Retry-After header, either in seconds or as HTTP date.
+func retryAfter(resp metrics.AnodotResponse, now time.Time) (time.Duration, bool) {
+	if resp == nil || resp.RawResponse() == nil {
+		return 0, false
+	}
+
+	v := resp.RawResponse().Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// closeResponse releases connection of response which is not returned to caller.
+func closeResponse(resp metrics.AnodotResponse) {
+	if resp == nil || resp.RawResponse() == nil || resp.RawResponse().Body == nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.RawResponse().Body)
+	_ = resp.RawResponse().Body.Close()
+}
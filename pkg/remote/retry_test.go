@@ -0,0 +1,160 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+var testRetryConfig = &RetryConfig{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 4 * time.Second, MaxElapsedTime: time.Minute}
+
+// failingSubmitter fails first n submissions with given status code, 0 means connection error.
+func failingSubmitter(calls *int, n int, code int, header http.Header) MockSubmitter {
+	return MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		*calls++
+		if *calls > n {
+			return &metrics.CreateResponse{HttpResponse: &http.Response{StatusCode: http.StatusOK}}, nil
+		}
+		if code == 0 {
+			return &metrics.CreateResponse{HttpResponse: nil}, errors.New("connection refused")
+		}
+		return &metrics.CreateResponse{HttpResponse: &http.Response{StatusCode: code, Header: header}}, fmt.Errorf("http error: %d", code)
+	}}
+}
+
+func testRetryingSubmitter(submitter MockSubmitter, config *RetryConfig, sleeps *[]time.Duration) *RetryingSubmitter {
+	s := NewRetryingSubmitter(submitter, config)
+	now := time.Unix(1600000000, 0)
+	s.now = func() time.Time { return now }
+	s.sleep = func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+		now = now.Add(d)
+	}
+	return s
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  int
+		fails int
+		calls int
+		err   bool
+	}{
+		{"connection error", 0, 2, 3, false},
+		{"service unavailable", http.StatusServiceUnavailable, 1, 2, false},
+		{"too many requests", http.StatusTooManyRequests, 1, 2, false},
+		{"retries exhausted", http.StatusBadGateway, 5, 3, true},
+		{"bad request", http.StatusBadRequest, 1, 1, true},
+		{"unauthorized", http.StatusUnauthorized, 1, 1, true},
+		{"not implemented", http.StatusNotImplemented, 1, 1, true},
+		{"rejected metrics", http.StatusOK, 1, 1, true},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		var sleeps []time.Duration
+		s := testRetryingSubmitter(failingSubmitter(&calls, tt.fails, tt.code, nil), testRetryConfig, &sleeps)
+
+		_, err := s.SubmitMetrics(randomMetrics(1))
+		if calls != tt.calls || (err != nil) != tt.err {
+			t.Fatal(fmt.Sprintf("Wrong result for %s \n got: %d calls, err: %v\n want: %d calls, err: %v", tt.name, calls, err, tt.calls, tt.err))
+		}
+		if len(sleeps) != calls-1 {
+			t.Fatal(fmt.Sprintf("Wrong number of backoffs for %s \n got: %d\n want: %d", tt.name, len(sleeps), calls-1))
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	config := &RetryConfig{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 4 * time.Second, MaxElapsedTime: time.Minute}
+	calls := 0
+	var sleeps []time.Duration
+	s := testRetryingSubmitter(failingSubmitter(&calls, 10, http.StatusInternalServerError, nil), config, &sleeps)
+
+	if _, err := s.SubmitMetrics(randomMetrics(1)); err == nil {
+		t.Fatal("error should be returned after retries are exhausted")
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	if fmt.Sprint(sleeps) != fmt.Sprint(want) {
+		t.Fatal(fmt.Sprintf("Wrong backoffs \n got: %v\n want: %v", sleeps, want))
+	}
+
+	config.Jitter = 0.5
+	for attempt := 1; attempt < 10; attempt++ {
+		d := config.backoff(attempt)
+		if d < config.InitialBackoff/2 || d > config.MaxBackoff*3/2 {
+			t.Fatal(fmt.Sprintf("Backoff with jitter is out of bounds \n got: %v", d))
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	calls := 0
+	var sleeps []time.Duration
+	header := http.Header{"Retry-After": []string{"10"}}
+	s := testRetryingSubmitter(failingSubmitter(&calls, 1, http.StatusTooManyRequests, header), testRetryConfig, &sleeps)
+
+	if _, err := s.SubmitMetrics(randomMetrics(1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sleeps) != 1 || sleeps[0] != 10*time.Second {
+		t.Fatal(fmt.Sprintf("Retry-After should be respected \n got: %v\n want: %v", sleeps, []time.Duration{10 * time.Second}))
+	}
+
+	now := time.Unix(1600000000, 0)
+	resp := &metrics.CreateResponse{HttpResponse: &http.Response{Header: http.Header{"Retry-After": []string{now.Add(time.Minute).UTC().Format(http.TimeFormat)}}}}
+	if d, ok := retryAfter(resp, now); !ok || d != time.Minute {
+		t.Fatal(fmt.Sprintf("Wrong Retry-After date \n got: %v\n want: %v", d, time.Minute))
+	}
+}
+
+func TestRetryMaxElapsedTime(t *testing.T) {
+	config := &RetryConfig{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: time.Second, MaxElapsedTime: 5 * time.Second}
+	calls := 0
+	var sleeps []time.Duration
+	s := testRetryingSubmitter(failingSubmitter(&calls, 10, http.StatusServiceUnavailable, nil), config, &sleeps)
+
+	if _, err := s.SubmitMetrics(randomMetrics(1)); err == nil {
+		t.Fatal("error should be returned when max elapsed time is exceeded")
+	}
+	if calls != 6 {
+		t.Fatal(fmt.Sprintf("Wrong number of attempts \n got: %d\n want: %d", calls, 6))
+	}
+
+	// Retry-After exceeding max elapsed time stops retries immediately
+	calls = 0
+	sleeps = nil
+	header := http.Header{"Retry-After": []string{"3600"}}
+	s = testRetryingSubmitter(failingSubmitter(&calls, 10, http.StatusServiceUnavailable, header), config, &sleeps)
+	if _, err := s.SubmitMetrics(randomMetrics(1)); err == nil || calls != 1 {
+		t.Fatal(fmt.Sprintf("Wrong result for long Retry-After \n got: %d calls, err: %v\n want: 1 call and error", calls, err))
+	}
+}
+
+func TestRetryConfig(t *testing.T) {
+	config, err := NewRetryConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxAttempts != 5 || config.InitialBackoff != time.Second || config.MaxBackoff != 30*time.Second {
+		t.Fatal(fmt.Sprintf("Wrong default retry config \n got: %+v", config))
+	}
+
+	_ = os.Setenv("ANODOT_RETRY_MAX_ATTEMPTS", "0")
+	defer os.Unsetenv("ANODOT_RETRY_MAX_ATTEMPTS")
+	if _, err := NewRetryConfig(); err == nil {
+		t.Fatal("error should be returned for zero max attempts")
+	}
+
+	override := (&RetryConfig{MaxAttempts: 1}).withDefaults(testRetryConfig)
+	if override.MaxAttempts != 1 || override.MaxBackoff != testRetryConfig.MaxBackoff {
+		t.Fatal(fmt.Sprintf("Wrong retry config override \n got: %+v", override))
+	}
+}
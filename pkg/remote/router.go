@@ -0,0 +1,310 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// PrimaryDestination sends metrics to Anodot URL and token passed with -url and -token flags.
+	PrimaryDestination = "primary"
+	// MirrorDestination sends metrics to Anodot URL and token passed with -murl and -mtoken flags.
+	MirrorDestination = "mirror"
+)
+
+var (
+	routedMetrics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_routed_metrics_total",
+		Help: "Total number of metrics sent to routing destination",
+	}, []string{"destination"})
+
+	routingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_routing_errors_total",
+		Help: "Total number of errors occurred while sending metrics to routing destination",
+	}, []string{"destination"})
+)
+
+type DestinationConfig struct {
+	Name  string `yaml:"name"`
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+	// Retry overrides default retry policy of the destination.
+	Retry *RetryConfig `yaml:"retry,omitempty"`
+	// MaxEPS limits number of metrics per second sent to the destination, allowing bursts up to MaxBurst metrics.
+	MaxEPS   int `yaml:"max_eps,omitempty"`
+	MaxBurst int `yaml:"max_burst,omitempty"`
+}
+
+// RouteConfig sends metrics which routing label has one of Values to Destinations.
+type RouteConfig struct {
+	Values       []string `yaml:"values"`
+	Destinations []string `yaml:"destinations"`
+}
+
+type RoutingConfig struct {
+	// Label holds routing value. Label is removed from metrics before they are sent.
+	Label        string              `yaml:"label"`
+	Destinations []DestinationConfig `yaml:"destinations,omitempty"`
+	Routes       []RouteConfig       `yaml:"routes,omitempty"`
+	// Default destinations receive metrics without routing label or with value not matching any route.
+	Default []string `yaml:"default,omitempty"`
+}
+
+func LoadRoutingConfig(path string) (*RoutingConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config RoutingConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", path)
+	}
+
+	if config.Label == "" {
+		return nil, fmt.Errorf("routing label should be specified in %s", path)
+	}
+	if len(config.Default) == 0 {
+		config.Default = []string{PrimaryDestination}
+	}
+	return &config, nil
+}
+
+// AddMirror makes destination receive all metrics, in addition to destinations of every route and default ones.
+func (c *RoutingConfig) AddMirror(name string) {
+	if len(c.Default) == 0 {
+		c.Default = []string{PrimaryDestination}
+	}
+	c.Default = withDestination(c.Default, name)
+	for i := range c.Routes {
+		c.Routes[i].Destinations = withDestination(c.Routes[i].Destinations, name)
+	}
+}
+
+func withDestination(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+// Router is a metrics submitter which sends every metric to destinations selected by value of routing label.
+type Router struct {
+	label        string
+	destinations map[string]metrics.Submitter
+	routes       map[string][]string
+	defaults     []string
+	// only restricts destinations metrics are sent to, if it is set
+	only map[string]bool
+}
+
+// routingError is returned if metrics were not sent to some destinations. Metrics can be sent again to destinations
+// which failed with transient errors only, so they are not duplicated in destinations which accepted them.
+type routingError struct {
+	errs      []string
+	retriable []string
+}
+
+func (e *routingError) Error() string {
+	return strings.Join(e.errs, "; ")
+}
+
+// NewRouter creates router with destinations from config and predefined submitters, such as PrimaryDestination.
+// Submissions to configured destinations are retried according to retry policy of destination or default one.
+func NewRouter(config *RoutingConfig, submitters map[string]metrics.Submitter, retry *RetryConfig, client *http.Client, compression *CompressionConfig) (*Router, error) {
+	router := &Router{label: config.Label, destinations: make(map[string]metrics.Submitter), routes: make(map[string][]string), defaults: config.Default}
+	for name, s := range submitters {
+		router.destinations[name] = s
+	}
+
+	for _, d := range config.Destinations {
+		if d.Name == "" {
+			return nil, fmt.Errorf("routing destination name should be specified")
+		}
+		if _, ok := router.destinations[d.Name]; ok {
+			return nil, fmt.Errorf("routing destination %q is defined more than once", d.Name)
+		}
+
+		anodotURL, err := url.Parse(d.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url of routing destination %q: %w", d.Name, err)
+		}
+		s, err := NewSubmitter(*anodotURL, d.Token, client, compression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create submitter of routing destination %q: %w", d.Name, err)
+		}
+
+		destinationRetry := retry
+		if d.Retry != nil {
+			destinationRetry = d.Retry.withDefaults(retry)
+			if err := destinationRetry.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid retry policy of routing destination %q: %w", d.Name, err)
+			}
+		}
+		limiter, err := NewRateLimiter("destination/"+d.Name, d.MaxEPS, d.MaxBurst)
+		if err != nil {
+			return nil, err
+		}
+		router.destinations[d.Name] = NewRetryingSubmitter(NewRateLimitedSubmitter(s, limiter), destinationRetry)
+	}
+
+	if err := router.checkDestinations(config.Default); err != nil {
+		return nil, err
+	}
+	for _, r := range config.Routes {
+		if err := router.checkDestinations(r.Destinations); err != nil {
+			return nil, err
+		}
+		for _, v := range r.Values {
+			if _, ok := router.routes[v]; ok {
+				return nil, fmt.Errorf("routing value %q is used in more than one route", v)
+			}
+			router.routes[v] = r.Destinations
+		}
+	}
+	return router, nil
+}
+
+func (r *Router) checkDestinations(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("at least one routing destination should be specified")
+	}
+	for _, n := range names {
+		if _, ok := r.destinations[n]; !ok {
+			return fmt.Errorf("unknown routing destination %q", n)
+		}
+	}
+	return nil
+}
+
+// SubmitMetrics splits metrics by destination and sends them. Every destination retries its own batch, so once
+// metrics are accepted by any destination, response is never retriable and metrics are not resent to it by caller.
+// Errors of rejected metrics of all destinations refer to indexes of data.
+func (r *Router) SubmitMetrics(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	batches := make(map[string][]metrics.Anodot20Metric)
+	indexes := make(map[string][]int)
+	for i, m := range data {
+		destinations := r.defaults
+		if v, ok := m.Properties[r.label]; ok {
+			if d, found := r.routes[v]; found {
+				destinations = d
+			}
+			// properties are shared with caller, which may send the same data again
+			m.Properties = withoutProperty(m.Properties, r.label)
+		}
+
+		for _, d := range destinations {
+			if r.only != nil && !r.only[d] {
+				continue
+			}
+			batches[d] = append(batches[d], m)
+			indexes[d] = append(indexes[d], i)
+		}
+	}
+
+	names := make([]string, 0, len(batches))
+	for name := range batches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var accepted, failed metrics.AnodotResponse
+	anyAccepted, anyFailed := false, false
+	rejected := &metrics.CreateResponse{}
+	errs := &routingError{}
+	for _, name := range names {
+		routedMetrics.WithLabelValues(name).Add(float64(len(batches[name])))
+		resp, err := r.destinations[name].SubmitMetrics(batches[name])
+		if err != nil {
+			routingErrors.WithLabelValues(name).Inc()
+			errs.errs = append(errs.errs, fmt.Sprintf("destination %s: %v", name, err))
+			if retriable(resp) {
+				errs.retriable = append(errs.retriable, name)
+			}
+		}
+
+		switch {
+		case err == nil || (resp != nil && resp.RawResponse() != nil && resp.RawResponse().StatusCode == http.StatusOK):
+			if !anyAccepted || accepted == nil || accepted.RawResponse() == nil {
+				accepted = resp
+			}
+			anyAccepted = true
+		case !anyFailed || (!retriable(failed) && retriable(resp)):
+			// transient error is preferred, so whole batch is retried
+			failed = resp
+			anyFailed = true
+		}
+
+		if createResponse, ok := resp.(*metrics.CreateResponse); ok && createResponse != nil {
+			for _, e := range createResponse.Errors {
+				if i, err := strconv.Atoi(e.Index); err == nil && i >= 0 && i < len(indexes[name]) {
+					e.Index = strconv.Itoa(indexes[name][i])
+				}
+				e.Description = fmt.Sprintf("destination %s: %s", name, e.Description)
+				rejected.Errors = append(rejected.Errors, e)
+			}
+		}
+	}
+
+	if len(errs.errs) == 0 {
+		return accepted, nil
+	}
+	if !anyAccepted {
+		// nothing is accepted, so it is safe to retry the whole batch
+		return failed, errs
+	}
+
+	// some destinations accepted metrics, retries of the failed ones are already exhausted
+	rejected.HttpResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	if accepted != nil && accepted.RawResponse() != nil {
+		rejected.HttpResponse = accepted.RawResponse()
+	}
+	return rejected, errs
+}
+
+// to returns router which sends metrics to the given destinations only.
+func (r *Router) to(names []string) *Router {
+	res := *r
+	res.only = make(map[string]bool, len(names))
+	for _, n := range names {
+		res.only[n] = true
+	}
+	return &res
+}
+
+// withoutRetries returns router which destinations do not retry failed submissions.
+func (r *Router) withoutRetries() *Router {
+	res := *r
+	res.destinations = make(map[string]metrics.Submitter, len(r.destinations))
+	for name, s := range r.destinations {
+		res.destinations[name] = withoutRetries(s)
+	}
+	return &res
+}
+
+func withoutProperty(properties map[string]string, name string) map[string]string {
+	res := make(map[string]string, len(properties))
+	for k, v := range properties {
+		if k != name {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// AnodotURL returns URL of the first default destination.
+func (r *Router) AnodotURL() *url.URL {
+	return r.destinations[r.defaults[0]].AnodotURL()
+}
@@ -0,0 +1,237 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+func recordingSubmitter(sent map[string][]metrics.Anodot20Metric, name string, err error) MockSubmitter {
+	return MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+		sent[name] = append(sent[name], data...)
+		return nil, err
+	}}
+}
+
+func TestRouterSubmitMetrics(t *testing.T) {
+	sent := make(map[string][]metrics.Anodot20Metric)
+	submitters := map[string]metrics.Submitter{
+		PrimaryDestination: recordingSubmitter(sent, PrimaryDestination, nil),
+		"team-a":           recordingSubmitter(sent, "team-a", nil),
+		"team-b":           recordingSubmitter(sent, "team-b", nil),
+	}
+	config := &RoutingConfig{
+		Label: "anodot_account",
+		Routes: []RouteConfig{
+			{Values: []string{"a"}, Destinations: []string{"team-a"}},
+			{Values: []string{"b", "shared"}, Destinations: []string{"team-b", PrimaryDestination}},
+		},
+		Default: []string{PrimaryDestination},
+	}
+	router, err := NewRouter(config, submitters, testRetryConfig, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metric := func(what string, account string) metrics.Anodot20Metric {
+		properties := map[string]string{"what": what}
+		if account != "" {
+			properties["anodot_account"] = account
+		}
+		return metrics.Anodot20Metric{Properties: properties}
+	}
+	if _, err := router.SubmitMetrics([]metrics.Anodot20Metric{metric("m1", "a"), metric("m2", "shared"), metric("m3", ""), metric("m4", "c")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		PrimaryDestination: {"m2", "m3", "m4"},
+		"team-a":           {"m1"},
+		"team-b":           {"m2"},
+	}
+	for name, whats := range expected {
+		var got []string
+		for _, m := range sent[name] {
+			if _, ok := m.Properties["anodot_account"]; ok {
+				t.Fatal(fmt.Sprintf("Routing label should be removed \n got: %v", m.Properties))
+			}
+			got = append(got, m.Properties["what"])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(whats) {
+			t.Fatal(fmt.Sprintf("Wrong metrics sent to %s \n got: %v\n want: %v", name, got, whats))
+		}
+	}
+
+	if router.AnodotURL().Host != "127.0.0.1" {
+		t.Fatal(fmt.Sprintf("Wrong Anodot URL \n got: %s\n want: 127.0.0.1", router.AnodotURL()))
+	}
+}
+
+func TestRouterRejectedMetrics(t *testing.T) {
+	submitters := map[string]metrics.Submitter{
+		PrimaryDestination: MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+			return rejectingResponse("1"), fmt.Errorf("rejected")
+		}},
+		"team-a": MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+			return rejectingResponse("0"), fmt.Errorf("rejected")
+		}},
+	}
+	config := &RoutingConfig{Label: "anodot_account", Routes: []RouteConfig{{Values: []string{"a"}, Destinations: []string{"team-a"}}}, Default: []string{PrimaryDestination}}
+	router, err := NewRouter(config, submitters, testRetryConfig, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []metrics.Anodot20Metric{
+		{Properties: map[string]string{"what": "m0"}},
+		{Properties: map[string]string{"what": "m1", "anodot_account": "a"}},
+		{Properties: map[string]string{"what": "m2"}},
+	}
+	resp, err := router.SubmitMetrics(data)
+	if err == nil {
+		t.Fatal("error should be returned for rejected metrics")
+	}
+
+	var got []string
+	for _, e := range resp.(*metrics.CreateResponse).Errors {
+		got = append(got, e.Index)
+	}
+	// primary received m0, m2 and rejected m2, team-a received m1 and rejected it
+	if fmt.Sprint(got) != "[2 1]" {
+		t.Fatal(fmt.Sprintf("Indexes of rejected metrics should refer to routed batch \n got: %v\n want: [2 1]", got))
+	}
+}
+
+func TestRouterFailedDestination(t *testing.T) {
+	sent := make(map[string][]metrics.Anodot20Metric)
+	submitters := map[string]metrics.Submitter{
+		PrimaryDestination: recordingSubmitter(sent, PrimaryDestination, nil),
+		"team-a":           recordingSubmitter(sent, "team-a", fmt.Errorf("team-a is down")),
+	}
+	config := &RoutingConfig{Label: "anodot_account", Routes: []RouteConfig{{Values: []string{"a"}, Destinations: []string{"team-a"}}}, Default: []string{PrimaryDestination}}
+	router, err := NewRouter(config, submitters, testRetryConfig, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []metrics.Anodot20Metric{
+		{Properties: map[string]string{"what": "m0"}},
+		{Properties: map[string]string{"what": "m1", "anodot_account": "a"}},
+	}
+	resp, err := router.SubmitMetrics(data)
+	if err == nil {
+		t.Fatalf("error of failed destination should be returned")
+	}
+	if retriable(resp) {
+		t.Fatalf("response should not be retriable once metrics are accepted by some destination")
+	}
+	if data[1].Properties["anodot_account"] != "a" {
+		t.Fatal(fmt.Sprintf("Routing label should not be removed from submitted data \n got: %v", data[1].Properties))
+	}
+
+	// nothing is accepted
+	resp, err = router.SubmitMetrics(data[1:])
+	if err == nil || !retriable(resp) {
+		t.Fatal(fmt.Sprintf("transient error should be retriable if no destination accepted metrics \n got: %v, %v", resp, err))
+	}
+	if len(sent["team-a"]) != 2 || sent["team-a"][1].Properties["anodot_account"] != "" {
+		t.Fatal(fmt.Sprintf("Resent metrics should be routed to the same destination \n got: %v", sent["team-a"]))
+	}
+}
+
+func TestRouterResponse(t *testing.T) {
+	response := &metrics.CreateResponse{HttpResponse: &http.Response{StatusCode: http.StatusOK}}
+	submitters := map[string]metrics.Submitter{
+		PrimaryDestination: MockSubmitter{},
+		"team-a": MockSubmitter{f: func(data []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+			return response, nil
+		}},
+	}
+	config := &RoutingConfig{Label: "anodot_account", Routes: []RouteConfig{{Values: []string{"a"}, Destinations: []string{"team-a"}}}, Default: []string{PrimaryDestination}}
+	router, err := NewRouter(config, submitters, testRetryConfig, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no metrics are routed to default destination
+	resp, err := router.SubmitMetrics([]metrics.Anodot20Metric{{Properties: map[string]string{"what": "m0", "anodot_account": "a"}}})
+	if err != nil || resp != response {
+		t.Fatal(fmt.Sprintf("Response of destination which received metrics should be returned \n got: %v, %v", resp, err))
+	}
+}
+
+func TestLoadRoutingConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routing.yml")
+	content := `
+label: anodot_account
+destinations:
+  - name: team-a
+    url: https://a.anodot.com
+    token: token-a
+    retry:
+      max_attempts: 10
+      max_backoff: 1m
+routes:
+  - values: [a]
+    destinations: [team-a]
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadRoutingConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Default) != 1 || config.Default[0] != PrimaryDestination {
+		t.Fatal(fmt.Sprintf("Wrong default destinations \n got: %v\n want: [%s]", config.Default, PrimaryDestination))
+	}
+
+	primary := map[string]metrics.Submitter{PrimaryDestination: MockSubmitter{}}
+	router, err := NewRouter(config, primary, testRetryConfig, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry := router.destinations["team-a"].(*RetryingSubmitter).config
+	if retry.MaxAttempts != 10 || retry.MaxBackoff != time.Minute || retry.InitialBackoff != testRetryConfig.InitialBackoff {
+		t.Fatal(fmt.Sprintf("Wrong retry policy of destination \n got: %+v", retry))
+	}
+
+	invalid := []*RoutingConfig{
+		{Label: "l", Default: []string{"unknown"}},
+		{Label: "l", Default: []string{PrimaryDestination}, Routes: []RouteConfig{{Values: []string{"a"}}}},
+		{Label: "l", Default: []string{PrimaryDestination}, Destinations: []DestinationConfig{{Name: PrimaryDestination, URL: "https://a.anodot.com"}}},
+		{Label: "l", Default: []string{PrimaryDestination}, Destinations: []DestinationConfig{{Name: "b", URL: "https://b.anodot.com", Retry: &RetryConfig{Jitter: 2}}}},
+		{Label: "l", Default: []string{PrimaryDestination}, Routes: []RouteConfig{
+			{Values: []string{"a"}, Destinations: []string{PrimaryDestination}},
+			{Values: []string{"a"}, Destinations: []string{PrimaryDestination}},
+		}},
+	}
+	for i, c := range invalid {
+		if _, err := NewRouter(c, primary, testRetryConfig, nil, nil); err == nil {
+			t.Fatalf("error should be returned for invalid config %d", i)
+		}
+	}
+}
+
+func TestRoutingConfigAddMirror(t *testing.T) {
+	config := &RoutingConfig{Label: "anodot_account", Routes: []RouteConfig{{Values: []string{"a"}, Destinations: []string{"team-a"}}}}
+	config.AddMirror(MirrorDestination)
+	config.AddMirror(MirrorDestination)
+
+	if fmt.Sprint(config.Default) != "[primary mirror]" || fmt.Sprint(config.Routes[0].Destinations) != "[team-a mirror]" {
+		t.Fatal(fmt.Sprintf("Mirror should receive metrics of all routes \n got: %v, %v", config.Default, config.Routes[0].Destinations))
+	}
+}
@@ -3,9 +3,9 @@ package remote
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"net/http"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,13 +17,30 @@ import (
 	log "k8s.io/klog/v2"
 )
 
+// DefaultTenant is a tenant of workers which send metrics of requests without tenant ID.
+const DefaultTenant = "default"
+
 type Worker struct {
 	metricsSubmitter metrics.Submitter
+	// Tenant is used to label worker metrics.
+	Tenant string
 
 	currentWorkers int64
 
 	mu            sync.RWMutex
 	MetricsBuffer []metrics.Anodot20Metric
+	// estimated size of buffered metrics in bytes
+	bufferBytes int
+	// signalled once metrics are removed from buffer
+	bufferDrained *sync.Cond
+	// queue persists metrics instead of buffer if disk queue is enabled
+	queue *DiskQueue
+	// limiter adjusts number of concurrent requests to Anodot
+	limiter *concurrencyLimiter
+	// rateLimiter limits number of metrics per second sent by worker
+	rateLimiter *RateLimiter
+	// aggregator rolls metrics up into time buckets before they are buffered, if aggregation is configured
+	aggregator *Aggregator
 
 	FlushBuffer chan bool
 
@@ -34,12 +51,44 @@ type Worker struct {
 
 type WorkerConfig struct {
 	BatchSendDeadline time.Duration `default:"1m" split_words:"true"`
-	MaxAllowedEPS     int           `default:"0" split_words:"true"`
-
+	// MaxAllowedEPS limits number of metrics per second sent by worker, allowing bursts up to MaxAllowedBurst metrics.
+	MaxAllowedEPS   int `default:"0" split_words:"true"`
+	MaxAllowedBurst int `default:"0" split_words:"true"`
+	// GlobalMaxAllowedEPS and GlobalMaxAllowedBurst configure GlobalLimiter.
+	GlobalMaxAllowedEPS   int `default:"0" split_words:"true"`
+	GlobalMaxAllowedBurst int `default:"0" split_words:"true"`
+
+	// MinWorkers and MaxWorkers bound number of concurrent requests. It starts at MaxWorkers and is decreased on Anodot
+	// errors and latency spikes.
+	MinWorkers            int64 `default:"1" split_words:"true"`
 	MaxWorkers            int64 `default:"20" split_words:"true" `
 	MetricsPerRequestSize int   `default:"1000" split_words:"true"`
+	// MaxRequestBytes limits estimated size of request payload in addition to MetricsPerRequestSize. Zero means no limit.
+	MaxRequestBytes int `default:"0" split_words:"true"`
+	// LatencyTolerance is a ratio of request latency to average one, exceeding which decreases concurrency.
+	LatencyTolerance float64 `default:"2" split_words:"true"`
+
+	// MaxBufferSize and MaxBufferBytes limit number and estimated size of buffered metrics. Zero means no limit.
+	MaxBufferSize  int `default:"1000000" split_words:"true"`
+	MaxBufferBytes int `default:"0" split_words:"true"`
+	// OverflowPolicy is applied once buffer is full: drop-oldest, drop-newest or block.
+	OverflowPolicy string `default:"drop-newest" split_words:"true"`
+	// BlockTimeout is a max time metrics wait for buffer room with block policy. Metrics which still do not fit are dropped.
+	BlockTimeout time.Duration `default:"5s" split_words:"true"`
+	// BufferFullStatusCode is returned to Prometheus for write requests received while buffer is full, either 429 or 503.
+	BufferFullStatusCode int `default:"503" split_words:"true"`
 
 	Debug bool `default:"false"`
+
+	// Queue is configured separately by NewQueueConfig.
+	Queue *QueueConfig `ignored:"true"`
+	// DeadLetter keeps metrics rejected by Anodot. It is shared by all workers.
+	DeadLetter *DeadLetterWriter `ignored:"true"`
+	// GlobalLimiter limits number of metrics per second sent by all workers to Anodot account.
+	GlobalLimiter *RateLimiter `ignored:"true"`
+	// Aggregation enables pre-aggregation of metrics into time buckets. It can not be used with disk queue, since
+	// open buckets are kept in memory only.
+	Aggregation *AggregationConfig `ignored:"true"`
 }
 
 func NewWorkerConfig() (*WorkerConfig, error) {
@@ -50,12 +99,32 @@ func NewWorkerConfig() (*WorkerConfig, error) {
 		config.MaxWorkers = 20
 	}
 
+	if config.MinWorkers <= 0 || config.MinWorkers > config.MaxWorkers {
+		config.MinWorkers = 1
+	}
+
 	if config.MetricsPerRequestSize <= 0 {
 		config.MetricsPerRequestSize = 1000
 	}
 
-	if config.MaxAllowedEPS != 0 && config.MaxAllowedEPS < config.MetricsPerRequestSize {
-		return nil, fmt.Errorf("ANODOT_MAX_ALLOWED_EPS should be grather than ANODOT_METRICS_PER_REQUEST_SIZE")
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = OverflowDropNewest
+	}
+	if config.BufferFullStatusCode == 0 {
+		config.BufferFullStatusCode = http.StatusServiceUnavailable
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = 5 * time.Second
+	}
+
+	switch config.OverflowPolicy {
+	case OverflowDropOldest, OverflowDropNewest, OverflowBlock:
+	default:
+		return nil, fmt.Errorf("ANODOT_OVERFLOW_POLICY should be one of %s, %s, %s", OverflowDropOldest, OverflowDropNewest, OverflowBlock)
+	}
+
+	if config.BufferFullStatusCode != http.StatusTooManyRequests && config.BufferFullStatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("ANODOT_BUFFER_FULL_STATUS_CODE should be either 429 or 503")
 	}
 
 	return config, err
@@ -66,9 +135,16 @@ func (w *Worker) SetStopWg(wg *sync.WaitGroup) {
 }
 
 func (w *Worker) String() string {
+	if w.Tenant != DefaultTenant {
+		return fmt.Sprintf("Anodot URL='%s' tenant='%s'", w.metricsSubmitter.AnodotURL().Host, w.Tenant)
+	}
 	return fmt.Sprintf("Anodot URL='%s'", w.metricsSubmitter.AnodotURL().Host)
 }
 
+func (w *Worker) labelValues() []string {
+	return []string{w.metricsSubmitter.AnodotURL().Host, w.Tenant}
+}
+
 func (w *Worker) BufferSize() int {
 	w.mu.RLock()
 	size := len(w.MetricsBuffer)
@@ -89,7 +165,7 @@ func (w *Worker) FirstTimestamp() *time.Time {
 	return &res.Time
 }
 
-var labels = []string{"anodot_url"}
+var labels = []string{"anodot_url", "tenant"}
 
 var (
 	concurrencyLimitReached = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -97,10 +173,10 @@ var (
 		Help: "Total count when concurrency limit was reached",
 	}, labels)
 
-	metricsReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	metricsReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "anodot_remote_write_prometheus_samples_received_total",
 		Help: "Total number of Prometheus metrics received",
-	})
+	}, []string{"tenant"})
 
 	concurrentWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "anodot_remote_write_concurrent_workers",
@@ -117,6 +193,22 @@ var (
 		Help: "Anodot remote write metrics buffer size.",
 	}, labels)
 
+	bufferedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_remote_write_buffered_bytes",
+		Help: "Estimated size of metrics stored in buffer in bytes",
+	}, labels)
+
+	bufferDroppedMetrics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_remote_write_buffer_dropped_metrics_total",
+		Help: "Total number of metrics dropped because buffer was full",
+	}, append(labels, "policy"))
+
+	requestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "anodot_remote_write_request_size_bytes",
+		Help:    "Estimated size of metrics payloads sent to Anodot in bytes",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, labels)
+
 	anodotServerResponseTime = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Name:       "anodot_server_response_time_seconds",
 		Help:       "Anodot server response time in seconds",
@@ -131,12 +223,12 @@ var (
 	serverHTTPResponses = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "anodot_server_http_responses_total",
 		Help: "Total number of HTTP responses of Anodot server",
-	}, []string{"anodot_url", "response_code"})
+	}, []string{"anodot_url", "tenant", "response_code"})
 
-	maxEPSLimit = promauto.NewGauge(prometheus.GaugeOpts{
+	maxEPSLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "anodot_remote_write_eps_limit",
 		Help: "Max number of events per second allowed to send to Anodot server",
-	})
+	}, []string{"limiter"})
 
 	throttlingTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "anodot_workers_throttle_time_ms",
@@ -145,6 +237,11 @@ var (
 )
 
 func NewWorker(metricsSubmitter metrics.Submitter, config *WorkerConfig) (*Worker, error) {
+	return NewTenantWorker(DefaultTenant, metricsSubmitter, config)
+}
+
+// NewTenantWorker creates worker which sends metrics of the given tenant.
+func NewTenantWorker(tenant string, metricsSubmitter metrics.Submitter, config *WorkerConfig) (*Worker, error) {
 	if metricsSubmitter == nil {
 		return nil, fmt.Errorf("metrics submitter should not be nil")
 	}
@@ -153,28 +250,40 @@ func NewWorker(metricsSubmitter metrics.Submitter, config *WorkerConfig) (*Worke
 		return nil, fmt.Errorf("worker config should not be nil")
 	}
 
-	maxEPSString := os.Getenv("ANODOT_MAX_ALLOWED_EPS")
-	maxAllowedEps := 0
-	if len(strings.TrimSpace(maxEPSString)) > 0 {
-		var err error
-		maxAllowedEps, err = strconv.Atoi(maxEPSString)
-		if err != nil {
-			return nil, err
-		}
+	worker := &Worker{metricsSubmitter: metricsSubmitter, Tenant: tenant, WorkerConfig: config, MetricsBuffer: make([]metrics.Anodot20Metric, 0, 100000), FlushBuffer: make(chan bool, 4*config.MaxWorkers), Done: make(chan bool)}
+	worker.bufferDrained = sync.NewCond(&worker.mu)
+	worker.limiter = newConcurrencyLimiter(config.MinWorkers, config.MaxWorkers, config.LatencyTolerance, worker.labelValues())
+	// workers of the same tenant may send metrics to different Anodot servers, e.g. primary and mirror
+	rateLimiter, err := NewRateLimiter(fmt.Sprintf("tenant/%s/%s", tenant, metricsSubmitter.AnodotURL().Host), config.MaxAllowedEPS, config.MaxAllowedBurst)
+	if err != nil {
+		return nil, err
 	}
-	maxEPSLimit.Set(float64(maxAllowedEps))
-
-	worker := &Worker{metricsSubmitter: metricsSubmitter, WorkerConfig: config, MetricsBuffer: make([]metrics.Anodot20Metric, 0, 100000), FlushBuffer: make(chan bool, 4*config.MaxWorkers), Done: make(chan bool)}
+	worker.rateLimiter = rateLimiter
+	maxEPSLimit.WithLabelValues(rateLimiter.Name).Set(float64(config.MaxAllowedEPS))
 	log.V(4).Infof("Metrics per request size is : %d", worker.MetricsPerRequestSize)
 	log.V(4).Infof("Metrics buffer size is : %d", len(worker.MetricsBuffer))
 
-	bufferSize.WithLabelValues(worker.metricsSubmitter.AnodotURL().Host).Set(float64(len(worker.MetricsBuffer)))
+	bufferSize.WithLabelValues(worker.labelValues()...).Set(float64(worker.MaxBufferSize))
 
-	var throttle *time.Ticker
-	if worker.MaxAllowedEPS > 0 {
-		duration := time.Duration(1e6/(maxAllowedEps/worker.MetricsPerRequestSize)) * time.Microsecond
-		log.V(2).Infof("Throttling interval is: %s", duration.String())
-		throttle = time.NewTicker(duration)
+	if config.Aggregation != nil {
+		if config.Queue.Enabled() && !config.Debug {
+			// open time buckets are kept in memory in front of disk queue, so they would be lost on restart
+			return nil, fmt.Errorf("aggregation is not supported together with disk queue, ANODOT_QUEUE_DIR should be empty")
+		}
+		worker.aggregator, err = NewAggregator(config.Aggregation, worker.labelValues())
+		if err != nil {
+			return nil, err
+		}
+		go worker.flushAggregated()
+	}
+
+	if config.Queue.Enabled() && !config.Debug {
+		queue, err := OpenDiskQueue(filepath.Join(config.Queue.Dir, tenant), config.Queue, worker.labelValues())
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk queue: %w", err)
+		}
+		worker.queue = queue
+		go worker.sendQueued()
 	}
 
 	//used to clean metrics buffer by expiration time
@@ -196,98 +305,251 @@ func NewWorker(metricsSubmitter metrics.Submitter, config *WorkerConfig) (*Worke
 	go func(w *Worker) {
 		for {
 			<-w.FlushBuffer
-			bufferedMetrics.WithLabelValues(w.metricsSubmitter.AnodotURL().Host).Set(float64(w.BufferSize()))
-
-			var chunkSize int
-
-			for w.BufferSize() > 0 {
-				//throttle if needed
-				if w.MaxAllowedEPS > 0 {
-					start := time.Now()
-					<-throttle.C
-					throttlingTime.WithLabelValues(w.metricsSubmitter.AnodotURL().Host).Add(float64(time.Since(start).Milliseconds()))
-				}
-
-				select {
-				case <-w.FlushBuffer:
-				default:
-				}
-
-				w.mu.Lock()
+			bufferedMetrics.WithLabelValues(w.labelValues()...).Set(float64(w.BufferSize()))
 
-				if len(w.MetricsBuffer) > w.MetricsPerRequestSize {
-					chunkSize = w.MetricsPerRequestSize
-				} else {
-					chunkSize = len(w.MetricsBuffer)
-				}
-
-				metricsToSend := make([]metrics.Anodot20Metric, chunkSize)
-				copy(metricsToSend, w.MetricsBuffer[0:chunkSize])
-				w.MetricsBuffer = append(w.MetricsBuffer[:0], w.MetricsBuffer[chunkSize:]...)
-				bufferedMetrics.WithLabelValues(w.metricsSubmitter.AnodotURL().Host).Set(float64(len(w.MetricsBuffer)))
-				w.mu.Unlock()
-
-				if atomic.LoadInt64(&w.currentWorkers) >= w.MaxWorkers {
-					concurrencyLimitReached.WithLabelValues(w.metricsSubmitter.AnodotURL().Host).Inc()
-					log.Warning("Reached workers concurrency limit. Sending metrics in single thread.")
-					w.pushMetrics(w.metricsSubmitter, metricsToSend)
-				} else {
-					go func() {
-						w.pushMetrics(w.metricsSubmitter, metricsToSend)
-					}()
-				}
-			}
+			w.sendBuffer()
 			select {
 			case <-w.Done:
 				log.Info("Stop worker")
+				if w.aggregator != nil {
+					// buckets which are still open are sent partially aggregated. They are buffered regardless of
+					// buffer limits, since only this goroutine sends buffered metrics, so it can not wait for room.
+					data := w.aggregator.FlushAll()
+					w.mu.Lock()
+					w.appendToBuffer(data)
+					w.mu.Unlock()
+					w.sendBuffer()
+				}
+				if w.queue != nil {
+					if err := w.queue.Close(); err != nil {
+						log.Error("Failed to close disk queue: ", err)
+					}
+				}
 				w.stopWg.Done()
 				return
 			default:
 			}
-			concurrentWorkers.WithLabelValues(w.metricsSubmitter.AnodotURL().Host).Set(float64(atomic.LoadInt64(&w.currentWorkers)))
+			concurrentWorkers.WithLabelValues(w.labelValues()...).Set(float64(atomic.LoadInt64(&w.currentWorkers)))
 		}
 	}(worker)
 
 	return worker, nil
 }
 
-func (w *Worker) Do(data []metrics.Anodot20Metric) {
+// sendBuffer sends all buffered metrics in chunks.
+func (w *Worker) sendBuffer() {
+	for w.BufferSize() > 0 {
+		select {
+		case <-w.FlushBuffer:
+		default:
+		}
+
+		w.mu.Lock()
+
+		chunkSize := w.chunkSize(w.MetricsBuffer)
+		metricsToSend := make([]metrics.Anodot20Metric, chunkSize)
+		copy(metricsToSend, w.MetricsBuffer[0:chunkSize])
+		w.removeOldest(chunkSize)
+		w.mu.Unlock()
+
+		w.throttle(len(metricsToSend))
+		w.acquire()
+		go func() {
+			w.pushMetrics(w.metricsSubmitter, metricsToSend)
+		}()
+	}
+}
+
+// acquire waits for a slot of concurrency limiter.
+func (w *Worker) acquire() {
+	if w.limiter.Acquire() {
+		concurrencyLimitReached.WithLabelValues(w.labelValues()...).Inc()
+		log.V(4).Infof("Reached workers concurrency limit of %d", w.limiter.Limit())
+	}
+}
+
+// Do adds metrics to buffer, or to time buckets if aggregation is enabled. Error is returned if some metrics were
+// dropped because buffer is full. With aggregation enabled and drop-newest policy, all metrics are dropped while
+// buffer is full, since their aggregates could not be buffered.
+func (w *Worker) Do(data []metrics.Anodot20Metric) error {
 	log.V(3).Infof("Received (%d) metric(s): ", len(data))
-	metricsReceivedTotal.Add(float64(len(data)))
+	metricsReceivedTotal.WithLabelValues(w.Tenant).Add(float64(len(data)))
 	if w.Debug {
 		bytes, err := json.Marshal(data)
 		if err != nil {
 			log.Error("failed to display metrics:", err)
 		}
 		log.V(2).Info(string(bytes))
-		return
+		return nil
+	}
+
+	if w.aggregator != nil {
+		if !w.HasRoom(data) {
+			bufferDroppedMetrics.WithLabelValues(append(w.labelValues(), w.OverflowPolicy)...).Add(float64(len(data)))
+			return ErrBufferFull
+		}
+		w.aggregator.Add(data, time.Now())
+		return nil
+	}
+	return w.enqueue(data)
+}
+
+// flushAggregated buffers metrics of closed time buckets.
+func (w *Worker) flushAggregated() {
+	ticker := time.NewTicker(aggregationFlushPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		data := w.aggregator.Flush(time.Now())
+		if len(data) == 0 {
+			continue
+		}
+		if err := w.enqueue(data); err != nil {
+			log.Error("Failed to buffer aggregated metrics: ", err)
+		}
+	}
+}
+
+// enqueue adds metrics to disk queue if it is enabled, or to buffer otherwise.
+func (w *Worker) enqueue(data []metrics.Anodot20Metric) error {
+	if w.queue != nil {
+		if err := w.queue.Append(data); err != nil {
+			log.Error("Failed to store metrics in disk queue: ", err)
+			return err
+		}
+		return nil
 	}
 
 	w.mu.Lock()
-	w.MetricsBuffer = append(w.MetricsBuffer, data...)
-	bufferedMetrics.WithLabelValues(w.metricsSubmitter.AnodotURL().Host).Set(float64(len(w.MetricsBuffer)))
+	dropped := w.addToBuffer(data, w.BlockTimeout)
 	w.mu.Unlock()
 
-	if w.BufferSize() >= w.MetricsPerRequestSize {
+	if w.BufferSize() >= w.MetricsPerRequestSize || w.bufferedRequestFull() {
 		w.FlushBuffer <- true
 	}
+
+	if dropped > 0 {
+		bufferDroppedMetrics.WithLabelValues(append(w.labelValues(), w.OverflowPolicy)...).Add(float64(dropped))
+		return ErrBufferFull
+	}
+	return nil
 }
 
-func (w *Worker) pushMetrics(metricsSubmitter metrics.Submitter, metricsToSend []metrics.Anodot20Metric) {
-	ts := time.Now()
+// throttle waits until n metrics can be sent without exceeding worker and global rate limits.
+func (w *Worker) throttle(n int) {
+	waited := w.rateLimiter.Wait(n)
+	if w.GlobalLimiter != nil {
+		waited += w.GlobalLimiter.Wait(n)
+	}
+	if waited > 0 {
+		throttlingTime.WithLabelValues(w.labelValues()...).Add(float64(waited.Milliseconds()))
+	}
+}
 
+// pushMetrics sends metrics in slot acquired from concurrency limiter and releases it.
+func (w *Worker) pushMetrics(metricsSubmitter metrics.Submitter, metricsToSend []metrics.Anodot20Metric) {
 	atomic.AddInt64(&w.currentWorkers, 1)
 	defer atomic.AddInt64(&w.currentWorkers, -1)
 
+	ts := time.Now()
+	resp, err := w.submit(metricsSubmitter, metricsToSend)
+	w.limiter.Release(time.Since(ts), err != nil && retriable(resp))
+	if err != nil {
+		log.Error("Failed to send metrics: ", err)
+	}
+}
+
+func (w *Worker) submit(metricsSubmitter metrics.Submitter, metricsToSend []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	ts := time.Now()
+
+	requestSize.WithLabelValues(w.labelValues()...).Observe(float64(estimatedPayloadSize(metricsToSend)))
 	anodotResponse, err := metricsSubmitter.SubmitMetrics(metricsToSend)
 	if anodotResponse != nil && anodotResponse.RawResponse() != nil {
-		serverHTTPResponses.WithLabelValues(w.metricsSubmitter.AnodotURL().Host, strconv.Itoa(anodotResponse.RawResponse().StatusCode)).Inc()
+		serverHTTPResponses.WithLabelValues(w.metricsSubmitter.AnodotURL().Host, w.Tenant, strconv.Itoa(anodotResponse.RawResponse().StatusCode)).Inc()
 	}
 	if err != nil {
-		anodotSubmitterErrors.WithLabelValues(metricsSubmitter.AnodotURL().Host).Inc()
-		log.Error("Failed to send metrics: ", err)
-		return
+		anodotSubmitterErrors.WithLabelValues(w.labelValues()...).Inc()
+		w.deadLetter(metricsToSend, anodotResponse)
+		return anodotResponse, err
+	}
+
+	anodotServerResponseTime.WithLabelValues(w.labelValues()...).Observe(time.Since(ts).Seconds())
+	return anodotResponse, nil
+}
+
+// sendQueued sends batches from disk queue in order. Chunks of batch are sent concurrently within limits of concurrency
+// limiter, and chunk failed with transient error is sent again until it succeeds, so batch is kept in queue until then.
+// Queue retries failed chunks itself, so submissions are not retried by RetryingSubmitter.
+func (w *Worker) sendQueued() {
+	submitter := withoutRetries(w.metricsSubmitter)
+	for {
+		data, pos, err := w.queue.Peek()
+		if err == ErrQueueClosed {
+			return
+		}
+		if err != nil {
+			log.Error("Failed to read disk queue: ", err)
+			if !w.queue.Wait(w.Queue.RetryInterval) {
+				return
+			}
+			continue
+		}
+
+		var wg sync.WaitGroup
+		var closed int32
+		for start, end := 0, 0; start < len(data); start = end {
+			end = start + w.chunkSize(data[start:])
+			w.throttle(end - start)
+			w.acquire()
+
+			wg.Add(1)
+			go func(chunk []metrics.Anodot20Metric) {
+				defer wg.Done()
+				if !w.sendQueuedChunk(submitter, chunk) {
+					atomic.StoreInt32(&closed, 1)
+				}
+			}(data[start:end])
+		}
+		wg.Wait()
+		if atomic.LoadInt32(&closed) == 1 {
+			return
+		}
+
+		if err := w.queue.Ack(pos); err != nil && err != ErrQueueClosed {
+			log.Error("Failed to acknowledge disk queue batch: ", err)
+		}
 	}
+}
+
+// sendQueuedChunk sends chunk of queued batch in slot acquired from concurrency limiter and releases it. Chunk failed with
+// transient error is sent again in a new slot, only to router destinations which failed, if metrics are routed.
+// It returns false if queue was closed before chunk was sent.
+func (w *Worker) sendQueuedChunk(submitter metrics.Submitter, chunk []metrics.Anodot20Metric) bool {
+	atomic.AddInt64(&w.currentWorkers, 1)
+	defer atomic.AddInt64(&w.currentWorkers, -1)
 
-	anodotServerResponseTime.WithLabelValues(metricsSubmitter.AnodotURL().Host).Observe(time.Since(ts).Seconds())
+	for {
+		ts := time.Now()
+		resp, err := w.submit(submitter, chunk)
+		failed := err != nil && retriable(resp)
+		if router, ok := submitter.(*Router); ok {
+			if routingErr, ok := err.(*routingError); ok {
+				failed = len(routingErr.retriable) > 0
+				submitter = router.to(routingErr.retriable)
+			}
+		}
+		w.limiter.Release(time.Since(ts), failed)
+		if !failed {
+			if err != nil {
+				log.Error("Failed to send metrics from disk queue: ", err)
+			}
+			return true
+		}
+
+		log.Warningf("Failed to send metrics from disk queue, retrying in %s: %v", w.Queue.RetryInterval, err)
+		closeResponse(resp)
+		if !w.queue.Wait(w.Queue.RetryInterval) {
+			return false
+		}
+		w.acquire()
+	}
 }
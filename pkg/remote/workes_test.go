@@ -200,6 +200,7 @@ func TestSubmitError(t *testing.T) {
 	os.Setenv("ANODOT_MAX_WORKERS", "0")
 
 	anodotSubmitterErrors.Reset()
+	serverHTTPResponses.Reset()
 	_ = os.Setenv("ANODOT_METRICS_PER_REQUEST_SIZE", "10")
 
 	config, err := NewWorkerConfig()
@@ -233,7 +234,7 @@ func TestSubmitError(t *testing.T) {
 
 	expected := `
 
-		anodot_server_http_responses_total{anodot_url="127.0.0.1",response_code="500"} 1
+		anodot_server_http_responses_total{anodot_url="127.0.0.1",response_code="500",tenant="default"} 1
 	`
 
 	err = testutil.CollectAndCompare(serverHTTPResponses, strings.NewReader(metadata+expected), "anodot_server_http_responses_total")
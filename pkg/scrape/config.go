@@ -0,0 +1,195 @@
+package scrape
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	DefaultScrapeConfig = ScrapeConfig{
+		ScrapeInterval: model.Duration(60 * time.Second),
+		ScrapeTimeout:  model.Duration(10 * time.Second),
+		MetricsPath:    "/metrics",
+		Scheme:         "http",
+	}
+
+	DefaultFileSDConfig = FileSDConfig{
+		RefreshInterval: model.Duration(5 * time.Minute),
+	}
+
+	DefaultFederateConfig = FederateConfig{
+		Interval: model.Duration(60 * time.Second),
+		Timeout:  model.Duration(30 * time.Second),
+	}
+)
+
+// Config is a list of scrape jobs, in the same format as 'scrape_configs' section of Prometheus configuration,
+// and a list of Prometheus servers which are pulled with '/federate' endpoint.
+type Config struct {
+	ScrapeConfigs   []*ScrapeConfig   `yaml:"scrape_configs"`
+	FederateConfigs []*FederateConfig `yaml:"federate_configs"`
+}
+
+// ScrapeConfig configures scraping of a single job.
+type ScrapeConfig struct {
+	JobName        string         `yaml:"job_name"`
+	ScrapeInterval model.Duration `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  model.Duration `yaml:"scrape_timeout,omitempty"`
+	MetricsPath    string         `yaml:"metrics_path,omitempty"`
+	Scheme         string         `yaml:"scheme,omitempty"`
+	// HonorLabels keeps labels of scraped metrics on conflict with target labels.
+	// Otherwise conflicting scraped labels are renamed to 'exported_<label>'.
+	HonorLabels bool `yaml:"honor_labels,omitempty"`
+
+	StaticConfigs []*TargetGroup  `yaml:"static_configs,omitempty"`
+	FileSDConfigs []*FileSDConfig `yaml:"file_sd_configs,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ScrapeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultScrapeConfig
+	type plain ScrapeConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.JobName == "" {
+		return errors.New("job_name is empty")
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return errors.Errorf("job %q: unsupported scheme %q", c.JobName, c.Scheme)
+	}
+	if c.ScrapeInterval <= 0 {
+		return errors.Errorf("job %q: scrape_interval should be positive", c.JobName)
+	}
+	if c.ScrapeTimeout <= 0 || c.ScrapeTimeout > c.ScrapeInterval {
+		return errors.Errorf("job %q: scrape_timeout should be positive and not greater than scrape_interval", c.JobName)
+	}
+	return nil
+}
+
+// TargetGroup is a set of targets with common labels. The same format is used by 'static_configs' and file_sd files.
+type TargetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// FileSDConfig configures discovery of target groups from JSON or YAML files.
+type FileSDConfig struct {
+	// Files are paths to target group files. The last path element may contain a glob pattern, e.g. 'targets/*.json'.
+	Files           []string       `yaml:"files"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *FileSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultFileSDConfig
+	type plain FileSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if len(c.Files) == 0 {
+		return errors.New("file_sd_configs: files are empty")
+	}
+	if c.RefreshInterval <= 0 {
+		return errors.New("file_sd_configs: refresh_interval should be positive")
+	}
+	return nil
+}
+
+// FederateConfig configures periodic pulling of Prometheus '/federate' endpoint.
+type FederateConfig struct {
+	// Name identifies source in logs and metrics. Defaults to URL.
+	Name string `yaml:"name,omitempty"`
+	// URL is Prometheus server URL, e.g. 'http://prometheus:9090'.
+	URL string `yaml:"url"`
+	// Match is a list of series selectors passed as 'match[]' parameters.
+	Match    []string       `yaml:"match"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+	Timeout  model.Duration `yaml:"timeout,omitempty"`
+	// Tags are added as Anodot tags to every federated metric.
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *FederateConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultFederateConfig
+	type plain FederateConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.Errorf("federate_configs: invalid url %q", c.URL)
+	}
+	if c.Name == "" {
+		c.Name = c.URL
+	}
+	if len(c.Match) == 0 {
+		return errors.Errorf("federate source %q: at least one match selector is required", c.Name)
+	}
+	if c.Interval <= 0 {
+		return errors.Errorf("federate source %q: interval should be positive", c.Name)
+	}
+	if c.Timeout <= 0 || c.Timeout > c.Interval {
+		return errors.Errorf("federate source %q: timeout should be positive and not greater than interval", c.Name)
+	}
+	return nil
+}
+
+// federateURL returns '/federate' URL of Prometheus server with all match selectors.
+func (c *FederateConfig) federateURL() string {
+	u, _ := url.Parse(c.URL)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/federate"
+
+	query := u.Query()
+	for _, m := range c.Match {
+		query.Add("match[]", m)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func LoadConfig(configPath string) (*Config, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf Config
+	if err = yaml.UnmarshalStrict(content, &conf); err != nil {
+		return nil, errors.Wrapf(err, "parsing YAML file %s", configPath)
+	}
+
+	jobs := make(map[string]struct{}, len(conf.ScrapeConfigs))
+	for _, c := range conf.ScrapeConfigs {
+		if _, ok := jobs[c.JobName]; ok {
+			return nil, fmt.Errorf("found multiple scrape configs with job name %q", c.JobName)
+		}
+		jobs[c.JobName] = struct{}{}
+	}
+
+	sources := make(map[string]struct{}, len(conf.FederateConfigs))
+	for _, c := range conf.FederateConfigs {
+		if _, ok := sources[c.Name]; ok {
+			return nil, fmt.Errorf("found multiple federate configs with name %q", c.Name)
+		}
+		sources[c.Name] = struct{}{}
+	}
+	return &conf, nil
+}
+
+// targetURL returns URL which is scraped for target address.
+func (c *ScrapeConfig) targetURL(address string) string {
+	u := url.URL{Scheme: c.Scheme, Host: address, Path: c.MetricsPath}
+	return u.String()
+}
@@ -0,0 +1,159 @@
+package scrape
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "scrape.yaml", `
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["localhost:9100"]
+        labels:
+          env: prod
+  - job_name: apps
+    scrape_interval: 30s
+    scrape_timeout: 5s
+    metrics_path: /stats
+    scheme: https
+    honor_labels: true
+    file_sd_configs:
+      - files: ["targets/*.json"]
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Config{ScrapeConfigs: []*ScrapeConfig{
+		{
+			JobName:        "node",
+			ScrapeInterval: model.Duration(time.Minute),
+			ScrapeTimeout:  model.Duration(10 * time.Second),
+			MetricsPath:    "/metrics",
+			Scheme:         "http",
+			StaticConfigs:  []*TargetGroup{{Targets: []string{"localhost:9100"}, Labels: map[string]string{"env": "prod"}}},
+		},
+		{
+			JobName:        "apps",
+			ScrapeInterval: model.Duration(30 * time.Second),
+			ScrapeTimeout:  model.Duration(5 * time.Second),
+			MetricsPath:    "/stats",
+			Scheme:         "https",
+			HonorLabels:    true,
+			FileSDConfigs:  []*FileSDConfig{{Files: []string{"targets/*.json"}, RefreshInterval: model.Duration(5 * time.Minute)}},
+		},
+	}}
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatal(fmt.Sprintf("Wrong config \n got: %+v\n want: %+v", config, expected))
+	}
+
+	if got := config.ScrapeConfigs[1].targetURL("app:8080"); got != "https://app:8080/stats" {
+		t.Fatal(fmt.Sprintf("Wrong target url \n got: %s\n want: %s", got, "https://app:8080/stats"))
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"missing job name": `
+scrape_configs:
+  - static_configs: [{targets: ["localhost:9100"]}]`,
+		"duplicate job": `
+scrape_configs:
+  - job_name: node
+  - job_name: node`,
+		"timeout greater than interval": `
+scrape_configs:
+  - job_name: node
+    scrape_interval: 10s
+    scrape_timeout: 20s`,
+		"unsupported scheme": `
+scrape_configs:
+  - job_name: node
+    scheme: ftp`,
+		"empty file_sd files": `
+scrape_configs:
+  - job_name: node
+    file_sd_configs: [{refresh_interval: 1m}]`,
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeFile(t, dir, "scrape.yaml", content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("error should be returned")
+			}
+		})
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "a.json", `[{"targets": ["host1:9100", "host2:9100"], "labels": {"env": "prod"}}]`)
+	writeFile(t, dir, "b.yml", "- targets: [\"host3:9100\"]\n")
+
+	d := newFileDiscovery(&FileSDConfig{Files: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")}})
+	groups := d.refresh()
+
+	expected := []*TargetGroup{
+		{Targets: []string{"host1:9100", "host2:9100"}, Labels: map[string]string{"env": "prod"}},
+		{Targets: []string{"host3:9100"}},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatal(fmt.Sprintf("Wrong target groups \n got: %+v\n want: %+v", groups, expected))
+	}
+
+	// invalid file keeps last valid groups
+	path := writeFile(t, dir, "b.yml", "not a list")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if groups := d.refresh(); !reflect.DeepEqual(groups, expected) {
+		t.Fatal(fmt.Sprintf("Wrong target groups \n got: %+v\n want: %+v", groups, expected))
+	}
+
+	// removed file drops its targets
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if groups := d.refresh(); !reflect.DeepEqual(groups, expected[:1]) {
+		t.Fatal(fmt.Sprintf("Wrong target groups \n got: %+v\n want: %+v", groups, expected[:1]))
+	}
+}
@@ -0,0 +1,104 @@
+package scrape
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	log "k8s.io/klog/v2"
+)
+
+type fileSDEntry struct {
+	modTime time.Time
+	groups  []*TargetGroup
+}
+
+// fileDiscovery reads target groups from file_sd files. Files are re-read only if their modification time changes,
+// and last successfully parsed groups are kept if file becomes invalid.
+type fileDiscovery struct {
+	config *FileSDConfig
+	files  map[string]*fileSDEntry
+}
+
+func newFileDiscovery(config *FileSDConfig) *fileDiscovery {
+	return &fileDiscovery{config: config, files: make(map[string]*fileSDEntry)}
+}
+
+// refresh returns target groups from all files matching configured patterns.
+func (d *fileDiscovery) refresh() []*TargetGroup {
+	seen := make(map[string]struct{})
+	var groups []*TargetGroup
+
+	for _, pattern := range d.config.Files {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Errorf("invalid file_sd pattern %q: %v", pattern, err)
+			continue
+		}
+
+		for _, path := range paths {
+			seen[path] = struct{}{}
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Errorf("failed to stat file_sd file %q: %v", path, err)
+				continue
+			}
+
+			entry, ok := d.files[path]
+			if !ok || !entry.modTime.Equal(info.ModTime()) {
+				fileGroups, err := readTargetGroups(path)
+				if err != nil {
+					fileSDReadFailed.Inc()
+					log.Errorf("failed to read file_sd file %q: %v", path, err)
+				} else {
+					log.V(4).Infof("loaded %d target group(s) from %q", len(fileGroups), path)
+					entry = &fileSDEntry{modTime: info.ModTime(), groups: fileGroups}
+					d.files[path] = entry
+				}
+			}
+
+			if entry != nil {
+				groups = append(groups, entry.groups...)
+			}
+		}
+	}
+
+	for path := range d.files {
+		if _, ok := seen[path]; !ok {
+			delete(d.files, path)
+		}
+	}
+	return groups
+}
+
+func readTargetGroups(path string) ([]*TargetGroup, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*TargetGroup
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(content, &groups)
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(content, &groups)
+	default:
+		return nil, errors.Errorf("unsupported file extension %q", ext)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing file %s", path)
+	}
+
+	for i, g := range groups {
+		if g == nil {
+			return nil, errors.Errorf("target group %d is empty", i)
+		}
+	}
+	return groups, nil
+}
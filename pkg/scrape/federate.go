@@ -0,0 +1,93 @@
+package scrape
+
+import (
+	"context"
+	"time"
+
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	log "k8s.io/klog/v2"
+)
+
+var (
+	federateRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_federate_requests_total",
+		Help: "Total number of Prometheus /federate requests",
+	}, []string{"source"})
+
+	federateFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_federate_failed_total",
+		Help: "Total number of failed Prometheus /federate requests",
+	}, []string{"source"})
+
+	federateSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_federate_samples_total",
+		Help: "Total number of new samples received from Prometheus /federate endpoint",
+	}, []string{"source"})
+)
+
+// federateSource keeps timestamps of last federated samples, since /federate returns the latest sample
+// of every series on each request and the same sample should not be sent twice.
+type federateSource struct {
+	config *FederateConfig
+	url    string
+	last   map[model.Fingerprint]model.Time
+}
+
+func newFederateSource(config *FederateConfig) *federateSource {
+	return &federateSource{config: config, url: config.federateURL(), last: make(map[model.Fingerprint]model.Time)}
+}
+
+func (m *Manager) runFederate(ctx context.Context, source *federateSource) {
+	ticker := time.NewTicker(time.Duration(source.config.Interval))
+	defer ticker.Stop()
+
+	for {
+		samples, err := m.Federate(ctx, source)
+		if err != nil {
+			log.Errorf("failed to federate from %q: %v", source.config.Name, err)
+		} else {
+			m.send(samples)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Federate pulls series from Prometheus '/federate' endpoint and returns samples which were not returned before.
+// Sample timestamps reported by Prometheus are kept. Source tags are added as Anodot tags.
+func (m *Manager) Federate(ctx context.Context, source *federateSource) (model.Samples, error) {
+	name := source.config.Name
+	federateRequests.WithLabelValues(name).Inc()
+
+	samples, err := m.fetch(ctx, source.url, time.Duration(source.config.Timeout), model.Now())
+	if err != nil {
+		federateFailed.WithLabelValues(name).Inc()
+		return nil, err
+	}
+
+	seen := make(map[model.Fingerprint]model.Time, len(samples))
+	res := make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		seen[fp] = s.Timestamp
+		if last, ok := source.last[fp]; ok && !s.Timestamp.After(last) {
+			continue
+		}
+
+		for k, v := range source.config.Tags {
+			s.Metric[model.LabelName(anodotPrometheus.AnodotTagLabelPrefix+k)] = model.LabelValue(v)
+		}
+		res = append(res, s)
+	}
+	source.last = seen
+
+	federateSamples.WithLabelValues(name).Add(float64(len(res)))
+	return res, nil
+}
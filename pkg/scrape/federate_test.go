@@ -0,0 +1,129 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestFederate(t *testing.T) {
+	var matches []string
+	body := `# TYPE node_load1 untyped
+node_load1{instance="host1:9100",job="node"} 0.5 1574693400000
+node_load1{instance="host2:9100",job="node"} 0.7 1574693400000
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prometheus/federate" {
+			http.NotFound(w, r)
+			return
+		}
+		matches = r.URL.Query()["match[]"]
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	config := &FederateConfig{
+		Name:    "prod",
+		URL:     server.URL + "/prometheus/",
+		Match:   []string{`{job="node"}`, `up`},
+		Timeout: model.Duration(time.Second),
+		Tags:    map[string]string{"env": "prod"},
+	}
+	source := newFederateSource(config)
+	m := &Manager{client: &http.Client{}}
+
+	samples, err := m.Federate(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(matches, config.Match) {
+		t.Fatal(fmt.Sprintf("Wrong match selectors \n got: %v\n want: %v", matches, config.Match))
+	}
+
+	if len(samples) != 2 {
+		t.Fatal(fmt.Sprintf("Wrong number of samples \n got: %v", samples))
+	}
+	expected := model.Metric{model.MetricNameLabel: "node_load1", "instance": "host1:9100", "job": "node", "anodot_tag_env": "prod"}
+	if !samples[0].Metric.Equal(expected) || samples[0].Value != 0.5 || samples[0].Timestamp != 1574693400000 {
+		t.Fatal(fmt.Sprintf("Wrong sample \n got: %v\n want: %s 0.5 @1574693400000", samples[0], expected))
+	}
+
+	// samples with the same timestamp are not sent again
+	body = `node_load1{instance="host1:9100",job="node"} 0.5 1574693400000
+node_load1{instance="host2:9100",job="node"} 0.9 1574693460000
+`
+	samples, err = m.Federate(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Value != 0.9 {
+		t.Fatal(fmt.Sprintf("Only new samples should be returned \n got: %v", samples))
+	}
+}
+
+func TestFederateFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad match", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	source := newFederateSource(&FederateConfig{Name: "prod", URL: server.URL, Match: []string{"up"}, Timeout: model.Duration(time.Second)})
+	m := &Manager{client: &http.Client{}}
+	if _, err := m.Federate(context.Background(), source); err == nil {
+		t.Fatalf("error should be returned")
+	}
+}
+
+func TestLoadFederateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "scrape.yaml", `
+federate_configs:
+  - url: http://prometheus:9090
+    match: ['{job="node"}']
+    tags:
+      env: prod
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*FederateConfig{{
+		Name:     "http://prometheus:9090",
+		URL:      "http://prometheus:9090",
+		Match:    []string{`{job="node"}`},
+		Interval: model.Duration(time.Minute),
+		Timeout:  model.Duration(30 * time.Second),
+		Tags:     map[string]string{"env": "prod"},
+	}}
+	if !reflect.DeepEqual(config.FederateConfigs, expected) {
+		t.Fatal(fmt.Sprintf("Wrong config \n got: %+v\n want: %+v", config.FederateConfigs[0], expected[0]))
+	}
+
+	if got := config.FederateConfigs[0].federateURL(); got != "http://prometheus:9090/federate?match%5B%5D=%7Bjob%3D%22node%22%7D" {
+		t.Fatal(fmt.Sprintf("Wrong federate url \n got: %s", got))
+	}
+
+	path = writeFile(t, dir, "scrape.yaml", `
+federate_configs:
+  - url: http://prometheus:9090
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatalf("error should be returned for missing match selectors")
+	}
+}
@@ -0,0 +1,305 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	acceptHeader = `text/plain;version=0.0.4;q=1,*/*;q=0.1`
+
+	upMetricName              = "up"
+	scrapeDurationMetricName  = "scrape_duration_seconds"
+	scrapeSamplesMetricName   = "scrape_samples_scraped"
+	exportedLabelPrefix       = "exported_"
+	defaultSyncInterval       = 5 * time.Minute
+	maxScrapeErrorBodyPreview = 256
+)
+
+var (
+	scrapeTargets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anodot_scrape_targets",
+		Help: "Number of currently scraped targets",
+	}, []string{"job"})
+
+	scrapesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_scrape_requests_total",
+		Help: "Total number of target scrapes",
+	}, []string{"job"})
+
+	scrapesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_scrape_failed_total",
+		Help: "Total number of failed target scrapes",
+	}, []string{"job"})
+
+	fileSDReadFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_scrape_file_sd_read_failed_total",
+		Help: "Total number of failed file_sd file reads",
+	})
+
+	scrapeBufferErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_scrape_buffer_errors_total",
+		Help: "Total number of times scraped samples were not fully buffered by worker because its buffer is full",
+	})
+)
+
+// Target is a single scraped endpoint.
+type Target struct {
+	URL string
+	// Labels are added to every scraped sample. Always contain 'job' and 'instance' labels.
+	Labels model.LabelSet
+}
+
+func (t *Target) key() string {
+	return t.URL + t.Labels.String()
+}
+
+// Manager periodically scrapes targets of configured jobs and sends scraped samples to Anodot workers.
+type Manager struct {
+	config     *Config
+	parser     *anodotPrometheus.AnodotParser
+	histograms *anodotPrometheus.HistogramConfig
+	workers    []*remote.Worker
+	client     *http.Client
+}
+
+func NewManager(config *Config, parser *anodotPrometheus.AnodotParser, histograms *anodotPrometheus.HistogramConfig, workers []*remote.Worker) (*Manager, error) {
+	if parser == nil {
+		return nil, fmt.Errorf("parser should not be nil")
+	}
+	return &Manager{config: config, parser: parser, histograms: histograms, workers: workers, client: &http.Client{}}, nil
+}
+
+// Run starts scraping of all configured jobs and federation sources until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	for _, job := range m.config.ScrapeConfigs {
+		log.V(2).Infof("Starting scrape job %q", job.JobName)
+		go m.runJob(ctx, job)
+	}
+
+	for _, source := range m.config.FederateConfigs {
+		log.V(2).Infof("Starting federation from %q", source.Name)
+		go m.runFederate(ctx, newFederateSource(source))
+	}
+}
+
+// Targets returns targets of job discovered from static and file_sd configs.
+func Targets(job *ScrapeConfig, groups []*TargetGroup) []*Target {
+	var targets []*Target
+	for _, g := range groups {
+		for _, address := range g.Targets {
+			labels := make(model.LabelSet, len(g.Labels)+2)
+			for k, v := range g.Labels {
+				labels[model.LabelName(k)] = model.LabelValue(v)
+			}
+			labels[model.JobLabel] = model.LabelValue(job.JobName)
+			labels[model.InstanceLabel] = model.LabelValue(address)
+			targets = append(targets, &Target{URL: job.targetURL(address), Labels: labels})
+		}
+	}
+	return targets
+}
+
+func (m *Manager) runJob(ctx context.Context, job *ScrapeConfig) {
+	discoveries := make([]*fileDiscovery, 0, len(job.FileSDConfigs))
+	syncInterval := defaultSyncInterval
+	for _, c := range job.FileSDConfigs {
+		discoveries = append(discoveries, newFileDiscovery(c))
+		if time.Duration(c.RefreshInterval) < syncInterval {
+			syncInterval = time.Duration(c.RefreshInterval)
+		}
+	}
+
+	running := make(map[string]context.CancelFunc)
+	sync := func() {
+		groups := append([]*TargetGroup{}, job.StaticConfigs...)
+		for _, d := range discoveries {
+			groups = append(groups, d.refresh()...)
+		}
+
+		desired := make(map[string]struct{})
+		for _, t := range Targets(job, groups) {
+			key := t.key()
+			desired[key] = struct{}{}
+			if _, ok := running[key]; ok {
+				continue
+			}
+
+			log.V(3).Infof("job %q: starting scrape of target %s", job.JobName, t.URL)
+			targetCtx, cancel := context.WithCancel(ctx)
+			running[key] = cancel
+			go m.runTarget(targetCtx, job, t)
+		}
+
+		for key, cancel := range running {
+			if _, ok := desired[key]; !ok {
+				log.V(3).Infof("job %q: stopping scrape of target %s", job.JobName, key)
+				cancel()
+				delete(running, key)
+			}
+		}
+		scrapeTargets.WithLabelValues(job.JobName).Set(float64(len(running)))
+	}
+
+	sync()
+	if len(discoveries) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sync()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Manager) runTarget(ctx context.Context, job *ScrapeConfig, target *Target) {
+	ticker := time.NewTicker(time.Duration(job.ScrapeInterval))
+	defer ticker.Stop()
+
+	for {
+		m.scrapeAndSend(ctx, job, target)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Manager) scrapeAndSend(ctx context.Context, job *ScrapeConfig, target *Target) {
+	m.send(m.Scrape(ctx, job, target))
+}
+
+func (m *Manager) send(samples model.Samples) {
+	if m.histograms != nil {
+		samples = m.histograms.ClassicHistogramsToSamples(samples)
+	}
+
+	data := m.parser.ParsePrometheusRequest(samples)
+	if len(data) == 0 {
+		return
+	}
+	for i := 0; i < len(m.workers); i++ {
+		if err := m.workers[i].Do(data); err != nil {
+			scrapeBufferErrors.Inc()
+			log.Warningf("Scraped samples are not fully buffered by worker %s: %v", m.workers[i], err)
+		}
+	}
+}
+
+// Scrape fetches metrics of target and returns them with target labels, followed by 'up', 'scrape_duration_seconds'
+// and 'scrape_samples_scraped' series. If scrape fails, only these series are returned with 'up' set to 0.
+func (m *Manager) Scrape(ctx context.Context, job *ScrapeConfig, target *Target) model.Samples {
+	scrapesTotal.WithLabelValues(job.JobName).Inc()
+
+	start := time.Now()
+	ts := model.TimeFromUnixNano(start.UnixNano())
+
+	samples, err := m.fetch(ctx, target.URL, time.Duration(job.ScrapeTimeout), ts)
+	duration := time.Since(start)
+
+	up := 1.0
+	if err != nil {
+		up = 0
+		samples = nil
+		scrapesFailed.WithLabelValues(job.JobName).Inc()
+		log.V(3).Infof("job %q: failed to scrape %s: %v", job.JobName, target.URL, err)
+	}
+
+	for _, s := range samples {
+		applyTargetLabels(s.Metric, target.Labels, job.HonorLabels)
+	}
+
+	scraped := len(samples)
+	for name, value := range map[string]float64{
+		upMetricName:             up,
+		scrapeDurationMetricName: duration.Seconds(),
+		scrapeSamplesMetricName:  float64(scraped),
+	} {
+		metric := make(model.Metric, len(target.Labels)+1)
+		for k, v := range target.Labels {
+			metric[k] = v
+		}
+		metric[model.MetricNameLabel] = model.LabelValue(name)
+		samples = append(samples, &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: ts})
+	}
+	return samples
+}
+
+// fetch requests url and decodes exposition format response. Samples without explicit timestamp get ts.
+func (m *Manager) fetch(ctx context.Context, url string, timeout time.Duration, ts model.Time) (model.Samples, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", timeout.Seconds()))
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxScrapeErrorBodyPreview))
+		return nil, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	decoder := expfmt.SampleDecoder{
+		Dec:  expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header)),
+		Opts: &expfmt.DecodeOptions{Timestamp: ts},
+	}
+
+	var samples model.Samples
+	for {
+		var v model.Vector
+		if err := decoder.Decode(&v); err != nil {
+			if err == io.EOF {
+				return samples, nil
+			}
+			return nil, err
+		}
+		samples = append(samples, v...)
+	}
+}
+
+// applyTargetLabels adds target labels to scraped metric. On conflict scraped label is either kept (honorLabels)
+// or renamed to 'exported_<label>'.
+func applyTargetLabels(metric model.Metric, labels model.LabelSet, honorLabels bool) {
+	for ln, lv := range labels {
+		if existing, ok := metric[ln]; ok && existing != "" {
+			if honorLabels {
+				continue
+			}
+			metric[exportedLabelPrefix+ln] = existing
+		}
+		metric[ln] = lv
+	}
+}
@@ -0,0 +1,98 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestScrape(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(`# TYPE http_requests_total counter
+http_requests_total{code="200",job="app"} 10
+http_requests_total{code="500"} 2 1574693400000
+`))
+	}))
+	defer server.Close()
+
+	job := &ScrapeConfig{JobName: "node", ScrapeTimeout: model.Duration(time.Second), MetricsPath: "/metrics", Scheme: "http"}
+	address := strings.TrimPrefix(server.URL, "http://")
+	targets := Targets(job, []*TargetGroup{{Targets: []string{address}, Labels: map[string]string{"env": "prod"}}})
+	if len(targets) != 1 {
+		t.Fatalf("unexpected number of targets: %d", len(targets))
+	}
+
+	m := &Manager{client: &http.Client{}}
+	samples := m.Scrape(context.Background(), job, targets[0])
+
+	got := make(map[string]*model.Sample, len(samples))
+	for _, s := range samples {
+		got[s.Metric.String()] = s
+	}
+
+	instance := model.LabelValue(address)
+	expected := []struct {
+		metric model.Metric
+		value  model.SampleValue
+	}{
+		{model.Metric{model.MetricNameLabel: "http_requests_total", "code": "200", "job": "node", "exported_job": "app", "instance": instance, "env": "prod"}, 10},
+		{model.Metric{model.MetricNameLabel: "http_requests_total", "code": "500", "job": "node", "instance": instance, "env": "prod"}, 2},
+		{model.Metric{model.MetricNameLabel: "up", "job": "node", "instance": instance, "env": "prod"}, 1},
+		{model.Metric{model.MetricNameLabel: "scrape_samples_scraped", "job": "node", "instance": instance, "env": "prod"}, 2},
+	}
+
+	if len(samples) != 5 {
+		t.Fatal(fmt.Sprintf("Wrong number of samples \n got: %v", samples))
+	}
+	for _, e := range expected {
+		s, ok := got[e.metric.String()]
+		if !ok || s.Value != e.value {
+			t.Fatal(fmt.Sprintf("Missing sample \n got: %v\n want: %s %v", samples, e.metric, e.value))
+		}
+	}
+
+	// explicit timestamp from exposition is kept
+	s := got[model.Metric{model.MetricNameLabel: "http_requests_total", "code": "500", "job": "node", "instance": instance, "env": "prod"}.String()]
+	if s.Timestamp != 1574693400000 {
+		t.Fatal(fmt.Sprintf("Wrong timestamp \n got: %d\n want: %d", s.Timestamp, 1574693400000))
+	}
+}
+
+func TestScrapeFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	job := &ScrapeConfig{JobName: "node", ScrapeTimeout: model.Duration(time.Second), MetricsPath: "/metrics", Scheme: "http"}
+	targets := Targets(job, []*TargetGroup{{Targets: []string{strings.TrimPrefix(server.URL, "http://")}}})
+
+	m := &Manager{client: &http.Client{}}
+	samples := m.Scrape(context.Background(), job, targets[0])
+	if len(samples) != 3 {
+		t.Fatal(fmt.Sprintf("Only scrape series should be returned \n got: %v", samples))
+	}
+
+	for _, s := range samples {
+		if s.Metric[model.MetricNameLabel] == "up" && s.Value != 0 {
+			t.Fatal(fmt.Sprintf("Wrong up value \n got: %v\n want: 0", s.Value))
+		}
+	}
+}
+
+func TestApplyTargetLabelsHonorLabels(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "m", "job": "app"}
+	applyTargetLabels(metric, model.LabelSet{"job": "node", "instance": "host:9100"}, true)
+
+	expected := model.Metric{model.MetricNameLabel: "m", "job": "app", "instance": "host:9100"}
+	if !metric.Equal(expected) {
+		t.Fatal(fmt.Sprintf("Wrong labels \n got: %s\n want: %s", metric, expected))
+	}
+}
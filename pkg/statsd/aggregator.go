@@ -0,0 +1,233 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const quantileLabel = "quantile"
+
+type counter struct {
+	tags  map[string]string
+	value float64
+}
+
+type gauge struct {
+	tags      map[string]string
+	value     float64
+	timestamp time.Time
+	// updated is set if gauge received value since last flush
+	updated bool
+	// lastUpdated is time of the last flush which sent gauge value
+	lastUpdated time.Time
+}
+
+type timer struct {
+	tags   map[string]string
+	values []float64
+	count  float64
+}
+
+type set struct {
+	tags   map[string]string
+	values map[string]struct{}
+}
+
+// Aggregator aggregates StatsD and Graphite events in memory until flush.
+// Counters, timers and sets are reset on every flush, while gauges keep their last value until they are not updated
+// during gauge TTL.
+type Aggregator struct {
+	percentiles []float64
+	gaugeTTL    time.Duration
+
+	mu        sync.Mutex
+	counters  map[string]*counter
+	gauges    map[string]*gauge
+	timers    map[string]*timer
+	sets      map[string]*set
+	graphite  map[string]*gauge
+	lastFlush time.Time
+}
+
+func NewAggregator(percentiles []float64, gaugeTTL time.Duration, now time.Time) *Aggregator {
+	a := &Aggregator{percentiles: percentiles, gaugeTTL: gaugeTTL, lastFlush: now}
+	a.reset()
+	a.gauges = make(map[string]*gauge)
+	return a
+}
+
+func (a *Aggregator) reset() {
+	a.counters = make(map[string]*counter)
+	a.timers = make(map[string]*timer)
+	a.sets = make(map[string]*set)
+	a.graphite = make(map[string]*gauge)
+}
+
+// seriesKey returns unique key of metric name and its tags.
+func seriesKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("\xff")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+func (a *Aggregator) Add(e Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := seriesKey(e.Name, e.Tags)
+	switch e.Type {
+	case Counter:
+		c, ok := a.counters[key]
+		if !ok {
+			c = &counter{tags: e.Tags}
+			a.counters[key] = c
+		}
+		c.value += e.Value / e.SampleRate
+	case Gauge:
+		g, ok := a.gauges[key]
+		if !ok {
+			g = &gauge{tags: e.Tags}
+			a.gauges[key] = g
+		}
+		if e.Relative {
+			g.value += e.Value
+		} else {
+			g.value = e.Value
+		}
+		g.updated = true
+	case Timer, Histogram, Distribution:
+		t, ok := a.timers[key]
+		if !ok {
+			t = &timer{tags: e.Tags}
+			a.timers[key] = t
+		}
+		t.values = append(t.values, e.Value)
+		t.count += 1 / e.SampleRate
+	case Set:
+		s, ok := a.sets[key]
+		if !ok {
+			s = &set{tags: e.Tags, values: make(map[string]struct{})}
+			a.sets[key] = s
+		}
+		s.values[e.SetValue] = struct{}{}
+	case graphiteType:
+		a.graphite[key] = &gauge{tags: e.Tags, value: e.Value, timestamp: e.Timestamp, updated: true}
+	}
+}
+
+// Flush returns samples aggregated since last flush:
+//   - counters as '<name>_count' (total in flush interval) and '<name>_rate' (per second)
+//   - gauges as '<name>' with their last value, gauges which were not updated during gauge TTL are removed
+//   - timers as '<name>_count', '<name>_sum', '<name>_min', '<name>_max', '<name>_mean' and '<name>' per percentile
+//   - sets as '<name>' with number of unique values
+//   - graphite metrics as '<name>' with their last value and timestamp
+func (a *Aggregator) Flush(now time.Time) model.Samples {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var samples model.Samples
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	interval := now.Sub(a.lastFlush).Seconds()
+	a.lastFlush = now
+
+	add := func(name string, tags map[string]string, value float64, ts model.Time) {
+		metric := make(model.Metric, len(tags)+1)
+		for k, v := range tags {
+			metric[model.LabelName(k)] = model.LabelValue(v)
+		}
+		metric[model.MetricNameLabel] = model.LabelValue(name)
+		samples = append(samples, &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: ts})
+	}
+
+	for key, c := range a.counters {
+		name := metricName(key)
+		add(name+"_count", c.tags, c.value, ts)
+		if interval > 0 {
+			add(name+"_rate", c.tags, c.value/interval, ts)
+		}
+	}
+
+	for key, g := range a.gauges {
+		if !g.updated {
+			if now.Sub(g.lastUpdated) > a.gaugeTTL {
+				delete(a.gauges, key)
+			}
+			continue
+		}
+		add(metricName(key), g.tags, g.value, ts)
+		g.updated, g.lastUpdated = false, now
+	}
+
+	for key, t := range a.timers {
+		name := metricName(key)
+		sort.Float64s(t.values)
+
+		sum := 0.0
+		for _, v := range t.values {
+			sum += v
+		}
+
+		add(name+"_count", t.tags, t.count, ts)
+		add(name+"_sum", t.tags, sum, ts)
+		add(name+"_min", t.tags, t.values[0], ts)
+		add(name+"_max", t.tags, t.values[len(t.values)-1], ts)
+		add(name+"_mean", t.tags, sum/float64(len(t.values)), ts)
+
+		for _, p := range a.percentiles {
+			tags := make(map[string]string, len(t.tags)+1)
+			for k, v := range t.tags {
+				tags[k] = v
+			}
+			tags[quantileLabel] = strconv.FormatFloat(p, 'f', -1, 64)
+			add(name, tags, percentile(t.values, p), ts)
+		}
+	}
+
+	for key, s := range a.sets {
+		add(metricName(key), s.tags, float64(len(s.values)), ts)
+	}
+
+	for key, g := range a.graphite {
+		add(metricName(key), g.tags, g.value, model.TimeFromUnixNano(g.timestamp.UnixNano()))
+	}
+
+	a.reset()
+	return samples
+}
+
+func metricName(key string) string {
+	if i := strings.Index(key, "\xff"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// percentile returns p-percentile of sorted values using nearest rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,104 @@
+package statsd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func samplesByMetric(samples model.Samples) map[string]model.SampleValue {
+	res := make(map[string]model.SampleValue, len(samples))
+	for _, s := range samples {
+		res[s.Metric.String()] = s.Value
+	}
+	return res
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	start := time.Unix(1574693400, 0)
+	a := NewAggregator([]float64{0.5, 0.9}, time.Minute, start)
+
+	lines := []string{
+		"requests:1|c|#env:prod",
+		"requests:3|c|@0.5|#env:prod",
+		"temp:20|g",
+		"temp:+5|g",
+		"latency:10:20:30:40|ms",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	}
+	for _, l := range lines {
+		events, err := ParseStatsdLine(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			a.Add(e)
+		}
+	}
+
+	got := samplesByMetric(a.Flush(start.Add(10 * time.Second)))
+	expected := map[string]model.SampleValue{
+		`requests_count{env="prod"}`: 7,
+		`requests_rate{env="prod"}`:  0.7,
+		`temp`:                       25,
+		`latency_count`:              4,
+		`latency_sum`:                100,
+		`latency_min`:                10,
+		`latency_max`:                40,
+		`latency_mean`:               25,
+		`latency{quantile="0.5"}`:    20,
+		`latency{quantile="0.9"}`:    40,
+		`users`:                      2,
+	}
+
+	if len(got) != len(expected) {
+		t.Fatal(fmt.Sprintf("Wrong number of samples \n got: %v\n want: %v", got, expected))
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Fatal(fmt.Sprintf("Wrong value of %s \n got: %v\n want: %v", k, got[k], v))
+		}
+	}
+
+	// counters, timers and sets are reset, not updated gauges are not sent
+	if samples := a.Flush(start.Add(20 * time.Second)); len(samples) != 0 {
+		t.Fatal(fmt.Sprintf("Samples should be reset after flush \n got: %v", samples))
+	}
+
+	// gauge keeps value for relative updates
+	a.Add(Event{Name: "temp", Type: Gauge, Value: -10, SampleRate: 1, Relative: true})
+	got = samplesByMetric(a.Flush(start.Add(30 * time.Second)))
+	if got["temp"] != 15 {
+		t.Fatal(fmt.Sprintf("Wrong gauge value \n got: %v\n want: %v", got["temp"], 15))
+	}
+
+	// gauge which is not updated during TTL is forgotten
+	a.Flush(start.Add(2 * time.Minute))
+	a.Add(Event{Name: "temp", Type: Gauge, Value: 5, SampleRate: 1, Relative: true})
+	got = samplesByMetric(a.Flush(start.Add(3 * time.Minute)))
+	if got["temp"] != 5 {
+		t.Fatal(fmt.Sprintf("Wrong gauge value after TTL \n got: %v\n want: %v", got["temp"], 5))
+	}
+}
+
+func TestAggregatorGraphite(t *testing.T) {
+	start := time.Unix(1574693400, 0)
+	a := NewAggregator(nil, time.Minute, start)
+
+	for _, l := range []string{"servers.web01.cpu 1 1574693401", "servers.web01.cpu 2 1574693402"} {
+		e, err := ParseGraphiteLine(l, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Add(e)
+	}
+
+	samples := a.Flush(start.Add(time.Minute))
+	if len(samples) != 1 || samples[0].Value != 2 || samples[0].Timestamp != model.TimeFromUnix(1574693402) {
+		t.Fatal(fmt.Sprintf("Wrong graphite samples \n got: %v", samples))
+	}
+}
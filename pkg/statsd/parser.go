@@ -0,0 +1,150 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metric types supported by StatsD protocol.
+const (
+	Counter = "c"
+	Gauge   = "g"
+	Timer   = "ms"
+	// Histogram and Distribution are DogStatsD extensions, aggregated the same way as timers.
+	Histogram    = "h"
+	Distribution = "d"
+	Set          = "s"
+
+	// graphiteType is used internally for Graphite plaintext metrics, which are aggregated as gauges with timestamp.
+	graphiteType = "graphite"
+)
+
+// Event is a single parsed StatsD or Graphite metric line.
+type Event struct {
+	Name       string
+	Type       string
+	Value      float64
+	SetValue   string
+	SampleRate float64
+	// Relative is set for gauges sent with explicit sign, which change current gauge value.
+	Relative bool
+	Tags     map[string]string
+	// Timestamp is set only for Graphite metrics.
+	Timestamp time.Time
+}
+
+// ParseStatsdLine parses StatsD line in '<name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,...]' format.
+// Multiple values for the same metric can be sent in one line separated by ':'.
+func ParseStatsdLine(line string) ([]Event, error) {
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return nil, fmt.Errorf("missing metric name or value in %q", line)
+	}
+	name := line[:colon]
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("missing metric type in %q", line)
+	}
+
+	event := Event{Name: name, Type: parts[1], SampleRate: 1}
+	switch event.Type {
+	case Counter, Gauge, Timer, Histogram, Distribution, Set:
+	default:
+		return nil, fmt.Errorf("unsupported metric type %q in %q", event.Type, line)
+	}
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q", p)
+			}
+			event.SampleRate = rate
+		case strings.HasPrefix(p, "#"):
+			event.Tags = parseDogStatsdTags(p[1:])
+		}
+	}
+
+	var events []Event
+	for _, v := range strings.Split(parts[0], ":") {
+		e := event
+		if e.Type == Set {
+			e.SetValue = v
+			events = append(events, e)
+			continue
+		}
+
+		if e.Type == Gauge && (strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-")) {
+			e.Relative = true
+		}
+
+		value, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid value %q in %q", v, line)
+		}
+		e.Value = value
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func parseDogStatsdTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ",") {
+		if t == "" {
+			continue
+		}
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) == 1 {
+			// tags without value are kept as tag with the same name and value
+			tags[kv[0]] = kv[0]
+			continue
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags
+}
+
+// ParseGraphiteLine parses Graphite plaintext line in '<path>[;tag=value...] <value> [<timestamp>]' format.
+func ParseGraphiteLine(line string, now time.Time) (Event, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Event{}, fmt.Errorf("invalid graphite line %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Event{}, fmt.Errorf("invalid value %q in %q", fields[1], line)
+	}
+
+	event := Event{Type: graphiteType, Value: value, SampleRate: 1, Timestamp: now}
+	if len(fields) == 3 && fields[2] != "-1" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return Event{}, fmt.Errorf("invalid timestamp %q in %q", fields[2], line)
+		}
+		event.Timestamp = time.Unix(int64(ts), 0)
+	}
+
+	path := strings.Split(fields[0], ";")
+	event.Name = path[0]
+	if event.Name == "" {
+		return Event{}, fmt.Errorf("missing metric path in %q", line)
+	}
+	for _, t := range path[1:] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return Event{}, fmt.Errorf("invalid tag %q in %q", t, line)
+		}
+		if event.Tags == nil {
+			event.Tags = make(map[string]string)
+		}
+		event.Tags[kv[0]] = kv[1]
+	}
+	return event, nil
+}
@@ -0,0 +1,74 @@
+package statsd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []Event
+	}{
+		{"requests:1|c", []Event{{Name: "requests", Type: Counter, Value: 1, SampleRate: 1}}},
+		{"requests:2|c|@0.5", []Event{{Name: "requests", Type: Counter, Value: 2, SampleRate: 0.5}}},
+		{"temp:-3|g", []Event{{Name: "temp", Type: Gauge, Value: -3, SampleRate: 1, Relative: true}}},
+		{"users:alice|s", []Event{{Name: "users", Type: Set, SetValue: "alice", SampleRate: 1}}},
+		{"latency:10:20|ms", []Event{
+			{Name: "latency", Type: Timer, Value: 10, SampleRate: 1},
+			{Name: "latency", Type: Timer, Value: 20, SampleRate: 1},
+		}},
+		{"latency:5|d|#env:prod,canary", []Event{
+			{Name: "latency", Type: Distribution, Value: 5, SampleRate: 1, Tags: map[string]string{"env": "prod", "canary": "canary"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseStatsdLine(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatal(fmt.Sprintf("Wrong events \n got: %+v\n want: %+v", got, tt.expected))
+			}
+		})
+	}
+}
+
+func TestParseStatsdLineErrors(t *testing.T) {
+	for _, line := range []string{"requests", ":1|c", "requests:1", "requests:1|x", "requests:abc|c", "requests:1|c|@2"} {
+		if _, err := ParseStatsdLine(line); err == nil {
+			t.Fatalf("error should be returned for %q", line)
+		}
+	}
+}
+
+func TestParseGraphiteLine(t *testing.T) {
+	now := time.Unix(1574693483, 0)
+
+	got, err := ParseGraphiteLine("servers.web01.cpu;dc=us-east 42.5 1574693400", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Event{Name: "servers.web01.cpu", Type: graphiteType, Value: 42.5, SampleRate: 1, Tags: map[string]string{"dc": "us-east"}, Timestamp: time.Unix(1574693400, 0)}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatal(fmt.Sprintf("Wrong event \n got: %+v\n want: %+v", got, expected))
+	}
+
+	got, err = ParseGraphiteLine("servers.web01.mem 7", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Timestamp.Equal(now) {
+		t.Fatal(fmt.Sprintf("Wrong timestamp \n got: %s\n want: %s", got.Timestamp, now))
+	}
+
+	for _, line := range []string{"servers.web01.mem", "servers.web01.mem abc", "servers.web01.mem;dc 1", "servers.web01.mem 1 abc"} {
+		if _, err := ParseGraphiteLine(line, now); err == nil {
+			t.Fatalf("error should be returned for %q", line)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	anodotPrometheus "github.com/anodot/anodot-remote-write/pkg/prometheus"
+	"github.com/anodot/anodot-remote-write/pkg/remote"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	protocolStatsd   = "statsd"
+	protocolGraphite = "graphite"
+
+	maxUDPPacketSize = 65535
+)
+
+var (
+	linesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_statsd_lines_received_total",
+		Help: "The total number of received StatsD and Graphite lines",
+	}, []string{"protocol", "transport"})
+
+	linesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anodot_statsd_lines_rejected_total",
+		Help: "The total number of StatsD and Graphite lines rejected due to parsing errors",
+	}, []string{"protocol"})
+
+	flushedSamples = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_statsd_flushed_samples_total",
+		Help: "The total number of aggregated samples flushed to Anodot workers",
+	})
+
+	flushBufferErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "anodot_statsd_flush_buffer_errors_total",
+		Help: "The total number of times flushed samples were not fully buffered by worker because its buffer is full",
+	})
+)
+
+type Config struct {
+	// UDPAddress and TCPAddress are StatsD listen addresses, e.g. ':8125'. Listener is disabled if address is empty.
+	UDPAddress string `split_words:"true"`
+	TCPAddress string `split_words:"true"`
+	// GraphiteUDPAddress and GraphiteTCPAddress are Graphite plaintext listen addresses, e.g. ':2003'.
+	GraphiteUDPAddress string `split_words:"true"`
+	GraphiteTCPAddress string `split_words:"true"`
+
+	FlushInterval time.Duration `default:"60s" split_words:"true"`
+	// Percentiles calculated for timers, histograms and distributions.
+	Percentiles []float64 `default:"0.5,0.9,0.99"`
+	// GaugeTTL is a time after which gauge which received no values is forgotten, so its relative updates start from zero.
+	GaugeTTL time.Duration `default:"10m" split_words:"true"`
+}
+
+func NewConfig() (*Config, error) {
+	config := &Config{}
+	if err := envconfig.Process("ANODOT_STATSD", config); err != nil {
+		return nil, err
+	}
+
+	if config.FlushInterval <= 0 {
+		return nil, fmt.Errorf("ANODOT_STATSD_FLUSH_INTERVAL should be positive")
+	}
+	if config.GaugeTTL <= 0 {
+		return nil, fmt.Errorf("ANODOT_STATSD_GAUGE_TTL should be positive")
+	}
+
+	for _, p := range config.Percentiles {
+		if p <= 0 || p > 1 {
+			return nil, fmt.Errorf("statsd percentile should be in range (0, 1], got: %v", p)
+		}
+	}
+	return config, nil
+}
+
+// Enabled reports whether at least one listener is configured.
+func (c *Config) Enabled() bool {
+	return c.UDPAddress != "" || c.TCPAddress != "" || c.GraphiteUDPAddress != "" || c.GraphiteTCPAddress != ""
+}
+
+// Server receives StatsD and Graphite metrics, aggregates them and sends them to Anodot workers on every flush.
+type Server struct {
+	config     *Config
+	parser     *anodotPrometheus.AnodotParser
+	workers    []*remote.Worker
+	aggregator *Aggregator
+}
+
+func NewServer(config *Config, parser *anodotPrometheus.AnodotParser, workers []*remote.Worker) (*Server, error) {
+	if parser == nil {
+		return nil, fmt.Errorf("parser should not be nil")
+	}
+	return &Server{config: config, parser: parser, workers: workers, aggregator: NewAggregator(config.Percentiles, config.GaugeTTL, time.Now())}, nil
+}
+
+// Start starts all configured listeners and flush loop. Aggregated metrics are flushed once more when ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	if s.config.UDPAddress != "" {
+		if err := s.listenUDP(ctx, s.config.UDPAddress, protocolStatsd); err != nil {
+			return err
+		}
+	}
+	if s.config.TCPAddress != "" {
+		if err := s.listenTCP(ctx, s.config.TCPAddress, protocolStatsd); err != nil {
+			return err
+		}
+	}
+	if s.config.GraphiteUDPAddress != "" {
+		if err := s.listenUDP(ctx, s.config.GraphiteUDPAddress, protocolGraphite); err != nil {
+			return err
+		}
+	}
+	if s.config.GraphiteTCPAddress != "" {
+		if err := s.listenTCP(ctx, s.config.GraphiteTCPAddress, protocolGraphite); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.config.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Flush()
+			case <-ctx.Done():
+				s.Flush()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Flush sends aggregated metrics to workers.
+func (s *Server) Flush() {
+	samples := s.aggregator.Flush(time.Now())
+	if len(samples) == 0 {
+		return
+	}
+	flushedSamples.Add(float64(len(samples)))
+
+	data := s.parser.ParsePrometheusRequest(samples)
+	if len(data) == 0 {
+		return
+	}
+	for i := 0; i < len(s.workers); i++ {
+		if err := s.workers[i].Do(data); err != nil {
+			flushBufferErrors.Inc()
+			log.Warningf("Flushed samples are not fully buffered by worker %s: %v", s.workers[i], err)
+		}
+	}
+}
+
+// HandleLine parses single line of given protocol and adds it to aggregator.
+func (s *Server) HandleLine(protocol string, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	switch protocol {
+	case protocolGraphite:
+		event, err := ParseGraphiteLine(line, time.Now())
+		if err != nil {
+			linesRejected.WithLabelValues(protocol).Inc()
+			log.V(4).Info(err)
+			return
+		}
+		s.aggregator.Add(event)
+	default:
+		events, err := ParseStatsdLine(line)
+		if err != nil {
+			linesRejected.WithLabelValues(protocol).Inc()
+			log.V(4).Info(err)
+			return
+		}
+		for _, e := range events {
+			s.aggregator.Add(e)
+		}
+	}
+}
+
+func (s *Server) listenUDP(ctx context.Context, address string, protocol string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen %s on udp %q: %w", protocol, address, err)
+	}
+	log.V(2).Infof("Listening %s metrics on udp '%s'", protocol, address)
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("failed to read %s udp packet: %v", protocol, err)
+					continue
+				}
+				return
+			}
+
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				linesReceived.WithLabelValues(protocol, "udp").Inc()
+				s.HandleLine(protocol, line)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Server) listenTCP(ctx context.Context, address string, protocol string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen %s on tcp %q: %w", protocol, address, err)
+	}
+	log.V(2).Infof("Listening %s metrics on tcp '%s'", protocol, address)
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("failed to accept %s tcp connection: %v", protocol, err)
+					continue
+				}
+				return
+			}
+			go s.handleConn(conn, protocol)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handleConn(conn io.ReadCloser, protocol string) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		linesReceived.WithLabelValues(protocol, "tcp").Inc()
+		s.HandleLine(protocol, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.V(3).Infof("%s tcp connection closed: %v", protocol, err)
+	}
+}
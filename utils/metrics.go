@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"io"
@@ -58,12 +59,8 @@ func FetchMetrics(url string, retries int, timeout time.Duration) ([]*model.Samp
 			if err == io.EOF {
 				for _, s := range samples {
 					s.Timestamp = scrapeTime
-
-					instanceName := os.Getenv("ANODOT_INSTANCE_NAME")
-					if len(strings.TrimSpace(instanceName)) > 0 {
-						s.Metric[model.LabelName("anodot_tag_source_host_id")] = model.LabelValue(instanceName)
-					}
 				}
+				withInstanceName(samples)
 				return samples, nil
 			}
 			return nil, err
@@ -71,3 +68,29 @@ func FetchMetrics(url string, retries int, timeout time.Duration) ([]*model.Samp
 		samples = append(samples, v...)
 	}
 }
+
+// GatherMetrics collects metrics of the given gatherer, e.g. own metrics of this process, without scraping them over HTTP.
+func GatherMetrics(gatherer prometheus.Gatherer) ([]*model.Sample, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.Now()}, families...)
+	if err != nil {
+		return nil, err
+	}
+	withInstanceName(samples)
+	return samples, nil
+}
+
+// withInstanceName tags samples with ANODOT_INSTANCE_NAME, if it is set.
+func withInstanceName(samples []*model.Sample) {
+	instanceName := os.Getenv("ANODOT_INSTANCE_NAME")
+	if len(strings.TrimSpace(instanceName)) == 0 {
+		return
+	}
+	for _, s := range samples {
+		s.Metric[model.LabelName("anodot_tag_source_host_id")] = model.LabelValue(instanceName)
+	}
+}